@@ -2,6 +2,7 @@ package bencode
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -44,3 +45,53 @@ func EncodeTorrentInfoToBencode(bencode *BencodeInfo) string {
 	sb.WriteString("e")
 	return sb.String()
 }
+
+// Encode serializes strings, integers, lists and dictionaries, the keys of the dictionaries are sorted as the format requires
+func Encode(value interface{}) ([]byte, error) {
+	var sb strings.Builder
+	err := encodeValue(&sb, value)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sb.String()), nil
+}
+
+func encodeValue(sb *strings.Builder, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		sb.WriteString(fmt.Sprintf("%d:%s", len(v), v))
+	case []byte:
+		sb.WriteString(fmt.Sprintf("%d:%s", len(v), v))
+	case int:
+		sb.WriteString(fmt.Sprintf("i%de", v))
+	case int64:
+		sb.WriteString(fmt.Sprintf("i%de", v))
+	case []interface{}:
+		sb.WriteString("l")
+		for _, item := range v {
+			err := encodeValue(sb, item)
+			if err != nil {
+				return err
+			}
+		}
+		sb.WriteString("e")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		sb.WriteString("d")
+		for _, key := range keys {
+			sb.WriteString(fmt.Sprintf("%d:%s", len(key), key))
+			err := encodeValue(sb, v[key])
+			if err != nil {
+				return err
+			}
+		}
+		sb.WriteString("e")
+	default:
+		return fmt.Errorf("impossible to bencode value of type %T", value)
+	}
+	return nil
+}
@@ -17,3 +17,25 @@ func TestEncodeTorrentInfoToBencode(t *testing.T) {
 		t.Errorf("Expected %s BUT GOT INSTEAD %s", expectedBencode, encodedBencode)
 	}
 }
+
+func TestEncode(t *testing.T) {
+	t.Log("Testing the generic bencode encoder")
+	value := map[string]interface{}{
+		"interval": 1800,
+		"peers":    []interface{}{map[string]interface{}{"port": 6881, "ip": "127.0.0.1"}},
+		"complete": int64(3),
+		"id":       []byte{0, 1},
+	}
+	encoded, err := Encode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "d8:completei3e2:id2:\x00\x018:intervali1800e5:peersld2:ip9:127.0.0.14:porti6881eeee"
+	if string(encoded) != expected {
+		t.Errorf("Expected %q BUT GOT INSTEAD %q", expected, encoded)
+	}
+	_, err = Encode(map[string]interface{}{"x": 1.5})
+	if err == nil {
+		t.Error("Expected an error encoding a float")
+	}
+}
@@ -3,16 +3,19 @@ package bencode
 import (
 	"crypto/sha1"
 	"fmt"
-	"log"
 	"strconv"
 )
 
+// maxDepth bounds the nesting of the lists and dictionaries, a few bytes of a peer must not exhaust the stack
+const maxDepth = 64
+
 type Bencode struct {
 	Announce     string       `bencode:"announce"`
 	AnnounceList [][]string   `bencode:"announce-list,omitempty"` // optional
 	Comment      string       `bencode:"comment,omitempty"`       // optional
 	CreatedBy    string       `bencode:"created by,omitempty"`    // optional
 	CreationDate int          `bencode:"creation date,omitempty"` // optional
+	UrlList      []string     `bencode:"url-list,omitempty"`      // optional, web seeds of BEP 19
 	Info         *BencodeInfo `bencode:"info"`
 }
 
@@ -34,8 +37,29 @@ type File struct {
 }
 
 type TrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string `bencode:"failure reason,omitempty"`  // only present when the announce failed
+	WarningMessage string `bencode:"warning message,omitempty"` // optional
+	Interval       int    `bencode:"interval"`
+	MinInterval    int    `bencode:"min interval,omitempty"` // optional
+	TrackerId      string `bencode:"tracker id,omitempty"`   // optional
+	Complete       int    `bencode:"complete,omitempty"`     // optional
+	Incomplete     int    `bencode:"incomplete,omitempty"`   // optional
+	// peers is either a compact string, saved in Peers, or a list of dictionaries, saved in PeerList
+	Peers    string        `bencode:"peers,omitempty"`
+	PeerList []TrackerPeer `bencode:"peers,omitempty"`
+	Peers6   string        `bencode:"peers6,omitempty"` // optional
+}
+
+type TrackerPeer struct {
+	PeerId string `bencode:"peer id,omitempty"` // optional
+	Ip     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+type ScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
 }
 
 func (b *Bencode) GetInfoHash() ([20]byte, error) {
@@ -59,7 +83,7 @@ func (b *Bencode) SplitPieceHashes() ([][20]byte, error) {
 
 // UnmarshallBencode serialize the raw interface{} bencode into the bencode struct
 func UnmarshallBencode(torrentData []byte) *Bencode {
-	rawBencode, _ := parseBencodeValue(torrentData, 0)
+	rawBencode, _ := parseBencodeValue(torrentData, 0, 0)
 	bencodeMap := rawBencode.(map[string]interface{})
 	bencode := Bencode{}
 	bencode.Announce = bencodeMap["announce"].(string)
@@ -81,6 +105,19 @@ func UnmarshallBencode(torrentData []byte) *Bencode {
 	if creationDate, ok := bencodeMap["creation date"]; ok {
 		bencode.CreationDate = creationDate.(int)
 	}
+	// url-list is either a single url or a list of them
+	switch urlList := bencodeMap["url-list"].(type) {
+	case string:
+		if urlList != "" {
+			bencode.UrlList = []string{urlList}
+		}
+	case []interface{}:
+		for _, webSeedUrl := range urlList {
+			if webSeedUrl, ok := webSeedUrl.(string); ok && webSeedUrl != "" {
+				bencode.UrlList = append(bencode.UrlList, webSeedUrl)
+			}
+		}
+	}
 	infoMap := bencodeMap["info"].(map[string]interface{})
 	info := BencodeInfo{}
 	info.PieceLength = infoMap["piece length"].(int)
@@ -122,25 +159,122 @@ func UnmarshallBencode(torrentData []byte) *Bencode {
 	return &bencode
 }
 
+// UnmarshallTrackerBencodeResponse parses the response of an http tracker, a failure reason is returned as an error
 func UnmarshallTrackerBencodeResponse(responseData []byte) (TrackerResp, error) {
-	rawBencode, _ := parseBencodeValue(responseData, 0)
+	rawBencode, err := parseBencodeResponse(responseData)
+	if err != nil {
+		return TrackerResp{}, err
+	}
 	bencodeMap := rawBencode.(map[string]interface{})
 	trackerResp := TrackerResp{}
-	trackerResp.Interval = bencodeMap["interval"].(int)
-	if bencodeMap["peers"] == nil {
-		return TrackerResp{}, fmt.Errorf("tracker does not support IPv4, impossible to use this tracker")
+	if failureReason, ok := bencodeMap["failure reason"].(string); ok {
+		trackerResp.FailureReason = failureReason
+		return trackerResp, fmt.Errorf("tracker refused the announce: %s", failureReason)
+	}
+	trackerResp.WarningMessage, _ = bencodeMap["warning message"].(string)
+	trackerResp.Interval, _ = bencodeMap["interval"].(int)
+	trackerResp.MinInterval, _ = bencodeMap["min interval"].(int)
+	trackerResp.TrackerId, _ = bencodeMap["tracker id"].(string)
+	trackerResp.Complete, _ = bencodeMap["complete"].(int)
+	trackerResp.Incomplete, _ = bencodeMap["incomplete"].(int)
+
+	if bencodeMap["peers"] == nil && bencodeMap["peers6"] == nil {
+		return TrackerResp{}, fmt.Errorf("tracker response does not contain peers")
+	}
+	switch peers := bencodeMap["peers"].(type) {
+	case string:
+		trackerResp.Peers = peers
+	case []interface{}:
+		for _, rawPeer := range peers {
+			peerMap, ok := rawPeer.(map[string]interface{})
+			if !ok {
+				return TrackerResp{}, fmt.Errorf("invalid peer in tracker response")
+			}
+			trackerPeer := TrackerPeer{}
+			trackerPeer.PeerId, _ = peerMap["peer id"].(string)
+			trackerPeer.Ip, ok = peerMap["ip"].(string)
+			if !ok {
+				return TrackerResp{}, fmt.Errorf("peer without ip in tracker response")
+			}
+			trackerPeer.Port, ok = peerMap["port"].(int)
+			if !ok {
+				return TrackerResp{}, fmt.Errorf("peer without port in tracker response")
+			}
+			trackerResp.PeerList = append(trackerResp.PeerList, trackerPeer)
+		}
 	}
-	trackerResp.Peers = bencodeMap["peers"].(string)
+	trackerResp.Peers6, _ = bencodeMap["peers6"].(string)
 	return trackerResp, nil
 }
 
-func parseBencodeValue(torrentData []byte, globalIndex int) (interface{}, int) {
+// UnmarshallScrapeBencodeResponse returns the scrape statistics indexed by the raw info hash
+func UnmarshallScrapeBencodeResponse(responseData []byte) (map[string]ScrapeFile, error) {
+	rawBencode, err := parseBencodeResponse(responseData)
+	if err != nil {
+		return nil, err
+	}
+	bencodeMap := rawBencode.(map[string]interface{})
+	if failureReason, ok := bencodeMap["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker refused the scrape: %s", failureReason)
+	}
+	files, ok := bencodeMap["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("scrape response does not contain files")
+	}
+	scrapeFiles := make(map[string]ScrapeFile, len(files))
+	for infoHash, rawFile := range files {
+		fileMap, ok := rawFile.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid scrape response for info hash %x", infoHash)
+		}
+		scrapeFile := ScrapeFile{}
+		scrapeFile.Complete, _ = fileMap["complete"].(int)
+		scrapeFile.Downloaded, _ = fileMap["downloaded"].(int)
+		scrapeFile.Incomplete, _ = fileMap["incomplete"].(int)
+		scrapeFiles[infoHash] = scrapeFile
+	}
+	return scrapeFiles, nil
+}
+
+// parseBencodeResponse parses a dictionary received from the network, where a malformed value must not crash the client
+func parseBencodeResponse(responseData []byte) (value interface{}, err error) {
+	if len(responseData) == 0 || responseData[0] != 'd' {
+		return nil, fmt.Errorf("response is not a bencoded dictionary")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			value = nil
+			err = fmt.Errorf("malformed bencoded response: %v", r)
+		}
+	}()
+	value, _ = parseBencodeValue(responseData, 0, 0)
+	return value, nil
+}
+
+// DecodePrefix parses the value at the start of data received from the network and returns it with its length,
+// the metadata messages of BEP 9 carry raw data after their dictionary
+func DecodePrefix(data []byte) (value interface{}, length int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, length = nil, 0
+			err = fmt.Errorf("malformed bencoded value: %v", r)
+		}
+	}()
+	value, length = parseBencodeValue(data, 0, 0)
+	return value, length, nil
+}
+
+// parseBencodeValue parses the value at globalIndex, depth is the number of lists and dictionaries it is in
+func parseBencodeValue(torrentData []byte, globalIndex int, depth int) (interface{}, int) {
 	bencodeByte := string(torrentData[globalIndex])
+	if (bencodeByte == "d" || bencodeByte == "l") && depth >= maxDepth {
+		panic(fmt.Sprintf("Error reading bencode value, more than %d nested lists and dictionaries", maxDepth))
+	}
 	switch bencodeByte {
 	case "d":
-		return handleDictionary(torrentData, globalIndex)
+		return handleDictionary(torrentData, globalIndex, depth+1)
 	case "l":
-		return handleList(torrentData, globalIndex)
+		return handleList(torrentData, globalIndex, depth+1)
 	case "i":
 		return handleInt(torrentData, globalIndex)
 	default:
@@ -148,26 +282,26 @@ func parseBencodeValue(torrentData []byte, globalIndex int) (interface{}, int) {
 	}
 }
 
-func handleDictionary(torrentData []byte, globalIndex int) (map[string]interface{}, int) {
+func handleDictionary(torrentData []byte, globalIndex int, depth int) (map[string]interface{}, int) {
 	dict := map[string]interface{}{}
 	// skip d
 	globalIndex++
 	for string(torrentData[globalIndex]) != "e" {
 		key, newGlobalIndex := handleString(torrentData, globalIndex)
 		globalIndex = newGlobalIndex
-		dict[key], globalIndex = parseBencodeValue(torrentData, globalIndex)
+		dict[key], globalIndex = parseBencodeValue(torrentData, globalIndex, depth)
 	}
 	// skip e
 	globalIndex++
 	return dict, globalIndex
 }
 
-func handleList(torrentData []byte, globalIndex int) ([]interface{}, int) {
+func handleList(torrentData []byte, globalIndex int, depth int) ([]interface{}, int) {
 	// skip l
 	globalIndex++
 	var list []interface{}
 	for string(torrentData[globalIndex]) != "e" {
-		value, newGlobalIndex := parseBencodeValue(torrentData, globalIndex)
+		value, newGlobalIndex := parseBencodeValue(torrentData, globalIndex, depth)
 		globalIndex = newGlobalIndex
 		list = append(list, value)
 	}
@@ -187,7 +321,7 @@ func handleString(torrentData []byte, globalIndex int) (string, int) {
 		return "", globalIndex + 2
 	}
 	if err != nil {
-		log.Fatal("Error reading bencode value, specifically trying to read a string")
+		panic("Error reading bencode value, specifically trying to read a string")
 	}
 	globalIndex = newGlobalIndex
 	// +1 because of :
@@ -203,7 +337,7 @@ func handleInt(torrentData []byte, globalIndex int) (int, int) {
 	}
 	value, err := strconv.ParseInt(string(torrentData[globalIndex:newGlobalIndex]), 10, 64)
 	if err != nil {
-		log.Fatal("Error reading bencode value, specifically trying to read int value")
+		panic("Error reading bencode value, specifically trying to read int value")
 	}
 	// skip e
 	globalIndex = newGlobalIndex + 1
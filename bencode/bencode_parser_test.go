@@ -1,7 +1,9 @@
 package bencode
 
 import (
+	"bytes"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -29,7 +31,7 @@ func TestHandleInteger(t *testing.T) {
 func TestHandleList(t *testing.T) {
 	t.Log("Testing handle List")
 	s := "li75234e5:helloe"
-	result, newGlobalIndex := handleList([]byte(s), 0)
+	result, newGlobalIndex := handleList([]byte(s), 0, 0)
 	if result[0].(int) != 75234 || result[1] != "hello" || newGlobalIndex != 16 {
 		t.Error("Expected 75234 GOT ", result[0], " as first member, as second member expected hello GOT ", result[1], " as global index expected 16 GOT", newGlobalIndex)
 	}
@@ -38,8 +40,8 @@ func TestHandleList(t *testing.T) {
 func TestHandleDictionary(t *testing.T) {
 	t.Log("Testing handle Dictionary")
 	s := "d4:listli75234e5:helloe1:a1:be"
-	value, globalIndex := handleDictionary([]byte(s), 0)
-	subList, _ := handleList([]byte("li75234e5:helloe"), 0)
+	value, globalIndex := handleDictionary([]byte(s), 0, 0)
+	subList, _ := handleList([]byte("li75234e5:helloe"), 0, 0)
 	if !reflect.DeepEqual(value["list"].([]interface{}), subList) {
 		t.Error("Expected:", subList, "got:", value["list"])
 	}
@@ -47,3 +49,103 @@ func TestHandleDictionary(t *testing.T) {
 		t.Error("Expected value with key a to be b and globalIndex to be", len(s), " instead got ", value["a"], globalIndex)
 	}
 }
+
+func TestUnmarshallScrapeBencodeResponse(t *testing.T) {
+	t.Log("Testing scrape response")
+	infoHash := "aaaaaaaaaaaaaaaaaaaa"
+	response := "d5:filesd20:" + infoHash + "d8:completei5e10:downloadedi50e10:incompletei10eeee"
+	result, err := UnmarshallScrapeBencodeResponse([]byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ScrapeFile{Complete: 5, Downloaded: 50, Incomplete: 10}
+	if result[infoHash] != expected {
+		t.Error("Expected ", expected, " got ", result[infoHash])
+	}
+	_, err = UnmarshallScrapeBencodeResponse([]byte("d14:failure reason6:refusee"))
+	if err == nil {
+		t.Error("Expected an error for a failed scrape")
+	}
+}
+
+func TestUnmarshallTrackerBencodeResponse(t *testing.T) {
+	t.Log("Testing tracker response with IPv6 peers only")
+	ipv6Peer := "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1"
+	result, err := UnmarshallTrackerBencodeResponse([]byte("d8:intervali900e6:peers618:" + ipv6Peer + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Interval != 900 || result.Peers != "" || result.Peers6 != ipv6Peer {
+		t.Error("unexpected tracker response ", result)
+	}
+	_, err = UnmarshallTrackerBencodeResponse([]byte("d8:intervali900ee"))
+	if err == nil {
+		t.Error("Expected an error for a response without peers")
+	}
+}
+
+func TestUnmarshallTrackerBencodeResponseDictPeers(t *testing.T) {
+	t.Log("Testing tracker response with a list of peers")
+	response := "d8:completei3e10:incompletei4e8:intervali900e5:peersld2:ip9:127.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti6881eed2:ip3:::14:porti51413eee10:tracker id3:abc15:warning message4:slowe"
+	result, err := UnmarshallTrackerBencodeResponse([]byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPeers := []TrackerPeer{
+		{PeerId: "aaaaaaaaaaaaaaaaaaaa", Ip: "127.0.0.1", Port: 6881},
+		{Ip: "::1", Port: 51413},
+	}
+	if !reflect.DeepEqual(result.PeerList, expectedPeers) {
+		t.Error("Expected ", expectedPeers, " got ", result.PeerList)
+	}
+	if result.TrackerId != "abc" || result.WarningMessage != "slow" || result.Complete != 3 || result.Incomplete != 4 {
+		t.Error("unexpected tracker response ", result)
+	}
+
+	result, err = UnmarshallTrackerBencodeResponse([]byte("d14:failure reason12:unregisterede"))
+	if err == nil || result.FailureReason != "unregistered" {
+		t.Error("Expected an error with the failure reason, got ", err)
+	}
+	_, err = UnmarshallTrackerBencodeResponse([]byte("d8:intervali9x9ee"))
+	if err == nil {
+		t.Error("Expected an error for a malformed response")
+	}
+	_, err = UnmarshallTrackerBencodeResponse([]byte("<html>"))
+	if err == nil {
+		t.Error("Expected an error for a response that is not bencoded")
+	}
+}
+
+func TestUnmarshallBencodeUrlList(t *testing.T) {
+	t.Log("Testing url-list as a single url and as a list")
+	info := "4:infod6:lengthi10e4:name4:file12:piece lengthi16384e6:pieces0:e"
+	torrent := UnmarshallBencode([]byte("d8:announce3:url8:url-list18:http://a.com/file1" + info + "e"))
+	if !reflect.DeepEqual(torrent.UrlList, []string{"http://a.com/file1"}) {
+		t.Error("Expected a single web seed, got ", torrent.UrlList)
+	}
+	torrent = UnmarshallBencode([]byte("d8:announce3:url8:url-listl13:http://a.com/13:http://b.com/e" + info + "e"))
+	if !reflect.DeepEqual(torrent.UrlList, []string{"http://a.com/", "http://b.com/"}) {
+		t.Error("Expected two web seeds, got ", torrent.UrlList)
+	}
+}
+
+func TestDecodePrefix(t *testing.T) {
+	t.Log("Testing a value followed by raw data")
+	value, length, err := DecodePrefix([]byte("d8:msg_typei1e5:piecei0eeraw data"))
+	if err != nil || length != 25 || !reflect.DeepEqual(value, map[string]interface{}{"msg_type": 1, "piece": 0}) {
+		t.Error("Expected the dictionary before the data, got ", value, length, err)
+	}
+	_, _, err = DecodePrefix([]byte("d8:msg_typei1"))
+	if err == nil {
+		t.Error("Expected an error for a truncated value")
+	}
+	// nested far deeper than any real message, it must not exhaust the stack
+	_, _, err = DecodePrefix(bytes.Repeat([]byte("l"), 1<<20))
+	if err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Error("Expected an error for a deeply nested value, got ", err)
+	}
+	value, _, err = DecodePrefix([]byte(strings.Repeat("l", maxDepth) + strings.Repeat("e", maxDepth)))
+	if err != nil || value == nil {
+		t.Error("Expected the values nested up to the limit to be parsed, got ", err)
+	}
+}
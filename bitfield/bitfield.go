@@ -5,6 +5,9 @@ type Bitfield []byte
 func (bf Bitfield) HavePiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return false
+	}
 	return bf[byteIndex]>>uint(7-offset)&1 != 0
 }
 
@@ -16,3 +19,13 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 1 << uint(7-offset)
 }
+
+// Empty reports whether no piece is set
+func (bf Bitfield) Empty() bool {
+	for _, b := range bf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
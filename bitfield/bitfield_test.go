@@ -21,3 +21,15 @@ func TestBitfieldSetPiece(t *testing.T) {
 	input.SetPiece(12)
 	// no crash
 }
+
+func TestBitfieldEmpty(t *testing.T) {
+	t.Log("Testing BitfieldEmpty")
+	input := Bitfield{0, 0}
+	if !input.Empty() {
+		t.Error("Expected the bitfield to be empty")
+	}
+	input.SetPiece(9)
+	if input.Empty() {
+		t.Error("Expected the bitfield with piece 9 to not be empty")
+	}
+}
@@ -0,0 +1,229 @@
+package blocklist
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// emuleMaxBlockedLevel is the highest access level of an eMule DAT line that is blocked, the ranges
+// with a higher level are allowed
+const emuleMaxBlockedLevel = 127
+
+// Blocklist is a set of address ranges peers are refused from, the ranges are sorted and merged so that
+// an address is looked up with a binary search
+type Blocklist struct {
+	ranges []addrRange
+}
+
+type addrRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+// Load reads a blocklist file, see Parse for the formats
+func Load(path string) (*Blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocklist %s: %s", path, err)
+	}
+	return b, nil
+}
+
+// Parse reads a blocklist, optionally gzip compressed. Every line can be in the P2P/PeerGuardian format
+// "name:1.2.3.0-1.2.3.255", in the eMule DAT format "001.002.003.000 - 001.002.003.255 , 000 , name", a CIDR
+// like "1.2.3.0/24" or a single address. Empty lines and the ones starting with # or // are ignored
+func Parse(reader io.Reader) (*Blocklist, error) {
+	bufferedReader := bufio.NewReader(reader)
+	magic, _ := bufferedReader.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(bufferedReader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		bufferedReader = bufio.NewReader(gzipReader)
+	}
+
+	b := &Blocklist{}
+	scanner := bufio.NewScanner(bufferedReader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, blocked, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		if blocked {
+			b.ranges = append(b.ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	b.merge()
+	return b, nil
+}
+
+// parseLine returns the range of a line, blocked is false for the eMule ranges that are allowed
+func parseLine(line string) (addrRange, bool, error) {
+	// eMule DAT: range , access level , description. A P2P name can contain commas too, so the line is
+	// eMule only when it starts with a range
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		if r, err := parseRange(fields[0]); err == nil {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return addrRange{}, false, fmt.Errorf("invalid access level in %q", line)
+			}
+			return r, level <= emuleMaxBlockedLevel, nil
+		}
+	}
+	switch {
+	case strings.Contains(line, "/") && !strings.Contains(line, "-"):
+		prefix, err := netip.ParsePrefix(line)
+		if err != nil {
+			return addrRange{}, false, err
+		}
+		prefix = prefix.Masked()
+		return addrRange{first: prefix.Addr().Unmap(), last: lastAddr(prefix)}, true, nil
+	case strings.Contains(line, "-"):
+		// P2P: the name can contain colons, the range is after the last one. IPv6 ranges are not supported
+		// in this format because of the colons of the addresses
+		if colon := strings.LastIndex(line, ":"); colon >= 0 {
+			line = line[colon+1:]
+		}
+		r, err := parseRange(line)
+		return r, true, err
+	default:
+		addr, err := parseAddr(line)
+		return addrRange{first: addr, last: addr}, true, err
+	}
+}
+
+func parseRange(s string) (addrRange, error) {
+	firstString, lastString, ok := strings.Cut(s, "-")
+	if !ok {
+		return addrRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	first, err := parseAddr(firstString)
+	if err != nil {
+		return addrRange{}, err
+	}
+	last, err := parseAddr(lastString)
+	if err != nil {
+		return addrRange{}, err
+	}
+	if first.Is4() != last.Is4() || last.Less(first) {
+		return addrRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	return addrRange{first: first, last: last}, nil
+}
+
+// parseAddr also accepts the zero padded IPv4 addresses of the eMule lists, like 001.002.003.004
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	addr, err := netip.ParseAddr(s)
+	if err == nil {
+		return addr.Unmap(), nil
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return netip.Addr{}, err
+	}
+	var ipv4 [4]byte
+	for i, octet := range octets {
+		value, atoiErr := strconv.Atoi(octet)
+		if atoiErr != nil || value < 0 || value > 255 {
+			return netip.Addr{}, err
+		}
+		ipv4[i] = byte(value)
+	}
+	return netip.AddrFrom4(ipv4), nil
+}
+
+// lastAddr returns the last address of a prefix by setting all its host bits
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().As16()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		addr[i/8] |= 1 << (7 - i%8)
+	}
+	last := netip.AddrFrom16(addr)
+	if prefix.Addr().Is4() {
+		return last.Unmap()
+	}
+	return last
+}
+
+// merge sorts the ranges and joins the ones that overlap or touch
+func (b *Blocklist) merge() {
+	slices.SortFunc(b.ranges, func(x, y addrRange) int {
+		return x.first.Compare(y.first)
+	})
+	merged := b.ranges[:0]
+	for _, r := range b.ranges {
+		if len(merged) > 0 {
+			previous := &merged[len(merged)-1]
+			if previous.last.Is4() == r.first.Is4() &&
+				(r.first.Compare(previous.last) <= 0 || previous.last.Next() == r.first) {
+				if previous.last.Less(r.last) {
+					previous.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	b.ranges = merged
+}
+
+// Len returns the number of ranges after merging
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.ranges)
+}
+
+// Contains reports whether the address is blocked, a nil blocklist blocks nothing
+func (b *Blocklist) Contains(ipAddr net.IP) bool {
+	if b == nil || len(b.ranges) == 0 {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ipAddr)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	// the first range starting after the address, the one before it is the only one that can contain it
+	i, _ := slices.BinarySearchFunc(b.ranges, addr, func(r addrRange, target netip.Addr) int {
+		if r.first.Compare(target) <= 0 {
+			return -1
+		}
+		return 1
+	})
+	if i == 0 {
+		return false
+	}
+	r := b.ranges[i-1]
+	return r.first.Is4() == addr.Is4() && addr.Compare(r.last) <= 0
+}
@@ -0,0 +1,70 @@
+package blocklist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"strings"
+	"testing"
+)
+
+const testList = `# a comment
+// another comment
+Bad Corp, Inc:1.2.3.0-1.2.3.255
+001.002.004.000 - 001.002.004.010 , 000 , eMule range
+010.000.000.000 - 010.255.255.255 , 200 , allowed eMule range
+192.168.0.0/16
+2001:db8::/32
+8.8.8.8
+`
+
+func TestParse(t *testing.T) {
+	t.Log("Testing the P2P, eMule, CIDR and single address formats and the lookup")
+	b, err := Parse(strings.NewReader(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the P2P and first eMule ranges touch and are merged
+	if b.Len() != 4 {
+		t.Errorf("expected 4 ranges after merging, got %d", b.Len())
+	}
+	blocked := []string{"1.2.3.0", "1.2.3.255", "1.2.4.10", "192.168.44.1", "2001:db8::1", "8.8.8.8", "::ffff:1.2.3.7"}
+	for _, addr := range blocked {
+		if !b.Contains(net.ParseIP(addr)) {
+			t.Errorf("expected %s to be blocked", addr)
+		}
+	}
+	allowed := []string{"1.2.2.255", "1.2.4.11", "10.0.0.1", "8.8.8.9", "2001:db9::1", "::1"}
+	for _, addr := range allowed {
+		if b.Contains(net.ParseIP(addr)) {
+			t.Errorf("expected %s to be allowed", addr)
+		}
+	}
+}
+
+func TestParseGzip(t *testing.T) {
+	t.Log("Testing that a gzip compressed blocklist is decompressed")
+	var buff bytes.Buffer
+	writer := gzip.NewWriter(&buff)
+	writer.Write([]byte(testList))
+	writer.Close()
+	b, err := Parse(&buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Contains(net.ParseIP("8.8.8.8")) {
+		t.Error("expected 8.8.8.8 to be blocked")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	t.Log("Testing that an invalid line is reported and that a nil blocklist blocks nothing")
+	_, err := Parse(strings.NewReader("name:1.2.3.4-1.2.3.0\n"))
+	if err == nil {
+		t.Error("expected an error for a reversed range")
+	}
+	var b *Blocklist
+	if b.Contains(net.ParseIP("1.2.3.4")) {
+		t.Error("expected a nil blocklist to block nothing")
+	}
+}
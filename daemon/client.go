@@ -0,0 +1,187 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"main/p2p"
+	"main/session"
+	"main/torrentfile"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientTimeout leaves the daemon the time to get the metadata of a magnet link from its peers
+const clientTimeout = 90 * time.Second
+
+// Client calls the REST API of a daemon, the torrents are identified like in the API. It gets the token of the
+// API from the first answer of the daemon
+type Client struct {
+	// BaseUrl is the address of the daemon, like http://127.0.0.1:9091
+	BaseUrl    string
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	sessionId string
+}
+
+func NewClient(baseUrl string) *Client {
+	return &Client{BaseUrl: strings.TrimSuffix(baseUrl, "/"), HTTPClient: &http.Client{Timeout: clientTimeout}}
+}
+
+// AddFile uploads the content of a .torrent file
+func (c *Client) AddFile(torrentData []byte, options session.AddOptions) (session.Status, error) {
+	query := url.Values{}
+	if options.SavePath != "" {
+		query.Set("save_path", options.SavePath)
+	}
+	if options.Paused {
+		query.Set("paused", "true")
+	}
+	var status session.Status
+	err := c.do(http.MethodPost, "/api/torrents?"+query.Encode(), "application/x-bittorrent", torrentData, &status)
+	return status, err
+}
+
+// AddURL makes the daemon fetch a .torrent file or the metadata of a magnet link from its peers
+func (c *Client) AddURL(torrentUrl string, options session.AddOptions) (session.Status, error) {
+	var status session.Status
+	err := c.doJSON(http.MethodPost, "/api/torrents", AddRequest{Url: torrentUrl, SavePath: options.SavePath, Paused: options.Paused}, &status)
+	return status, err
+}
+
+func (c *Client) List() ([]session.Status, error) {
+	var statuses []session.Status
+	err := c.do(http.MethodGet, "/api/torrents", "", nil, &statuses)
+	return statuses, err
+}
+
+func (c *Client) Get(id string) (session.Status, error) {
+	var status session.Status
+	err := c.do(http.MethodGet, torrentPath(id), "", nil, &status)
+	return status, err
+}
+
+func (c *Client) Pause(id string) (session.Status, error) {
+	var status session.Status
+	err := c.do(http.MethodPost, torrentPath(id)+"/pause", "", nil, &status)
+	return status, err
+}
+
+func (c *Client) Resume(id string) (session.Status, error) {
+	var status session.Status
+	err := c.do(http.MethodPost, torrentPath(id)+"/resume", "", nil, &status)
+	return status, err
+}
+
+func (c *Client) Remove(id string, deleteData bool) error {
+	return c.do(http.MethodDelete, torrentPath(id)+"?delete_data="+strconv.FormatBool(deleteData), "", nil, nil)
+}
+
+// SetLimits changes the limits of a torrent in bytes per second, nil leaves a limit as it is
+func (c *Client) SetLimits(id string, download, upload *int) (session.Status, error) {
+	var status session.Status
+	err := c.doJSON(http.MethodPatch, torrentPath(id), LimitsRequest{DownloadLimit: download, UploadLimit: upload}, &status)
+	return status, err
+}
+
+func (c *Client) SetFilePriority(id string, file int, priority p2p.Priority) (session.Status, error) {
+	var status session.Status
+	err := c.doJSON(http.MethodPut, torrentPath(id)+"/files/"+strconv.Itoa(file), PriorityRequest{Priority: priority}, &status)
+	return status, err
+}
+
+func (c *Client) Peers(id string) ([]p2p.PeerStatus, error) {
+	var peers []p2p.PeerStatus
+	err := c.do(http.MethodGet, torrentPath(id)+"/peers", "", nil, &peers)
+	return peers, err
+}
+
+func (c *Client) Trackers(id string) ([]torrentfile.TrackerStatus, error) {
+	var trackers []torrentfile.TrackerStatus
+	err := c.do(http.MethodGet, torrentPath(id)+"/trackers", "", nil, &trackers)
+	return trackers, err
+}
+
+func (c *Client) Session() (SessionStatus, error) {
+	var status SessionStatus
+	err := c.do(http.MethodGet, "/api/session", "", nil, &status)
+	return status, err
+}
+
+// SetSessionLimits changes the limits shared by every torrent in bytes per second, nil leaves a limit as it is
+func (c *Client) SetSessionLimits(download, upload *int) (SessionStatus, error) {
+	var status SessionStatus
+	err := c.doJSON(http.MethodPatch, "/api/session", LimitsRequest{DownloadLimit: download, UploadLimit: upload}, &status)
+	return status, err
+}
+
+func torrentPath(id string) string {
+	return "/api/torrents/" + url.PathEscape(id)
+}
+
+func (c *Client) doJSON(method, path string, request any, result any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return c.do(method, path, "application/json", body, result)
+}
+
+// do sends a request and decodes the json response into result, the error of a failed request is the one the
+// daemon answered with
+func (c *Client) do(method, path, contentType string, body []byte, result any) error {
+	response, err := c.send(method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		var errResponse errorResponse
+		data, _ := io.ReadAll(response.Body)
+		if json.Unmarshal(data, &errResponse) != nil || errResponse.Error == "" {
+			return fmt.Errorf("daemon answered %s", response.Status)
+		}
+		return errors.New(errResponse.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// send sends a request with the token of the API, a 409 with another token means that ours is missing or
+// outdated, the request is sent again with the new one
+func (c *Client) send(method, path, contentType string, body []byte) (*http.Response, error) {
+	for retried := false; ; retried = true {
+		request, err := http.NewRequest(method, c.BaseUrl+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+		c.mu.Lock()
+		sessionId := c.sessionId
+		c.mu.Unlock()
+		request.Header.Set(SessionHeader, sessionId)
+		response, err := c.HTTPClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		newSessionId := response.Header.Get(SessionHeader)
+		if response.StatusCode != http.StatusConflict || newSessionId == "" || newSessionId == sessionId || retried {
+			return response, nil
+		}
+		response.Body.Close()
+		c.mu.Lock()
+		c.sessionId = newSessionId
+		c.mu.Unlock()
+	}
+}
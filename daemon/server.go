@@ -0,0 +1,336 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"main/logging"
+	"main/p2p"
+	"main/session"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// maxTorrentSize is the biggest .torrent file accepted in an upload
+	maxTorrentSize = 16 << 20
+	// SessionHeader carries the token of the API, a request without it is answered with 409 and the token
+	SessionHeader = "X-Session-Id"
+)
+
+// SessionStatus is the state of the session returned by /api/session
+type SessionStatus struct {
+	DownloadDir   string `json:"download_dir"`
+	Port          uint16 `json:"port"`
+	DownloadLimit int    `json:"download_limit"`
+	UploadLimit   int    `json:"upload_limit"`
+	Downloaded    int64  `json:"downloaded"`
+	Uploaded      int64  `json:"uploaded"`
+	Torrents      int    `json:"torrents"`
+}
+
+// AddRequest is the json body of POST /api/torrents, the url can be an http one of a .torrent file or a magnet link
+type AddRequest struct {
+	Url      string `json:"url"`
+	SavePath string `json:"save_path,omitempty"`
+	Paused   bool   `json:"paused,omitempty"`
+}
+
+// LimitsRequest changes the limits of a torrent or of the session, the missing ones are left as they are
+type LimitsRequest struct {
+	DownloadLimit *int `json:"download_limit,omitempty"`
+	UploadLimit   *int `json:"upload_limit,omitempty"`
+}
+
+func (request *LimitsRequest) valid() bool {
+	return valueOr(request.DownloadLimit, 0) >= 0 && valueOr(request.UploadLimit, 0) >= 0
+}
+
+// PriorityRequest is the json body of PUT /api/torrents/{id}/files/{index}
+type PriorityRequest struct {
+	Priority p2p.Priority `json:"priority"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server is the REST API of a session, the torrents are identified by their hex info hash or a unique prefix of it.
+// The core of the Transmission RPC is served at /transmission/rpc for the tools made for Transmission
+type Server struct {
+	session *session.Session
+	mux     *http.ServeMux
+	// sessionId is the token of the API, a web page of another site cannot read it so it cannot send it
+	sessionId string
+	// Logger receives the requests that failed on our side, nil discards them
+	Logger *slog.Logger
+}
+
+func NewServer(s *session.Session) *Server {
+	token := make([]byte, 24)
+	rand.Read(token)
+	server := &Server{session: s, mux: http.NewServeMux(), sessionId: base64.RawURLEncoding.EncodeToString(token)}
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/session", server.getSession)
+	api.HandleFunc("PATCH /api/session", server.patchSession)
+	api.HandleFunc("GET /api/torrents", server.listTorrents)
+	api.HandleFunc("POST /api/torrents", server.addTorrent)
+	api.HandleFunc("GET /api/torrents/{id}", server.getTorrent)
+	api.HandleFunc("PATCH /api/torrents/{id}", server.patchTorrent)
+	api.HandleFunc("DELETE /api/torrents/{id}", server.removeTorrent)
+	api.HandleFunc("POST /api/torrents/{id}/pause", server.pauseTorrent)
+	api.HandleFunc("POST /api/torrents/{id}/resume", server.resumeTorrent)
+	api.HandleFunc("PUT /api/torrents/{id}/files/{index}", server.setFilePriority)
+	api.HandleFunc("GET /api/torrents/{id}/peers", server.getPeers)
+	api.HandleFunc("GET /api/torrents/{id}/trackers", server.getTrackers)
+	server.mux.Handle("/api/", server.requireSession(api))
+	server.mux.Handle("/transmission/rpc", newTransmission(s, func() *slog.Logger { return logging.Or(server.Logger) }))
+	return server
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// requireSession answers the requests without the token of the API with 409 and the token to use, like the
+// Transmission RPC does. A form or a script of another site can send requests to the API but cannot set the header
+func (s *Server) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SessionHeader, s.sessionId)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(SessionHeader)), []byte(s.sessionId)) != 1 {
+			writeError(w, http.StatusConflict, errors.New("invalid or missing "+SessionHeader+" header"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) sessionStatus() SessionStatus {
+	downloadLimit, uploadLimit := s.session.Limits()
+	downloaded, uploaded := s.session.Totals()
+	return SessionStatus{
+		DownloadDir:   s.session.DownloadDir(),
+		Port:          s.session.Port(),
+		DownloadLimit: downloadLimit,
+		UploadLimit:   uploadLimit,
+		Downloaded:    downloaded,
+		Uploaded:      uploaded,
+		Torrents:      len(s.session.List()),
+	}
+}
+
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.sessionStatus())
+}
+
+func (s *Server) patchSession(w http.ResponseWriter, r *http.Request) {
+	var request LimitsRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if !request.valid() {
+		writeError(w, http.StatusBadRequest, errors.New("the limits cannot be negative"))
+		return
+	}
+	downloadLimit, uploadLimit := s.session.Limits()
+	s.session.SetLimits(valueOr(request.DownloadLimit, downloadLimit), valueOr(request.UploadLimit, uploadLimit))
+	writeJSON(w, http.StatusOK, s.sessionStatus())
+}
+
+func (s *Server) listTorrents(w http.ResponseWriter, r *http.Request) {
+	statuses := []session.Status{}
+	for _, t := range s.session.List() {
+		statuses = append(statuses, t.Status())
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// addTorrent accepts a .torrent file as a multipart upload in the torrent field or as the whole body, or the url
+// of one in a json body. The save path and the paused flag are form fields, query parameters or json fields
+func (s *Server) addTorrent(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxTorrentSize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var t *session.Torrent
+	var err error
+	switch mediaType {
+	case "application/json":
+		var request AddRequest
+		if !readJSON(w, r, &request) {
+			return
+		}
+		if request.Url == "" {
+			writeError(w, http.StatusBadRequest, errors.New("missing url"))
+			return
+		}
+		t, err = s.session.AddURL(request.Url, session.AddOptions{SavePath: request.SavePath, Paused: request.Paused})
+	case "multipart/form-data":
+		file, _, formErr := r.FormFile("torrent")
+		if formErr != nil {
+			writeError(w, http.StatusBadRequest, formErr)
+			return
+		}
+		defer file.Close()
+		torrentData, readErr := io.ReadAll(file)
+		if readErr != nil {
+			writeError(w, http.StatusBadRequest, readErr)
+			return
+		}
+		paused, _ := strconv.ParseBool(r.FormValue("paused"))
+		t, err = s.session.Add(torrentData, session.AddOptions{SavePath: r.FormValue("save_path"), Paused: paused})
+	default:
+		torrentData, readErr := io.ReadAll(r.Body)
+		if readErr != nil {
+			writeError(w, http.StatusBadRequest, readErr)
+			return
+		}
+		paused, _ := strconv.ParseBool(r.URL.Query().Get("paused"))
+		t, err = s.session.Add(torrentData, session.AddOptions{SavePath: r.URL.Query().Get("save_path"), Paused: paused})
+	}
+	switch {
+	case errors.Is(err, session.ErrDuplicate):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, session.ErrUnavailable):
+		writeError(w, http.StatusBadGateway, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeJSON(w, http.StatusCreated, t.Status())
+	}
+}
+
+// torrent finds the torrent of the request, it writes the error and returns nil when there is none
+func (s *Server) torrent(w http.ResponseWriter, r *http.Request) *session.Torrent {
+	t, err := s.session.Find(r.PathValue("id"))
+	if errors.Is(err, session.ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return nil
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+	return t
+}
+
+func (s *Server) getTorrent(w http.ResponseWriter, r *http.Request) {
+	if t := s.torrent(w, r); t != nil {
+		writeJSON(w, http.StatusOK, t.Status())
+	}
+}
+
+func (s *Server) patchTorrent(w http.ResponseWriter, r *http.Request) {
+	t := s.torrent(w, r)
+	if t == nil {
+		return
+	}
+	var request LimitsRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if !request.valid() {
+		writeError(w, http.StatusBadRequest, errors.New("the limits cannot be negative"))
+		return
+	}
+	status := t.Status()
+	t.SetLimits(valueOr(request.DownloadLimit, status.DownloadLimit), valueOr(request.UploadLimit, status.UploadLimit))
+	writeJSON(w, http.StatusOK, t.Status())
+}
+
+func (s *Server) removeTorrent(w http.ResponseWriter, r *http.Request) {
+	t := s.torrent(w, r)
+	if t == nil {
+		return
+	}
+	deleteData, _ := strconv.ParseBool(r.URL.Query().Get("delete_data"))
+	err := s.session.Remove(t.InfoHash(), deleteData)
+	if err != nil {
+		logging.Or(s.Logger).Error("error removing torrent", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) pauseTorrent(w http.ResponseWriter, r *http.Request) {
+	if t := s.torrent(w, r); t != nil {
+		t.Pause()
+		writeJSON(w, http.StatusOK, t.Status())
+	}
+}
+
+func (s *Server) resumeTorrent(w http.ResponseWriter, r *http.Request) {
+	if t := s.torrent(w, r); t != nil {
+		t.Resume()
+		writeJSON(w, http.StatusOK, t.Status())
+	}
+}
+
+func (s *Server) setFilePriority(w http.ResponseWriter, r *http.Request) {
+	t := s.torrent(w, r)
+	if t == nil {
+		return
+	}
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var request PriorityRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	err = t.SetFilePriority(index, request.Priority)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.Status())
+}
+
+func (s *Server) getPeers(w http.ResponseWriter, r *http.Request) {
+	if t := s.torrent(w, r); t != nil {
+		peers := t.Peers()
+		if peers == nil {
+			peers = []p2p.PeerStatus{}
+		}
+		writeJSON(w, http.StatusOK, peers)
+	}
+}
+
+func (s *Server) getTrackers(w http.ResponseWriter, r *http.Request) {
+	if t := s.torrent(w, r); t != nil {
+		writeJSON(w, http.StatusOK, t.Trackers())
+	}
+}
+
+func valueOr(value *int, fallback int) int {
+	if value == nil {
+		return fallback
+	}
+	return *value
+}
+
+// readJSON decodes the body of the request, it writes the error and returns false when the body is invalid
+func readJSON(w http.ResponseWriter, r *http.Request, value any) bool {
+	err := json.NewDecoder(r.Body).Decode(value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
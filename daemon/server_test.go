@@ -0,0 +1,127 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"main/bencode"
+	"main/p2p"
+	"main/session"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testTorrent returns a .torrent file whose tracker does not answer
+func testTorrent(t *testing.T, name string) []byte {
+	hash := sha1.Sum([]byte(name))
+	torrentData, err := bencode.Encode(map[string]interface{}{
+		"announce": "http://127.0.0.1:1/announce",
+		"info": map[string]interface{}{
+			"name":         name,
+			"length":       10,
+			"piece length": 16384,
+			"pieces":       string(hash[:]),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrentData
+}
+
+func TestServer(t *testing.T) {
+	t.Log("Testing the REST API through the client")
+	s := session.New(session.Options{DownloadDir: t.TempDir()})
+	defer s.Close()
+	server := httptest.NewServer(NewServer(s))
+	defer server.Close()
+	client := NewClient(server.URL + "/")
+
+	status, err := client.AddFile(testTorrent(t, "a.iso"), session.AddOptions{Paused: true, SavePath: "/tmp/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Name != "a.iso" || status.State != session.StatePaused || status.SavePath != "/tmp/a" {
+		t.Error("wrong status of the added torrent ", status)
+	}
+	id := status.InfoHash
+	if _, err := client.AddFile(testTorrent(t, "a.iso"), session.AddOptions{}); err == nil || !strings.Contains(err.Error(), "already added") {
+		t.Error("expected a duplicate error but got ", err)
+	}
+	// the torrent of a magnet link that is already added needs no metadata from the peers
+	if _, err := client.AddURL("magnet:?xt=urn:btih:"+id, session.AddOptions{}); err == nil || !strings.Contains(err.Error(), "already added") {
+		t.Error("expected a duplicate error for the magnet link but got ", err)
+	}
+
+	// a multipart upload like the one of an html form, the one a page of another site can send lacks the token
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("torrent", "b.torrent")
+	part.Write(testTorrent(t, "b.iso"))
+	form.WriteField("paused", "true")
+	form.Close()
+	response, err := http.Post(server.URL+"/api/torrents", form.FormDataContentType(), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	sessionId := response.Header.Get(SessionHeader)
+	if response.StatusCode != http.StatusConflict || sessionId == "" {
+		t.Fatal("expected a request without token to be refused with the token to use but got ", response.Status)
+	}
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/api/torrents", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	request.Header.Set(SessionHeader, sessionId)
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		t.Error("expected the multipart upload to be created but got ", response.Status)
+	}
+
+	statuses, err := client.List()
+	if err != nil || len(statuses) != 2 || statuses[0].Name != "a.iso" || statuses[1].Name != "b.iso" {
+		t.Error("wrong torrent list ", statuses, err)
+	}
+	downloadLimit := 1000
+	status, err = client.SetLimits(id[:8], &downloadLimit, nil)
+	if err != nil || status.DownloadLimit != 1000 || status.UploadLimit != 0 {
+		t.Error("wrong limits ", status, err)
+	}
+	status, err = client.SetFilePriority(id, 0, p2p.PrioritySkip)
+	if err != nil || status.Files[0].Priority != p2p.PrioritySkip {
+		t.Error("wrong file priority ", status, err)
+	}
+	if _, err := client.SetFilePriority(id, 3, p2p.PriorityHigh); err == nil {
+		t.Error("expected an error for a file the torrent does not have")
+	}
+	trackers, err := client.Trackers(id)
+	if err != nil || len(trackers) != 1 || trackers[0].Url != "http://127.0.0.1:1/announce" {
+		t.Error("wrong trackers ", trackers, err)
+	}
+	peers, err := client.Peers(id)
+	if err != nil || len(peers) != 0 {
+		t.Error("expected no peers ", peers, err)
+	}
+	uploadLimit := 2000
+	sessionStatus, err := client.SetSessionLimits(nil, &uploadLimit)
+	if err != nil || sessionStatus.UploadLimit != 2000 || sessionStatus.Torrents != 2 || sessionStatus.Port == 0 {
+		t.Error("wrong session status ", sessionStatus, err)
+	}
+	negative := -1
+	if _, err := client.SetSessionLimits(&negative, nil); err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+
+	err = client.Remove(id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(id); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Error("expected the removed torrent to be not found but got ", err)
+	}
+}
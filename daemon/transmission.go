@@ -0,0 +1,867 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/p2p"
+	"main/session"
+	"main/torrentfile"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// TransmissionSessionHeader carries the token of the CSRF handshake of the Transmission RPC
+	TransmissionSessionHeader = "X-Transmission-Session-Id"
+	transmissionVersion       = "3.00 (go-torrent-client)"
+	transmissionRPCVersion    = 15
+	// the speeds of the Transmission RPC are in kB/s
+	transmissionSpeedBytes = 1000
+	// defaultSpeedLimit is the limit reported for a torrent or the session that never had one, in kB/s
+	defaultSpeedLimit = 100
+	// maxTransmissionRequest fits a base64 .torrent file of maxTorrentSize
+	maxTransmissionRequest = maxTorrentSize * 2
+)
+
+// the status codes of the torrents in the Transmission RPC
+const (
+	transmissionStopped     = 0
+	transmissionDownloading = 4
+)
+
+var errUnknownMethod = errors.New("method name not recognized")
+
+type transmissionRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string          `json:"result"`
+	Arguments any             `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// fileArguments are the file changes of torrent-add and torrent-set, the files are indices
+type fileArguments struct {
+	FilesWanted    []int `json:"files-wanted"`
+	FilesUnwanted  []int `json:"files-unwanted"`
+	PriorityHigh   []int `json:"priority-high"`
+	PriorityLow    []int `json:"priority-low"`
+	PriorityNormal []int `json:"priority-normal"`
+}
+
+type torrentAddArguments struct {
+	fileArguments
+	Filename    string `json:"filename"`
+	Metainfo    string `json:"metainfo"`
+	DownloadDir string `json:"download-dir"`
+	Paused      bool   `json:"paused"`
+}
+
+type torrentGetArguments struct {
+	Ids    json.RawMessage `json:"ids"`
+	Fields []string        `json:"fields"`
+	Format string          `json:"format"`
+}
+
+type torrentSetArguments struct {
+	fileArguments
+	Ids             json.RawMessage `json:"ids"`
+	DownloadLimit   *int            `json:"downloadLimit"`
+	DownloadLimited *bool           `json:"downloadLimited"`
+	UploadLimit     *int            `json:"uploadLimit"`
+	UploadLimited   *bool           `json:"uploadLimited"`
+}
+
+type torrentRemoveArguments struct {
+	Ids             json.RawMessage `json:"ids"`
+	DeleteLocalData bool            `json:"delete-local-data"`
+}
+
+type sessionSetArguments struct {
+	DownloadDir           *string `json:"download-dir"`
+	SpeedLimitDown        *int    `json:"speed-limit-down"`
+	SpeedLimitDownEnabled *bool   `json:"speed-limit-down-enabled"`
+	SpeedLimitUp          *int    `json:"speed-limit-up"`
+	SpeedLimitUpEnabled   *bool   `json:"speed-limit-up-enabled"`
+}
+
+// speedLimits remembers the limits in kB/s of a torrent or of the session while they are disabled, the
+// Transmission RPC keeps a limit and whether it applies apart but the session only knows the applied one
+type speedLimits struct {
+	download int
+	upload   int
+}
+
+// transmission serves the core of the Transmission RPC on top of the session, so that the tools made for
+// Transmission can control the daemon. The torrents get the numeric ids of the RPC in the order they are seen
+type transmission struct {
+	session   *session.Session
+	sessionId string
+	logger    func() *slog.Logger
+
+	mu     sync.Mutex
+	ids    map[[20]byte]int
+	nextId int
+	// fetching are the magnet links added whose metadata is being downloaded
+	fetching      map[[20]byte]bool
+	limits        map[[20]byte]*speedLimits
+	sessionLimits speedLimits
+}
+
+// transmissionTorrent is a torrent of the session with its id of the RPC
+type transmissionTorrent struct {
+	*session.Torrent
+	id int
+}
+
+func newTransmission(s *session.Session, logger func() *slog.Logger) *transmission {
+	token := make([]byte, 24)
+	rand.Read(token)
+	return &transmission{
+		session:       s,
+		sessionId:     base64.RawURLEncoding.EncodeToString(token),
+		logger:        logger,
+		ids:           make(map[[20]byte]int),
+		nextId:        1,
+		fetching:      make(map[[20]byte]bool),
+		limits:        make(map[[20]byte]*speedLimits),
+		sessionLimits: speedLimits{download: defaultSpeedLimit, upload: defaultSpeedLimit},
+	}
+}
+
+// ServeHTTP answers the requests without the session id of the handshake with 409 and the id to use, like
+// Transmission does against CSRF
+func (tr *transmission) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(TransmissionSessionHeader, tr.sessionId)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(TransmissionSessionHeader)), []byte(tr.sessionId)) != 1 {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "<h1>409: Conflict</h1><p>Your request had an invalid session-id header.</p>"+
+			"<p><code>%s: %s</code></p>", TransmissionSessionHeader, tr.sessionId)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxTransmissionRequest)
+	var request transmissionRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	arguments, err := tr.call(request.Method, request.Arguments)
+	response := transmissionResponse{Result: "success", Arguments: arguments, Tag: request.Tag}
+	if err != nil {
+		response.Result = err.Error()
+	}
+	if response.Arguments == nil {
+		response.Arguments = map[string]any{}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (tr *transmission) call(method string, rawArguments json.RawMessage) (any, error) {
+	if len(rawArguments) == 0 {
+		rawArguments = []byte("{}")
+	}
+	switch method {
+	case "torrent-add":
+		var arguments torrentAddArguments
+		if err := json.Unmarshal(rawArguments, &arguments); err != nil {
+			return nil, err
+		}
+		return tr.torrentAdd(arguments)
+	case "torrent-get":
+		var arguments torrentGetArguments
+		if err := json.Unmarshal(rawArguments, &arguments); err != nil {
+			return nil, err
+		}
+		return tr.torrentGet(arguments)
+	case "torrent-set":
+		var arguments torrentSetArguments
+		if err := json.Unmarshal(rawArguments, &arguments); err != nil {
+			return nil, err
+		}
+		return nil, tr.torrentSet(arguments)
+	case "torrent-start", "torrent-start-now", "torrent-stop", "torrent-verify":
+		var arguments torrentGetArguments
+		if err := json.Unmarshal(rawArguments, &arguments); err != nil {
+			return nil, err
+		}
+		torrents, err := tr.selectTorrents(arguments.Ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range torrents {
+			switch method {
+			case "torrent-stop":
+				t.Pause()
+			case "torrent-verify":
+				// a download checks the pieces on disk before it starts, a stopped torrent stays stopped
+				if t.Status().State == session.StateDownloading {
+					t.Pause()
+					t.Resume()
+				}
+			default:
+				t.Resume()
+			}
+		}
+		return nil, nil
+	case "torrent-remove":
+		var arguments torrentRemoveArguments
+		if err := json.Unmarshal(rawArguments, &arguments); err != nil {
+			return nil, err
+		}
+		torrents, err := tr.selectTorrents(arguments.Ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range torrents {
+			err := tr.session.Remove(t.InfoHash(), arguments.DeleteLocalData)
+			if err != nil && !errors.Is(err, session.ErrNotFound) {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case "session-get":
+		return tr.sessionGet(), nil
+	case "session-set":
+		var arguments sessionSetArguments
+		if err := json.Unmarshal(rawArguments, &arguments); err != nil {
+			return nil, err
+		}
+		return nil, tr.sessionSet(arguments)
+	case "session-stats":
+		return tr.sessionStats(), nil
+	}
+	return nil, errUnknownMethod
+}
+
+// torrents returns the torrents of the session with their ids, the new ones get the next ids
+func (tr *transmission) torrents() []transmissionTorrent {
+	list := tr.session.List()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	torrents := make([]transmissionTorrent, 0, len(list))
+	for _, t := range list {
+		id, ok := tr.ids[t.InfoHash()]
+		if !ok {
+			id = tr.nextId
+			tr.nextId++
+			tr.ids[t.InfoHash()] = id
+		}
+		torrents = append(torrents, transmissionTorrent{Torrent: t, id: id})
+	}
+	return torrents
+}
+
+// selectTorrents returns the torrents of the ids argument: none for all of them, a number, a hex info hash,
+// recently-active or a list of numbers and hashes. The ids that match no torrent are ignored
+func (tr *transmission) selectTorrents(rawIds json.RawMessage) ([]transmissionTorrent, error) {
+	torrents := tr.torrents()
+	rawIds = bytes.TrimSpace(rawIds)
+	if len(rawIds) == 0 || bytes.Equal(rawIds, []byte("null")) {
+		return torrents, nil
+	}
+	var name string
+	if json.Unmarshal(rawIds, &name) == nil && name == "recently-active" {
+		var active []transmissionTorrent
+		for _, t := range torrents {
+			if t.Status().State == session.StateDownloading {
+				active = append(active, t)
+			}
+		}
+		return active, nil
+	}
+	var ids []any
+	if rawIds[0] != '[' {
+		rawIds = append(append([]byte("["), rawIds...), ']')
+	}
+	decoder := json.NewDecoder(bytes.NewReader(rawIds))
+	decoder.UseNumber()
+	if err := decoder.Decode(&ids); err != nil {
+		return nil, fmt.Errorf("invalid ids: %w", err)
+	}
+	var selected []transmissionTorrent
+	for _, id := range ids {
+		for _, t := range torrents {
+			if matchesId(t, id) {
+				selected = append(selected, t)
+				break
+			}
+		}
+	}
+	return selected, nil
+}
+
+func matchesId(t transmissionTorrent, id any) bool {
+	switch id := id.(type) {
+	case json.Number:
+		number, err := id.Int64()
+		return err == nil && number == int64(t.id)
+	case string:
+		infoHash := t.InfoHash()
+		return strings.EqualFold(id, hex.EncodeToString(infoHash[:]))
+	}
+	return false
+}
+
+// torrentAdd adds the metainfo, a base64 .torrent file, or the filename, the url of a .torrent file or a path on
+// the machine of the daemon
+func (tr *transmission) torrentAdd(arguments torrentAddArguments) (any, error) {
+	options := session.AddOptions{SavePath: arguments.DownloadDir, Paused: arguments.Paused}
+	var t *session.Torrent
+	var err error
+	switch {
+	case arguments.Metainfo != "":
+		torrentData, decodeErr := base64.StdEncoding.DecodeString(arguments.Metainfo)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("invalid metainfo: %w", decodeErr)
+		}
+		t, err = tr.session.Add(torrentData, options)
+	case arguments.Filename == "":
+		return nil, errors.New("no filename or metainfo specified")
+	case strings.HasPrefix(arguments.Filename, "magnet:"):
+		return tr.addMagnet(arguments.Filename, options, arguments.fileArguments)
+	case isTorrentUrl(arguments.Filename):
+		t, err = tr.session.AddURL(arguments.Filename, options)
+	default:
+		torrentData, readErr := os.ReadFile(arguments.Filename)
+		if readErr != nil {
+			return nil, readErr
+		}
+		t, err = tr.session.Add(torrentData, options)
+	}
+	if err != nil && !errors.Is(err, session.ErrDuplicate) {
+		return nil, err
+	}
+	var added transmissionTorrent
+	for _, candidate := range tr.torrents() {
+		if candidate.Torrent == t {
+			added = candidate
+		}
+	}
+	infoHash := t.InfoHash()
+	result := map[string]any{"id": added.id, "name": t.Name(), "hashString": hex.EncodeToString(infoHash[:])}
+	if errors.Is(err, session.ErrDuplicate) {
+		return map[string]any{"torrent-duplicate": result}, nil
+	}
+	if err := tr.setFiles(added, arguments.fileArguments); err != nil {
+		return nil, err
+	}
+	return map[string]any{"torrent-added": result}, nil
+}
+
+// addMagnet answers at once with the id of a magnet link and adds its torrent in the background once the peers
+// sent the metadata, like the import of the watch directory does, the clients give up on a request that takes a
+// minute. The failures are only logged
+func (tr *transmission) addMagnet(link string, options session.AddOptions, files fileArguments) (any, error) {
+	file, err := torrentfile.ParseMagnet(link)
+	if err != nil {
+		return nil, err
+	}
+	infoHash := file.InfoHash
+	result := map[string]any{"name": file.Name, "hashString": hex.EncodeToString(infoHash[:])}
+	existing, err := tr.session.Get(infoHash)
+	if err == nil {
+		result["name"] = existing.Name()
+	}
+	tr.mu.Lock()
+	id, ok := tr.ids[infoHash]
+	if !ok {
+		id = tr.nextId
+		tr.nextId++
+		tr.ids[infoHash] = id
+	}
+	duplicate := existing != nil || tr.fetching[infoHash]
+	if !duplicate {
+		tr.fetching[infoHash] = true
+	}
+	tr.mu.Unlock()
+	result["id"] = id
+	if duplicate {
+		return map[string]any{"torrent-duplicate": result}, nil
+	}
+	go func() {
+		t, err := tr.session.AddURL(link, options)
+		tr.mu.Lock()
+		delete(tr.fetching, infoHash)
+		tr.mu.Unlock()
+		switch {
+		case errors.Is(err, session.ErrDuplicate):
+		case err != nil:
+			tr.logger().Warn("impossible to add the magnet link", "link", link, "error", err)
+		default:
+			if err := tr.setFiles(transmissionTorrent{Torrent: t, id: id}, files); err != nil {
+				tr.logger().Warn("impossible to set the files of the magnet link", "link", link, "error", err)
+			}
+		}
+	}()
+	return map[string]any{"torrent-added": result}, nil
+}
+
+func isTorrentUrl(filename string) bool {
+	torrentUrl, err := url.Parse(filename)
+	return err == nil && (torrentUrl.Scheme == "http" || torrentUrl.Scheme == "https" || torrentUrl.Scheme == "magnet")
+}
+
+// torrentGet returns the fields of the torrents as objects or as a table whose first row holds the field names
+func (tr *transmission) torrentGet(arguments torrentGetArguments) (any, error) {
+	if len(arguments.Fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+	torrents, err := tr.selectTorrents(arguments.Ids)
+	if err != nil {
+		return nil, err
+	}
+	var objects []map[string]any
+	table := [][]any{}
+	fieldNames := make([]any, 0, len(arguments.Fields))
+	for _, field := range arguments.Fields {
+		fieldNames = append(fieldNames, field)
+	}
+	table = append(table, fieldNames)
+	for _, t := range torrents {
+		object := tr.torrentFields(t, arguments.Fields)
+		objects = append(objects, object)
+		row := make([]any, 0, len(arguments.Fields))
+		for _, field := range arguments.Fields {
+			row = append(row, object[field])
+		}
+		table = append(table, row)
+	}
+	result := map[string]any{}
+	if arguments.Format == "table" {
+		result["torrents"] = table
+	} else {
+		if objects == nil {
+			objects = []map[string]any{}
+		}
+		result["torrents"] = objects
+	}
+	var rawIds string
+	if json.Unmarshal(arguments.Ids, &rawIds) == nil && rawIds == "recently-active" {
+		result["removed"] = []int{}
+	}
+	return result, nil
+}
+
+// torrentFields returns the fields of a torrent that the RPC knows about, the unknown ones are left out
+func (tr *transmission) torrentFields(t transmissionTorrent, fields []string) map[string]any {
+	status := t.Status()
+	var wantedSize, wantedLeft int64
+	for _, file := range status.Files {
+		if file.Priority != p2p.PrioritySkip {
+			wantedSize += file.Length
+			wantedLeft += file.Length - file.Completed
+		}
+	}
+	// the progress of the files is only known once the pieces on disk have been checked by a download
+	wantedLeft = min(wantedLeft, status.Left)
+	limits := tr.torrentLimits(t)
+	object := make(map[string]any, len(fields))
+	for _, field := range fields {
+		var value any
+		switch field {
+		case "id":
+			value = t.id
+		case "name":
+			value = status.Name
+		case "hashString":
+			value = status.InfoHash
+		case "status":
+			value = transmissionStopped
+			if status.State == session.StateDownloading {
+				value = transmissionDownloading
+			}
+		case "error":
+			value = 0
+			if status.State == session.StateError {
+				// 3 is a local error
+				value = 3
+			}
+		case "errorString":
+			value = status.Error
+		case "isFinished":
+			value = status.State == session.StateCompleted
+		case "isPrivate":
+			value = status.Private
+		case "isStalled":
+			value = status.State == session.StateDownloading && status.DownloadRate == 0
+		case "totalSize":
+			value = status.Size
+		case "sizeWhenDone":
+			value = wantedSize
+		case "leftUntilDone":
+			value = wantedLeft
+		case "haveValid":
+			value = status.Size - status.Left
+		case "haveUnchecked", "corruptEver", "secondsDownloading", "secondsSeeding", "queuePosition",
+			"recheckProgress", "peersSendingToUs", "peersGettingFromUs", "webseedsSendingToUs":
+			value = 0
+		case "percentDone":
+			value = 1.0
+			if wantedSize > 0 {
+				value = float64(wantedSize-wantedLeft) / float64(wantedSize)
+			}
+		case "rateDownload":
+			value = status.DownloadRate
+		case "rateUpload":
+			value = status.UploadRate
+		case "downloadedEver":
+			value = status.Downloaded
+		case "uploadedEver":
+			value = status.Uploaded
+		case "uploadRatio":
+			value = -1.0
+			if status.Downloaded > 0 {
+				value = float64(status.Uploaded) / float64(status.Downloaded)
+			}
+		case "eta":
+			// -1 is unknown
+			value = int64(-1)
+			if status.DownloadRate > 0 {
+				value = wantedLeft / status.DownloadRate
+			}
+		case "downloadDir":
+			value = status.SavePath
+		case "addedDate", "activityDate", "startDate":
+			value = status.AddedAt.Unix()
+		case "doneDate":
+			value = 0
+		case "peersConnected":
+			value = status.Peers
+		case "downloadLimit":
+			value = limits.download
+		case "downloadLimited":
+			value = status.DownloadLimit > 0
+		case "uploadLimit":
+			value = limits.upload
+		case "uploadLimited":
+			value = status.UploadLimit > 0
+		case "honorsSessionLimits":
+			value = true
+		case "seedRatioMode", "seedIdleMode":
+			// 0 follows the session
+			value = 0
+		case "seedRatioLimit", "seedIdleLimit":
+			value = 0
+		case "labels":
+			value = []string{}
+		case "fileCount":
+			value = len(status.Files)
+		case "files":
+			files := make([]map[string]any, 0, len(status.Files))
+			for _, file := range status.Files {
+				files = append(files, map[string]any{"name": file.Path, "length": file.Length, "bytesCompleted": file.Completed})
+			}
+			value = files
+		case "fileStats":
+			fileStats := make([]map[string]any, 0, len(status.Files))
+			for _, file := range status.Files {
+				fileStats = append(fileStats, map[string]any{
+					"bytesCompleted": file.Completed,
+					"wanted":         file.Priority != p2p.PrioritySkip,
+					"priority":       transmissionPriority(file.Priority),
+				})
+			}
+			value = fileStats
+		case "priorities":
+			priorities := make([]int, 0, len(status.Files))
+			for _, file := range status.Files {
+				priorities = append(priorities, transmissionPriority(file.Priority))
+			}
+			value = priorities
+		case "wanted":
+			wanted := make([]int, 0, len(status.Files))
+			for _, file := range status.Files {
+				if file.Priority == p2p.PrioritySkip {
+					wanted = append(wanted, 0)
+				} else {
+					wanted = append(wanted, 1)
+				}
+			}
+			value = wanted
+		case "trackers":
+			trackers := []map[string]any{}
+			for i, tracker := range t.Trackers() {
+				trackers = append(trackers, map[string]any{"id": i, "announce": tracker.Url, "tier": tracker.Tier})
+			}
+			value = trackers
+		case "trackerStats":
+			trackerStats := []map[string]any{}
+			for i, tracker := range t.Trackers() {
+				var host string
+				if trackerUrl, err := url.Parse(tracker.Url); err == nil {
+					host = trackerUrl.Scheme + "://" + trackerUrl.Host
+				}
+				lastAnnounceTime := int64(0)
+				if !tracker.LastAnnounce.IsZero() {
+					lastAnnounceTime = tracker.LastAnnounce.Unix()
+				}
+				lastAnnounceResult := "Success"
+				if tracker.LastError != "" {
+					lastAnnounceResult = tracker.LastError
+				}
+				trackerStats = append(trackerStats, map[string]any{
+					"id":                    i,
+					"announce":              tracker.Url,
+					"host":                  host,
+					"tier":                  tracker.Tier,
+					"hasAnnounced":          lastAnnounceTime != 0,
+					"lastAnnounceTime":      lastAnnounceTime,
+					"lastAnnounceSucceeded": lastAnnounceTime != 0 && tracker.LastError == "",
+					"lastAnnounceResult":    lastAnnounceResult,
+					"lastAnnouncePeerCount": tracker.Peers,
+					"seederCount":           tracker.Seeders,
+					"leecherCount":          tracker.Leechers,
+				})
+			}
+			value = trackerStats
+		case "peers":
+			peers := []map[string]any{}
+			for _, peerStatus := range t.Peers() {
+				if !peerStatus.Connected {
+					continue
+				}
+				host, port, _ := net.SplitHostPort(peerStatus.Address)
+				portNumber, _ := strconv.Atoi(port)
+				peers = append(peers, map[string]any{
+					"address":           host,
+					"port":              portNumber,
+					"clientName":        "",
+					"isDownloadingFrom": peerStatus.Downloaded > 0,
+					"peerIsChoked":      peerStatus.Choked,
+					"peerIsInterested":  peerStatus.Interested,
+					"rateToClient":      0,
+					"rateToPeer":        0,
+					"progress":          0,
+				})
+			}
+			value = peers
+		default:
+			continue
+		}
+		object[field] = value
+	}
+	return object
+}
+
+// transmissionPriority converts a priority to the -1, 0 and 1 of the RPC, the skipped files are the unwanted ones
+func transmissionPriority(priority p2p.Priority) int {
+	switch priority {
+	case p2p.PriorityLow:
+		return -1
+	case p2p.PriorityHigh:
+		return 1
+	}
+	return 0
+}
+
+// torrentLimits returns the limits of a torrent in kB/s, the remembered ones when they are disabled
+func (tr *transmission) torrentLimits(t transmissionTorrent) speedLimits {
+	status := t.Status()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	limits, ok := tr.limits[t.InfoHash()]
+	if !ok {
+		limits = &speedLimits{download: defaultSpeedLimit, upload: defaultSpeedLimit}
+		tr.limits[t.InfoHash()] = limits
+	}
+	if status.DownloadLimit > 0 {
+		limits.download = status.DownloadLimit / transmissionSpeedBytes
+	}
+	if status.UploadLimit > 0 {
+		limits.upload = status.UploadLimit / transmissionSpeedBytes
+	}
+	return *limits
+}
+
+func (tr *transmission) torrentSet(arguments torrentSetArguments) error {
+	if valueOr(arguments.DownloadLimit, 0) < 0 || valueOr(arguments.UploadLimit, 0) < 0 {
+		return errors.New("the limits cannot be negative")
+	}
+	torrents, err := tr.selectTorrents(arguments.Ids)
+	if err != nil {
+		return err
+	}
+	for _, t := range torrents {
+		limits := tr.torrentLimits(t)
+		status := t.Status()
+		downloadLimit := applySpeedLimit(&limits.download, status.DownloadLimit, arguments.DownloadLimit, arguments.DownloadLimited)
+		uploadLimit := applySpeedLimit(&limits.upload, status.UploadLimit, arguments.UploadLimit, arguments.UploadLimited)
+		tr.mu.Lock()
+		*tr.limits[t.InfoHash()] = limits
+		tr.mu.Unlock()
+		t.SetLimits(downloadLimit, uploadLimit)
+		if err := tr.setFiles(t, arguments.fileArguments); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applySpeedLimit updates the remembered limit in kB/s and returns the limit to apply in bytes per second. A new
+// value only applies at once when the limit is enabled
+func applySpeedLimit(remembered *int, current int, value *int, enabled *bool) int {
+	if value != nil {
+		*remembered = *value
+	}
+	isEnabled := current > 0
+	if enabled != nil {
+		isEnabled = *enabled
+	}
+	if !isEnabled {
+		return 0
+	}
+	return *remembered * transmissionSpeedBytes
+}
+
+// setFiles applies the priorities and then the wanted flags, a file that stays unwanted keeps being skipped
+// whatever its priority
+func (tr *transmission) setFiles(t transmissionTorrent, arguments fileArguments) error {
+	files := t.Status().Files
+	priorities := make([]p2p.Priority, len(files))
+	for i, file := range files {
+		priorities[i] = file.Priority
+	}
+	wanted := func(file int) bool {
+		return priorities[file] != p2p.PrioritySkip
+	}
+	changes := []struct {
+		files    []int
+		priority p2p.Priority
+		applies  func(file int) bool
+	}{
+		{arguments.PriorityHigh, p2p.PriorityHigh, wanted},
+		{arguments.PriorityLow, p2p.PriorityLow, wanted},
+		{arguments.PriorityNormal, p2p.PriorityNormal, wanted},
+		{arguments.FilesWanted, p2p.PriorityNormal, func(file int) bool { return !wanted(file) }},
+		{arguments.FilesUnwanted, p2p.PrioritySkip, func(int) bool { return true }},
+	}
+	for _, change := range changes {
+		for _, file := range change.files {
+			if file < 0 || file >= len(files) {
+				return fmt.Errorf("invalid file %d, the torrent has %d", file, len(files))
+			}
+			if !change.applies(file) || priorities[file] == change.priority {
+				continue
+			}
+			if err := t.SetFilePriority(file, change.priority); err != nil {
+				return err
+			}
+			priorities[file] = change.priority
+		}
+	}
+	return nil
+}
+
+func (tr *transmission) sessionGet() map[string]any {
+	downloadLimit, uploadLimit := tr.session.Limits()
+	limits := tr.rememberSessionLimits(downloadLimit, uploadLimit)
+	return map[string]any{
+		"version":                  transmissionVersion,
+		"rpc-version":              transmissionRPCVersion,
+		"rpc-version-minimum":      transmissionRPCVersion,
+		"session-id":               tr.sessionId,
+		"download-dir":             tr.session.DownloadDir(),
+		"peer-port":                tr.session.Port(),
+		"speed-limit-down":         limits.download,
+		"speed-limit-down-enabled": downloadLimit > 0,
+		"speed-limit-up":           limits.upload,
+		"speed-limit-up-enabled":   uploadLimit > 0,
+		"dht-enabled":              false,
+		"pex-enabled":              false,
+		"units": map[string]any{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  transmissionSpeedBytes,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+}
+
+// rememberSessionLimits keeps the enabled limits of the session in kB/s and returns the remembered ones
+func (tr *transmission) rememberSessionLimits(downloadLimit, uploadLimit int) speedLimits {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if downloadLimit > 0 {
+		tr.sessionLimits.download = downloadLimit / transmissionSpeedBytes
+	}
+	if uploadLimit > 0 {
+		tr.sessionLimits.upload = uploadLimit / transmissionSpeedBytes
+	}
+	return tr.sessionLimits
+}
+
+// sessionSet changes the download dir and the limits, the other settings of Transmission are ignored
+func (tr *transmission) sessionSet(arguments sessionSetArguments) error {
+	if valueOr(arguments.SpeedLimitDown, 0) < 0 || valueOr(arguments.SpeedLimitUp, 0) < 0 {
+		return errors.New("the limits cannot be negative")
+	}
+	if arguments.DownloadDir != nil {
+		tr.session.SetDownloadDir(*arguments.DownloadDir)
+	}
+	downloadLimit, uploadLimit := tr.session.Limits()
+	limits := tr.rememberSessionLimits(downloadLimit, uploadLimit)
+	downloadLimit = applySpeedLimit(&limits.download, downloadLimit, arguments.SpeedLimitDown, arguments.SpeedLimitDownEnabled)
+	uploadLimit = applySpeedLimit(&limits.upload, uploadLimit, arguments.SpeedLimitUp, arguments.SpeedLimitUpEnabled)
+	tr.mu.Lock()
+	tr.sessionLimits = limits
+	tr.mu.Unlock()
+	tr.session.SetLimits(downloadLimit, uploadLimit)
+	return nil
+}
+
+func (tr *transmission) sessionStats() map[string]any {
+	torrents := tr.session.List()
+	var active, paused int
+	var downloadSpeed, uploadSpeed int64
+	for _, t := range torrents {
+		status := t.Status()
+		if status.State == session.StateDownloading {
+			active++
+		} else {
+			paused++
+		}
+		downloadSpeed += status.DownloadRate
+		uploadSpeed += status.UploadRate
+	}
+	downloaded, uploaded := tr.session.Totals()
+	stats := map[string]any{
+		"downloadedBytes": downloaded,
+		"uploadedBytes":   uploaded,
+		"filesAdded":      len(torrents),
+		"sessionCount":    1,
+		"secondsActive":   0,
+	}
+	return map[string]any{
+		"torrentCount":       len(torrents),
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"downloadSpeed":      downloadSpeed,
+		"uploadSpeed":        uploadSpeed,
+		"current-stats":      stats,
+		"cumulative-stats":   stats,
+	}
+}
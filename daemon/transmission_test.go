@@ -0,0 +1,197 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"main/session"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// transmissionClient calls the Transmission RPC like the tools made for Transmission, with the session id handshake
+type transmissionClient struct {
+	t         *testing.T
+	rpcUrl    string
+	sessionId string
+}
+
+func (c *transmissionClient) call(method string, arguments any) (string, map[string]any) {
+	body, err := json.Marshal(map[string]any{"method": method, "arguments": arguments, "tag": 7})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		request, _ := http.NewRequest(http.MethodPost, c.rpcUrl, bytes.NewReader(body))
+		request.Header.Set(TransmissionSessionHeader, c.sessionId)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if response.StatusCode == http.StatusConflict && c.sessionId == "" {
+			response.Body.Close()
+			c.sessionId = response.Header.Get(TransmissionSessionHeader)
+			continue
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			c.t.Fatal("unexpected response ", response.Status)
+		}
+		var result struct {
+			Result    string         `json:"result"`
+			Arguments map[string]any `json:"arguments"`
+			Tag       int            `json:"tag"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+			c.t.Fatal(err)
+		}
+		if result.Tag != 7 {
+			c.t.Error("expected the tag of the request but got ", result.Tag)
+		}
+		return result.Result, result.Arguments
+	}
+}
+
+func TestTransmission(t *testing.T) {
+	t.Log("Testing the core of the Transmission RPC")
+	s := session.New(session.Options{DownloadDir: t.TempDir()})
+	defer s.Close()
+	server := httptest.NewServer(NewServer(s))
+	defer server.Close()
+	client := &transmissionClient{t: t, rpcUrl: server.URL + "/transmission/rpc"}
+
+	response, err := http.Post(client.rpcUrl, "application/json", bytes.NewReader([]byte(`{"method":"session-get"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusConflict || response.Header.Get(TransmissionSessionHeader) == "" {
+		t.Error("expected a request without session id to be refused with the id to use but got ", response.Status)
+	}
+
+	result, arguments := client.call("session-get", nil)
+	if result != "success" || arguments["download-dir"] != s.DownloadDir() || arguments["rpc-version"] != float64(15) {
+		t.Error("wrong session-get ", result, arguments)
+	}
+
+	downloadDir := t.TempDir()
+	metainfo := base64.StdEncoding.EncodeToString(testTorrent(t, "a.iso"))
+	result, arguments = client.call("torrent-add", map[string]any{"metainfo": metainfo, "paused": true, "download-dir": downloadDir})
+	added, ok := arguments["torrent-added"].(map[string]any)
+	if result != "success" || !ok || added["id"] != float64(1) || added["name"] != "a.iso" {
+		t.Fatal("wrong torrent-add ", result, arguments)
+	}
+	hash := added["hashString"].(string)
+	result, arguments = client.call("torrent-add", map[string]any{"metainfo": metainfo})
+	if duplicate, ok := arguments["torrent-duplicate"].(map[string]any); result != "success" || !ok || duplicate["id"] != float64(1) {
+		t.Error("wrong torrent-add of a duplicate ", result, arguments)
+	}
+	result, arguments = client.call("torrent-add", map[string]any{"filename": "magnet:?xt=urn:btih:" + hash})
+	if duplicate, ok := arguments["torrent-duplicate"].(map[string]any); result != "success" || !ok || duplicate["id"] != float64(1) {
+		t.Error("wrong torrent-add of the magnet link of a duplicate ", result, arguments)
+	}
+
+	result, _ = client.call("torrent-set", map[string]any{"ids": []any{hash}, "downloadLimit": 50, "downloadLimited": true,
+		"uploadLimit": 20, "files-unwanted": []int{0}})
+	if result != "success" {
+		t.Error("wrong torrent-set ", result)
+	}
+	fields := []string{"id", "name", "status", "downloadDir", "totalSize", "sizeWhenDone", "downloadLimit",
+		"downloadLimited", "uploadLimit", "uploadLimited", "wanted", "trackers", "unknownField"}
+	result, arguments = client.call("torrent-get", map[string]any{"ids": 1, "fields": fields})
+	torrents, _ := arguments["torrents"].([]any)
+	if result != "success" || len(torrents) != 1 {
+		t.Fatal("wrong torrent-get ", result, arguments)
+	}
+	torrent := torrents[0].(map[string]any)
+	expected := map[string]any{"id": float64(1), "name": "a.iso", "status": float64(0), "downloadDir": downloadDir,
+		"totalSize": float64(10), "sizeWhenDone": float64(0), "downloadLimit": float64(50), "downloadLimited": true,
+		"uploadLimit": float64(20), "uploadLimited": false}
+	for field, value := range expected {
+		if torrent[field] != value {
+			t.Errorf("expected %s %v but got %v", field, value, torrent[field])
+		}
+	}
+	if _, ok := torrent["unknownField"]; ok {
+		t.Error("expected the unknown fields to be left out")
+	}
+	if wanted := torrent["wanted"].([]any); len(wanted) != 1 || wanted[0] != float64(0) {
+		t.Error("expected the file to be unwanted but got ", wanted)
+	}
+	if trackers := torrent["trackers"].([]any); len(trackers) != 1 {
+		t.Error("wrong trackers ", trackers)
+	}
+	status := s.List()[0].Status()
+	if status.DownloadLimit != 50000 || status.UploadLimit != 0 {
+		t.Error("wrong limits of the session torrent ", status.DownloadLimit, status.UploadLimit)
+	}
+
+	result, _ = client.call("torrent-start", map[string]any{"ids": []any{1}})
+	if status := s.List()[0].Status(); result != "success" || status.State == session.StatePaused {
+		t.Error("expected the torrent to start ", result, status.State)
+	}
+	result, _ = client.call("torrent-stop", map[string]any{"ids": hash})
+	if status := s.List()[0].Status(); result != "success" || status.State == session.StateDownloading {
+		t.Error("expected the torrent to stop ", result, status.State, status.Error)
+	}
+	result, _ = client.call("torrent-verify", map[string]any{"ids": hash})
+	if status := s.List()[0].Status(); result != "success" || status.State == session.StateDownloading {
+		t.Error("expected the verified torrent to stay stopped ", result, status.State)
+	}
+
+	result, _ = client.call("session-set", map[string]any{"download-dir": "/tmp/b", "speed-limit-up": 30, "speed-limit-up-enabled": true})
+	downloadLimit, uploadLimit := s.Limits()
+	if result != "success" || s.DownloadDir() != "/tmp/b" || downloadLimit != 0 || uploadLimit != 30000 {
+		t.Error("wrong session-set ", result, s.DownloadDir(), downloadLimit, uploadLimit)
+	}
+	result, arguments = client.call("session-stats", nil)
+	if result != "success" || arguments["torrentCount"] != float64(1) || arguments["activeTorrentCount"] != float64(0) {
+		t.Error("wrong session-stats ", result, arguments)
+	}
+
+	result, _ = client.call("torrent-remove", map[string]any{"ids": []any{1}})
+	if result != "success" || len(s.List()) != 0 {
+		t.Error("expected the torrent to be removed ", result)
+	}
+	result, arguments = client.call("torrent-get", map[string]any{"fields": []string{"id"}})
+	if torrents, _ := arguments["torrents"].([]any); result != "success" || len(torrents) != 0 {
+		t.Error("expected no torrents ", result, arguments)
+	}
+	if result, _ = client.call("torrent-rename-path", nil); result != "method name not recognized" {
+		t.Error("expected an unknown method to fail but got ", result)
+	}
+}
+
+func TestTransmissionMagnet(t *testing.T) {
+	t.Log("Testing that torrent-add answers a magnet link before its metadata is downloaded")
+	// a tracker that never answers keeps the download of the metadata going
+	release := make(chan struct{})
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer tracker.Close()
+	defer close(release)
+	s := session.New(session.Options{DownloadDir: t.TempDir()})
+	defer s.Close()
+	server := httptest.NewServer(NewServer(s))
+	defer server.Close()
+	client := &transmissionClient{t: t, rpcUrl: server.URL + "/transmission/rpc"}
+
+	hash := strings.Repeat("ab", 20)
+	link := "magnet:?xt=urn:btih:" + hash + "&dn=slow.iso&tr=" + tracker.URL + "/announce"
+	result, arguments := client.call("torrent-add", map[string]any{"filename": link})
+	added, ok := arguments["torrent-added"].(map[string]any)
+	if result != "success" || !ok || added["id"] != float64(1) || added["name"] != "slow.iso" || added["hashString"] != hash {
+		t.Error("wrong torrent-add of the magnet link ", result, arguments)
+	}
+	result, arguments = client.call("torrent-add", map[string]any{"filename": link})
+	if duplicate, ok := arguments["torrent-duplicate"].(map[string]any); result != "success" || !ok || duplicate["id"] != float64(1) {
+		t.Error("wrong torrent-add of a magnet link whose metadata is being downloaded ", result, arguments)
+	}
+	if len(s.List()) != 0 {
+		t.Error("expected the torrent to be added once its metadata is downloaded")
+	}
+	if result, _ = client.call("torrent-add", map[string]any{"filename": "magnet:?xt=urn:btih:abcd"}); result == "success" {
+		t.Error("expected an invalid magnet link to be refused")
+	}
+}
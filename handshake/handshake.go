@@ -7,16 +7,37 @@ import (
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerId   [20]byte
 }
 
+const (
+	// fastExtensionBit is the bit of the last reserved byte that announces the Fast Extension of BEP 6
+	fastExtensionBit = 0x04
+	// extensionProtocolBit is the bit of the sixth reserved byte that announces the Extension Protocol of BEP 10
+	extensionProtocolBit = 0x10
+)
+
 func NewHandshake(infoHash [20]byte, peerId [20]byte) *Handshake {
-	return &Handshake{
+	h := &Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerId:   peerId,
 	}
+	h.Reserved[5] |= extensionProtocolBit
+	h.Reserved[7] |= fastExtensionBit
+	return h
+}
+
+// SupportsFast reports whether the sender of the handshake supports the Fast Extension
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[7]&fastExtensionBit != 0
+}
+
+// SupportsExtensions reports whether the sender of the handshake supports the Extension Protocol
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&extensionProtocolBit != 0
 }
 
 func ReadHandshake(r io.Reader) (*Handshake, error) {
@@ -37,8 +58,8 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
-	// reserved space
-	_, err = io.ReadFull(r, make([]byte, 8))
+	var reserved [8]byte
+	_, err = io.ReadFull(r, reserved[:])
 	if err != nil {
 		return nil, err
 	}
@@ -63,6 +84,7 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 
 	return &Handshake{
 		Pstr:     string(pstrBuff),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerId:   peerId,
 	}, nil
@@ -73,7 +95,7 @@ func (h *Handshake) Serialize() []byte {
 	buff[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buff[curr:], h.Pstr)
-	curr += copy(buff[curr:], make([]byte, 8))
+	curr += copy(buff[curr:], h.Reserved[:])
 	curr += copy(buff[curr:], h.InfoHash[:])
 	curr += copy(buff[curr:], h.PeerId[:])
 	return buff
@@ -22,3 +22,18 @@ func TestReadHandshake(t *testing.T) {
 		t.Error("Expected", expectedHandskake, "got", result)
 	}
 }
+
+func TestSupportsFast(t *testing.T) {
+	t.Log("Testing the extension bits of the handshake")
+	h := NewHandshake([20]byte{1}, [20]byte{2})
+	result, err := ReadHandshake(bytes.NewReader(h.Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.SupportsFast() || !result.SupportsExtensions() {
+		t.Error("expected our handshake to announce the Fast Extension and the Extension Protocol")
+	}
+	if (&Handshake{Pstr: "BitTorrent protocol"}).SupportsFast() || (&Handshake{Pstr: "BitTorrent protocol"}).SupportsExtensions() {
+		t.Error("expected a handshake without reserved bits to not support the extensions")
+	}
+}
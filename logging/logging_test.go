@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	t.Log("Testing the levels and the formats of the command line logger")
+	var buff bytes.Buffer
+	logger, err := New(&buff, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", InfoHash([20]byte{0xab}), "piece", 3)
+	var record map[string]any
+	err = json.Unmarshal(buff.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("expected a single json record, got %q: %s", buff.String(), err)
+	}
+	if record["msg"] != "shown" || record["piece"] != float64(3) || !strings.HasPrefix(record["info_hash"].(string), "ab00") {
+		t.Error("wrong json record ", buff.String())
+	}
+
+	buff.Reset()
+	logger, err = New(&buff, "DEBUG", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("connected", "peer", "1.2.3.4:6881")
+	if !strings.Contains(buff.String(), "level=DEBUG msg=connected peer=1.2.3.4:6881") {
+		t.Error("wrong text record ", buff.String())
+	}
+
+	_, err = New(&buff, "loud", "text")
+	if err == nil {
+		t.Error("expected an error for an invalid level")
+	}
+	_, err = New(&buff, "info", "xml")
+	if err == nil {
+		t.Error("expected an error for an invalid format")
+	}
+	if Or(nil) != Discard || Discard.Enabled(context.Background(), slog.LevelError) {
+		t.Error("expected a nil logger to discard every record")
+	}
+}
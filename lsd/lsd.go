@@ -0,0 +1,245 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/logging"
+	"main/peer"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// announceInterval is how often every torrent is announced again, BEP 14 asks for at most one announce per minute
+const announceInterval = 5 * time.Minute
+
+var (
+	ipv4Group = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	ipv6Group = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// Service announces the active torrents on the local network with BT-SEARCH multicast messages and
+// hands the peers that announce the same torrents to their handler
+type Service struct {
+	port   uint16
+	cookie string
+
+	mu       sync.Mutex
+	handlers map[[20]byte]func([]peer.Peer)
+	conns    map[*net.UDPConn]*net.UDPAddr
+	stop     chan struct{}
+	closed   bool
+	// logger receives the errors of the multicast sockets, nothing until SetLogger is called
+	logger *slog.Logger
+}
+
+// New joins the IPv4 and the IPv6 multicast groups, port is the port on which we accept peer connections.
+// It fails only if neither of the groups can be joined
+func New(port uint16) (*Service, error) {
+	cookie := make([]byte, 8)
+	_, err := rand.Read(cookie)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		handlers: make(map[[20]byte]func([]peer.Peer)),
+		conns:    make(map[*net.UDPConn]*net.UDPAddr),
+		stop:     make(chan struct{}),
+	}
+	var errs []error
+	for network, group := range map[string]*net.UDPAddr{"udp4": ipv4Group, "udp6": ipv6Group} {
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.conns[conn] = group
+		go s.readLoop(conn)
+	}
+	if len(s.conns) == 0 {
+		return nil, fmt.Errorf("impossible to join the local service discovery groups: %w", errors.Join(errs...))
+	}
+	go s.announceLoop()
+	return s, nil
+}
+
+// Add announces the torrent on the local network, onPeers receives the peers found for it
+func (s *Service) Add(infoHash [20]byte, onPeers func([]peer.Peer)) {
+	s.mu.Lock()
+	s.handlers[infoHash] = onPeers
+	s.mu.Unlock()
+	s.announce([][20]byte{infoHash})
+}
+
+// SetLogger sets the logger of the errors of the multicast sockets
+func (s *Service) SetLogger(logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+}
+
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.handlers, infoHash)
+}
+
+func (s *Service) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	var err error
+	for conn := range s.conns {
+		if closeErr := conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *Service) announceLoop() {
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			infoHashes := make([][20]byte, 0, len(s.handlers))
+			for infoHash := range s.handlers {
+				infoHashes = append(infoHashes, infoHash)
+			}
+			s.mu.Unlock()
+			s.announce(infoHashes)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// announce sends a single BT-SEARCH message for the torrents to every group we joined
+func (s *Service) announce(infoHashes [][20]byte) {
+	if len(infoHashes) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, group := range s.conns {
+		_, err := conn.WriteToUDP(searchMessage(group, s.port, infoHashes, s.cookie), group)
+		if err != nil {
+			logging.Or(s.logger).Warn("error sending local service discovery announce", "group", group.String(), "error", err)
+		}
+	}
+}
+
+func (s *Service) readLoop(conn *net.UDPConn) {
+	buff := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buff)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			s.mu.Lock()
+			logger := logging.Or(s.logger)
+			s.mu.Unlock()
+			logger.Warn("error reading local service discovery announce", "error", err)
+			continue
+		}
+		s.handleSearch(buff[:n], addr.IP)
+	}
+}
+
+// handleSearch gives the sender of an announce to the handlers of the torrents it is announcing
+func (s *Service) handleSearch(data []byte, ipAddr net.IP) {
+	port, infoHashes, cookie, err := parseSearchMessage(data)
+	if err != nil || cookie == s.cookie {
+		// malformed messages and our own announces looped back are ignored
+		return
+	}
+	if ipv4 := ipAddr.To4(); ipv4 != nil {
+		ipAddr = ipv4
+	}
+	localPeer := peer.Peer{IpAddr: ipAddr, Port: port}
+	for _, infoHash := range infoHashes {
+		s.mu.Lock()
+		onPeers, ok := s.handlers[infoHash]
+		s.mu.Unlock()
+		if ok {
+			onPeers([]peer.Peer{localPeer})
+		}
+	}
+}
+
+func searchMessage(group *net.UDPAddr, port uint16, infoHashes [][20]byte, cookie string) []byte {
+	var buff bytes.Buffer
+	buff.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buff, "Host: %s\r\n", group.String())
+	fmt.Fprintf(&buff, "Port: %d\r\n", port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&buff, "Infohash: %s\r\n", hex.EncodeToString(infoHash[:]))
+	}
+	fmt.Fprintf(&buff, "cookie: %s\r\n", cookie)
+	buff.WriteString("\r\n\r\n")
+	return buff.Bytes()
+}
+
+// parseSearchMessage returns the port, the info hashes and the cookie of a BT-SEARCH message
+func parseSearchMessage(data []byte) (uint16, [][20]byte, string, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	requestLine, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(requestLine, "BT-SEARCH * HTTP/1.1") {
+		return 0, nil, "", fmt.Errorf("not a BT-SEARCH message")
+	}
+	var port uint16
+	var infoHashes [][20]byte
+	var cookie string
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return 0, nil, "", fmt.Errorf("malformed header %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+		case "Port":
+			parsedPort, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || parsedPort == 0 {
+				return 0, nil, "", fmt.Errorf("invalid port %q", value)
+			}
+			port = uint16(parsedPort)
+		case "Infohash":
+			rawInfoHash, err := hex.DecodeString(value)
+			if err != nil || len(rawInfoHash) != 20 {
+				return 0, nil, "", fmt.Errorf("invalid info hash %q", value)
+			}
+			infoHashes = append(infoHashes, [20]byte(rawInfoHash))
+		case "Cookie":
+			cookie = value
+		}
+		if err != nil {
+			break
+		}
+	}
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", fmt.Errorf("BT-SEARCH message without port or info hash")
+	}
+	return port, infoHashes, cookie, nil
+}
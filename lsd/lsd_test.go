@@ -0,0 +1,48 @@
+package lsd
+
+import (
+	"main/peer"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSearchMessage(t *testing.T) {
+	t.Log("Testing that a BT-SEARCH message can be parsed back")
+	infoHashes := [][20]byte{{1, 2, 3}, {4, 5, 6}}
+	message := searchMessage(ipv4Group, 6881, infoHashes, "abcd")
+	port, parsedInfoHashes, cookie, err := parseSearchMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 6881 || cookie != "abcd" || !reflect.DeepEqual(parsedInfoHashes, infoHashes) {
+		t.Errorf("unexpected values parsed: port %d, cookie %s, info hashes %v", port, cookie, parsedInfoHashes)
+	}
+
+	_, _, _, err = parseSearchMessage([]byte("M-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n"))
+	if err == nil {
+		t.Error("expected an error parsing a message that is not a BT-SEARCH")
+	}
+	_, _, _, err = parseSearchMessage([]byte("BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 1234\r\n\r\n\r\n"))
+	if err == nil {
+		t.Error("expected an error parsing an invalid info hash")
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	t.Log("Testing that announces reach the handler of their torrent and that our own are ignored")
+	infoHash := [20]byte{1, 2, 3}
+	s := &Service{cookie: "ours", handlers: make(map[[20]byte]func([]peer.Peer))}
+	var found []peer.Peer
+	s.handlers[infoHash] = func(peers []peer.Peer) {
+		found = append(found, peers...)
+	}
+
+	s.handleSearch(searchMessage(ipv4Group, 7000, [][20]byte{infoHash}, "ours"), net.IPv4(192, 168, 1, 2))
+	s.handleSearch(searchMessage(ipv4Group, 7001, [][20]byte{{9, 9, 9}}, "theirs"), net.IPv4(192, 168, 1, 3))
+	s.handleSearch(searchMessage(ipv4Group, 7002, [][20]byte{infoHash}, "theirs"), net.IPv4(192, 168, 1, 4))
+
+	if len(found) != 1 || found[0].Port != 7002 || !found[0].IpAddr.Equal(net.IPv4(192, 168, 1, 4)) {
+		t.Errorf("expected only the peer 192.168.1.4:7002 but got %v", found)
+	}
+}
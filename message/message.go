@@ -18,8 +18,23 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+	// Fast Extension, BEP 6
+	MsgSuggestPiece  messageID = 0x0D
+	MsgHaveAll       messageID = 0x0E
+	MsgHaveNone      messageID = 0x0F
+	MsgRejectRequest messageID = 0x10
+	MsgAllowedFast   messageID = 0x11
+	// Extension Protocol, BEP 10
+	MsgExtended messageID = 20
 )
 
+// ExtendedHandshakeID is the extended message id of the handshake of the Extension Protocol
+const ExtendedHandshakeID = 0
+
+// MaxLength bounds the messages a peer can send before anything is allocated, it fits a block of 16 KiB, a
+// metadata piece with its header and the bitfield of a million pieces
+const MaxLength = 256 << 10
+
 type Message struct {
 	ID      messageID
 	Payload []byte
@@ -36,6 +51,9 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > MaxLength {
+		return nil, fmt.Errorf("message of %d bytes is longer than %d bytes", length, MaxLength)
+	}
 	payloadBuff := make([]byte, length)
 	_, err = io.ReadFull(r, payloadBuff)
 	if err != nil {
@@ -100,3 +118,67 @@ func FormatRequest(index, begin, length int) *Message {
 		Payload: requestBuff,
 	}
 }
+
+// FormatIndexMessage formats the messages whose payload is only a piece index: have, suggest piece and allowed fast
+func FormatIndexMessage(id messageID, index int) *Message {
+	buff := make([]byte, 4)
+	binary.BigEndian.PutUint32(buff, uint32(index))
+	return &Message{ID: id, Payload: buff}
+}
+
+// ParseIndex returns the piece index of a have, suggest piece or allowed fast message
+func ParseIndex(indexMessage *Message) (int, error) {
+	if len(indexMessage.Payload) != 4 {
+		return 0, fmt.Errorf("invalid message with id %d, expected 4 bytes of payload but got %d", indexMessage.ID, len(indexMessage.Payload))
+	}
+	return int(binary.BigEndian.Uint32(indexMessage.Payload)), nil
+}
+
+// FormatRejectRequest formats the reject of a request, it has the same payload of the request
+func FormatRejectRequest(index, begin, length int) *Message {
+	rejectMessage := FormatRequest(index, begin, length)
+	rejectMessage.ID = MsgRejectRequest
+	return rejectMessage
+}
+
+// ParseRequest returns index, begin and length of a request, cancel or reject request message
+func ParseRequest(requestMessage *Message) (int, int, int, error) {
+	if len(requestMessage.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("invalid message with id %d, expected 12 bytes of payload but got %d", requestMessage.ID, len(requestMessage.Payload))
+	}
+	index := int(binary.BigEndian.Uint32(requestMessage.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(requestMessage.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(requestMessage.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// FormatPiece formats the message carrying a block of a piece
+func FormatPiece(index, begin int, data []byte) *Message {
+	buff := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(buff[0:4], uint32(index))
+	binary.BigEndian.PutUint32(buff[4:8], uint32(begin))
+	copy(buff[8:], data)
+	return &Message{
+		ID:      MsgPiece,
+		Payload: buff,
+	}
+}
+
+// FormatExtended formats a message of the Extension Protocol, id is the one the receiver gave to the extension
+func FormatExtended(id byte, payload []byte) *Message {
+	buff := make([]byte, 1+len(payload))
+	buff[0] = id
+	copy(buff[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buff}
+}
+
+// ParseExtended returns the extended message id and the payload of a message of the Extension Protocol
+func ParseExtended(extendedMessage *Message) (byte, []byte, error) {
+	if extendedMessage.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("message is not an extended message")
+	}
+	if len(extendedMessage.Payload) == 0 {
+		return 0, nil, fmt.Errorf("extended message without extended message id")
+	}
+	return extendedMessage.Payload[0], extendedMessage.Payload[1:], nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -39,6 +40,11 @@ func TestReadForAnInvalidMessage(t *testing.T) {
 	if err == nil {
 		t.Errorf("Expected an error for trying to read an invalid message (truncated), but got nil")
 	}
+	// the length is refused before the payload is allocated
+	_, err = ReadMessage(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF, 7}))
+	if err == nil || !strings.Contains(err.Error(), "longer") {
+		t.Errorf("Expected an error for a message longer than MaxLength, but got %v", err)
+	}
 }
 
 func TestSerializeMessage(t *testing.T) {
@@ -85,3 +91,44 @@ func TestFormatRequest(t *testing.T) {
 
 	}
 }
+
+func TestFastExtensionMessages(t *testing.T) {
+	t.Log("Testing the messages of the Fast Extension")
+	index, err := ParseIndex(FormatIndexMessage(MsgAllowedFast, 42))
+	if err != nil || index != 42 {
+		t.Error("expected index 42 but got ", index, err)
+	}
+	rejectMessage := FormatRejectRequest(3, 16384, 1024)
+	if rejectMessage.ID != MsgRejectRequest {
+		t.Error("expected a reject request but got id ", rejectMessage.ID)
+	}
+	index, begin, length, err := ParseRequest(rejectMessage)
+	if err != nil || index != 3 || begin != 16384 || length != 1024 {
+		t.Error("unexpected reject request parsed ", index, begin, length, err)
+	}
+	_, _, _, err = ParseRequest(&Message{ID: MsgRejectRequest, Payload: []byte{1, 2}})
+	if err == nil {
+		t.Error("expected an error parsing a truncated reject request")
+	}
+}
+
+func TestFormatPiece(t *testing.T) {
+	t.Log("Testing FormatPiece")
+	buff := make([]byte, 8)
+	n, err := ParsePiece(2, buff, FormatPiece(2, 4, []byte{1, 2, 3, 4}))
+	if err != nil || n != 4 || !bytes.Equal(buff, []byte{0, 0, 0, 0, 1, 2, 3, 4}) {
+		t.Error("expected the block at offset 4 but got ", buff, n, err)
+	}
+}
+
+func TestExtendedMessages(t *testing.T) {
+	t.Log("Testing the messages of the Extension Protocol")
+	id, payload, err := ParseExtended(FormatExtended(3, []byte("d1:ai1ee")))
+	if err != nil || id != 3 || string(payload) != "d1:ai1ee" {
+		t.Error("expected extended message 3 but got ", id, payload, err)
+	}
+	_, _, err = ParseExtended(&Message{ID: MsgExtended})
+	if err == nil {
+		t.Error("expected an error parsing an extended message without id")
+	}
+}
@@ -0,0 +1,263 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// contentType is the one of the Prometheus text exposition format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// LatencyBuckets are the upper bounds in seconds of the histograms of the disk and network latencies
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Label is a dimension of a sample, like the info hash of the torrent it belongs to
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Collector writes its metrics on every scrape, the values are read from the sources when they are asked for
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// CollectorFunc turns a function into a Collector
+type CollectorFunc func(w *Writer)
+
+func (f CollectorFunc) Collect(w *Writer) {
+	f(w)
+}
+
+// Registry serves the metrics of its collectors in the Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+	servers    []*http.Server
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(collector Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+// Gather asks every collector for its metrics
+func (r *Registry) Gather() *Writer {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+	w := &Writer{families: make(map[string]*family)}
+	for _, collector := range collectors {
+		collector.Collect(w)
+	}
+	return w
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	r.Gather().WriteTo(w)
+}
+
+// ListenHTTP serves the metrics on /metrics of the given address until Close is called
+func (r *Registry) ListenHTTP(address string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	server := &http.Server{Handler: mux}
+	r.mu.Lock()
+	r.servers = append(r.servers, server)
+	r.mu.Unlock()
+	go server.Serve(listener)
+	return listener.Addr(), nil
+}
+
+// Close stops the servers started by ListenHTTP
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	for _, server := range r.servers {
+		errs = append(errs, server.Close())
+	}
+	r.servers = nil
+	return errors.Join(errs...)
+}
+
+// Writer groups the samples of the collectors by metric, every metric is written once with all its samples
+// whatever the order the collectors wrote them in
+type Writer struct {
+	order    []string
+	families map[string]*family
+}
+
+type family struct {
+	help    string
+	kind    string
+	samples []sample
+}
+
+type sample struct {
+	name   string
+	labels []Label
+	value  float64
+}
+
+func (w *Writer) Counter(name, help string, value float64, labels ...Label) {
+	w.add(name, help, "counter", sample{name: name, labels: labels, value: value})
+}
+
+func (w *Writer) Gauge(name, help string, value float64, labels ...Label) {
+	w.add(name, help, "gauge", sample{name: name, labels: labels, value: value})
+}
+
+// Histogram writes the cumulative buckets, the sum and the count of the observations of h
+func (w *Writer) Histogram(name, help string, h *Histogram, labels ...Label) {
+	bounds, counts, sum, count := h.snapshot()
+	cumulative := uint64(0)
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		bucketLabels := append(append([]Label(nil), labels...), Label{"le", formatFloat(bound)})
+		w.add(name, help, "histogram", sample{name: name + "_bucket", labels: bucketLabels, value: float64(cumulative)})
+	}
+	infLabels := append(append([]Label(nil), labels...), Label{"le", "+Inf"})
+	w.add(name, help, "histogram", sample{name: name + "_bucket", labels: infLabels, value: float64(count)})
+	w.add(name, help, "histogram", sample{name: name + "_sum", labels: labels, value: sum})
+	w.add(name, help, "histogram", sample{name: name + "_count", labels: labels, value: float64(count)})
+}
+
+func (w *Writer) add(name, help, kind string, s sample) {
+	if w.families == nil {
+		w.families = make(map[string]*family)
+	}
+	f, ok := w.families[name]
+	if !ok {
+		f = &family{help: help, kind: kind}
+		w.families[name] = f
+		w.order = append(w.order, name)
+	}
+	f.samples = append(f.samples, s)
+}
+
+// WriteTo writes the metrics in the text exposition format, in the order they were first written
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	counter := &countingWriter{writer: out}
+	buffered := bufio.NewWriter(counter)
+	for _, name := range w.order {
+		f := w.families[name]
+		buffered.WriteString("# HELP " + name + " " + escapeHelp(f.help) + "\n")
+		buffered.WriteString("# TYPE " + name + " " + f.kind + "\n")
+		for _, s := range f.samples {
+			buffered.WriteString(s.name)
+			if len(s.labels) > 0 {
+				buffered.WriteByte('{')
+				for i, label := range s.labels {
+					if i > 0 {
+						buffered.WriteByte(',')
+					}
+					buffered.WriteString(label.Name + `="` + escapeLabel(label.Value) + `"`)
+				}
+				buffered.WriteByte('}')
+			}
+			buffered.WriteString(" " + formatFloat(s.value) + "\n")
+		}
+	}
+	err := buffered.Flush()
+	return counter.n, err
+}
+
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (c *countingWriter) Write(buff []byte) (int, error) {
+	n, err := c.writer.Write(buff)
+	c.n += int64(n)
+	return n, err
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Histogram counts the observations in buckets, it is safe to use from many goroutines and a nil Histogram
+// ignores the observations
+type Histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram counts the observations in buckets with the given upper bounds, sorted from the smallest
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(value float64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// snapshot returns the bounds, the observations of every bucket alone, their sum and their number
+func (h *Histogram) snapshot() ([]float64, []uint64, float64, uint64) {
+	if h == nil {
+		return nil, nil, 0, 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.bounds, append([]uint64(nil), h.counts...), h.sum, h.count
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	t.Log("Testing the text exposition format of counters, gauges and histograms")
+	registry := NewRegistry()
+	for _, infoHash := range []string{"aa", "bb"} {
+		registry.Register(CollectorFunc(func(w *Writer) {
+			w.Counter("test_bytes_total", "Bytes\nreceived", 10, Label{"info_hash", infoHash})
+			w.Gauge("test_peers", "Connected peers", 3, Label{"info_hash", infoHash}, Label{"state", `a"b`})
+		}))
+	}
+	histogram := NewHistogram([]float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(7)
+	registry.Register(CollectorFunc(func(w *Writer) {
+		w.Histogram("test_seconds", "Latency", histogram)
+	}))
+
+	var output strings.Builder
+	_, err := registry.Gather().WriteTo(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_bytes_total Bytes\nreceived
+# TYPE test_bytes_total counter
+test_bytes_total{info_hash="aa"} 10
+test_bytes_total{info_hash="bb"} 10
+# HELP test_peers Connected peers
+# TYPE test_peers gauge
+test_peers{info_hash="aa",state="a\"b"} 3
+test_peers{info_hash="bb",state="a\"b"} 3
+# HELP test_seconds Latency
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 7.55
+test_seconds_count 3
+`
+	if output.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, output.String())
+	}
+	var nilHistogram *Histogram
+	nilHistogram.Observe(1)
+}
+
+func TestListenHTTP(t *testing.T) {
+	t.Log("Testing the /metrics endpoint")
+	registry := NewRegistry()
+	registry.Register(CollectorFunc(func(w *Writer) {
+		w.Gauge("test_up", "Up", 1)
+	}))
+	addr, err := registry.ListenHTTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+	response, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.Header.Get("Content-Type") != contentType || !strings.HasSuffix(string(body), "test_up 1\n") {
+		t.Errorf("wrong metrics response %s %q", response.Header.Get("Content-Type"), body)
+	}
+}
@@ -0,0 +1,217 @@
+package p2p
+
+import (
+	"main/peer"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	rechokeInterval = 10 * time.Second
+	// the optimistic unchoke moves to another peer every third rechoke, 30 seconds
+	optimisticUnchokeRounds = 3
+	defaultUploadSlots      = 4
+)
+
+// chokedPeer is what the choker knows about a connection, the byte counters are reset on every rechoke
+type chokedPeer struct {
+	interested     bool
+	choked         bool
+	downloadedFrom int64
+	uploadedTo     int64
+	// allowedFast are the pieces of our allowed fast set for the peer, served even while it is choked
+	allowedFast map[int]bool
+}
+
+// choker decides which peers we upload to: every 10 seconds the peers that gave us the most data are unchoked,
+// or the ones we sent the most data to once we are seeding, and every 30 seconds a random peer gets an optimistic
+// unchoke so that new peers get a chance to show their speed
+type choker struct {
+	// uploadSlots is the number of unchoked peers, the optimistic unchoke included
+	uploadSlots int
+	seeding     func() bool
+
+	mu         sync.Mutex
+	peers      map[*peer.PeerConnection]*chokedPeer
+	optimistic *peer.PeerConnection
+	rounds     int
+}
+
+func newChoker(uploadSlots int, seeding func() bool) *choker {
+	if uploadSlots <= 0 {
+		uploadSlots = defaultUploadSlots
+	}
+	return &choker{
+		uploadSlots: uploadSlots,
+		seeding:     seeding,
+		peers:       make(map[*peer.PeerConnection]*chokedPeer),
+	}
+}
+
+func (c *choker) run(stop chan struct{}) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.rechoke()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// add registers a connection, every peer starts choked as the protocol says
+func (c *choker) add(peerConnection *peer.PeerConnection, allowedFast []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := &chokedPeer{choked: true, allowedFast: make(map[int]bool)}
+	for _, index := range allowedFast {
+		state.allowedFast[index] = true
+	}
+	c.peers[peerConnection] = state
+}
+
+func (c *choker) remove(peerConnection *peer.PeerConnection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.peers, peerConnection)
+	if c.optimistic == peerConnection {
+		c.optimistic = nil
+	}
+}
+
+func (c *choker) setInterested(peerConnection *peer.PeerConnection, interested bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state, ok := c.peers[peerConnection]; ok {
+		state.interested = interested
+	}
+}
+
+func (c *choker) addDownloaded(peerConnection *peer.PeerConnection, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state, ok := c.peers[peerConnection]; ok {
+		state.downloadedFrom += int64(n)
+	}
+}
+
+func (c *choker) addUploaded(peerConnection *peer.PeerConnection, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state, ok := c.peers[peerConnection]; ok {
+		state.uploadedTo += int64(n)
+	}
+}
+
+// canUpload reports whether a request of the peer for the piece can be served
+func (c *choker) canUpload(peerConnection *peer.PeerConnection, index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.peers[peerConnection]
+	return ok && (!state.choked || state.allowedFast[index])
+}
+
+func (c *choker) rechoke() {
+	c.mu.Lock()
+	seeding := c.seeding != nil && c.seeding()
+	var interested []*peer.PeerConnection
+	for peerConnection, state := range c.peers {
+		if state.interested {
+			interested = append(interested, peerConnection)
+		}
+	}
+	rate := func(peerConnection *peer.PeerConnection) int64 {
+		if seeding {
+			return c.peers[peerConnection].uploadedTo
+		}
+		return c.peers[peerConnection].downloadedFrom
+	}
+	// the fastest first, ties are broken randomly so that equal peers take turns
+	rand.Shuffle(len(interested), func(i, j int) { interested[i], interested[j] = interested[j], interested[i] })
+	slices.SortStableFunc(interested, func(a, b *peer.PeerConnection) int {
+		if rate(a) > rate(b) {
+			return -1
+		}
+		if rate(a) < rate(b) {
+			return 1
+		}
+		return 0
+	})
+
+	unchoked := make(map[*peer.PeerConnection]bool)
+	regularSlots := c.uploadSlots - 1
+	for _, peerConnection := range interested[:min(regularSlots, len(interested))] {
+		unchoked[peerConnection] = true
+	}
+
+	c.rounds++
+	if c.optimistic == nil || unchoked[c.optimistic] || !c.peers[c.optimistic].interested || c.rounds%optimisticUnchokeRounds == 0 {
+		c.optimistic = nil
+		var candidates []*peer.PeerConnection
+		for _, peerConnection := range interested {
+			if !unchoked[peerConnection] {
+				candidates = append(candidates, peerConnection)
+			}
+		}
+		if len(candidates) > 0 {
+			c.optimistic = candidates[rand.IntN(len(candidates))]
+		}
+	}
+	if c.optimistic != nil {
+		unchoked[c.optimistic] = true
+	}
+
+	var toChoke, toUnchoke []*peer.PeerConnection
+	for peerConnection, state := range c.peers {
+		if unchoked[peerConnection] && state.choked {
+			toUnchoke = append(toUnchoke, peerConnection)
+		} else if !unchoked[peerConnection] && !state.choked {
+			toChoke = append(toChoke, peerConnection)
+		}
+		state.choked = !unchoked[peerConnection]
+		state.downloadedFrom = 0
+		state.uploadedTo = 0
+	}
+	c.mu.Unlock()
+
+	// the messages are sent without the lock, a slow peer must not block the others
+	for _, peerConnection := range toChoke {
+		peerConnection.SendChoke()
+	}
+	for _, peerConnection := range toUnchoke {
+		peerConnection.SendUnchoke()
+	}
+}
+
+// counts returns the number of choked, unchoked and interested peers
+func (c *choker) counts() (int, int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	choked, unchoked, interested := 0, 0, 0
+	for _, state := range c.peers {
+		if state.choked {
+			choked++
+		} else {
+			unchoked++
+		}
+		if state.interested {
+			interested++
+		}
+	}
+	return choked, unchoked, interested
+}
+
+// state returns whether we choke the peer and whether it is interested in our pieces
+func (c *choker) state(peerConnection *peer.PeerConnection) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.peers[peerConnection]
+	if !ok {
+		return true, false
+	}
+	return state.choked, state.interested
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"main/message"
+	"main/peer"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordingConn keeps the ids of the messages written to it
+type recordingConn struct {
+	net.Conn
+	mu       sync.Mutex
+	messages []uint8
+	closed   bool
+}
+
+func (c *recordingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *recordingConn) Write(buff []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, buff[4])
+	return len(buff), nil
+}
+
+func (c *recordingConn) lastMessage() (uint8, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.messages) == 0 {
+		return 0, false
+	}
+	return c.messages[len(c.messages)-1], true
+}
+
+func TestRechoke(t *testing.T) {
+	t.Log("Testing that the fastest peers and one optimistic peer are unchoked")
+	seeding := false
+	c := newChoker(3, func() bool { return seeding })
+	var peers []*peer.PeerConnection
+	for i := 0; i < 5; i++ {
+		peerConnection := &peer.PeerConnection{Conn: &recordingConn{}}
+		peers = append(peers, peerConnection)
+		c.add(peerConnection, nil)
+		c.setInterested(peerConnection, i != 4)
+		c.addDownloaded(peerConnection, 1000*(i+1))
+	}
+	c.addUploaded(peers[0], 1<<20)
+	c.rechoke()
+
+	// peers 3 and 2 gave us the most, one of 0 and 1 gets the optimistic unchoke, 4 is not interested
+	for _, i := range []int{2, 3} {
+		if id, _ := peers[i].Conn.(*recordingConn).lastMessage(); id != uint8(message.MsgUnchoke) {
+			t.Errorf("expected peer %d to be unchoked", i)
+		}
+	}
+	if c.optimistic != peers[0] && c.optimistic != peers[1] {
+		t.Error("expected the optimistic unchoke to go to peer 0 or 1")
+	}
+	if _, sent := peers[4].Conn.(*recordingConn).lastMessage(); sent {
+		t.Error("expected the peer that is not interested to stay choked")
+	}
+	if !c.canUpload(peers[3], 0) || c.canUpload(peers[4], 0) {
+		t.Error("expected only unchoked peers to be allowed to download")
+	}
+
+	// once seeding the peers we upload the most to are preferred
+	seeding = true
+	c.addUploaded(peers[0], 1<<20)
+	c.rechoke()
+	if id, _ := peers[0].Conn.(*recordingConn).lastMessage(); id != uint8(message.MsgUnchoke) {
+		t.Error("expected peer 0 to be unchoked while seeding")
+	}
+}
+
+func TestAllowedFastUpload(t *testing.T) {
+	t.Log("Testing that a choked peer can download the pieces of its allowed fast set")
+	c := newChoker(0, nil)
+	peerConnection := &peer.PeerConnection{Conn: &recordingConn{}}
+	c.add(peerConnection, []int{7})
+	if !c.canUpload(peerConnection, 7) || c.canUpload(peerConnection, 8) {
+		t.Error("expected only piece 7 to be allowed while choked")
+	}
+}
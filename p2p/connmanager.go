@@ -0,0 +1,169 @@
+package p2p
+
+import (
+	"main/bitfield"
+	"main/blocklist"
+	"main/peer"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConnections        = 200
+	defaultMaxTorrentConnections = 50
+	defaultMaxHalfOpen           = 20
+	// failedPeerMemory is how long a peer we could not connect to, or that timed out, is not dialed again
+	failedPeerMemory = 10 * time.Minute
+	// badPeerMemory is how long a peer that sent corrupt pieces is not dialed again
+	badPeerMemory = time.Hour
+	// maxHashFailures is the number of corrupt pieces after which a peer is dropped
+	maxHashFailures = 2
+	// every replaceInterval the worst peer is swapped for a fresh candidate, if it has been connected for minPeerAge
+	replaceInterval = 30 * time.Second
+	minPeerAge      = time.Minute
+)
+
+// ConnManager limits the connections of all the torrents together and remembers the peers that misbehaved,
+// a single one is meant to be shared by every torrent of the client
+type ConnManager struct {
+	// MaxConnections is the limit of connected peers of all the torrents
+	MaxConnections int
+	// MaxHalfOpen is the limit of connections being dialed or handshaked at the same time
+	MaxHalfOpen int
+	// Bans are the addresses banned for sending corrupt data, every port of them is refused
+	Bans *BanList
+	// Blocklist are the address ranges that are never dialed or accepted, it can be nil. Every peer goes
+	// through isBad before being dialed or accepted, whether it comes from a tracker, the local network or an
+	// incoming connection
+	Blocklist *blocklist.Blocklist
+
+	// totals are the counters of every torrent that used the manager
+	totals *Stats
+
+	mu          sync.Mutex
+	connections int
+	halfOpen    int
+	bad         map[string]time.Time
+	// waiting are the torrents that have candidates to dial, they are woken up when a slot is released
+	waiting map[*Torrent]func()
+}
+
+func NewConnManager(maxConnections, maxHalfOpen int) *ConnManager {
+	if maxConnections <= 0 {
+		maxConnections = defaultMaxConnections
+	}
+	if maxHalfOpen <= 0 {
+		maxHalfOpen = defaultMaxHalfOpen
+	}
+	return &ConnManager{
+		MaxConnections: maxConnections,
+		MaxHalfOpen:    maxHalfOpen,
+		Bans:           &BanList{banned: make(map[string]bool)},
+		totals:         NewStats(0),
+		bad:            make(map[string]time.Time),
+		waiting:        make(map[*Torrent]func()),
+	}
+}
+
+// acquire takes a connection slot, halfOpen also takes a dial slot that is released by releaseHalfOpen
+func (m *ConnManager) acquire(halfOpen bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connections >= m.MaxConnections || (halfOpen && m.halfOpen >= m.MaxHalfOpen) {
+		return false
+	}
+	m.connections++
+	if halfOpen {
+		m.halfOpen++
+	}
+	return true
+}
+
+func (m *ConnManager) releaseHalfOpen() {
+	m.mu.Lock()
+	m.halfOpen--
+	m.mu.Unlock()
+	m.wakeUp()
+}
+
+func (m *ConnManager) release() {
+	m.mu.Lock()
+	m.connections--
+	m.mu.Unlock()
+	m.wakeUp()
+}
+
+// wakeUp lets the torrents waiting for a slot dial their candidates
+func (m *ConnManager) wakeUp() {
+	m.mu.Lock()
+	fills := make([]func(), 0, len(m.waiting))
+	for _, fill := range m.waiting {
+		fills = append(fills, fill)
+	}
+	m.mu.Unlock()
+	for _, fill := range fills {
+		go fill()
+	}
+}
+
+func (m *ConnManager) register(t *Torrent, fill func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waiting[t] = fill
+}
+
+func (m *ConnManager) unregister(t *Torrent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.waiting, t)
+}
+
+// markBad keeps the peer from being dialed or accepted for the given time
+func (m *ConnManager) markBad(addr string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until := time.Now().Add(duration)
+	if until.After(m.bad[addr]) {
+		m.bad[addr] = until
+	}
+}
+
+// Refuses reports whether the peer is banned, blocklisted or recently failed, the connections opened outside of a
+// download, like the ones fetching the metadata of a magnet link, are checked with it too
+func (m *ConnManager) Refuses(addr string) bool {
+	return m.isBad(addr)
+}
+
+func (m *ConnManager) isBad(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ipAddr := net.ParseIP(host)
+		if m.Bans.IsBanned(ipAddr) || m.Blocklist.Contains(ipAddr) {
+			return true
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.bad[addr]
+	if ok && time.Now().After(until) {
+		delete(m.bad, addr)
+		return false
+	}
+	return ok
+}
+
+// activePeer is a peer a worker is connected or connecting to, its score decides which peers are replaced
+type activePeer struct {
+	conn         *peer.PeerConnection
+	connectedAt  time.Time
+	downloaded   int64
+	hashFailures int
+	// pieces is a copy of the bitfield of the peer that the other workers can read under the lock of the torrent
+	pieces bitfield.Bitfield
+}
+
+// score is the download rate of the peer, lowered by every corrupt piece it sent
+func (p *activePeer) score(now time.Time) float64 {
+	rate := float64(p.downloaded) / max(now.Sub(p.connectedAt).Seconds(), 1)
+	return rate / float64(1+4*p.hashFailures)
+}
@@ -0,0 +1,124 @@
+package p2p
+
+import (
+	"main/blocklist"
+	"main/peer"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnManagerLimits(t *testing.T) {
+	t.Log("Testing the connection and half-open limits and the memory of bad peers")
+	m := NewConnManager(2, 1)
+	if !m.acquire(true) || m.acquire(true) {
+		t.Error("expected a single half-open connection")
+	}
+	if !m.acquire(false) || m.acquire(false) {
+		t.Error("expected two connections at most")
+	}
+	m.releaseHalfOpen()
+	m.release()
+	if !m.acquire(true) {
+		t.Error("expected the released slots to be available again")
+	}
+
+	m.markBad("1.2.3.4:5", time.Hour)
+	m.markBad("5.6.7.8:9", -time.Second)
+	if !m.isBad("1.2.3.4:5") || m.isBad("5.6.7.8:9") || m.isBad("9.9.9.9:9") {
+		t.Error("expected only the peer marked for an hour to be bad")
+	}
+}
+
+// silentPeer accepts connections and never answers the handshake, the dials to it stay half-open
+func silentPeer(t *testing.T) peer.Peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	addr := listener.Addr().(*net.TCPAddr)
+	return peer.Peer{IpAddr: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestAddPeersRespectsLimits(t *testing.T) {
+	t.Log("Testing that candidates wait for a half-open slot and that bad peers are skipped")
+	torrent := &Torrent{MaxConnections: 2, Conns: NewConnManager(10, 1)}
+	torrent.workQueue = make(chan *PieceWork)
+	torrent.resultQueue = make(chan *PieceResult)
+	torrent.activePeers = make(map[string]*activePeer)
+	torrent.pending = make(map[string]bool)
+
+	badPeer := silentPeer(t)
+	torrent.Conns.markBad(badPeer.String(), time.Hour)
+	peers := []peer.Peer{silentPeer(t), silentPeer(t), badPeer, silentPeer(t)}
+	torrent.AddPeers(append(peers, peers[0]))
+
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+	if len(torrent.activePeers) != 1 || torrent.activePeers[peers[0].String()] == nil {
+		t.Errorf("expected only the first peer to be dialed but %d are", len(torrent.activePeers))
+	}
+	if len(torrent.candidates) != 2 {
+		t.Errorf("expected 2 candidates waiting, the duplicate and the bad peer skipped, but got %d", len(torrent.candidates))
+	}
+}
+
+func TestBlocklistRefusesPeers(t *testing.T) {
+	t.Log("Testing that the peers of a blocked range are never dialed")
+	blocked, err := blocklist.Parse(strings.NewReader("127.0.0.0/8\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent := &Torrent{MaxConnections: 2, Conns: NewConnManager(10, 10)}
+	torrent.Conns.Blocklist = blocked
+	torrent.workQueue = make(chan *PieceWork)
+	torrent.resultQueue = make(chan *PieceResult)
+	torrent.activePeers = make(map[string]*activePeer)
+	torrent.pending = make(map[string]bool)
+	torrent.AddPeers([]peer.Peer{silentPeer(t)})
+
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+	if len(torrent.activePeers) != 0 || len(torrent.candidates) != 0 {
+		t.Error("expected the blocked peer to be dropped")
+	}
+}
+
+func TestReplaceWorstPeer(t *testing.T) {
+	t.Log("Testing that the slowest peer is replaced when candidates are waiting")
+	torrent := &Torrent{MaxConnections: 2, Conns: NewConnManager(10, 10)}
+	torrent.activePeers = make(map[string]*activePeer)
+	connectedAt := time.Now().Add(-2 * minPeerAge)
+	slowConn, fastConn := &recordingConn{}, &recordingConn{}
+	torrent.activePeers["slow"] = &activePeer{conn: &peer.PeerConnection{Conn: slowConn, PeerToConnect: &peer.Peer{}}, connectedAt: connectedAt, downloaded: 100}
+	torrent.activePeers["fast"] = &activePeer{conn: &peer.PeerConnection{Conn: fastConn, PeerToConnect: &peer.Peer{}}, connectedAt: connectedAt, downloaded: 1000}
+
+	torrent.replaceWorstPeer()
+	if slowConn.closed || fastConn.closed {
+		t.Error("expected no peer to be replaced without candidates")
+	}
+	torrent.candidates = []peer.Peer{{IpAddr: net.IPv4(1, 2, 3, 4), Port: 1}}
+	torrent.activePeers["fast"].hashFailures = 1
+	torrent.activePeers["fast"].downloaded = 400
+	torrent.replaceWorstPeer()
+	if slowConn.closed || !fastConn.closed {
+		t.Error("expected the peer that sent a corrupt piece to be replaced")
+	}
+}
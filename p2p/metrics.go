@@ -0,0 +1,81 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/hex"
+	"main/metrics"
+	"slices"
+)
+
+// Collect writes the metrics of the connections of the manager, the totals of the torrents and the metrics of
+// every torrent that is downloading
+func (m *ConnManager) Collect(w *metrics.Writer) {
+	m.mu.Lock()
+	connections, halfOpen := m.connections, m.halfOpen
+	torrents := make([]*Torrent, 0, len(m.waiting))
+	for t := range m.waiting {
+		torrents = append(torrents, t)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(torrents, func(a, b *Torrent) int {
+		return bytes.Compare(a.InfoHash[:], b.InfoHash[:])
+	})
+
+	w.Gauge("gotorrent_torrents", "Torrents being downloaded", float64(len(torrents)))
+	w.Gauge("gotorrent_connections", "Peers connected or being connected, of every torrent", float64(connections))
+	w.Gauge("gotorrent_half_open_connections", "Peers being dialed or handshaked, of every torrent", float64(halfOpen))
+	w.Gauge("gotorrent_max_connections", "Limit of the connections of every torrent", float64(m.MaxConnections))
+	w.Counter("gotorrent_session_downloaded_bytes_total", "Piece bytes received by every torrent",
+		float64(m.totals.Downloaded()))
+	w.Counter("gotorrent_session_uploaded_bytes_total", "Piece bytes sent by every torrent", float64(m.totals.Uploaded()))
+	w.Counter("gotorrent_session_pieces_verified_total", "Pieces of every torrent that passed the hash check",
+		float64(m.totals.PiecesVerified()))
+	w.Counter("gotorrent_session_pieces_failed_total", "Pieces of every torrent that failed the hash check",
+		float64(m.totals.PiecesFailed()))
+	for _, t := range torrents {
+		t.collect(w)
+	}
+}
+
+// collect writes the metrics of the torrent, labeled with its info hash
+func (t *Torrent) collect(w *metrics.Writer) {
+	infoHash := metrics.Label{Name: "info_hash", Value: hex.EncodeToString(t.InfoHash[:])}
+	t.mu.Lock()
+	connected, connecting := 0, 0
+	for _, activePeer := range t.activePeers {
+		if activePeer.conn != nil {
+			connected++
+		} else {
+			connecting++
+		}
+	}
+	candidates := len(t.candidates)
+	queuedPieces := len(t.workQueue)
+	choker := t.choker
+	t.mu.Unlock()
+
+	w.Counter("gotorrent_downloaded_bytes_total", "Piece bytes received, including the ones of corrupt pieces",
+		float64(t.Stats.Downloaded()), infoHash)
+	w.Counter("gotorrent_uploaded_bytes_total", "Piece bytes sent", float64(t.Stats.Uploaded()), infoHash)
+	w.Gauge("gotorrent_left_bytes", "Bytes still to download and verify", float64(t.Stats.Left()), infoHash)
+	w.Counter("gotorrent_pieces_verified_total", "Pieces that passed the hash check", float64(t.Stats.PiecesVerified()),
+		infoHash)
+	w.Counter("gotorrent_pieces_failed_total", "Pieces that failed the hash check", float64(t.Stats.PiecesFailed()),
+		infoHash)
+	w.Gauge("gotorrent_peers", "Peers of the torrent by state of the connection", float64(connected), infoHash,
+		metrics.Label{Name: "state", Value: "connected"})
+	w.Gauge("gotorrent_peers", "Peers of the torrent by state of the connection", float64(connecting), infoHash,
+		metrics.Label{Name: "state", Value: "connecting"})
+	w.Gauge("gotorrent_candidate_peers", "Peers waiting for a connection slot", float64(candidates), infoHash)
+	w.Gauge("gotorrent_queued_pieces", "Pieces waiting for a peer or a web seed to download them",
+		float64(queuedPieces), infoHash)
+	if choker != nil {
+		choked, unchoked, interested := choker.counts()
+		w.Gauge("gotorrent_choked_peers", "Connected peers by our choke state towards them", float64(choked), infoHash,
+			metrics.Label{Name: "state", Value: "choked"})
+		w.Gauge("gotorrent_choked_peers", "Connected peers by our choke state towards them", float64(unchoked), infoHash,
+			metrics.Label{Name: "state", Value: "unchoked"})
+		w.Gauge("gotorrent_interested_peers", "Connected peers interested in our pieces", float64(interested), infoHash)
+	}
+	w.Histogram("gotorrent_disk_write_seconds", "Time to write a verified piece to disk", t.Stats.diskWrites, infoHash)
+}
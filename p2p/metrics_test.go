@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"main/metrics"
+	"main/peer"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollect(t *testing.T) {
+	t.Log("Testing the metrics of the connection manager and of its torrents")
+	conns := NewConnManager(10, 5)
+	torrent := &Torrent{InfoHash: [20]byte{0xab}, Conns: conns, Stats: NewStats(1000)}
+	torrent.Stats.session.Store(conns.totals)
+	torrent.workQueue = make(chan *PieceWork, 4)
+	torrent.workQueue <- &PieceWork{}
+	torrent.activePeers = make(map[string]*activePeer)
+	torrent.choker = newChoker(4, nil)
+	connected := &peer.PeerConnection{PeerToConnect: &peer.Peer{}}
+	torrent.activePeers["connected"] = &activePeer{conn: connected}
+	torrent.activePeers["connecting"] = &activePeer{}
+	torrent.choker.add(connected, nil)
+	torrent.choker.setInterested(connected, true)
+	conns.register(torrent, func() {})
+	conns.acquire(true)
+
+	torrent.Stats.addDownloaded(600)
+	torrent.Stats.addUploaded(100)
+	torrent.Stats.pieceVerified(500, 3*time.Millisecond)
+	torrent.Stats.pieceFailed()
+
+	registry := metrics.NewRegistry()
+	registry.Register(conns)
+	var output strings.Builder
+	registry.Gather().WriteTo(&output)
+	infoHash := `info_hash="ab00000000000000000000000000000000000000"`
+	for _, line := range []string{
+		"gotorrent_torrents 1",
+		"gotorrent_half_open_connections 1",
+		"gotorrent_session_downloaded_bytes_total 600",
+		"gotorrent_session_pieces_failed_total 1",
+		"gotorrent_downloaded_bytes_total{" + infoHash + "} 600",
+		"gotorrent_uploaded_bytes_total{" + infoHash + "} 100",
+		"gotorrent_left_bytes{" + infoHash + "} 500",
+		"gotorrent_pieces_verified_total{" + infoHash + "} 1",
+		"gotorrent_peers{" + infoHash + `,state="connecting"} 1`,
+		"gotorrent_queued_pieces{" + infoHash + "} 1",
+		"gotorrent_choked_peers{" + infoHash + `,state="choked"} 1`,
+		"gotorrent_interested_peers{" + infoHash + "} 1",
+		"gotorrent_disk_write_seconds_bucket{" + infoHash + `,le="0.005"} 1`,
+	} {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Errorf("expected %q in the metrics:\n%s", line, output.String())
+		}
+	}
+}
@@ -3,17 +3,36 @@ package p2p
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"main/bitfield"
+	"main/handshake"
+	"main/logging"
 	"main/message"
 	"main/peer"
+	"main/ratelimit"
+	"net"
+	"net/http"
 	"os"
-	"runtime"
+	"slices"
+	"sync"
 	"time"
 )
 
 const maxBlockSize = 16384
 
+// blockTimeout is how long a peer has to send the next block of a piece, a piece slowed down by the rate limits can
+// take longer than it as a whole
+const blockTimeout = 30 * time.Second
+
+// smartBanPause is the wait of a worker whose peer only has pieces that must come from other peers
+const smartBanPause = time.Second
+
+// maxRequestLength is the biggest block we upload, longer requests are refused
+const maxRequestLength = 128 * 1024
+
 // Torrent != TorrentFile
 type Torrent struct {
 	InfoHash    [20]byte
@@ -23,6 +42,49 @@ type Torrent struct {
 	Name        string
 	PeerId      [20]byte
 	Peers       []peer.Peer
+	Stats       *Stats
+	// Files is the layout of a multi-file torrent, empty for a single file
+	Files []File
+	// WebSeeds are the BEP 19 urls the pieces are also downloaded from
+	WebSeeds []string
+	// UploadSlots is the number of peers we upload to at the same time, 4 when not set
+	UploadSlots int
+	// Limits caps the transfer rates of the torrent, GlobalLimits the ones shared with the other torrents, both can be nil
+	Limits       *ratelimit.Limits
+	GlobalLimits *ratelimit.Limits
+	// MaxConnections is the limit of connected peers of the torrent, 50 when not set
+	MaxConnections int
+	// Conns is the connection manager shared with the other torrents, when nil the torrent uses its own
+	Conns *ConnManager
+	// Dialer opens the connections to the peers, with our MSE policy and over uTP when it has a socket, its
+	// proxy also carries the requests to the web seeds
+	Dialer peer.Dialer
+	// Logger receives the progress of the download and the misbehaving peers, nil discards them
+	Logger *slog.Logger
+	// FilePriorities are the priorities of the files by index, or of the only file of a single-file torrent,
+	// the missing ones are PriorityNormal
+	FilePriorities []Priority
+
+	mu          sync.Mutex
+	workQueue   chan *PieceWork
+	resultQueue chan *PieceResult
+	activePeers map[string]*activePeer
+	candidates  []peer.Peer
+	pending     map[string]bool
+	bitfield    bitfield.Bitfield
+	done        bool
+	stopped     bool
+	// stop is closed when the download completes or is stopped, changed wakes it up when the priorities change
+	stop        chan struct{}
+	changed     chan struct{}
+	pieceStates []pieceState
+	// missing is the number of wanted pieces we do not have
+	missing  int
+	file     *os.File
+	choker   *choker
+	smartBan *smartBan
+	// webSeedClient goes through the proxy of the Dialer
+	webSeedClient *http.Client
 }
 
 type PieceWork struct {
@@ -34,10 +96,20 @@ type PieceWork struct {
 type PieceProgress struct {
 	pieceBuff       []byte
 	peerConn        *peer.PeerConnection
+	torrent         *Torrent
 	blockDownloaded int
 	blockRequested  int
 	backlog         int
 	index           int
+	// rejected are the blocks the peer refused to send, they are requested again before the next ones
+	rejected []block
+	// senders has the address of the peer that sent every block, for the smart ban
+	senders []string
+}
+
+type block struct {
+	begin  int
+	length int
 }
 
 type PieceResult struct {
@@ -45,6 +117,10 @@ type PieceResult struct {
 	buff  []byte
 }
 
+func (t *Torrent) logger() *slog.Logger {
+	return logging.Or(t.Logger)
+}
+
 func (t *Torrent) calculatePieceLength(index int) int {
 	begin, end := t.calculateBoundForPiece(index)
 	return end - begin
@@ -63,75 +139,497 @@ func (t *Torrent) calculateBoundForPiece(index int) (int, int) {
 	return begin, end
 }
 
+// ErrStopped is returned by Download when Stop ends it before every wanted piece is downloaded
+var ErrStopped = errors.New("download stopped")
+
 func (t *Torrent) Download(outputPath string) error {
-	// Apri un file su disco per scrivere il contenuto del torrent
-	file, err := os.Create(outputPath)
+	// the file is not truncated, the pieces it already holds are checked and kept so a stopped download goes on
+	file, err := os.OpenFile(outputPath, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %s", err)
+		return fmt.Errorf("failed to open output file: %s", err)
 	}
 	defer file.Close()
 
+	if t.Length == 0 {
+		t.Length = len(t.PieceHashes) * t.PieceLength
+	}
+	if t.Stats == nil {
+		t.Stats = NewStats(int64(t.Length))
+	}
+	t.Stats.left.Store(int64(t.Length))
+	if t.Conns == nil {
+		t.Conns = NewConnManager(0, 0)
+	}
+	// the Stats of a resumed download can still be in use by the workers of the stopped one
+	t.Stats.session.Store(t.Conns.totals)
+	if t.MaxConnections <= 0 {
+		t.MaxConnections = defaultMaxTorrentConnections
+	}
+	have, err := t.recheck(file)
+	if err != nil {
+		return err
+	}
+
 	workQueue := make(chan *PieceWork, len(t.PieceHashes))
 	resultQueue := make(chan *PieceResult)
-
-	for i, hash := range t.PieceHashes {
-		workQueue <- &PieceWork{i, t.calculatePieceLength(i), hash}
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return ErrStopped
+	}
+	t.stop = make(chan struct{})
+	t.changed = make(chan struct{}, 1)
+	t.workQueue = workQueue
+	t.resultQueue = resultQueue
+	t.activePeers = make(map[string]*activePeer)
+	t.pending = make(map[string]bool)
+	t.bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	t.pieceStates = make([]pieceState, len(t.PieceHashes))
+	for index, restored := range have {
+		if restored {
+			t.bitfield.SetPiece(index)
+			t.pieceStates[index] = pieceHave
+		}
 	}
-	for _, downloadPeer := range t.Peers {
-		go t.startDownloadWorker(downloadPeer, workQueue, resultQueue)
+	t.queueWantedPieces()
+	t.file = file
+	t.webSeedClient = t.Dialer.Proxy.HTTPClient(webSeedTimeout)
+	t.choker = newChoker(t.UploadSlots, func() bool { return t.Stats.Left() == 0 })
+	t.smartBan = newSmartBan()
+	initialPeers := t.Peers
+	stop := t.stop
+	t.mu.Unlock()
+	defer t.finish()
+	go t.choker.run(stop)
+	go t.replacePeersLoop(stop)
+	t.Conns.register(t, t.fillConnections)
+	defer t.Conns.unregister(t)
+	t.AddPeers(initialPeers)
+	for _, webSeedUrl := range t.WebSeeds {
+		go t.startWebSeedWorker(webSeedUrl, workQueue, resultQueue)
 	}
 
-	donePieces := 0
-	log.Println(t.Length)
+	t.logger().Info("starting download", "length", t.Length, "pieces", len(t.PieceHashes), "left", t.Stats.Left())
 
-	for donePieces < len(t.PieceHashes) {
-		resultPiece := <-resultQueue
-		donePieces++
+	for {
+		t.mu.Lock()
+		missing := t.missing
+		t.mu.Unlock()
+		if missing == 0 {
+			return nil
+		}
+		var resultPiece *PieceResult
+		select {
+		case resultPiece = <-resultQueue:
+		case <-t.changed:
+			continue
+		case <-stop:
+			return ErrStopped
+		}
 
 		begin, _ := t.calculateBoundForPiece(resultPiece.index)
-		_, err := file.Seek(int64(begin), 0)
+		writeStart := time.Now()
+		_, err := file.WriteAt(resultPiece.buff, int64(begin))
 		if err != nil {
-			return fmt.Errorf("failed to seek file: %s", err)
+			return fmt.Errorf("failed to write piece to file: %s", err)
+		}
+		t.Stats.pieceVerified(len(resultPiece.buff), time.Since(writeStart))
+		t.mu.Lock()
+		t.bitfield.SetPiece(resultPiece.index)
+		t.pieceDone(resultPiece.index)
+		t.mu.Unlock()
+
+		percentage := float64(int64(t.Length)-t.Stats.Left()) / float64(t.Length) * 100
+		t.logger().Debug("piece written", "piece", resultPiece.index, "progress", fmt.Sprintf("%0.2f%%", percentage))
+	}
+}
+
+// recheck hashes the pieces already in the file, the ones that match are not downloaded again
+func (t *Torrent) recheck(file *os.File) ([]bool, error) {
+	have := make([]bool, len(t.PieceHashes))
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check output file: %s", err)
+	}
+	restored := 0
+	for i, hash := range t.PieceHashes {
+		begin, end := t.calculateBoundForPiece(i)
+		if int64(end) > info.Size() {
+			break
 		}
-		_, err = file.Write(resultPiece.buff)
+		pieceBuff := make([]byte, end-begin)
+		_, err := file.ReadAt(pieceBuff, int64(begin))
 		if err != nil {
-			return fmt.Errorf("failed to write piece to file: %s", err)
+			return nil, fmt.Errorf("failed to read output file: %s", err)
 		}
+		if checkHash(pieceBuff, &PieceWork{index: i, length: len(pieceBuff), hash: hash}) {
+			have[i] = true
+			t.Stats.pieceRestored(len(pieceBuff))
+			restored++
+		}
+	}
+	if restored > 0 {
+		t.logger().Info("resuming download", "restored_pieces", restored)
+	}
+	return have, nil
+}
 
-		percentage := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		log.Printf("Download at %0.2f%%, downloading a piece from %d peers with index %d", percentage, runtime.NumGoroutine()-1, resultPiece.index)
+// Stop ends the download, Download returns ErrStopped and the peers are disconnected. The pieces already written
+// stay in the file and the next Download on it does not download them again
+func (t *Torrent) Stop() {
+	t.mu.Lock()
+	t.stopped = true
+	running := t.stop != nil
+	t.mu.Unlock()
+	if running {
+		t.finish()
+	}
+}
+
+// finish ends the workers and the loops of the download and closes the connections to its peers
+func (t *Torrent) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done = true
+	t.candidates = nil
+	select {
+	case <-t.stop:
+		return
+	default:
+		close(t.stop)
+	}
+	for _, activePeer := range t.activePeers {
+		if activePeer.conn != nil {
+			// the worker of the peer fails its next read and frees the slot
+			activePeer.conn.Conn.Close()
+		}
+	}
+}
+
+// AddPeers adds the peers we are not already connected to as candidates, they are dialed as soon as the
+// connection limits allow it. It can be called while Download is running to feed it with fresh peers
+func (t *Torrent) AddPeers(peers []peer.Peer) {
+	t.mu.Lock()
+	if t.workQueue == nil {
+		t.Peers = append(t.Peers, peers...)
+		t.mu.Unlock()
+		return
+	}
+	if t.done {
+		t.mu.Unlock()
+		return
+	}
+	for _, candidate := range peers {
+		key := candidate.String()
+		if t.activePeers[key] != nil || t.pending[key] || t.Conns.isBad(key) {
+			continue
+		}
+		t.pending[key] = true
+		t.candidates = append(t.candidates, candidate)
+	}
+	// peers on the local network are dialed first, they are usually much faster than the ones on the internet
+	slices.SortStableFunc(t.candidates, func(a, b peer.Peer) int {
+		if a.IsLocal() == b.IsLocal() {
+			return 0
+		}
+		if a.IsLocal() {
+			return -1
+		}
+		return 1
+	})
+	t.mu.Unlock()
+	t.fillConnections()
+}
+
+// fillConnections dials candidates until a limit of the torrent or of the connection manager is reached
+func (t *Torrent) fillConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.workQueue == nil || t.done {
+		return
+	}
+	for len(t.candidates) > 0 && len(t.activePeers) < t.MaxConnections {
+		candidate := t.candidates[0]
+		key := candidate.String()
+		if t.activePeers[key] != nil || t.Conns.isBad(key) {
+			t.candidates = t.candidates[1:]
+			delete(t.pending, key)
+			continue
+		}
+		if !t.Conns.acquire(true) {
+			return
+		}
+		t.candidates = t.candidates[1:]
+		delete(t.pending, key)
+		t.activePeers[key] = &activePeer{}
+		go t.startDownloadWorker(candidate, t.workQueue, t.resultQueue)
+	}
+}
+
+// AddIncomingPeer answers the handshake of a peer that connected to us and starts downloading from it
+func (t *Torrent) AddIncomingPeer(conn net.Conn, peerHandshake *handshake.Handshake) {
+	remoteAddr := conn.RemoteAddr().String()
+	t.mu.Lock()
+	if t.workQueue == nil || t.done || t.activePeers[remoteAddr] != nil || len(t.activePeers) >= t.MaxConnections ||
+		t.Conns.isBad(remoteAddr) || !t.Conns.acquire(false) {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.activePeers[remoteAddr] = &activePeer{}
+	ownBitfield := t.ownBitfield()
+	workQueue, resultQueue := t.workQueue, t.resultQueue
+	t.mu.Unlock()
+
+	go func() {
+		defer t.removeActivePeer(remoteAddr)
+		defer conn.Close()
+		peerConnection, err := peer.AcceptPeer(conn, t.PeerId, t.InfoHash, peerHandshake, ownBitfield)
+		if err != nil {
+			t.logger().Debug("error handshaking incoming peer", "peer", remoteAddr, "error", err)
+			return
+		}
+		t.downloadFromPeer(peerConnection, workQueue, resultQueue)
+	}()
+}
+
+// ownBitfield returns a copy of the pieces we have, the caller must hold t.mu
+func (t *Torrent) ownBitfield() bitfield.Bitfield {
+	ownBitfield := make(bitfield.Bitfield, len(t.bitfield))
+	copy(ownBitfield, t.bitfield)
+	return ownBitfield
+}
+
+// removeActivePeer frees the connection slot of the peer, the slot goes to the next candidate
+func (t *Torrent) removeActivePeer(addr string) {
+	t.mu.Lock()
+	delete(t.activePeers, addr)
+	t.mu.Unlock()
+	t.Conns.release()
+	t.fillConnections()
+}
+
+// peerConnected starts the score of a peer once its handshake is done
+func (t *Torrent) peerConnected(peerConnection *peer.PeerConnection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if activePeer, ok := t.activePeers[peerConnection.PeerToConnect.String()]; ok {
+		activePeer.conn = peerConnection
+		activePeer.connectedAt = time.Now()
+		activePeer.pieces = slices.Clone(peerConnection.Bitfield)
+	}
+}
+
+// peerAnnounced replaces the copy of the bitfield of the peer once it announced its pieces late
+func (t *Torrent) peerAnnounced(peerConnection *peer.PeerConnection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if activePeer, ok := t.activePeers[peerConnection.PeerToConnect.String()]; ok {
+		activePeer.pieces = slices.Clone(peerConnection.Bitfield)
+	}
+}
+
+// peerHas records a have message of the peer in the copy of its bitfield
+func (t *Torrent) peerHas(peerConnection *peer.PeerConnection, index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if activePeer, ok := t.activePeers[peerConnection.PeerToConnect.String()]; ok {
+		activePeer.pieces.SetPiece(index)
+	}
+}
+
+// othersCanSend reports whether a connected peer other than key has the piece and may send its next version
+func (t *Torrent) othersCanSend(index int, key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, activePeer := range t.activePeers {
+		if addr != key && activePeer.conn != nil && activePeer.pieces.HavePiece(index) && !t.smartBan.lastVersionFrom(index, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Torrent) addPeerDownloaded(peerConnection *peer.PeerConnection, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if activePeer, ok := t.activePeers[peerConnection.PeerToConnect.String()]; ok {
+		activePeer.downloaded += int64(n)
+	}
+}
+
+// addHashFailure lowers the score of the peer, it returns true when the peer sent too many corrupt pieces
+// and has to be dropped, in which case it is not dialed again for a while
+func (t *Torrent) addHashFailure(peerConnection *peer.PeerConnection) bool {
+	key := peerConnection.PeerToConnect.String()
+	t.mu.Lock()
+	activePeer, ok := t.activePeers[key]
+	tooManyFailures := false
+	if ok {
+		activePeer.hashFailures++
+		tooManyFailures = activePeer.hashFailures >= maxHashFailures
+	}
+	t.mu.Unlock()
+	if tooManyFailures {
+		t.Conns.markBad(key, badPeerMemory)
+	}
+	return tooManyFailures
+}
+
+func (t *Torrent) replacePeersLoop(stop chan struct{}) {
+	ticker := time.NewTicker(replaceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.replaceWorstPeer()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// replaceWorstPeer disconnects the peer with the lowest score when the torrent is full and has fresh candidates,
+// its slot goes to the first candidate
+func (t *Torrent) replaceWorstPeer() {
+	t.mu.Lock()
+	if len(t.candidates) == 0 || len(t.activePeers) < t.MaxConnections {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	var worst *activePeer
+	for _, activePeer := range t.activePeers {
+		if activePeer.conn == nil || now.Sub(activePeer.connectedAt) < minPeerAge {
+			continue
+		}
+		if worst == nil || activePeer.score(now) < worst.score(now) {
+			worst = activePeer
+		}
+	}
+	t.mu.Unlock()
+	if worst != nil {
+		t.logger().Debug("replacing peer with a fresh candidate", "peer", worst.conn.PeerToConnect.String())
+		// the worker of the peer fails its next read and frees the slot
+		worst.conn.Conn.Close()
 	}
-	close(workQueue)
-	return nil
 }
 
 func (t *Torrent) startDownloadWorker(downloadPeer peer.Peer, workQueue chan *PieceWork, resultQueue chan *PieceResult) {
-	peerConnection, err := peer.ConnectToPeer(downloadPeer, t.PeerId, t.InfoHash)
+	defer t.removeActivePeer(downloadPeer.String())
+	t.mu.Lock()
+	ownBitfield := t.ownBitfield()
+	t.mu.Unlock()
+	peerConnection, err := peer.ConnectToPeer(downloadPeer, t.PeerId, t.InfoHash, ownBitfield, t.Dialer)
+	t.Conns.releaseHalfOpen()
 	if err != nil {
-		log.Printf("Error handshaking peer %s: ERROR %s", downloadPeer.String(), err)
+		t.logger().Debug("error handshaking peer", "peer", downloadPeer.String(), "error", err)
+		t.Conns.markBad(downloadPeer.String(), failedPeerMemory)
 		return
 	}
-	peerConnection.SendUnchoke()
+	defer peerConnection.Conn.Close()
+	t.downloadFromPeer(peerConnection, workQueue, resultQueue)
+}
+
+func (t *Torrent) downloadFromPeer(peerConnection *peer.PeerConnection, workQueue chan *PieceWork, resultQueue chan *PieceResult) {
+	// Throttle replaces Conn, it must happen before peerConnected shares the connection with the other goroutines
+	peerConnection.Throttle(t.GlobalLimits, t.Limits)
+	t.peerConnected(peerConnection)
+	// the peer stays choked until the choker picks it
+	var allowedFast []int
+	if peerConnection.Fast {
+		allowedFast = peer.AllowedFastSet(peer.AllowedFastSetSize, len(t.PieceHashes), peerConnection.PeerToConnect.IpAddr, t.InfoHash)
+	}
+	t.choker.add(peerConnection, allowedFast)
+	defer t.choker.remove(peerConnection)
+	for _, index := range allowedFast {
+		peerConnection.SendAllowedFast(index)
+	}
 	peerConnection.SendInterested()
 
-	for workPiece := range workQueue {
+	key := peerConnection.PeerToConnect.String()
+	skipped := 0
+	for {
+		workPiece, ok := t.nextPiece(workQueue)
+		if !ok {
+			return
+		}
 		if !peerConnection.Bitfield.HavePiece(workPiece.index) {
 			workQueue <- workPiece
 			return
 		}
-		pieceBuff, err := attemptToDownloadPiece(workPiece, peerConnection)
+		if t.smartBan.lastVersionFrom(workPiece.index, key) && t.othersCanSend(workPiece.index, key) {
+			// the last version of the piece was corrupt and all of it came from this peer, the next one comes from
+			// someone else so that the blocks can be compared. The peer gets it again when nobody else has it
+			workQueue <- workPiece
+			skipped++
+			if skipped > len(t.PieceHashes) {
+				skipped = 0
+				select {
+				case <-time.After(smartBanPause):
+				case <-t.stop:
+					return
+				}
+			}
+			continue
+		}
+		skipped = 0
+		pieceBuff, senders, err := t.attemptToDownloadPiece(workPiece, peerConnection)
 		if err != nil {
-			log.Println("Error downloading piece, ", err, " trying again later")
+			t.logger().Debug("error downloading piece, trying again later", "peer", key, "piece", workPiece.index, "error", err)
 			workQueue <- workPiece
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Conns.markBad(peerConnection.PeerToConnect.String(), failedPeerMemory)
+			}
 			return
 		}
 		if !checkHash(pieceBuff, workPiece) {
-			log.Println("Error downloading piece, hash mismatch trying again later")
+			t.logger().Warn("piece failed the hash check, trying again later", "peer", key, "piece", workPiece.index)
+			t.Stats.pieceFailed()
+			t.smartBan.pieceFailed(workPiece.index, pieceBuff, senders)
 			workQueue <- workPiece
-			return
+			if t.addHashFailure(peerConnection) {
+				return
+			}
+			continue
 		}
+		t.banGuiltyPeers(t.smartBan.piecePassed(workPiece.index, pieceBuff))
 		peerConnection.SendHaveMessage(workPiece.index)
-		resultQueue <- &PieceResult{index: workPiece.index, buff: pieceBuff}
+		select {
+		case resultQueue <- &PieceResult{index: workPiece.index, buff: pieceBuff}:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// banGuiltyPeers bans the address of the peers that sent corrupt blocks and disconnects them
+func (t *Torrent) banGuiltyPeers(guilty []string) {
+	if len(guilty) == 0 {
+		return
+	}
+	bannedHosts := make(map[string]bool)
+	for _, addr := range guilty {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		t.logger().Warn("banning peer for sending corrupt data", "peer", host)
+		err = t.Conns.Bans.Ban(net.ParseIP(host))
+		if err != nil {
+			t.logger().Error("error saving the ban", "peer", host, "error", err)
+		}
+		bannedHosts[host] = true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, activePeer := range t.activePeers {
+		host, _, _ := net.SplitHostPort(addr)
+		if bannedHosts[host] && activePeer.conn != nil {
+			// the worker of the peer fails its next read and frees the slot
+			activePeer.conn.Conn.Close()
+		}
 	}
 }
 
@@ -140,13 +638,17 @@ func checkHash(piece []byte, workPiece *PieceWork) bool {
 	return bytes.Equal(result[:], workPiece.hash[:])
 }
 
-func attemptToDownloadPiece(workPiece *PieceWork, peerConnection *peer.PeerConnection) ([]byte, error) {
+// attemptToDownloadPiece downloads the blocks of a piece from the peer, it returns the piece with the sender of
+// every block
+func (t *Torrent) attemptToDownloadPiece(workPiece *PieceWork, peerConnection *peer.PeerConnection) ([]byte, []string, error) {
 	state := PieceProgress{
 		peerConn:  peerConnection,
+		torrent:   t,
 		pieceBuff: make([]byte, workPiece.length),
 		index:     workPiece.index,
+		senders:   make([]string, (workPiece.length+maxBlockSize-1)/maxBlockSize),
 	}
-	peerConnection.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+	peerConnection.Conn.SetDeadline(time.Now().Add(blockTimeout))
 	defer peerConnection.Conn.SetDeadline(time.Time{})
 
 	startTime := time.Now()
@@ -162,26 +664,43 @@ func attemptToDownloadPiece(workPiece *PieceWork, peerConnection *peer.PeerConne
 		} else {
 			adaptiveBacklog = int(downloadRate/5 + 18)
 		}
-		if !peerConnection.Chocked && state.backlog < adaptiveBacklog && state.blockRequested < workPiece.length {
+		canRequest := !peerConnection.Chocked || peerConnection.AllowedFast[workPiece.index]
+		if canRequest && state.backlog < adaptiveBacklog && len(state.rejected) > 0 {
+			rejectedBlock := state.rejected[0]
+			err := peerConnection.SendRequest(workPiece.index, rejectedBlock.begin, rejectedBlock.length)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error sending request while downloading piece: %s", err)
+			}
+			state.rejected = state.rejected[1:]
+			state.backlog++
+		} else if canRequest && state.backlog < adaptiveBacklog && state.blockRequested < workPiece.length {
 			blockSize := maxBlockSize
 			if workPiece.length-state.blockRequested < maxBlockSize {
 				blockSize = workPiece.length - state.blockRequested
 			}
 			err := peerConnection.SendRequest(workPiece.index, state.blockRequested, blockSize)
 			if err != nil {
-				return []byte{}, fmt.Errorf("error sending request while downloading piece: %s", err)
+				return nil, nil, fmt.Errorf("error sending request while downloading piece: %s", err)
 			}
 			state.blockRequested += blockSize
 			state.backlog++
 		}
+		if !canRequest && state.backlog == 0 && len(state.rejected) > 0 {
+			// the peer choked us and rejected every request, no block is coming so the piece goes back to the queue now
+			return nil, nil, fmt.Errorf("peer %s choked us and rejected the requests of piece %d", peerConnection.PeerToConnect.String(), workPiece.index)
+		}
+		downloaded := state.blockDownloaded
 		err := state.readMessage()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if state.blockDownloaded > downloaded {
+			peerConnection.Conn.SetDeadline(time.Now().Add(blockTimeout))
 		}
 		blocksReceived++
 	}
-	log.Println("Successfully downloaded piece")
-	return state.pieceBuff, nil
+	t.logger().Debug("downloaded piece", "peer", peerConnection.PeerToConnect.String(), "piece", workPiece.index)
+	return state.pieceBuff, state.senders, nil
 }
 
 func (state *PieceProgress) readMessage() error {
@@ -203,13 +722,78 @@ func (state *PieceProgress) readMessage() error {
 			return err
 		}
 		state.peerConn.Bitfield.SetPiece(index)
+		state.torrent.peerHas(state.peerConn, index)
+	case message.MsgBitfield, message.MsgHaveAll, message.MsgHaveNone:
+		err := state.peerConn.ApplyPieces(readMessage)
+		if err != nil {
+			return err
+		}
+		state.torrent.peerAnnounced(state.peerConn)
 	case message.MsgPiece:
 		n, err := state.peerConn.ParsePieceMessage(state.index, state.pieceBuff, readMessage)
 		if err != nil {
 			return err
 		}
+		// the payload was checked by ParsePieceMessage
+		begin := int(binary.BigEndian.Uint32(readMessage.Payload[4:8]))
+		for block := begin / maxBlockSize; block*maxBlockSize < begin+n; block++ {
+			state.senders[block] = state.peerConn.PeerToConnect.String()
+		}
 		state.blockDownloaded += n
+		state.torrent.Stats.addDownloaded(n)
+		state.torrent.addPeerDownloaded(state.peerConn, n)
+		state.torrent.choker.addDownloaded(state.peerConn, n)
 		state.backlog--
+	case message.MsgInterested, message.MsgNotInterested:
+		state.torrent.choker.setInterested(state.peerConn, readMessage.ID == message.MsgInterested)
+	case message.MsgRequest:
+		return state.torrent.serveRequest(state.peerConn, readMessage)
+	case message.MsgRejectRequest:
+		index, begin, length, err := message.ParseRequest(readMessage)
+		if err != nil {
+			return err
+		}
+		if index == state.index && state.backlog > 0 {
+			state.rejected = append(state.rejected, block{begin: begin, length: length})
+			state.backlog--
+		}
+	default:
+		_, err := state.peerConn.HandleFastMessage(readMessage)
+		return err
+	}
+	return nil
+}
+
+// serveRequest uploads a block to a peer we unchoked, the requests we do not serve are rejected when the peer
+// supports the Fast Extension and ignored otherwise
+func (t *Torrent) serveRequest(peerConnection *peer.PeerConnection, requestMessage *message.Message) error {
+	index, begin, length, err := message.ParseRequest(requestMessage)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	havePiece := t.bitfield.HavePiece(index)
+	t.mu.Unlock()
+	validRequest := index >= 0 && index < len(t.PieceHashes) && begin >= 0 && length > 0 && length <= maxRequestLength &&
+		begin+length <= t.calculatePieceLength(index)
+	if !validRequest || !havePiece || !t.choker.canUpload(peerConnection, index) {
+		if peerConnection.Fast {
+			return peerConnection.SendRejectRequest(index, begin, length)
+		}
+		return nil
+	}
+
+	pieceBegin, _ := t.calculateBoundForPiece(index)
+	data := make([]byte, length)
+	_, err = t.file.ReadAt(data, int64(pieceBegin+begin))
+	if err != nil {
+		return fmt.Errorf("impossible to read the block to upload: %s", err)
+	}
+	err = peerConnection.SendPiece(index, begin, data)
+	if err != nil {
+		return err
 	}
+	t.Stats.addUploaded(length)
+	t.choker.addUploaded(peerConnection, length)
 	return nil
 }
@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Priority decides whether the pieces of a file are downloaded and how soon, the zero value is PriorityNormal
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PrioritySkip
+	PriorityLow
+	PriorityHigh
+)
+
+var priorityNames = map[Priority]string{
+	PriorityNormal: "normal",
+	PrioritySkip:   "skip",
+	PriorityLow:    "low",
+	PriorityHigh:   "high",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority reads the name of a priority: skip, low, normal or high
+func ParsePriority(name string) (Priority, error) {
+	for priority, priorityName := range priorityNames {
+		if strings.EqualFold(name, priorityName) {
+			return priority, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q, use skip, low, normal or high", name)
+}
+
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Priority) UnmarshalText(text []byte) error {
+	priority, err := ParsePriority(string(text))
+	if err != nil {
+		return err
+	}
+	*p = priority
+	return nil
+}
+
+// rank orders the priorities from skip to high
+func (p Priority) rank() int {
+	switch p {
+	case PrioritySkip:
+		return 0
+	case PriorityLow:
+		return 1
+	case PriorityHigh:
+		return 3
+	}
+	return 2
+}
+
+// pieceState tracks a piece from the queue to the file, a queued piece is in the work queue or being downloaded
+type pieceState int
+
+const (
+	pieceNotQueued pieceState = iota
+	pieceQueued
+	pieceHave
+)
+
+// pieceRank is the highest rank of the files the piece belongs to, a piece shared with a wanted file is wanted
+// even when the other file is skipped. The caller must hold t.mu
+func (t *Torrent) pieceRank(index int) int {
+	begin, end := t.calculateBoundForPiece(index)
+	rank := 0
+	for _, segment := range t.fileSegments(begin, end-begin) {
+		priority := PriorityNormal
+		if segment.file < len(t.FilePriorities) {
+			priority = t.FilePriorities[segment.file]
+		}
+		rank = max(rank, priority.rank())
+	}
+	return rank
+}
+
+// queueWantedPieces queues the wanted pieces that are not queued yet, the ones of the high priority files first,
+// and counts the wanted pieces still missing. The caller must hold t.mu
+func (t *Torrent) queueWantedPieces() {
+	var toQueue []int
+	ranks := make([]int, len(t.PieceHashes))
+	t.missing = 0
+	for index := range t.PieceHashes {
+		ranks[index] = t.pieceRank(index)
+		if ranks[index] == 0 || t.pieceStates[index] == pieceHave {
+			continue
+		}
+		t.missing++
+		if t.pieceStates[index] == pieceNotQueued {
+			toQueue = append(toQueue, index)
+		}
+	}
+	slices.SortStableFunc(toQueue, func(a, b int) int {
+		return ranks[b] - ranks[a]
+	})
+	for _, index := range toQueue {
+		t.pieceStates[index] = pieceQueued
+		// the queue has room for every piece and a piece is queued once, the send never blocks
+		t.workQueue <- &PieceWork{index, t.calculatePieceLength(index), t.PieceHashes[index]}
+	}
+}
+
+// pieceDone marks a written piece, the caller must hold t.mu
+func (t *Torrent) pieceDone(index int) {
+	if t.pieceStates[index] == pieceHave {
+		return
+	}
+	t.pieceStates[index] = pieceHave
+	if t.pieceRank(index) > 0 {
+		t.missing--
+	}
+}
+
+// nextPiece waits for a piece to download, it returns false once the download is over. The pieces of the files
+// skipped after they were queued are dropped, SetFilePriority queues them again when they are wanted back
+func (t *Torrent) nextPiece(workQueue chan *PieceWork) (*PieceWork, bool) {
+	for {
+		select {
+		case workPiece := <-workQueue:
+			t.mu.Lock()
+			wanted := t.pieceStates[workPiece.index] == pieceQueued && t.pieceRank(workPiece.index) > 0
+			if !wanted && t.pieceStates[workPiece.index] == pieceQueued {
+				t.pieceStates[workPiece.index] = pieceNotQueued
+			}
+			t.mu.Unlock()
+			if wanted {
+				return workPiece, true
+			}
+		case <-t.stop:
+			return nil, false
+		}
+	}
+}
+
+// SetFilePriority changes the priority of a file, also while Download is running: the pieces of a skipped file
+// are no longer downloaded unless another file needs them and the ones of a file that is wanted again are queued
+func (t *Torrent) SetFilePriority(file int, priority Priority) error {
+	files := max(len(t.Files), 1)
+	if file < 0 || file >= files {
+		return fmt.Errorf("the torrent has no file %d", file)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.FilePriorities) < files {
+		t.FilePriorities = append(t.FilePriorities, PriorityNormal)
+	}
+	t.FilePriorities[file] = priority
+	if t.pieceStates == nil || t.done {
+		return nil
+	}
+	t.queueWantedPieces()
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
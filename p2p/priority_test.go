@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFilePrioritiesAndResume(t *testing.T) {
+	t.Log("Testing a download that skips a file and a second one that resumes it")
+	files := map[string][]byte{
+		"/dir/a": []byte("0123456789"),
+		"/dir/b": []byte("abcdefg"),
+		"/dir/c": []byte("ABCDEFGH"),
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	data := []byte("0123456789abcdefgABCDEFGH")
+	pieceLength := 8
+	var pieceHashes [][20]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		pieceHashes = append(pieceHashes, sha1.Sum(data[begin:min(begin+pieceLength, len(data))]))
+	}
+	newTorrent := func() *Torrent {
+		return &Torrent{
+			PieceHashes: pieceHashes,
+			PieceLength: pieceLength,
+			Length:      len(data),
+			Name:        "dir",
+			Files:       []File{{Path: []string{"a"}, Length: 10}, {Path: []string{"b"}, Length: 7}, {Path: []string{"c"}, Length: 8}},
+			WebSeeds:    []string{server.URL},
+		}
+	}
+	outputPath := filepath.Join(t.TempDir(), "dir")
+
+	// the last piece belongs to c alone, the third one is still needed by b
+	torrent := newTorrent()
+	if torrent.SetFilePriority(3, PriorityHigh) == nil {
+		t.Error("expected an error for a file the torrent does not have")
+	}
+	torrent.SetFilePriority(2, PrioritySkip)
+	err := torrent.Download(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Stats.Left() != 1 {
+		t.Errorf("expected the byte of the skipped piece left but %d bytes are", torrent.Stats.Left())
+	}
+	downloaded, _ := os.ReadFile(outputPath)
+	if !bytes.Equal(downloaded, data[:24]) {
+		t.Errorf("expected %q but got %q", data[:24], downloaded)
+	}
+
+	requests.Store(0)
+	torrent = newTorrent()
+	err = torrent.Download(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ = os.ReadFile(outputPath)
+	if !bytes.Equal(downloaded, data) {
+		t.Errorf("expected %q but got %q", data, downloaded)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected only the missing piece to be downloaded but the web seed got %d requests", requests.Load())
+	}
+}
+
+func TestStop(t *testing.T) {
+	t.Log("Testing that Stop ends a download that has no peers")
+	torrent := &Torrent{PieceHashes: [][20]byte{{1}}, PieceLength: 8, Length: 8}
+	outputPath := filepath.Join(t.TempDir(), "file")
+	result := make(chan error)
+	go func() {
+		result <- torrent.Download(outputPath)
+	}()
+	for started := false; !started; time.Sleep(time.Millisecond) {
+		torrent.mu.Lock()
+		started = torrent.stop != nil
+		torrent.mu.Unlock()
+	}
+	torrent.Stop()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrStopped) {
+			t.Error("expected ErrStopped but got ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download did not stop")
+	}
+
+	torrent = &Torrent{PieceHashes: [][20]byte{{1}}, PieceLength: 8, Length: 8}
+	torrent.Stop()
+	if err := torrent.Download(outputPath); !errors.Is(err, ErrStopped) {
+		t.Error("expected a torrent stopped before the download to return ErrStopped but got ", err)
+	}
+}
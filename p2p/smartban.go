@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// BanList is the set of peer addresses banned for sending corrupt data, when it has a path every ban is
+// appended to the file so that the bans survive a restart
+type BanList struct {
+	path   string
+	mu     sync.Mutex
+	banned map[string]bool
+}
+
+// LoadBanList reads the ban list at path, a missing file is an empty list. An empty path keeps the bans in memory
+func LoadBanList(path string) (*BanList, error) {
+	b := &BanList{path: path, banned: make(map[string]bool)}
+	if path == "" {
+		return b, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ipAddr := net.ParseIP(line)
+		if ipAddr == nil {
+			return nil, fmt.Errorf("invalid address %q in ban list %s", line, path)
+		}
+		b.banned[ipAddr.String()] = true
+	}
+	return b, scanner.Err()
+}
+
+// Ban bans every port of the address, a peer that poisons pieces is likely to come back with another port
+func (b *BanList) Ban(ipAddr net.IP) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.banned[ipAddr.String()] {
+		return nil
+	}
+	b.banned[ipAddr.String()] = true
+	if b.path == "" {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(b.path), 0777)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintln(file, ipAddr.String())
+	return err
+}
+
+func (b *BanList) IsBanned(ipAddr net.IP) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.banned[ipAddr.String()]
+}
+
+// blockRecord is a block of a piece that failed the hash check, with the peer that sent it
+type blockRecord struct {
+	block  int
+	hash   [20]byte
+	sender string
+}
+
+// smartBan remembers who sent every block of the pieces that failed the hash check. When the piece is
+// downloaded again and passes, the peers whose blocks differ from the good ones are the ones that sent bad data
+type smartBan struct {
+	mu     sync.Mutex
+	failed map[int][]blockRecord
+	// lastSenders are the peers that sent the blocks of the last corrupt version of a piece
+	lastSenders map[int]map[string]bool
+}
+
+func newSmartBan() *smartBan {
+	return &smartBan{
+		failed:      make(map[int][]blockRecord),
+		lastSenders: make(map[int]map[string]bool),
+	}
+}
+
+// pieceFailed records the blocks of a corrupt piece, senders has the peer of every block
+func (s *smartBan) pieceFailed(index int, pieceBuff []byte, senders []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lastSenders := make(map[string]bool)
+	for i, sender := range senders {
+		begin := i * maxBlockSize
+		end := min(begin+maxBlockSize, len(pieceBuff))
+		s.failed[index] = append(s.failed[index], blockRecord{block: i, hash: sha1.Sum(pieceBuff[begin:end]), sender: sender})
+		lastSenders[sender] = true
+	}
+	s.lastSenders[index] = lastSenders
+}
+
+// lastVersionFrom reports whether every block of the last corrupt version of the piece came from the peer. A version
+// sent again by the same peer alone tells nothing new, once another peer sent a version the first one can retry
+func (s *smartBan) lastVersionFrom(index int, sender string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lastSenders := s.lastSenders[index]
+	return len(lastSenders) == 1 && lastSenders[sender]
+}
+
+// piecePassed compares the good piece with the blocks of its failed versions and returns the peers that sent bad blocks
+func (s *smartBan) piecePassed(index int, pieceBuff []byte) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, ok := s.failed[index]
+	if !ok {
+		return nil
+	}
+	delete(s.failed, index)
+	delete(s.lastSenders, index)
+	guilty := make(map[string]bool)
+	for _, record := range records {
+		begin := record.block * maxBlockSize
+		end := min(begin+maxBlockSize, len(pieceBuff))
+		if sha1.Sum(pieceBuff[begin:end]) != record.hash {
+			guilty[record.sender] = true
+		}
+	}
+	var senders []string
+	for sender := range guilty {
+		senders = append(senders, sender)
+	}
+	return senders
+}
@@ -0,0 +1,68 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSmartBan(t *testing.T) {
+	t.Log("Testing that the peer whose blocks differ from the good piece is found")
+	good := bytes.Repeat([]byte{1}, 3*maxBlockSize)
+	corrupt := bytes.Clone(good)
+	corrupt[2*maxBlockSize] = 0
+	s := newSmartBan()
+
+	// the first copy is corrupt in the last block, sent by the second peer
+	s.pieceFailed(4, corrupt, []string{"10.0.0.1:6881", "10.0.0.1:6881", "10.0.0.2:6881"})
+	if s.lastVersionFrom(4, "10.0.0.1:6881") || s.lastVersionFrom(4, "10.0.0.2:6881") {
+		t.Error("expected the senders of a mixed copy to be allowed to send the piece again")
+	}
+	guilty := s.piecePassed(4, good)
+	if len(guilty) != 1 || guilty[0] != "10.0.0.2:6881" {
+		t.Errorf("expected 10.0.0.2:6881 to be guilty, got %v", guilty)
+	}
+	if s.piecePassed(4, good) != nil {
+		t.Error("expected the records of the piece to be forgotten once it passed")
+	}
+
+	// a copy sent by a single peer is only compared once someone else sent a version of the piece
+	s.pieceFailed(5, corrupt, []string{"10.0.0.1:6881", "10.0.0.1:6881", "10.0.0.1:6881"})
+	if !s.lastVersionFrom(5, "10.0.0.1:6881") || s.lastVersionFrom(5, "10.0.0.3:6881") {
+		t.Error("expected only the sender of the whole corrupt copy to wait for another peer")
+	}
+	s.pieceFailed(5, corrupt, []string{"10.0.0.3:6881", "10.0.0.3:6881", "10.0.0.1:6881"})
+	if s.lastVersionFrom(5, "10.0.0.1:6881") || s.lastVersionFrom(5, "10.0.0.3:6881") {
+		t.Error("expected the first sender to retry once the blocks of another peer were mixed in")
+	}
+	guilty = s.piecePassed(5, good)
+	if len(guilty) != 1 || guilty[0] != "10.0.0.1:6881" {
+		t.Errorf("expected 10.0.0.1:6881 to be guilty, got %v", guilty)
+	}
+}
+
+func TestBanListPersists(t *testing.T) {
+	t.Log("Testing that the ban list is saved and reloaded")
+	path := filepath.Join(t.TempDir(), "config", "banned.txt")
+	bans, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bans.Ban(net.ParseIP("10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.IsBanned(net.ParseIP("10.0.0.2")) || reloaded.IsBanned(net.ParseIP("10.0.0.3")) {
+		t.Error("expected only 10.0.0.2 to be banned after reloading")
+	}
+	m := NewConnManager(0, 0)
+	m.Bans = reloaded
+	if !m.isBad("10.0.0.2:51413") {
+		t.Error("expected every port of a banned address to be refused")
+	}
+}
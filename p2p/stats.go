@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"main/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the transfer counters of a download, they are reported to the trackers on every announce
+// and are safe to read while the download is running
+type Stats struct {
+	downloaded     atomic.Int64
+	uploaded       atomic.Int64
+	left           atomic.Int64
+	piecesVerified atomic.Int64
+	piecesFailed   atomic.Int64
+	// diskWrites is the latency of the writes of the verified pieces
+	diskWrites *metrics.Histogram
+	// session are the totals of every torrent of the connection manager, the counters are added to them too. Download
+	// sets it while the workers of a stopped download can still count on the same Stats, so it is only used atomically
+	session atomic.Pointer[Stats]
+}
+
+func NewStats(left int64) *Stats {
+	stats := &Stats{diskWrites: metrics.NewHistogram(metrics.LatencyBuckets)}
+	stats.left.Store(left)
+	return stats
+}
+
+// Downloaded returns the number of piece bytes received from peers, including the ones of pieces that failed the hash check
+func (s *Stats) Downloaded() int64 {
+	return s.downloaded.Load()
+}
+
+// Uploaded returns the number of piece bytes sent to peers
+func (s *Stats) Uploaded() int64 {
+	return s.uploaded.Load()
+}
+
+// Left returns the number of bytes that still need to be downloaded and verified
+func (s *Stats) Left() int64 {
+	return s.left.Load()
+}
+
+// PiecesVerified returns the number of pieces that passed the hash check and were written
+func (s *Stats) PiecesVerified() int64 {
+	return s.piecesVerified.Load()
+}
+
+// PiecesFailed returns the number of pieces that failed the hash check, whether they came from a peer or a web seed
+func (s *Stats) PiecesFailed() int64 {
+	return s.piecesFailed.Load()
+}
+
+func (s *Stats) addDownloaded(n int) {
+	s.downloaded.Add(int64(n))
+	if session := s.session.Load(); session != nil {
+		session.addDownloaded(n)
+	}
+}
+
+func (s *Stats) pieceVerified(length int, writeTime time.Duration) {
+	s.left.Add(-int64(length))
+	s.piecesVerified.Add(1)
+	s.diskWrites.Observe(writeTime.Seconds())
+	if session := s.session.Load(); session != nil {
+		session.pieceVerified(0, writeTime)
+	}
+}
+
+// pieceRestored counts a piece that was already in the file when the download started
+func (s *Stats) pieceRestored(length int) {
+	s.left.Add(-int64(length))
+}
+
+func (s *Stats) pieceFailed() {
+	s.piecesFailed.Add(1)
+	if session := s.session.Load(); session != nil {
+		session.pieceFailed()
+	}
+}
+
+func (s *Stats) addUploaded(n int) {
+	s.uploaded.Add(int64(n))
+	if session := s.session.Load(); session != nil {
+		session.addUploaded(n)
+	}
+}
@@ -0,0 +1,66 @@
+package p2p
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// PeerStatus is what the torrent knows about a peer it is connected or connecting to
+type PeerStatus struct {
+	Address string `json:"address"`
+	// Connected is false while the peer is being dialed or handshaked
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// Downloaded are the piece bytes received from the peer
+	Downloaded   int64 `json:"downloaded"`
+	HashFailures int   `json:"hash_failures"`
+	// Choked is true when we do not upload to the peer, Interested when the peer wants our pieces
+	Choked     bool `json:"choked"`
+	Interested bool `json:"interested"`
+}
+
+// PeerStatuses returns the peers of the running download sorted by address
+func (t *Torrent) PeerStatuses() []PeerStatus {
+	t.mu.Lock()
+	peers := make([]PeerStatus, 0, len(t.activePeers))
+	for addr, activePeer := range t.activePeers {
+		status := PeerStatus{
+			Address:      addr,
+			Connected:    activePeer.conn != nil,
+			Downloaded:   activePeer.downloaded,
+			HashFailures: activePeer.hashFailures,
+			Choked:       true,
+		}
+		if activePeer.conn != nil {
+			status.ConnectedAt = activePeer.connectedAt
+			status.Choked, status.Interested = t.choker.state(activePeer.conn)
+		}
+		peers = append(peers, status)
+	}
+	t.mu.Unlock()
+	slices.SortFunc(peers, func(a, b PeerStatus) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+	return peers
+}
+
+// FileProgress returns the bytes of every file that are in verified pieces, a single-file torrent has one file
+func (t *Torrent) FileProgress() []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	progress := make([]int64, max(len(t.Files), 1))
+	if t.bitfield == nil {
+		return progress
+	}
+	for index := range t.PieceHashes {
+		if !t.bitfield.HavePiece(index) {
+			continue
+		}
+		begin, end := t.calculateBoundForPiece(index)
+		for _, segment := range t.fileSegments(begin, end-begin) {
+			progress[segment.file] += int64(segment.length)
+		}
+	}
+	return progress
+}
@@ -0,0 +1,175 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"main/ratelimit"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// webSeedRetryDelay is the wait after the first failure of a web seed, it doubles on every following failure
+	webSeedRetryDelay    = 5 * time.Second
+	webSeedMaxRetryDelay = 10 * time.Minute
+	webSeedTimeout       = 60 * time.Second
+)
+
+// File is a file of a multi-file torrent, the files are stored one after the other in the pieces
+type File struct {
+	Path   []string
+	Length int
+}
+
+// fileSegment is the part of a file that belongs to a piece
+type fileSegment struct {
+	file   int
+	offset int
+	length int
+}
+
+// startWebSeedWorker downloads pieces from a BEP 19 web seed until every piece is downloaded,
+// a web seed that fails is retried with an exponential backoff instead of being dropped like a peer
+func (t *Torrent) startWebSeedWorker(webSeedUrl string, workQueue chan *PieceWork, resultQueue chan *PieceResult) {
+	failures := 0
+	for {
+		workPiece, ok := t.nextPiece(workQueue)
+		if !ok {
+			return
+		}
+		pieceBuff, err := t.downloadPieceFromWebSeed(webSeedUrl, workPiece)
+		if err == nil && !checkHash(pieceBuff, workPiece) {
+			t.Stats.pieceFailed()
+			err = fmt.Errorf("hash mismatch of piece %d", workPiece.index)
+		}
+		if err != nil {
+			workQueue <- workPiece
+			delay := webSeedBackoff(failures, err)
+			failures++
+			t.logger().Warn("error downloading from web seed", "web_seed", webSeedUrl, "piece", workPiece.index,
+				"retry_in", delay, "error", err)
+			select {
+			case <-time.After(delay):
+			case <-t.stop:
+				return
+			}
+			continue
+		}
+		failures = 0
+		// a good copy from the web seed exposes the peers that sent corrupt versions of the piece
+		t.banGuiltyPeers(t.smartBan.piecePassed(workPiece.index, pieceBuff))
+		select {
+		case resultQueue <- &PieceResult{index: workPiece.index, buff: pieceBuff}:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// webSeedBackoff returns how long to wait before asking the web seed again, honoring the Retry-After of a busy server
+func webSeedBackoff(failures int, err error) time.Duration {
+	if busyErr, ok := err.(*webSeedBusyError); ok && busyErr.retryAfter > 0 {
+		return min(busyErr.retryAfter, webSeedMaxRetryDelay)
+	}
+	delay := webSeedRetryDelay << min(failures, 16)
+	return min(delay, webSeedMaxRetryDelay)
+}
+
+type webSeedBusyError struct {
+	status     string
+	retryAfter time.Duration
+}
+
+func (e *webSeedBusyError) Error() string {
+	return "web seed busy: " + e.status
+}
+
+func (t *Torrent) downloadPieceFromWebSeed(webSeedUrl string, workPiece *PieceWork) ([]byte, error) {
+	pieceBuff := make([]byte, workPiece.length)
+	begin, _ := t.calculateBoundForPiece(workPiece.index)
+	written := 0
+	for _, segment := range t.fileSegments(begin, workPiece.length) {
+		fileUrl, err := t.webSeedFileUrl(webSeedUrl, segment.file)
+		if err != nil {
+			return nil, err
+		}
+		err = fetchRange(t.webSeedClient, fileUrl, segment.offset, pieceBuff[written:written+segment.length], t.GlobalLimits, t.Limits)
+		if err != nil {
+			return nil, err
+		}
+		written += segment.length
+		t.Stats.addDownloaded(segment.length)
+	}
+	return pieceBuff, nil
+}
+
+// fileSegments splits the bytes of the torrent from begin to begin+length into the files that contain them
+func (t *Torrent) fileSegments(begin, length int) []fileSegment {
+	if len(t.Files) == 0 {
+		return []fileSegment{{file: 0, offset: begin, length: length}}
+	}
+	var segments []fileSegment
+	fileBegin := 0
+	for i, file := range t.Files {
+		fileEnd := fileBegin + file.Length
+		if length > 0 && begin < fileEnd {
+			segmentLength := min(fileEnd-begin, length)
+			if segmentLength > 0 {
+				segments = append(segments, fileSegment{file: i, offset: begin - fileBegin, length: segmentLength})
+			}
+			begin += segmentLength
+			length -= segmentLength
+		}
+		fileBegin = fileEnd
+	}
+	return segments
+}
+
+// webSeedFileUrl follows BEP 19: a single-file url ending with a slash gets the name of the torrent,
+// in a multi-file torrent the url is a directory containing the name and the path of every file
+func (t *Torrent) webSeedFileUrl(webSeedUrl string, file int) (string, error) {
+	parsedUrl, err := url.Parse(webSeedUrl)
+	if err != nil {
+		return "", err
+	}
+	if len(t.Files) == 0 {
+		if strings.HasSuffix(parsedUrl.Path, "/") {
+			parsedUrl = parsedUrl.JoinPath(t.Name)
+		}
+		return parsedUrl.String(), nil
+	}
+	return parsedUrl.JoinPath(append([]string{t.Name}, t.Files[file].Path...)...).String(), nil
+}
+
+// fetchRange reads len(buff) bytes of the file at fileUrl starting from offset, respecting the download limits
+func fetchRange(client *http.Client, fileUrl string, offset int, buff []byte, limits ...*ratelimit.Limits) error {
+	request, err := http.NewRequest(http.MethodGet, fileUrl, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+len(buff)-1))
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, skip the bytes before it
+		_, err = io.CopyN(io.Discard, response.Body, int64(offset))
+		if err != nil {
+			return err
+		}
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		retryAfter, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+		return &webSeedBusyError{status: response.Status, retryAfter: time.Duration(retryAfter) * time.Second}
+	default:
+		return fmt.Errorf("unexpected status %s from %s", response.Status, fileUrl)
+	}
+	_, err = io.ReadFull(ratelimit.NewReader(response.Body, limits...), buff)
+	return err
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileSegments(t *testing.T) {
+	t.Log("Testing the split of a piece between the files")
+	torrent := &Torrent{Files: []File{{Path: []string{"a"}, Length: 10}, {Path: []string{"b"}, Length: 0}, {Path: []string{"c"}, Length: 7}}}
+	expected := []fileSegment{{file: 0, offset: 8, length: 2}, {file: 2, offset: 0, length: 6}}
+	segments := torrent.fileSegments(8, 8)
+	if !reflect.DeepEqual(segments, expected) {
+		t.Error("expected ", expected, " but got ", segments)
+	}
+
+	torrent = &Torrent{}
+	expected = []fileSegment{{file: 0, offset: 16, length: 4}}
+	if segments := torrent.fileSegments(16, 4); !reflect.DeepEqual(segments, expected) {
+		t.Error("expected ", expected, " but got ", segments)
+	}
+}
+
+func TestWebSeedFileUrl(t *testing.T) {
+	t.Log("Testing the urls of the files of a web seed")
+	torrent := &Torrent{Name: "file.iso"}
+	if fileUrl, _ := torrent.webSeedFileUrl("http://a.com/file.iso", 0); fileUrl != "http://a.com/file.iso" {
+		t.Error("expected the url unchanged but got ", fileUrl)
+	}
+	if fileUrl, _ := torrent.webSeedFileUrl("http://a.com/isos/", 0); fileUrl != "http://a.com/isos/file.iso" {
+		t.Error("expected the name appended but got ", fileUrl)
+	}
+	torrent = &Torrent{Name: "my dir", Files: []File{{Path: []string{"sub", "b.txt"}, Length: 1}}}
+	if fileUrl, _ := torrent.webSeedFileUrl("http://a.com/seed", 0); fileUrl != "http://a.com/seed/my%20dir/sub/b.txt" {
+		t.Error("expected the name and the path appended but got ", fileUrl)
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	t.Log("Testing a multi-file download from a web seed that is busy at first")
+	webSeedRetryDelay = time.Millisecond
+	files := map[string][]byte{
+		"/seed/dir/a":     []byte("0123456789"),
+		"/seed/dir/sub/b": []byte("abcdefg"),
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	data := []byte("0123456789abcdefg")
+	pieceLength := 8
+	var pieceHashes [][20]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		pieceHashes = append(pieceHashes, sha1.Sum(data[begin:min(begin+pieceLength, len(data))]))
+	}
+	torrent := &Torrent{
+		PieceHashes: pieceHashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "dir",
+		Files:       []File{{Path: []string{"a"}, Length: 10}, {Path: []string{"sub", "b"}, Length: 7}},
+		WebSeeds:    []string{strings.TrimSuffix(server.URL, "/") + "/seed"},
+	}
+	outputPath := filepath.Join(t.TempDir(), "dir")
+	err := torrent.Download(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Errorf("expected %q but got %q", data, downloaded)
+	}
+	if torrent.Stats.Left() != 0 {
+		t.Errorf("expected nothing left but %d bytes are", torrent.Stats.Left())
+	}
+}
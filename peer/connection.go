@@ -3,11 +3,16 @@ package peer
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"main/bitfield"
 	"main/handshake"
+	"main/logging"
 	"main/message"
+	"main/proxy"
+	"main/ratelimit"
+	"main/utp"
 	"net"
 	"time"
 )
@@ -19,37 +24,228 @@ type PeerConnection struct {
 	PeerId        [20]byte
 	Bitfield      bitfield.Bitfield
 	Chocked       bool
+	// Fast is set when both sides support the Fast Extension of BEP 6
+	Fast bool
+	// AllowedFast are the pieces the peer lets us download while it is choking us
+	AllowedFast map[int]bool
 }
 
-func ConnectToPeer(peer Peer, peerId, infoHash [20]byte) (*PeerConnection, error) {
-	peerConn, err := net.DialTimeout("tcp", peer.String(), 5*time.Second)
+const (
+	// utpDialTimeout is short because a peer that does not answer over uTP is dialed again over TCP
+	utpDialTimeout = 3 * time.Second
+	tcpDialTimeout = 5 * time.Second
+)
+
+// Dialer opens the connections to the peers, over uTP first when UTP is set and over TCP otherwise
+type Dialer struct {
+	// Encryption is the MSE policy of the connections
+	Encryption Encryption
+	// UTP is the uTP socket the connections are opened from, nil for TCP only
+	UTP *utp.Socket
+	// Proxy carries the TCP connections, uTP is direct and only used when the proxy allows direct connections
+	Proxy *proxy.Proxy
+	// Logger receives the outcome of every connection, nil discards it
+	Logger *slog.Logger
+}
+
+func (d Dialer) logger() *slog.Logger {
+	return logging.Or(d.Logger)
+}
+
+// ConnectToPeer connects and handshakes the peer, then exchanges the pieces we have with the ones of the peer
+func ConnectToPeer(peer Peer, peerId, infoHash [20]byte, ownBitfield bitfield.Bitfield, dialer Dialer) (*PeerConnection, error) {
+	peerConn, peerHandshake, err := dialer.dialAndHandshake(peer, peerId, infoHash)
 	if err != nil {
-		log.Printf("Error connecting to peer: %s because of ERROR: %s, skipping it\n", peer.String(), err)
 		return nil, err
 	}
-	log.Println("Connected to peer ", peer.String())
-	_, err = HandshakePeer(peerConn, peerId, infoHash)
+
+	peerConnection := &PeerConnection{
+		Conn:          peerConn,
+		PeerToConnect: &peer,
+		InfoHash:      infoHash,
+		PeerId:        peerId,
+		Bitfield:      make(bitfield.Bitfield, len(ownBitfield)),
+		Chocked:       true,
+		Fast:          peerHandshake.SupportsFast(),
+		AllowedFast:   make(map[int]bool),
+	}
+	err = peerConnection.exchangeBitfields(ownBitfield)
+	if err != nil {
+		peerConn.Close()
+		return nil, fmt.Errorf("error reading bitfield from peer: %s", err)
+	}
+	dialer.logger().Debug("received bitfield", "peer", peer.String())
+	return peerConnection, nil
+}
+
+// dialAndHandshake connects to the peer following the encryption policy, when encryption is only preferred a peer
+// that does not speak MSE is dialed again in plaintext
+func (d Dialer) dialAndHandshake(peer Peer, peerId, infoHash [20]byte) (net.Conn, *handshake.Handshake, error) {
+	encryption := d.Encryption
+	if encryption.Policy != EncryptionDisable {
+		peerConn, err := d.dial(peer)
+		if err != nil {
+			return nil, nil, err
+		}
+		encryptedConn, err := encryptOutgoing(peerConn, infoHash, encryption)
+		if err == nil {
+			var peerHandshake *handshake.Handshake
+			peerHandshake, err = HandshakePeer(encryptedConn, peerId, infoHash)
+			if err == nil {
+				return encryptedConn, peerHandshake, nil
+			}
+		}
+		peerConn.Close()
+		if encryption.Policy == EncryptionRequire {
+			return nil, nil, fmt.Errorf("encrypted handshake with peer %s failed: %s", peer.String(), err)
+		}
+		d.logger().Debug("encrypted handshake failed, trying in plaintext", "peer", peer.String(), "error", err)
+	}
+	peerConn, err := d.dial(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerHandshake, err := HandshakePeer(peerConn, peerId, infoHash)
 	if err != nil {
+		peerConn.Close()
+		return nil, nil, err
+	}
+	return peerConn, peerHandshake, nil
+}
+
+func (d Dialer) dial(peer Peer) (net.Conn, error) {
+	if d.UTP != nil && d.Proxy.AllowsDirect() {
+		peerConn, err := d.UTP.DialTimeout(peer.String(), utpDialTimeout)
+		if err == nil {
+			d.logger().Debug("connected to peer", "peer", peer.String(), "transport", "utp")
+			return peerConn, nil
+		}
+		d.logger().Debug("error connecting over uTP, trying TCP", "peer", peer.String(), "error", err)
+	}
+	peerConn, err := d.Proxy.DialTimeout(peer.String(), tcpDialTimeout)
+	if err != nil {
+		d.logger().Debug("error connecting to peer", "peer", peer.String(), "error", err)
 		return nil, err
 	}
+	d.logger().Debug("connected to peer", "peer", peer.String(), "transport", "tcp")
+	return peerConn, nil
+}
 
-	bitfieldMessage, err := message.ReadMessage(peerConn)
-	if err != nil || bitfieldMessage.ID != message.MsgBitfield {
-		return nil, fmt.Errorf("error reading bitfield from peer: %s", err)
+// AcceptPeer answers the handshake of a peer that connected to us, sends our bitfield and reads the pieces the peer has
+func AcceptPeer(conn net.Conn, peerId, infoHash [20]byte, peerHandshake *handshake.Handshake, ownBitfield bitfield.Bitfield) (*PeerConnection, error) {
+	remotePeer, err := peerOfAddr(conn.RemoteAddr())
+	if err != nil {
+		return nil, err
 	}
-	log.Println("Successfully received bitfield")
-	return &PeerConnection{
-		Conn:          peerConn,
-		PeerToConnect: &peer,
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	clientHandshake := handshake.NewHandshake(infoHash, peerId)
+	_, err = conn.Write(clientHandshake.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	peerConnection := &PeerConnection{
+		Conn:          conn,
+		PeerToConnect: remotePeer,
 		InfoHash:      infoHash,
 		PeerId:        peerId,
-		Bitfield:      bitfieldMessage.Payload,
+		Bitfield:      make(bitfield.Bitfield, len(ownBitfield)),
 		Chocked:       true,
-	}, nil
+		Fast:          peerHandshake.SupportsFast(),
+		AllowedFast:   make(map[int]bool),
+	}
+	err = peerConnection.exchangeBitfields(ownBitfield)
+	if err != nil {
+		return nil, err
+	}
+	return peerConnection, nil
+}
+
+// peerOfAddr returns the peer at the remote address of a TCP or uTP connection
+func peerOfAddr(addr net.Addr) (*Peer, error) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return &Peer{IpAddr: addr.IP, Port: uint16(addr.Port)}, nil
+	case *net.UDPAddr:
+		return &Peer{IpAddr: addr.IP, Port: uint16(addr.Port)}, nil
+	}
+	return nil, fmt.Errorf("unsupported peer address %s", addr.String())
+}
+
+// exchangeBitfields sends the pieces we have and reads the first message of the peer, with the Fast Extension the
+// pieces can also be announced with have all and have none. The keepalives and the extended handshake that the
+// peers of the Extension Protocol send before their pieces are skipped
+func (c *PeerConnection) exchangeBitfields(ownBitfield bitfield.Bitfield) error {
+	c.Conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer c.Conn.SetDeadline(time.Time{})
+	var ownPieces *message.Message
+	switch {
+	case !ownBitfield.Empty():
+		ownPieces = &message.Message{ID: message.MsgBitfield, Payload: ownBitfield}
+	case c.Fast:
+		// with the Fast Extension one of the three messages is mandatory
+		ownPieces = &message.Message{ID: message.MsgHaveNone}
+	}
+	if ownPieces != nil {
+		_, err := c.Conn.Write(ownPieces.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	// a peer that has no piece is allowed to not send the bitfield at all
+	var firstMessage *message.Message
+	for firstMessage == nil || firstMessage.ID == message.MsgExtended {
+		var err error
+		firstMessage, err = message.ReadMessage(c.Conn)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !c.Fast {
+				return nil
+			}
+			return err
+		}
+	}
+	switch firstMessage.ID {
+	case message.MsgBitfield, message.MsgHaveAll, message.MsgHaveNone:
+		return c.ApplyPieces(firstMessage)
+	case message.MsgHave:
+		index, err := c.ParseHaveMessage(firstMessage)
+		if err != nil {
+			return err
+		}
+		c.Bitfield.SetPiece(index)
+	case message.MsgUnchoke:
+		c.Chocked = false
+	}
+	return nil
+}
+
+// ApplyPieces replaces the pieces of the peer with the ones of a bitfield, have all or have none message, which
+// can also come after the first message when the peer sent other messages before it
+func (c *PeerConnection) ApplyPieces(piecesMessage *message.Message) error {
+	switch piecesMessage.ID {
+	case message.MsgBitfield:
+		copy(c.Bitfield, piecesMessage.Payload)
+		return nil
+	case message.MsgHaveAll, message.MsgHaveNone:
+		if !c.Fast {
+			return fmt.Errorf("peer sent a Fast Extension message without supporting it")
+		}
+		var value byte
+		if piecesMessage.ID == message.MsgHaveAll {
+			value = 0xFF
+		}
+		for i := range c.Bitfield {
+			c.Bitfield[i] = value
+		}
+		return nil
+	}
+	return fmt.Errorf("message %d does not announce the pieces of the peer", piecesMessage.ID)
 }
 
 func HandshakePeer(peerConn net.Conn, peerId [20]byte, infoHash [20]byte) (*handshake.Handshake, error) {
-	log.Println("Trying to handshake peer: ", peerConn.RemoteAddr().String())
 	peerConn.SetDeadline(time.Now().Add(10 * time.Second))
 	defer peerConn.SetDeadline(time.Time{})
 	clientHandshake := handshake.NewHandshake(infoHash, peerId)
@@ -69,6 +265,12 @@ func HandshakePeer(peerConn net.Conn, peerId [20]byte, infoHash [20]byte) (*hand
 	return peerHandshake, nil
 }
 
+// Throttle makes every following read and write of the connection respect the limits. It replaces Conn, so it must
+// be called before the connection is shared with another goroutine
+func (c *PeerConnection) Throttle(limits ...*ratelimit.Limits) {
+	c.Conn = ratelimit.NewConn(c.Conn, limits...)
+}
+
 func (c *PeerConnection) SendChoke() error {
 	chockeMessage := message.Message{
 		ID:      message.MsgChoke,
@@ -110,6 +312,12 @@ func (c *PeerConnection) SendRequest(index, begin, length int) error {
 	return err
 }
 
+func (c *PeerConnection) SendPiece(index, begin int, data []byte) error {
+	pieceMessage := message.FormatPiece(index, begin, data)
+	_, err := c.Conn.Write(pieceMessage.Serialize())
+	return err
+}
+
 func (c *PeerConnection) SendHaveMessage(index int) error {
 	haveMessage := message.FormatHaveMessage(index)
 	_, err := c.Conn.Write(haveMessage.Serialize())
@@ -133,3 +341,43 @@ func (c *PeerConnection) ParsePieceMessage(index int, buff []byte, pieceMessage
 	}
 	return downloaded, nil
 }
+
+func (c *PeerConnection) SendRejectRequest(index, begin, length int) error {
+	rejectMessage := message.FormatRejectRequest(index, begin, length)
+	_, err := c.Conn.Write(rejectMessage.Serialize())
+	return err
+}
+
+func (c *PeerConnection) SendAllowedFast(index int) error {
+	allowedFastMessage := message.FormatIndexMessage(message.MsgAllowedFast, index)
+	_, err := c.Conn.Write(allowedFastMessage.Serialize())
+	return err
+}
+
+// HandleFastMessage updates the connection with a Fast Extension message received after the bitfield,
+// it returns false for the messages that are not part of the extension. Suggest Piece is checked and ignored as
+// BEP 6 allows, the pieces are picked by priority from the queue shared by every peer
+func (c *PeerConnection) HandleFastMessage(fastMessage *message.Message) (bool, error) {
+	switch fastMessage.ID {
+	case message.MsgAllowedFast, message.MsgSuggestPiece:
+	case message.MsgHaveAll, message.MsgHaveNone:
+		// a late one comes from a peer that sent its extended handshake first
+		return true, c.ApplyPieces(fastMessage)
+	case message.MsgRejectRequest:
+		// the rejects are handled by whoever sent the request
+		return true, nil
+	default:
+		return false, nil
+	}
+	if !c.Fast {
+		return true, fmt.Errorf("peer sent a Fast Extension message without supporting it")
+	}
+	index, err := message.ParseIndex(fastMessage)
+	if err != nil {
+		return true, err
+	}
+	if fastMessage.ID == message.MsgAllowedFast {
+		c.AllowedFast[index] = true
+	}
+	return true, nil
+}
@@ -0,0 +1,36 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"slices"
+)
+
+// AllowedFastSetSize is the number of pieces a peer can download from us while choked
+const AllowedFastSetSize = 10
+
+// AllowedFastSet generates the allowed fast set of BEP 6 for a peer, it is only defined for IPv4 peers
+func AllowedFastSet(k int, numPieces int, ipAddr net.IP, infoHash [20]byte) []int {
+	ipv4 := ipAddr.To4()
+	if ipv4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+	// the last byte of the address is ignored so that peers of the same /24 get the same set
+	x := make([]byte, 0, 24)
+	x = append(x, ipv4[0], ipv4[1], ipv4[2], 0)
+	x = append(x, infoHash[:]...)
+	var allowedFast []int
+	for len(allowedFast) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(allowedFast) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(numPieces))
+			if !slices.Contains(allowedFast, index) {
+				allowedFast = append(allowedFast, index)
+			}
+		}
+	}
+	return allowedFast
+}
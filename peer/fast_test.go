@@ -0,0 +1,108 @@
+package peer
+
+import (
+	"main/bitfield"
+	"main/handshake"
+	"main/message"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	t.Log("Testing the allowed fast set with the example of BEP 6")
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+	ipAddr := net.IPv4(80, 4, 4, 200)
+	expected := []int{1059, 431, 808, 1217, 287, 376, 1188}
+	if result := AllowedFastSet(7, 1313, ipAddr, infoHash); !reflect.DeepEqual(result, expected) {
+		t.Error("expected ", expected, " but got ", result)
+	}
+	expected = append(expected, 353, 508)
+	if result := AllowedFastSet(9, 1313, ipAddr, infoHash); !reflect.DeepEqual(result, expected) {
+		t.Error("expected ", expected, " but got ", result)
+	}
+	if result := AllowedFastSet(10, 3, ipAddr, infoHash); len(result) != 3 {
+		t.Error("expected every piece of a 3 pieces torrent but got ", result)
+	}
+}
+
+func TestExchangeBitfieldsHaveAll(t *testing.T) {
+	t.Log("Testing a Fast Extension peer that has every piece")
+	clientConnection, serverConnection := connectToTestServer(t)
+	defer clientConnection.Close()
+	infoHash := [20]byte{1, 2, 3}
+	go func() {
+		handshake.ReadHandshake(clientConnection)
+		clientConnection.Write(handshake.NewHandshake(infoHash, [20]byte{4}).Serialize())
+		haveAllMessage := message.Message{ID: message.MsgHaveAll}
+		clientConnection.Write(haveAllMessage.Serialize())
+	}()
+	peerHandshake, err := HandshakePeer(serverConnection, [20]byte{5}, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerConnection := &PeerConnection{
+		Conn:        serverConnection,
+		Bitfield:    make(bitfield.Bitfield, 2),
+		Fast:        peerHandshake.SupportsFast(),
+		AllowedFast: make(map[int]bool),
+	}
+	err = peerConnection.exchangeBitfields(bitfield.Bitfield{0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peerConnection.Bitfield.HavePiece(0) || !peerConnection.Bitfield.HavePiece(15) {
+		t.Error("expected the peer to have every piece but got ", peerConnection.Bitfield)
+	}
+	haveNoneMessage, err := message.ReadMessage(clientConnection)
+	if err != nil || haveNoneMessage.ID != message.MsgHaveNone {
+		t.Error("expected us to send have none but got ", haveNoneMessage, err)
+	}
+
+	handled, err := peerConnection.HandleFastMessage(message.FormatIndexMessage(message.MsgAllowedFast, 7))
+	if !handled || err != nil || !peerConnection.AllowedFast[7] {
+		t.Error("expected piece 7 to be allowed fast ", err)
+	}
+	handled, err = peerConnection.HandleFastMessage(message.FormatIndexMessage(message.MsgSuggestPiece, 3))
+	if !handled || err != nil || peerConnection.AllowedFast[3] {
+		t.Error("expected a suggestion to be accepted and ignored ", err)
+	}
+}
+
+func TestExchangeBitfieldsAfterExtendedHandshake(t *testing.T) {
+	t.Log("Testing a peer that sends its extended handshake before its bitfield and announces its pieces again later")
+	clientConnection, serverConnection := connectToTestServer(t)
+	defer clientConnection.Close()
+	go func() {
+		clientConnection.Write(message.FormatExtended(message.ExtendedHandshakeID, []byte("de")).Serialize())
+		// a keepalive
+		clientConnection.Write([]byte{0, 0, 0, 0})
+		bitfieldMessage := message.Message{ID: message.MsgBitfield, Payload: []byte{0x80, 0}}
+		clientConnection.Write(bitfieldMessage.Serialize())
+	}()
+	peerConnection := &PeerConnection{
+		Conn:        serverConnection,
+		Bitfield:    make(bitfield.Bitfield, 2),
+		Fast:        true,
+		AllowedFast: make(map[int]bool),
+	}
+	err := peerConnection.exchangeBitfields(bitfield.Bitfield{0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !peerConnection.Bitfield.HavePiece(0) || peerConnection.Bitfield.HavePiece(1) {
+		t.Error("expected the peer to have only piece 0 but got ", peerConnection.Bitfield)
+	}
+
+	handled, err := peerConnection.HandleFastMessage(&message.Message{ID: message.MsgHaveAll})
+	if !handled || err != nil || !peerConnection.Bitfield.HavePiece(15) {
+		t.Error("expected a late have all to be applied ", peerConnection.Bitfield, err)
+	}
+	handled, err = peerConnection.HandleFastMessage(&message.Message{ID: message.MsgHaveNone})
+	if !handled || err != nil || peerConnection.Bitfield.HavePiece(0) {
+		t.Error("expected a late have none to be applied ", peerConnection.Bitfield, err)
+	}
+}
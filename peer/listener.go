@@ -0,0 +1,161 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"main/handshake"
+	"main/logging"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IncomingHandler takes over a connection opened by a peer, after its handshake has been read
+type IncomingHandler func(conn net.Conn, peerHandshake *handshake.Handshake)
+
+// Listener accepts the connections of the peers on both IPv4 and IPv6 and hands every one of them to the
+// torrent whose info hash is in the handshake
+type Listener struct {
+	listener net.Listener
+	mu       sync.Mutex
+	handlers map[[20]byte]IncomingHandler
+	// encryption decides which incoming connections are accepted, plaintext only until SetEncryption is called
+	encryption Encryption
+	// logger receives the refused connections, nothing until SetLogger is called
+	logger *slog.Logger
+}
+
+func Listen(port uint16) (*Listener, error) {
+	// listening on the unspecified address accepts both IPv4 and IPv6 connections
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		listener: listener,
+		handlers: make(map[[20]byte]IncomingHandler),
+	}
+	go l.acceptLoop(listener)
+	return l, nil
+}
+
+// Port returns the port we are listening on, useful when listening on port 0
+func (l *Listener) Port() uint16 {
+	return uint16(l.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Handle registers the handler of the incoming connections for a torrent
+func (l *Listener) Handle(infoHash [20]byte, handler IncomingHandler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[infoHash] = handler
+}
+
+// SetEncryption sets the policy the following incoming connections are accepted with
+func (l *Listener) SetEncryption(encryption Encryption) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.encryption = encryption
+}
+
+// SetLogger sets the logger of the refused incoming connections
+func (l *Listener) SetLogger(logger *slog.Logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger = logger
+}
+
+func (l *Listener) log() *slog.Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return logging.Or(l.logger)
+}
+
+func (l *Listener) Remove(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.handlers, infoHash)
+}
+
+// Close stops accepting the TCP connections, the listeners passed to Serve are closed by their owners
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+// Serve also accepts the peers connecting through another listener, like a uTP socket, until it is closed
+func (l *Listener) Serve(listener net.Listener) {
+	go l.acceptLoop(listener)
+}
+
+func (l *Listener) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			l.log().Warn("error accepting peer connection", "error", err)
+			continue
+		}
+		go l.handleConnection(conn)
+	}
+}
+
+func (l *Listener) handleConnection(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	l.mu.Lock()
+	encryption := l.encryption
+	logger := logging.Or(l.logger).With("peer", conn.RemoteAddr().String())
+	infoHashes := make([][20]byte, 0, len(l.handlers))
+	for infoHash := range l.handlers {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	l.mu.Unlock()
+
+	// a plaintext handshake starts with the protocol name, anything else is the public key of an encrypted one
+	reader := bufio.NewReader(conn)
+	start, err := reader.Peek(len(plaintextHeader))
+	if err != nil {
+		logger.Debug("error reading handshake of incoming peer", "error", err)
+		conn.Close()
+		return
+	}
+	var incomingConn net.Conn = &streamConn{Conn: conn, reader: reader}
+	switch {
+	case bytes.Equal(start, plaintextHeader) && encryption.Policy == EncryptionRequire:
+		logger.Debug("refusing plaintext connection of incoming peer")
+		conn.Close()
+		return
+	case !bytes.Equal(start, plaintextHeader) && encryption.Policy == EncryptionDisable:
+		logger.Debug("refusing encrypted connection of incoming peer")
+		conn.Close()
+		return
+	case !bytes.Equal(start, plaintextHeader):
+		incomingConn, err = acceptEncrypted(conn, reader, infoHashes, encryption)
+		if err != nil {
+			logger.Debug("error in the encrypted handshake of incoming peer", "error", err)
+			conn.Close()
+			return
+		}
+	}
+	peerHandshake, err := handshake.ReadHandshake(incomingConn)
+	if err != nil {
+		logger.Debug("error reading handshake of incoming peer", "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	l.mu.Lock()
+	handler, ok := l.handlers[peerHandshake.InfoHash]
+	l.mu.Unlock()
+	if !ok {
+		logger.Debug("incoming peer asked for an unknown torrent", logging.InfoHash(peerHandshake.InfoHash))
+		conn.Close()
+		return
+	}
+	handler(incomingConn, peerHandshake)
+}
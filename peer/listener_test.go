@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"main/bitfield"
+	"main/handshake"
+	"main/message"
+	"main/utp"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestListener(t *testing.T) {
+	t.Log("Testing incoming peers on IPv4 and IPv6")
+	listener, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	infoHash := [20]byte{1, 2, 3}
+	ourPeerId := [20]byte{9, 9, 9}
+	accepted := make(chan *PeerConnection, 1)
+	listener.Handle(infoHash, func(conn net.Conn, peerHandshake *handshake.Handshake) {
+		peerConnection, err := AcceptPeer(conn, ourPeerId, infoHash, peerHandshake, bitfield.Bitfield{0b10000000})
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- peerConnection
+	})
+
+	addresses := []string{"127.0.0.1"}
+	if probe, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		probe.Close()
+		addresses = append(addresses, "::1")
+	}
+	for _, address := range addresses {
+		conn, err := net.Dial("tcp", net.JoinHostPort(address, strconv.Itoa(int(listener.Port()))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write(handshake.NewHandshake(infoHash, [20]byte{4, 5, 6}).Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ourHandshake, err := handshake.ReadHandshake(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ourHandshake.PeerId != ourPeerId {
+			t.Error("expected our peer id in the handshake but got ", ourHandshake.PeerId)
+		}
+		bitfieldMessage, err := message.ReadMessage(conn)
+		if err != nil || bitfieldMessage.ID != message.MsgBitfield || bitfieldMessage.Payload[0] != 0b10000000 {
+			t.Error("expected our bitfield but got ", bitfieldMessage, err)
+		}
+		theirBitfield := message.Message{ID: message.MsgBitfield, Payload: []byte{0b01000000}}
+		conn.Write(theirBitfield.Serialize())
+
+		peerConnection := <-accepted
+		if peerConnection == nil || !peerConnection.Bitfield.HavePiece(1) {
+			t.Error("expected the bitfield of the incoming peer to be read")
+		}
+		conn.Close()
+	}
+}
+
+func TestUTPConnection(t *testing.T) {
+	t.Log("Testing peers connecting over uTP in plaintext and encrypted")
+	infoHash := [20]byte{1, 2, 3}
+	for _, encryption := range []Encryption{{Policy: EncryptionDisable}, {Policy: EncryptionRequire}} {
+		listener, err := Listen(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		listener.SetEncryption(encryption)
+		accepted := make(chan *PeerConnection, 1)
+		listener.Handle(infoHash, func(conn net.Conn, peerHandshake *handshake.Handshake) {
+			peerConnection, err := AcceptPeer(conn, [20]byte{9}, infoHash, peerHandshake, bitfield.Bitfield{0b10000000})
+			if err != nil {
+				t.Error(err)
+			}
+			accepted <- peerConnection
+		})
+		listenerPeer := Peer{IpAddr: net.IPv4(127, 0, 0, 1), Port: listener.Port()}
+		// the uTP socket listens on the same port as TCP
+		listenerSocket, err := utp.Listen("udp", listenerPeer.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listenerSocket.Close()
+		listener.Serve(listenerSocket)
+		socket, err := utp.Listen("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer socket.Close()
+
+		peerConnection, err := ConnectToPeer(listenerPeer, [20]byte{4}, infoHash, bitfield.Bitfield{0b01000000}, Dialer{Encryption: encryption, UTP: socket})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := peerConnection.Conn.RemoteAddr().(*net.UDPAddr); !ok || !peerConnection.Bitfield.HavePiece(0) {
+			t.Errorf("expected a uTP connection with the bitfield of the peer, got %s", peerConnection.Conn.RemoteAddr())
+		}
+		incoming := <-accepted
+		if incoming == nil || !incoming.Bitfield.HavePiece(1) || incoming.PeerToConnect.String() != socket.Addr().String() {
+			t.Errorf("expected the listener to accept the uTP connection from %s", socket.Addr())
+		}
+		peerConnection.Conn.Close()
+		incoming.Conn.Close()
+	}
+}
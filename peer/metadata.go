@@ -0,0 +1,181 @@
+package peer
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"main/bencode"
+	"main/message"
+	"net"
+	"time"
+)
+
+const (
+	// MaxMetadataSize bounds the info dictionary a peer can make us download
+	MaxMetadataSize = 16 << 20
+	// metadataPieceSize is the size of the pieces the info dictionary is exchanged in
+	metadataPieceSize = 16384
+	// utMetadataID is the id our extended handshake gives to ut_metadata, the peers send its messages with it
+	utMetadataID = 1
+	// metadataTimeout is how long a peer has to send the whole info dictionary
+	metadataTimeout = 30 * time.Second
+)
+
+// the message types of ut_metadata
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// FetchMetadata downloads the info dictionary of a torrent from a peer with the metadata exchange of BEP 9, the
+// dictionary is checked against the info hash. The connection is closed when ctx is done
+func FetchMetadata(ctx context.Context, peer Peer, peerId, infoHash [20]byte, dialer Dialer) ([]byte, error) {
+	conn, peerHandshake, err := dialer.dialAndHandshake(peer, peerId, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stopClose := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClose()
+	if !peerHandshake.SupportsExtensions() {
+		return nil, fmt.Errorf("peer %s does not support the extension protocol", peer.String())
+	}
+	conn.SetDeadline(time.Now().Add(metadataTimeout))
+	// with the Fast Extension one of the messages of the pieces we have is mandatory, we have none yet
+	if peerHandshake.SupportsFast() {
+		_, err = conn.Write((&message.Message{ID: message.MsgHaveNone}).Serialize())
+		if err != nil {
+			return nil, err
+		}
+	}
+	extendedHandshake, err := bencode.Encode(map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": utMetadataID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sendExtended(conn, message.ExtendedHandshakeID, extendedHandshake)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata []byte
+	var missing map[int]bool
+	var peerMetadataID int
+	for {
+		readMessage, err := message.ReadMessage(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		// the other messages of the peer are of no use without the metadata
+		if readMessage == nil || readMessage.ID != message.MsgExtended {
+			continue
+		}
+		id, payload, err := message.ParseExtended(readMessage)
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case message.ExtendedHandshakeID:
+			if metadata != nil {
+				continue
+			}
+			var size int
+			peerMetadataID, size, err = parseExtendedHandshake(payload)
+			if err != nil {
+				return nil, fmt.Errorf("peer %s: %w", peer.String(), err)
+			}
+			metadata = make([]byte, size)
+			missing = make(map[int]bool)
+			for piece := 0; piece*metadataPieceSize < size; piece++ {
+				missing[piece] = true
+				request, _ := bencode.Encode(map[string]interface{}{"msg_type": metadataRequest, "piece": piece})
+				err = sendExtended(conn, byte(peerMetadataID), request)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case utMetadataID:
+			msgType, piece, data, err := parseMetadataMessage(payload)
+			if err != nil {
+				return nil, fmt.Errorf("peer %s: %w", peer.String(), err)
+			}
+			if msgType == metadataRequest {
+				// we have no metadata to share, the reject needs the id of the extended handshake of the peer
+				if peerMetadataID != 0 {
+					reject, _ := bencode.Encode(map[string]interface{}{"msg_type": metadataReject, "piece": piece})
+					err = sendExtended(conn, byte(peerMetadataID), reject)
+					if err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			if metadata == nil {
+				return nil, fmt.Errorf("peer %s sent metadata before its extended handshake", peer.String())
+			}
+			begin := piece * metadataPieceSize
+			if !missing[piece] || len(data) != min(metadataPieceSize, len(metadata)-begin) {
+				return nil, fmt.Errorf("peer %s sent an unexpected metadata piece %d", peer.String(), piece)
+			}
+			copy(metadata[begin:], data)
+			delete(missing, piece)
+			if len(missing) > 0 {
+				continue
+			}
+			if sha1.Sum(metadata) != infoHash {
+				return nil, fmt.Errorf("peer %s sent metadata that does not match the info hash", peer.String())
+			}
+			return metadata, nil
+		}
+	}
+}
+
+func sendExtended(conn net.Conn, id byte, payload []byte) error {
+	_, err := conn.Write(message.FormatExtended(id, payload).Serialize())
+	return err
+}
+
+// parseExtendedHandshake returns the id the peer gave to ut_metadata and the size of the info dictionary
+func parseExtendedHandshake(payload []byte) (int, int, error) {
+	value, _, err := bencode.DecodePrefix(payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	dict, _ := value.(map[string]interface{})
+	extensions, _ := dict["m"].(map[string]interface{})
+	id, _ := extensions["ut_metadata"].(int)
+	size, _ := dict["metadata_size"].(int)
+	if id <= 0 || id > 255 {
+		return 0, 0, fmt.Errorf("the peer does not share the metadata")
+	}
+	if size <= 0 || size > MaxMetadataSize {
+		return 0, 0, fmt.Errorf("invalid metadata size %d", size)
+	}
+	return id, size, nil
+}
+
+// parseMetadataMessage returns the type, the piece and the data of a request or a data message of ut_metadata, a
+// reject is an error
+func parseMetadataMessage(payload []byte) (int, int, []byte, error) {
+	value, length, err := bencode.DecodePrefix(payload)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	dict, _ := value.(map[string]interface{})
+	msgType, ok := dict["msg_type"].(int)
+	piece, _ := dict["piece"].(int)
+	switch {
+	case !ok:
+		return 0, 0, nil, fmt.Errorf("metadata message without type")
+	case msgType == metadataReject:
+		return 0, 0, nil, fmt.Errorf("the peer rejected the request of metadata piece %d", piece)
+	case msgType != metadataData && msgType != metadataRequest:
+		return 0, 0, nil, fmt.Errorf("unexpected metadata message of type %d", msgType)
+	}
+	return msgType, piece, payload[length:], nil
+}
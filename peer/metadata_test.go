@@ -0,0 +1,76 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"main/bencode"
+	"main/handshake"
+	"main/message"
+	"net"
+	"strings"
+	"testing"
+)
+
+// metadataSeed listens for a peer and sends it the info dictionary with ut_metadata, under the id 3
+func metadataSeed(t *testing.T, infoHash [20]byte, info []byte) Peer {
+	listener, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	listener.Handle(infoHash, func(conn net.Conn, peerHandshake *handshake.Handshake) {
+		defer conn.Close()
+		conn.Write(handshake.NewHandshake(infoHash, [20]byte{7}).Serialize())
+		conn.Write((&message.Message{ID: message.MsgHaveAll}).Serialize())
+		extendedHandshake, _ := bencode.Encode(map[string]interface{}{
+			"m":             map[string]interface{}{"ut_metadata": 3},
+			"metadata_size": len(info),
+		})
+		conn.Write(message.FormatExtended(message.ExtendedHandshakeID, extendedHandshake).Serialize())
+		peerMetadataID := 0
+		for {
+			readMessage, err := message.ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if readMessage == nil || readMessage.ID != message.MsgExtended {
+				continue
+			}
+			id, payload, _ := message.ParseExtended(readMessage)
+			value, _, _ := bencode.DecodePrefix(payload)
+			dict, _ := value.(map[string]interface{})
+			if id == message.ExtendedHandshakeID {
+				peerMetadataID = dict["m"].(map[string]interface{})["ut_metadata"].(int)
+				continue
+			}
+			piece := dict["piece"].(int)
+			data := info[piece*metadataPieceSize : min((piece+1)*metadataPieceSize, len(info))]
+			header, _ := bencode.Encode(map[string]interface{}{"msg_type": metadataData, "piece": piece, "total_size": len(info)})
+			conn.Write(message.FormatExtended(byte(peerMetadataID), append(header, data...)).Serialize())
+		}
+	})
+	return Peer{IpAddr: net.IPv4(127, 0, 0, 1), Port: listener.Port()}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	t.Log("Testing the download of the info dictionary from a peer")
+	// the dictionary takes more than one piece of metadata
+	info := []byte("d4:name" + "20000:" + strings.Repeat("a", 20000) + "e")
+	infoHash := sha1.Sum(info)
+	dialer := Dialer{Encryption: Encryption{Policy: EncryptionDisable}}
+	metadata, err := FetchMetadata(context.Background(), metadataSeed(t, infoHash, info), [20]byte{4}, infoHash, dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(metadata, info) {
+		t.Error("expected the info dictionary of the peer")
+	}
+
+	// a peer sending the dictionary of another torrent is caught by the hash check
+	wrongHash := [20]byte{1}
+	_, err = FetchMetadata(context.Background(), metadataSeed(t, wrongHash, info), [20]byte{4}, wrongHash, dialer)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Error("expected the metadata of another torrent to be refused but got ", err)
+	}
+}
@@ -0,0 +1,365 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// EncryptionPolicy decides whether the connections use the Message Stream Encryption, also called Protocol Encryption
+type EncryptionPolicy int
+
+const (
+	// EncryptionDisable only speaks the plaintext protocol
+	EncryptionDisable EncryptionPolicy = iota
+	// EncryptionPrefer encrypts the outgoing connections and falls back to plaintext when the peer does not support it,
+	// both kinds of incoming connections are accepted
+	EncryptionPrefer
+	// EncryptionRequire refuses every plaintext connection
+	EncryptionRequire
+)
+
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	switch s {
+	case "disable":
+		return EncryptionDisable, nil
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	}
+	return 0, fmt.Errorf("invalid encryption policy %q, expected prefer, require or disable", s)
+}
+
+// Encryption configures the Message Stream Encryption of the connections
+type Encryption struct {
+	Policy EncryptionPolicy
+	// HeaderOnly only obfuscates the handshake and sends the rest of the stream in plaintext, it is enough to get
+	// past most throttling and costs no CPU. The peer can still pick the full encryption
+	HeaderOnly bool
+}
+
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+	// maxPadLength is the longest random padding of the handshake
+	maxPadLength = 512
+	// rc4Discard is the part of the RC4 keystream thrown away, its first bytes are weak
+	rc4Discard = 1024
+)
+
+var (
+	// mseP and mseG are the parameters of the Diffie-Hellman key exchange, P is a 768 bit prime
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+	// plaintextHeader starts every plaintext handshake, an incoming connection that starts differently is encrypted
+	plaintextHeader = append([]byte{19}, "BitTorrent protocol"...)
+)
+
+const dhKeyLength = 96
+
+// streamConn is a connection after the MSE handshake, its payload is RC4 encrypted unless plaintext was selected.
+// It is also used for plaintext incoming connections, whose first bytes were read to tell them from encrypted ones
+type streamConn struct {
+	net.Conn
+	reader io.Reader
+	// pending is the initial payload sent with the handshake, already decrypted
+	pending     []byte
+	readCipher  *rc4.Cipher
+	writeMu     sync.Mutex
+	writeCipher *rc4.Cipher
+}
+
+func (c *streamConn) Read(buff []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(buff, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.reader.Read(buff)
+	if c.readCipher != nil {
+		c.readCipher.XORKeyStream(buff[:n], buff[:n])
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(buff []byte) (int, error) {
+	if c.writeCipher == nil {
+		return c.Conn.Write(buff)
+	}
+	// the keystream has to be used in the same order the bytes are written
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	encrypted := make([]byte, len(buff))
+	c.writeCipher.XORKeyStream(encrypted, buff)
+	return c.Conn.Write(encrypted)
+}
+
+// dhKeys generates a private key and the public key sent to the peer
+func dhKeys() (*big.Int, []byte, error) {
+	privateBuff := make([]byte, 20)
+	_, err := rand.Read(privateBuff)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(privateBuff)
+	public := new(big.Int).Exp(mseG, private, mseP)
+	return private, public.FillBytes(make([]byte, dhKeyLength)), nil
+}
+
+func dhSecret(private *big.Int, peerPublic []byte) []byte {
+	secret := new(big.Int).Exp(new(big.Int).SetBytes(peerPublic), private, mseP)
+	return secret.FillBytes(make([]byte, dhKeyLength))
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+// mseCipher returns the RC4 cipher of one direction, "keyA" for the data sent by the side that connected and
+// "keyB" for the data sent by the side that accepted
+func mseCipher(name string, secret []byte, infoHash [20]byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(mseHash([]byte(name), secret, infoHash[:]))
+	discard := make([]byte, rc4Discard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+func randomPad() ([]byte, error) {
+	pad := make([]byte, mathrand.IntN(maxPadLength+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+// cryptoProvide returns the methods we offer, or accept, for the payload of the stream
+func (e Encryption) cryptoProvide() uint32 {
+	if e.HeaderOnly {
+		return cryptoPlaintext | cryptoRC4
+	}
+	if e.Policy == EncryptionRequire {
+		return cryptoRC4
+	}
+	return cryptoPlaintext | cryptoRC4
+}
+
+// cryptoSelect picks one of the methods offered by the peer, zero if none is acceptable
+func (e Encryption) cryptoSelect(provided uint32) uint32 {
+	provided &= e.cryptoProvide()
+	if e.HeaderOnly && provided&cryptoPlaintext != 0 {
+		return cryptoPlaintext
+	}
+	if provided&cryptoRC4 != 0 {
+		return cryptoRC4
+	}
+	return provided & cryptoPlaintext
+}
+
+// synchronize reads from the stream until pattern is found, the padding before it can be at most maxPadLength bytes
+func synchronize(reader io.ByteReader, pattern []byte) error {
+	window := make([]byte, 0, maxPadLength+len(pattern))
+	for len(window) < cap(window) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("MSE handshake synchronization failed")
+}
+
+// encryptOutgoing runs the MSE handshake on a connection we opened, the BitTorrent handshake is sent afterwards
+// on the returned connection
+func encryptOutgoing(conn net.Conn, infoHash [20]byte, encryption Encryption) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+
+	private, public, err := dhKeys()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, padA...))
+	if err != nil {
+		return nil, err
+	}
+	peerPublic := make([]byte, dhKeyLength)
+	_, err = io.ReadFull(reader, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret := dhSecret(private, peerPublic)
+
+	encryptCipher := mseCipher("keyA", secret, infoHash)
+	decryptCipher := mseCipher("keyB", secret, infoHash)
+	buff := mseHash([]byte("req1"), secret)
+	req2 := mseHash([]byte("req2"), infoHash[:])
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		buff = append(buff, req2[i]^req3[i])
+	}
+	// verification constant, crypto provide, no padding and no initial payload
+	header := make([]byte, 8, 16)
+	header = binary.BigEndian.AppendUint32(header, encryption.cryptoProvide())
+	header = binary.BigEndian.AppendUint16(header, 0)
+	header = binary.BigEndian.AppendUint16(header, 0)
+	encryptCipher.XORKeyStream(header, header)
+	_, err = conn.Write(append(buff, header...))
+	if err != nil {
+		return nil, err
+	}
+
+	// the answer starts with the verification constant encrypted with keyB after the padding of the peer
+	verificationConstant := make([]byte, 8)
+	decryptCipher.XORKeyStream(verificationConstant, verificationConstant)
+	err = synchronize(reader, verificationConstant)
+	if err != nil {
+		return nil, err
+	}
+	answer := make([]byte, 6)
+	_, err = io.ReadFull(reader, answer)
+	if err != nil {
+		return nil, err
+	}
+	decryptCipher.XORKeyStream(answer, answer)
+	cryptoSelect := binary.BigEndian.Uint32(answer)
+	padLength := int(binary.BigEndian.Uint16(answer[4:]))
+	if cryptoSelect&encryption.cryptoProvide() == 0 || (cryptoSelect != cryptoPlaintext && cryptoSelect != cryptoRC4) {
+		return nil, fmt.Errorf("peer selected the unknown encryption method %d", cryptoSelect)
+	}
+	if padLength > maxPadLength {
+		return nil, errors.New("MSE padding too long")
+	}
+	padD := make([]byte, padLength)
+	_, err = io.ReadFull(reader, padD)
+	if err != nil {
+		return nil, err
+	}
+	decryptCipher.XORKeyStream(padD, padD)
+
+	encrypted := &streamConn{Conn: conn, reader: reader}
+	if cryptoSelect == cryptoRC4 {
+		encrypted.readCipher = decryptCipher
+		encrypted.writeCipher = encryptCipher
+	}
+	return encrypted, nil
+}
+
+// acceptEncrypted answers the MSE handshake of a peer that connected to us, the info hash of the torrent is
+// recognized among the ones we serve. The BitTorrent handshake of the peer is read from the returned connection
+func acceptEncrypted(conn net.Conn, reader *bufio.Reader, infoHashes [][20]byte, encryption Encryption) (net.Conn, error) {
+	peerPublic := make([]byte, dhKeyLength)
+	_, err := io.ReadFull(reader, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	private, public, err := dhKeys()
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, padB...))
+	if err != nil {
+		return nil, err
+	}
+	secret := dhSecret(private, peerPublic)
+
+	err = synchronize(reader, mseHash([]byte("req1"), secret))
+	if err != nil {
+		return nil, err
+	}
+	obfuscatedHash := make([]byte, 20)
+	_, err = io.ReadFull(reader, obfuscatedHash)
+	if err != nil {
+		return nil, err
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range obfuscatedHash {
+		obfuscatedHash[i] ^= req3[i]
+	}
+	var infoHash [20]byte
+	found := false
+	for _, candidate := range infoHashes {
+		if bytes.Equal(mseHash([]byte("req2"), candidate[:]), obfuscatedHash) {
+			infoHash = candidate
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("peer asked for an unknown torrent")
+	}
+
+	decryptCipher := mseCipher("keyA", secret, infoHash)
+	encryptCipher := mseCipher("keyB", secret, infoHash)
+	header := make([]byte, 14)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	decryptCipher.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], make([]byte, 8)) {
+		return nil, errors.New("invalid MSE verification constant")
+	}
+	cryptoSelect := encryption.cryptoSelect(binary.BigEndian.Uint32(header[8:]))
+	if cryptoSelect == 0 {
+		return nil, errors.New("no acceptable encryption method offered by the peer")
+	}
+	padLength := int(binary.BigEndian.Uint16(header[12:]))
+	if padLength > maxPadLength {
+		return nil, errors.New("MSE padding too long")
+	}
+	// the padding of the peer is followed by the length of its initial payload
+	padC := make([]byte, padLength+2)
+	_, err = io.ReadFull(reader, padC)
+	if err != nil {
+		return nil, err
+	}
+	decryptCipher.XORKeyStream(padC, padC)
+	initialPayload := make([]byte, binary.BigEndian.Uint16(padC[padLength:]))
+	_, err = io.ReadFull(reader, initialPayload)
+	if err != nil {
+		return nil, err
+	}
+	decryptCipher.XORKeyStream(initialPayload, initialPayload)
+
+	answer := make([]byte, 8, 14)
+	answer = binary.BigEndian.AppendUint32(answer, cryptoSelect)
+	answer = binary.BigEndian.AppendUint16(answer, 0)
+	encryptCipher.XORKeyStream(answer, answer)
+	_, err = conn.Write(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := &streamConn{Conn: conn, reader: reader, pending: initialPayload}
+	if cryptoSelect == cryptoRC4 {
+		encrypted.readCipher = decryptCipher
+		encrypted.writeCipher = encryptCipher
+	}
+	return encrypted, nil
+}
@@ -0,0 +1,88 @@
+package peer
+
+import (
+	"main/bitfield"
+	"main/handshake"
+	"net"
+	"testing"
+)
+
+// encryptedListener accepts the peers of a torrent with the encryption policy and hands over their connections
+func encryptedListener(t *testing.T, infoHash [20]byte, encryption Encryption) (Peer, chan *PeerConnection) {
+	listener, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	listener.SetEncryption(encryption)
+	accepted := make(chan *PeerConnection, 1)
+	listener.Handle(infoHash, func(conn net.Conn, peerHandshake *handshake.Handshake) {
+		peerConnection, err := AcceptPeer(conn, [20]byte{9}, infoHash, peerHandshake, bitfield.Bitfield{0b10000000})
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- peerConnection
+	})
+	return Peer{IpAddr: net.IPv4(127, 0, 0, 1), Port: listener.Port()}, accepted
+}
+
+func TestEncryptedConnection(t *testing.T) {
+	t.Log("Testing the MSE handshake with full and header-only encryption")
+	infoHash := [20]byte{1, 2, 3}
+	tests := []struct {
+		outgoing, incoming Encryption
+		rc4                bool
+	}{
+		{Encryption{Policy: EncryptionRequire}, Encryption{Policy: EncryptionRequire}, true},
+		{Encryption{Policy: EncryptionPrefer}, Encryption{Policy: EncryptionPrefer, HeaderOnly: true}, false},
+		{Encryption{Policy: EncryptionRequire, HeaderOnly: true}, Encryption{Policy: EncryptionRequire}, true},
+	}
+	for _, test := range tests {
+		listenerPeer, accepted := encryptedListener(t, infoHash, test.incoming)
+		peerConnection, err := ConnectToPeer(listenerPeer, [20]byte{4}, infoHash, bitfield.Bitfield{0b01000000}, Dialer{Encryption: test.outgoing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !peerConnection.Bitfield.HavePiece(0) {
+			t.Error("expected the bitfield to be read through the encrypted stream")
+		}
+		incoming := <-accepted
+		if incoming == nil || !incoming.Bitfield.HavePiece(1) {
+			t.Error("expected the listener to read our bitfield")
+		}
+		encrypted, ok := peerConnection.Conn.(*streamConn)
+		if !ok {
+			t.Fatal("expected an MSE connection")
+		}
+		if (encrypted.writeCipher != nil) != test.rc4 {
+			t.Errorf("expected RC4 to be %v for %+v to %+v", test.rc4, test.outgoing, test.incoming)
+		}
+		peerConnection.Conn.Close()
+		incoming.Conn.Close()
+	}
+}
+
+func TestEncryptionFallback(t *testing.T) {
+	t.Log("Testing the plaintext fallback and the refusal of plaintext peers")
+	infoHash := [20]byte{1, 2, 3}
+	plaintextPeer, accepted := encryptedListener(t, infoHash, Encryption{Policy: EncryptionDisable})
+	peerConnection, err := ConnectToPeer(plaintextPeer, [20]byte{4}, infoHash, bitfield.Bitfield{0}, Dialer{Encryption: Encryption{Policy: EncryptionPrefer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, encrypted := peerConnection.Conn.(*streamConn); encrypted {
+		t.Error("expected a plaintext connection to a peer without MSE")
+	}
+	peerConnection.Conn.Close()
+	(<-accepted).Conn.Close()
+
+	_, err = ConnectToPeer(plaintextPeer, [20]byte{4}, infoHash, bitfield.Bitfield{0}, Dialer{Encryption: Encryption{Policy: EncryptionRequire}})
+	if err == nil {
+		t.Error("expected the connection to fail when encryption is required")
+	}
+	encryptedPeer, _ := encryptedListener(t, infoHash, Encryption{Policy: EncryptionRequire})
+	_, err = ConnectToPeer(encryptedPeer, [20]byte{4}, infoHash, bitfield.Bitfield{0}, Dialer{Encryption: Encryption{Policy: EncryptionDisable}})
+	if err == nil {
+		t.Error("expected a peer that requires encryption to refuse plaintext")
+	}
+}
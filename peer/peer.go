@@ -13,7 +13,7 @@ type Peer struct {
 }
 
 func UnmarshallPeers(peers []byte) ([]Peer, error) {
-	if len(peers) == 0 || len(peers)%6 != 0 {
+	if len(peers)%6 != 0 {
 		return nil, errors.New("invalid peers length")
 	}
 	numPeers := len(peers) / 6
@@ -31,6 +31,57 @@ func UnmarshallPeers(peers []byte) ([]Peer, error) {
 	return peerList, nil
 }
 
+// UnmarshallPeers6 parses the compact IPv6 peer list of BEP 7, 16 bytes of address and 2 of port for every peer
+func UnmarshallPeers6(peers []byte) ([]Peer, error) {
+	if len(peers)%18 != 0 {
+		return nil, errors.New("invalid IPv6 peers length")
+	}
+	numPeers := len(peers) / 18
+	peerList := make([]Peer, numPeers)
+	for i := 0; i < numPeers; i++ {
+		peerIndex := i * 18
+		ipAdress := make(net.IP, net.IPv6len)
+		copy(ipAdress, peers[peerIndex:peerIndex+16])
+		peerList[i] = Peer{
+			IpAddr: ipAdress,
+			Port:   binary.BigEndian.Uint16(peers[peerIndex+16 : peerIndex+18]),
+		}
+	}
+	return peerList, nil
+}
+
+// MarshallPeers writes the IPv4 peers in the compact format, IPv6 peers are skipped
+func MarshallPeers(peers []Peer) []byte {
+	buff := make([]byte, 0, len(peers)*6)
+	for _, p := range peers {
+		ipv4 := p.IpAddr.To4()
+		if ipv4 == nil {
+			continue
+		}
+		buff = append(buff, ipv4...)
+		buff = binary.BigEndian.AppendUint16(buff, p.Port)
+	}
+	return buff
+}
+
+// MarshallPeers6 writes the IPv6 peers in the compact format of BEP 7, IPv4 peers are skipped
+func MarshallPeers6(peers []Peer) []byte {
+	buff := make([]byte, 0, len(peers)*18)
+	for _, p := range peers {
+		if p.IpAddr.To4() != nil || len(p.IpAddr) != net.IPv6len {
+			continue
+		}
+		buff = append(buff, p.IpAddr...)
+		buff = binary.BigEndian.AppendUint16(buff, p.Port)
+	}
+	return buff
+}
+
 func (p *Peer) String() string {
 	return net.JoinHostPort(p.IpAddr.String(), strconv.Itoa(int(p.Port)))
 }
+
+// IsLocal reports whether the peer is on our local network, such peers are preferred over the ones on the internet
+func (p *Peer) IsLocal() bool {
+	return p.IpAddr.IsPrivate() || p.IpAddr.IsLoopback() || p.IpAddr.IsLinkLocalUnicast()
+}
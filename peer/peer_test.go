@@ -26,3 +26,57 @@ func TestUnmarshallPeer(t *testing.T) {
 		t.Error("UnmarshallPeers should have failed for malformed peers")
 	}
 }
+
+func TestUnmarshallPeers6(t *testing.T) {
+	t.Log("Testing unmarshallPeers6")
+	input := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1}
+	outputPeers, err := UnmarshallPeers6(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputPeers) != 1 || !outputPeers[0].IpAddr.Equal(net.ParseIP("2001:db8::1")) || outputPeers[0].Port != 6881 {
+		t.Error("UnmarshallPeers6 output does not match expected output ", outputPeers)
+	}
+	if outputPeers[0].String() != "[2001:db8::1]:6881" {
+		t.Error("expected an IPv6 address with brackets but got ", outputPeers[0].String())
+	}
+	_, err = UnmarshallPeers6(input[:17])
+	if err == nil {
+		t.Error("UnmarshallPeers6 should have failed for malformed peers")
+	}
+}
+
+func TestMarshallPeers(t *testing.T) {
+	t.Log("Testing marshallPeers")
+	peers := []Peer{
+		{IpAddr: net.IP{127, 0, 0, 1}, Port: 80},
+		{IpAddr: net.ParseIP("2001:db8::1"), Port: 6881},
+		{IpAddr: net.ParseIP("1.1.1.1"), Port: 443},
+	}
+	expected := []byte{127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb}
+	if !reflect.DeepEqual(MarshallPeers(peers), expected) {
+		t.Error("expected ", expected, " but got ", MarshallPeers(peers))
+	}
+	peers6, err := UnmarshallPeers6(MarshallPeers6(peers))
+	if err != nil || len(peers6) != 1 || !peers6[0].IpAddr.Equal(peers[1].IpAddr) {
+		t.Error("expected only the IPv6 peer but got ", peers6, err)
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	t.Log("Testing isLocal")
+	local := []string{"192.168.1.10", "10.0.0.2", "127.0.0.1", "fe80::1", "fd00::1"}
+	remote := []string{"1.1.1.1", "2001:db8::1"}
+	for _, ip := range local {
+		p := Peer{IpAddr: net.ParseIP(ip), Port: 6881}
+		if !p.IsLocal() {
+			t.Errorf("expected %s to be local", ip)
+		}
+	}
+	for _, ip := range remote {
+		p := Peer{IpAddr: net.ParseIP(ip), Port: 6881}
+		if p.IsLocal() {
+			t.Errorf("expected %s not to be local", ip)
+		}
+	}
+}
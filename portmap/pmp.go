@@ -0,0 +1,249 @@
+package portmap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// values of PCP (RFC 6887) and of NAT-PMP (RFC 6886), the PCP servers answer NAT-PMP too and the NAT-PMP ones
+// answer a PCP request with an unsupported version error in the NAT-PMP format
+const (
+	pcpVersion           = 2
+	natPmpVersion        = 0
+	pcpOpAnnounce        = 0
+	pcpOpMap             = 1
+	pcpHeaderSize        = 24
+	pcpMapSize           = 36
+	pcpResultSuccess     = 0
+	natPmpOpExternalIP   = 0
+	natPmpOpMapUdp       = 1
+	natPmpOpMapTcp       = 2
+	natPmpResultSuccess  = 0
+	pmpInitialRetransmit = 250 * time.Millisecond
+	responseBit          = 0x80
+)
+
+var pcpProtocols = map[string]byte{"TCP": 6, "UDP": 17}
+
+var pcpResults = map[byte]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	7:  "malformed option",
+	8:  "network failure",
+	9:  "no resources",
+	10: "unsupported protocol",
+	11: "user exceeded quota",
+	12: "cannot provide external",
+	13: "address mismatch",
+	14: "excessive remote peers",
+}
+
+var natPmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// pmpGateway speaks PCP or, with the gateways that only know it, its predecessor NAT-PMP
+type pmpGateway struct {
+	addr    string
+	version byte
+	timeout time.Duration
+	// clientIP is our address on the network of the gateway, PCP asks for it in every request
+	clientIP net.IP
+	// nonces are the ones of the PCP mappings of every protocol, a renewal or a removal must use the same one
+	nonces map[string][12]byte
+}
+
+// discoverPmp asks the gateway which of the two protocols it speaks with a PCP announce
+func discoverPmp(addr string, timeout time.Duration) (*pmpGateway, error) {
+	g := &pmpGateway{addr: addr, timeout: timeout, nonces: make(map[string][12]byte)}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g.clientIP = conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	response, err := g.exchange(g.pcpHeader(pcpOpAnnounce, 0), func(response []byte) bool {
+		return len(response) >= 4 && response[1] == responseBit|pcpOpAnnounce
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no PCP or NAT-PMP gateway at %s: %w", addr, err)
+	}
+	g.version = response[0]
+	if g.version != pcpVersion && g.version != natPmpVersion {
+		return nil, fmt.Errorf("gateway %s speaks an unknown version %d", addr, g.version)
+	}
+	return g, nil
+}
+
+func (g *pmpGateway) String() string {
+	if g.version == pcpVersion {
+		return "PCP gateway " + g.addr
+	}
+	return "NAT-PMP gateway " + g.addr
+}
+
+func (g *pmpGateway) addMapping(protocol string, internalPort, externalPort uint16, lease time.Duration) (mapping, error) {
+	if g.version == natPmpVersion {
+		return g.natPmpMap(protocol, internalPort, externalPort, lease)
+	}
+	return g.pcpMap(protocol, internalPort, externalPort, lease)
+}
+
+// deleteMapping asks for a lease of 0, which removes the mapping
+func (g *pmpGateway) deleteMapping(protocol string, internalPort, externalPort uint16) error {
+	var err error
+	if g.version == natPmpVersion {
+		_, err = g.natPmpMap(protocol, internalPort, 0, 0)
+	} else {
+		_, err = g.pcpMap(protocol, internalPort, 0, 0)
+	}
+	return err
+}
+
+// pcpHeader is the common header of the PCP requests
+func (g *pmpGateway) pcpHeader(opcode byte, lease time.Duration) []byte {
+	header := make([]byte, pcpHeaderSize)
+	header[0] = pcpVersion
+	header[1] = opcode
+	binary.BigEndian.PutUint32(header[4:], uint32(lease/time.Second))
+	copy(header[8:], g.clientIP.To16())
+	return header
+}
+
+func (g *pmpGateway) pcpMap(protocol string, internalPort, externalPort uint16, lease time.Duration) (mapping, error) {
+	nonce, ok := g.nonces[protocol]
+	if !ok {
+		rand.Read(nonce[:])
+		g.nonces[protocol] = nonce
+	}
+	request := g.pcpHeader(pcpOpMap, lease)
+	request = append(request, nonce[:]...)
+	request = append(request, pcpProtocols[protocol], 0, 0, 0)
+	request = binary.BigEndian.AppendUint16(request, internalPort)
+	request = binary.BigEndian.AppendUint16(request, externalPort)
+	// no preference for the external address, the IPv4 unspecified address mapped to IPv6
+	request = append(request, net.IPv4zero.To16()...)
+	response, err := g.exchange(request, func(response []byte) bool {
+		return len(response) >= pcpHeaderSize+pcpMapSize && response[0] == pcpVersion &&
+			response[1] == responseBit|pcpOpMap && [12]byte(response[24:36]) == nonce
+	})
+	if err != nil {
+		return mapping{}, err
+	}
+	if response[3] != pcpResultSuccess {
+		return mapping{}, fmt.Errorf("%s refused the mapping: %s", g, pcpResultString(response[3]))
+	}
+	externalIP := net.IP(response[44:60])
+	if externalIP.To4() != nil {
+		externalIP = externalIP.To4()
+	}
+	return mapping{
+		externalPort: binary.BigEndian.Uint16(response[42:44]),
+		externalIP:   externalIP,
+		lease:        time.Duration(binary.BigEndian.Uint32(response[4:8])) * time.Second,
+	}, nil
+}
+
+func (g *pmpGateway) natPmpMap(protocol string, internalPort, externalPort uint16, lease time.Duration) (mapping, error) {
+	opcode := byte(natPmpOpMapTcp)
+	if protocol == "UDP" {
+		opcode = natPmpOpMapUdp
+	}
+	request := []byte{natPmpVersion, opcode, 0, 0}
+	request = binary.BigEndian.AppendUint16(request, internalPort)
+	request = binary.BigEndian.AppendUint16(request, externalPort)
+	request = binary.BigEndian.AppendUint32(request, uint32(lease/time.Second))
+	response, err := g.exchange(request, func(response []byte) bool {
+		return len(response) >= 16 && response[0] == natPmpVersion && response[1] == responseBit|opcode &&
+			binary.BigEndian.Uint16(response[8:10]) == internalPort
+	})
+	if err != nil {
+		return mapping{}, err
+	}
+	err = natPmpResult(response)
+	if err != nil {
+		return mapping{}, fmt.Errorf("%s refused the mapping: %w", g, err)
+	}
+	m := mapping{
+		externalPort: binary.BigEndian.Uint16(response[10:12]),
+		lease:        time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second,
+	}
+	if lease == 0 {
+		return m, nil
+	}
+	// NAT-PMP tells the external address with a request of its own
+	response, err = g.exchange([]byte{natPmpVersion, natPmpOpExternalIP}, func(response []byte) bool {
+		return len(response) >= 12 && response[0] == natPmpVersion && response[1] == responseBit|natPmpOpExternalIP
+	})
+	if err == nil && natPmpResult(response) == nil {
+		m.externalIP = net.IP(response[8:12])
+	}
+	return m, nil
+}
+
+// exchange sends the request until a response passes the check, waiting 250ms and then twice as long every time
+// as both RFCs ask, until the timeout is over
+func (g *pmpGateway) exchange(request []byte, check func([]byte) bool) ([]byte, error) {
+	conn, err := net.Dial("udp", g.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(g.timeout)
+	buff := make([]byte, 1100)
+	for wait := pmpInitialRetransmit; time.Now().Before(deadline); wait *= 2 {
+		_, err = conn.Write(request)
+		if err != nil {
+			return nil, err
+		}
+		readDeadline := time.Now().Add(wait)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+		for {
+			n, err := conn.Read(buff)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if check(buff[:n]) {
+				return buff[:n], nil
+			}
+		}
+	}
+	return nil, os.ErrDeadlineExceeded
+}
+
+func pcpResultString(result byte) string {
+	message, ok := pcpResults[result]
+	if !ok {
+		return fmt.Sprint("error ", result)
+	}
+	return message
+}
+
+func natPmpResult(response []byte) error {
+	result := binary.BigEndian.Uint16(response[2:4])
+	if result == natPmpResultSuccess {
+		return nil
+	}
+	message, ok := natPmpResults[result]
+	if !ok {
+		message = fmt.Sprint("error ", result)
+	}
+	return errors.New(message)
+}
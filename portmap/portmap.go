@@ -0,0 +1,235 @@
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"main/logging"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// leaseDuration is asked for every mapping, the mappings are renewed when half of the lease granted is over
+	leaseDuration = time.Hour
+	minRenewal    = time.Second
+	description   = "go-torrent-client"
+	pmpPort       = 5351
+	ssdpAddress   = "239.255.255.250:1900"
+)
+
+// protocols are mapped together, uTP and the udp trackers use the UDP port with the same number as the TCP one
+var protocols = []string{"TCP", "UDP"}
+
+var errNoGateway = errors.New("no NAT-PMP, PCP or UPnP gateway found")
+
+// gateway is a NAT that maps ports with PCP, NAT-PMP or UPnP IGD
+type gateway interface {
+	// addMapping maps externalPort, or another port when the gateway prefers, to internalPort
+	addMapping(protocol string, internalPort, externalPort uint16, lease time.Duration) (mapping, error)
+	deleteMapping(protocol string, internalPort, externalPort uint16) error
+	String() string
+}
+
+type mapping struct {
+	externalPort uint16
+	externalIP   net.IP
+	// lease is the time the gateway keeps the mapping, 0 for a permanent one
+	lease time.Duration
+}
+
+type Options struct {
+	// Gateway is the address of the PCP and NAT-PMP server, the default gateway on port 5351 when empty
+	Gateway string
+	// SSDPAddress is where the UPnP gateways are searched, the SSDP multicast group when empty
+	SSDPAddress string
+	// Timeout bounds the discovery with every protocol, 2 seconds when not set
+	Timeout time.Duration
+	// Logger receives the mappings and the renewal errors, nil discards them
+	Logger *slog.Logger
+}
+
+// Service keeps a port mapped on the gateway of the local network until it is closed, the external address and
+// port are the ones to tell the trackers
+type Service struct {
+	gateway gateway
+	port    uint16
+	logger  *slog.Logger
+
+	mu         sync.Mutex
+	external   map[string]uint16
+	externalIP net.IP
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// Start finds the gateway, maps port for TCP and UDP and renews the mappings in the background
+func Start(port uint16, options Options) (*Service, error) {
+	if options.Timeout == 0 {
+		options.Timeout = 2 * time.Second
+	}
+	if options.SSDPAddress == "" {
+		options.SSDPAddress = ssdpAddress
+	}
+	if options.Gateway == "" {
+		if gatewayIP := defaultGateway(); gatewayIP != nil {
+			options.Gateway = net.JoinHostPort(gatewayIP.String(), fmt.Sprint(pmpPort))
+		}
+	}
+	s := &Service{
+		port:     port,
+		logger:   logging.Or(options.Logger),
+		external: make(map[string]uint16),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	renewal, err := s.discover(options)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("mapped port", "port", port, "external_ip", s.ExternalIP(), "external_port", s.ExternalPort(),
+		"gateway", s.gateway.String())
+	go s.renewLoop(renewal)
+	return s, nil
+}
+
+// discover maps the port with the first protocol the gateway answers to
+func (s *Service) discover(options Options) (time.Duration, error) {
+	var errs []error
+	if options.Gateway != "" {
+		pmp, err := discoverPmp(options.Gateway, options.Timeout)
+		if err == nil {
+			s.gateway = pmp
+			var renewal time.Duration
+			renewal, err = s.mapAll()
+			if err == nil {
+				return renewal, nil
+			}
+		}
+		errs = append(errs, err)
+	}
+	upnp, err := discoverUpnp(options.SSDPAddress, options.Timeout)
+	if err == nil {
+		s.gateway = upnp
+		var renewal time.Duration
+		renewal, err = s.mapAll()
+		if err == nil {
+			return renewal, nil
+		}
+	}
+	errs = append(errs, err)
+	return 0, fmt.Errorf("%w: %w", errNoGateway, errors.Join(errs...))
+}
+
+// mapAll maps or renews the port for every protocol and returns when the mappings have to be renewed
+func (s *Service) mapAll() (time.Duration, error) {
+	renewal := time.Duration(0)
+	for _, protocol := range protocols {
+		s.mu.Lock()
+		externalPort, ok := s.external[protocol]
+		s.mu.Unlock()
+		if !ok {
+			externalPort = s.port
+		}
+		m, err := s.gateway.addMapping(protocol, s.port, externalPort, leaseDuration)
+		if err != nil {
+			return 0, fmt.Errorf("error mapping %s port %d: %w", protocol, s.port, err)
+		}
+		s.mu.Lock()
+		s.external[protocol] = m.externalPort
+		if m.externalIP != nil {
+			s.externalIP = m.externalIP
+		}
+		s.mu.Unlock()
+		if m.lease > 0 && (renewal == 0 || m.lease/2 < renewal) {
+			renewal = max(m.lease/2, minRenewal)
+		}
+	}
+	return renewal, nil
+}
+
+// renewLoop renews the mappings before their lease is over, a permanent mapping is never renewed
+func (s *Service) renewLoop(renewal time.Duration) {
+	defer close(s.done)
+	for {
+		var renew <-chan time.Time
+		if renewal > 0 {
+			renew = time.After(renewal)
+		}
+		select {
+		case <-renew:
+			var err error
+			renewal, err = s.mapAll()
+			if err != nil {
+				s.logger.Warn("error renewing the port mapping", "gateway", s.gateway.String(), "error", err)
+				renewal = minRenewal * 30
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// ExternalPort is the TCP port the peers reach us on from outside of the local network
+func (s *Service) ExternalPort() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.external["TCP"]
+}
+
+// ExternalIP is the address of the gateway on the internet, nil when the gateway did not tell it
+func (s *Service) ExternalIP() net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.externalIP
+}
+
+// Close stops renewing the mappings and removes them from the gateway
+func (s *Service) Close() error {
+	close(s.stop)
+	<-s.done
+	var errs []error
+	for _, protocol := range protocols {
+		s.mu.Lock()
+		externalPort := s.external[protocol]
+		s.mu.Unlock()
+		err := s.gateway.deleteMapping(protocol, s.port, externalPort)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error removing the %s port mapping: %w", protocol, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// defaultGateway reads the gateway of the default route from the routing table of Linux, nil elsewhere
+func defaultGateway() net.IP {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., the addresses are the hexadecimal of little endian integers
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		if !ip.IsUnspecified() {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeExternalIP = net.IPv4(203, 0, 113, 7).To4()
+
+// fakeGateway records the mappings of the fake PCP, NAT-PMP and UPnP gateways, the external port is the internal
+// one plus 1000
+type fakeGateway struct {
+	mu sync.Mutex
+	// mappings are the active mappings by protocol, adds counts the requests that created or renewed one
+	mappings map[string]uint16
+	adds     int
+}
+
+func newFakeGateway() *fakeGateway {
+	return &fakeGateway{mappings: make(map[string]uint16)}
+}
+
+func (f *fakeGateway) add(protocol string, internalPort uint16) uint16 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mappings[protocol] = internalPort + 1000
+	f.adds++
+	return internalPort + 1000
+}
+
+func (f *fakeGateway) remove(protocol string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.mappings, protocol)
+}
+
+func (f *fakeGateway) state() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.mappings), f.adds
+}
+
+// servePmp answers as a PCP gateway, or as a NAT-PMP one when natPmp is set, granting leases of 1 second
+func (f *fakeGateway) servePmp(t *testing.T, natPmp bool) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buff := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			request := buff[:n]
+			var response []byte
+			switch {
+			case natPmp && request[0] != natPmpVersion:
+				response = []byte{natPmpVersion, responseBit | request[1], 0, 1, 0, 0, 0, 0}
+			case natPmp && request[1] == natPmpOpExternalIP:
+				response = append([]byte{natPmpVersion, responseBit, 0, 0, 0, 0, 0, 0}, fakeExternalIP...)
+			case natPmp:
+				protocol := map[byte]string{natPmpOpMapTcp: "TCP", natPmpOpMapUdp: "UDP"}[request[1]]
+				internalPort := binary.BigEndian.Uint16(request[4:6])
+				response = []byte{natPmpVersion, responseBit | request[1], 0, 0, 0, 0, 0, 0}
+				response = binary.BigEndian.AppendUint16(response, internalPort)
+				if binary.BigEndian.Uint32(request[8:12]) == 0 {
+					f.remove(protocol)
+					response = append(response, 0, 0, 0, 0, 0, 0)
+					break
+				}
+				response = binary.BigEndian.AppendUint16(response, f.add(protocol, internalPort))
+				response = binary.BigEndian.AppendUint32(response, 1)
+			case request[1] == pcpOpAnnounce:
+				response = make([]byte, pcpHeaderSize)
+				response[0], response[1] = pcpVersion, responseBit|pcpOpAnnounce
+			case request[1] == pcpOpMap:
+				protocol := map[byte]string{6: "TCP", 17: "UDP"}[request[36]]
+				internalPort := binary.BigEndian.Uint16(request[40:42])
+				response = make([]byte, pcpHeaderSize+pcpMapSize)
+				copy(response[pcpHeaderSize:], request[pcpHeaderSize:])
+				response[0], response[1] = pcpVersion, responseBit|pcpOpMap
+				if binary.BigEndian.Uint32(request[4:8]) == 0 {
+					f.remove(protocol)
+					break
+				}
+				binary.BigEndian.PutUint32(response[4:8], 1)
+				binary.BigEndian.PutUint16(response[42:44], f.add(protocol, internalPort))
+				copy(response[44:60], fakeExternalIP.To16())
+			}
+			conn.WriteToUDP(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// serveUpnp answers the SSDP searches and the SOAP actions of a WANIPConnection service that only accepts
+// permanent leases
+func (f *fakeGateway) serveUpnp(t *testing.T) string {
+	serviceType := "urn:schemas-upnp-org:service:WANIPConnection:1"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/description.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+			<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><deviceList><device>
+			<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList><device>
+			<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType><serviceList><service>
+			<serviceType>%s</serviceType><controlURL>/control</controlURL></service></serviceList>
+			</device></deviceList></device></deviceList></device></root>`, serviceType)
+	})
+	mux.HandleFunc("/control", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fault := func(code int) {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+				<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode>
+				<errorDescription>error</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code)
+		}
+		protocol := xmlElement(body, "NewProtocol")
+		switch r.Header.Get("SOAPAction") {
+		case `"` + serviceType + `#AddPortMapping"`:
+			if xmlElement(body, "NewLeaseDuration") != "0" {
+				fault(upnpOnlyPermanentLeases)
+				return
+			}
+			internalPort, _ := strconv.Atoi(xmlElement(body, "NewInternalPort"))
+			if xmlElement(body, "NewExternalPort") != strconv.Itoa(internalPort) {
+				fault(718)
+				return
+			}
+			f.add(protocol, uint16(internalPort))
+		case `"` + serviceType + `#DeletePortMapping"`:
+			f.remove(protocol)
+		case `"` + serviceType + `#GetExternalIPAddress"`:
+			fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+				<u:GetExternalIPAddressResponse xmlns:u="%s"><NewExternalIPAddress>%s</NewExternalIPAddress>
+				</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, serviceType, fakeExternalIP)
+			return
+		default:
+			fault(401)
+			return
+		}
+		fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body></s:Body></s:Envelope>`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	ssdp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ssdp.Close() })
+	go func() {
+		buff := make([]byte, 2048)
+		for {
+			_, addr, err := ssdp.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			response := "HTTP/1.1 200 OK\r\nST: " + ssdpSearchTarget + "\r\nLOCATION: " + server.URL + "/description.xml\r\n\r\n"
+			ssdp.WriteToUDP([]byte(response), addr)
+		}
+	}()
+	return ssdp.LocalAddr().String()
+}
+
+// closedPort returns the address of a UDP port nobody listens on
+func closedPort(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestPmpMapping(t *testing.T) {
+	t.Log("Testing the mapping, renewal and removal of the port with PCP and NAT-PMP gateways")
+	for _, natPmp := range []bool{false, true} {
+		gateway := newFakeGateway()
+		options := Options{Gateway: gateway.servePmp(t, natPmp), SSDPAddress: closedPort(t), Timeout: time.Second}
+		s, err := Start(6881, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ExternalPort() != 7881 || !s.ExternalIP().Equal(fakeExternalIP) {
+			t.Errorf("expected the external address 203.0.113.7:7881, got %s:%d", s.ExternalIP(), s.ExternalPort())
+		}
+		// the leases of 1 second are renewed every second
+		time.Sleep(1500 * time.Millisecond)
+		mappings, adds := gateway.state()
+		if mappings != 2 || adds < 4 {
+			t.Errorf("expected the TCP and UDP mappings to be renewed, got %d mappings and %d requests", mappings, adds)
+		}
+		err = s.Close()
+		if mappings, _ := gateway.state(); err != nil || mappings != 0 {
+			t.Errorf("expected the mappings to be removed, %d are left: %v", mappings, err)
+		}
+	}
+}
+
+func TestUpnpMapping(t *testing.T) {
+	t.Log("Testing the mapping with a UPnP gateway that only accepts permanent leases")
+	gateway := newFakeGateway()
+	s, err := Start(6881, Options{Gateway: closedPort(t), SSDPAddress: gateway.serveUpnp(t), Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ExternalPort() != 6881 || !s.ExternalIP().Equal(fakeExternalIP) {
+		t.Errorf("expected the external address 203.0.113.7:6881, got %s:%d", s.ExternalIP(), s.ExternalPort())
+	}
+	if mappings, _ := gateway.state(); mappings != 2 {
+		t.Errorf("expected the TCP and UDP mappings, got %d", mappings)
+	}
+	err = s.Close()
+	if mappings, _ := gateway.state(); err != nil || mappings != 0 {
+		t.Errorf("expected the mappings to be removed, %d are left: %v", mappings, err)
+	}
+}
+
+func TestNoGateway(t *testing.T) {
+	t.Log("Testing that Start fails without a gateway")
+	_, err := Start(6881, Options{Gateway: closedPort(t), SSDPAddress: closedPort(t), Timeout: 200 * time.Millisecond})
+	if err == nil {
+		t.Error("expected an error without a gateway")
+	}
+}
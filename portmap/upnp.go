@@ -0,0 +1,273 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpSearchTarget = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	// upnpOnlyPermanentLeases is the error of the gateways that refuse leases other than 0
+	upnpOnlyPermanentLeases = 725
+)
+
+// the services of an Internet Gateway Device that map ports
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:",
+	"urn:schemas-upnp-org:service:WANPPPConnection:",
+}
+
+// upnpGateway maps ports with the SOAP actions of the WANIPConnection or WANPPPConnection service of UPnP IGD
+type upnpGateway struct {
+	controlUrl  string
+	serviceType string
+	// localIP is our address on the network of the gateway, the internal client of the mappings
+	localIP net.IP
+	client  *http.Client
+	// permanent is set once the gateway refused a lease, the following mappings are permanent
+	permanent bool
+}
+
+type upnpRoot struct {
+	UrlBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlUrl  string `xml:"controlURL"`
+}
+
+// upnpError is the fault of a SOAP action
+type upnpError struct {
+	code        int
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d %s", e.code, e.description)
+}
+
+// discoverUpnp searches the gateway with SSDP and reads the control url of its port mapping service
+func discoverUpnp(ssdpAddr string, timeout time.Duration) (*upnpGateway, error) {
+	location, err := ssdpSearch(ssdpAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	response, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var root upnpRoot
+	err = xml.NewDecoder(response.Body).Decode(&root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPnP description at %s: %w", location, err)
+	}
+	service, ok := findUpnpService(root.Device)
+	if !ok {
+		return nil, fmt.Errorf("the UPnP device at %s does not map ports", location)
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.UrlBase != "" {
+		base, err = url.Parse(root.UrlBase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	controlUrl, err := base.Parse(strings.TrimSpace(service.ControlUrl))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", controlUrl.Host)
+	if err != nil {
+		return nil, err
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	return &upnpGateway{
+		controlUrl:  controlUrl.String(),
+		serviceType: strings.TrimSpace(service.ServiceType),
+		localIP:     localIP,
+		client:      client,
+	}, nil
+}
+
+// ssdpSearch sends an M-SEARCH for the Internet Gateway Devices and returns the location of the first that answers
+func ssdpSearch(ssdpAddr string, timeout time.Duration) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"ST: " + ssdpSearchTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	_, err = conn.WriteTo([]byte(search), addr)
+	if err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buff := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buff)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return "", fmt.Errorf("no UPnP gateway answered the search")
+		}
+		if err != nil {
+			return "", err
+		}
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buff[:n])), nil)
+		if err != nil || response.StatusCode != http.StatusOK {
+			continue
+		}
+		location := response.Header.Get("Location")
+		if location != "" {
+			return location, nil
+		}
+	}
+}
+
+func findUpnpService(device upnpDevice) (upnpService, bool) {
+	for _, service := range device.Services {
+		for _, serviceType := range upnpServiceTypes {
+			if strings.HasPrefix(strings.TrimSpace(service.ServiceType), serviceType) {
+				return service, true
+			}
+		}
+	}
+	for _, child := range device.Devices {
+		service, ok := findUpnpService(child)
+		if ok {
+			return service, true
+		}
+	}
+	return upnpService{}, false
+}
+
+func (g *upnpGateway) String() string {
+	return "UPnP gateway " + g.controlUrl
+}
+
+func (g *upnpGateway) addMapping(protocol string, internalPort, externalPort uint16, lease time.Duration) (mapping, error) {
+	if g.permanent {
+		lease = 0
+	}
+	_, err := g.call("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(externalPort))},
+		{"NewProtocol", protocol},
+		{"NewInternalPort", strconv.Itoa(int(internalPort))},
+		{"NewInternalClient", g.localIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", description},
+		{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+	})
+	var upnpErr *upnpError
+	if errors.As(err, &upnpErr) && upnpErr.code == upnpOnlyPermanentLeases && lease != 0 {
+		g.permanent = true
+		return g.addMapping(protocol, internalPort, externalPort, 0)
+	}
+	if err != nil {
+		return mapping{}, err
+	}
+	m := mapping{externalPort: externalPort, lease: lease}
+	response, err := g.call("GetExternalIPAddress", nil)
+	if err == nil {
+		m.externalIP = net.ParseIP(xmlElement(response, "NewExternalIPAddress"))
+	}
+	return m, nil
+}
+
+func (g *upnpGateway) deleteMapping(protocol string, internalPort, externalPort uint16) error {
+	_, err := g.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(externalPort))},
+		{"NewProtocol", protocol},
+	})
+	return err
+}
+
+// call runs a SOAP action of the service with the arguments in order and returns the body of the response
+func (g *upnpGateway) call(action string, arguments [][2]string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	body.WriteString(`<u:` + action + ` xmlns:u="` + g.serviceType + `">`)
+	for _, argument := range arguments {
+		body.WriteString("<" + argument[0] + ">")
+		xml.EscapeText(&body, []byte(argument[1]))
+		body.WriteString("</" + argument[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	request, err := http.NewRequest(http.MethodPost, g.controlUrl, &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+g.serviceType+"#"+action+`"`)
+	response, err := g.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		code, err := strconv.Atoi(xmlElement(responseBody, "errorCode"))
+		if err != nil {
+			return nil, fmt.Errorf("%s of %s failed with %s", action, g, response.Status)
+		}
+		return nil, &upnpError{code: code, description: xmlElement(responseBody, "errorDescription")}
+	}
+	return responseBody, nil
+}
+
+// xmlElement returns the text of the first element with the name, whatever its namespace
+func xmlElement(document []byte, name string) string {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != name {
+			continue
+		}
+		var text string
+		if decoder.DecodeElement(&text, &start) != nil {
+			return ""
+		}
+		return strings.TrimSpace(text)
+	}
+}
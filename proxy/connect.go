@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// httpConnect opens a tunnel to address with the CONNECT method of the HTTP proxy on conn
+func (p *Proxy) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if p.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	_, err := conn.Write([]byte(request + "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the proxy answered %s", response.Status)
+	}
+	if reader.Buffered() > 0 {
+		// the peer already sent something through the tunnel, it was read together with the response
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while reading the response of the proxy before the rest of the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(buff []byte) (int, error) {
+	return c.reader.Read(buff)
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeSocks5 is a SOCKS5 proxy asking for user:secret, it connects to the targets and relays udp datagrams
+func fakeSocks5(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveSocks5(conn net.Conn) {
+	defer conn.Close()
+	greeting := make([]byte, 2)
+	io.ReadFull(conn, greeting)
+	io.ReadFull(conn, make([]byte, greeting[1]))
+	conn.Write([]byte{socksVersion, socksAuthPassword})
+	header := make([]byte, 2)
+	io.ReadFull(conn, header)
+	username := make([]byte, header[1])
+	io.ReadFull(conn, username)
+	io.ReadFull(conn, header[:1])
+	password := make([]byte, header[0])
+	io.ReadFull(conn, password)
+	if string(username) != "user" || string(password) != "secret" {
+		conn.Write([]byte{socksPasswordAuth, 1})
+		return
+	}
+	conn.Write([]byte{socksPasswordAuth, 0})
+
+	request := make([]byte, 3)
+	io.ReadFull(conn, request)
+	target, err := readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+	switch request[1] {
+	case socksCmdConnect:
+		targetConn, err := net.Dial("tcp", target.String())
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer targetConn.Close()
+		conn.Write([]byte{socksVersion, socksReplySuccess, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+		go func() {
+			io.Copy(targetConn, conn)
+			targetConn.Close()
+		}()
+		io.Copy(conn, targetConn)
+	case socksCmdAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply := []byte{socksVersion, socksReplySuccess, 0, socksAtypIPv4, 0, 0, 0, 0}
+		reply = binary.BigEndian.AppendUint16(reply, uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+		conn.Write(reply)
+		go relayUdp(relay)
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// relayUdp forwards the datagrams of the client and wraps the answers in the header of their sender
+func relayUdp(relay *net.UDPConn) {
+	var client *net.UDPAddr
+	buff := make([]byte, 65536)
+	for {
+		n, from, err := relay.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+		if client == nil || (from.IP.Equal(client.IP) && from.Port == client.Port) {
+			client = from
+			reader := &sliceReader{buff: buff[3:n]}
+			target, err := readSocksAddr(reader)
+			if err == nil {
+				relay.WriteToUDP(reader.buff, target)
+			}
+			continue
+		}
+		packet, _ := appendSocksAddr([]byte{0, 0, 0}, from.String())
+		relay.WriteToUDP(append(packet, buff[:n]...), client)
+	}
+}
+
+// fakeHttpProxy is an HTTP proxy asking for user:secret, it only supports CONNECT
+func fakeHttpProxy(t *testing.T) string {
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credentials := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		targetConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer targetConn.Close()
+		conn, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(targetConn, buffered)
+			targetConn.Close()
+		}()
+		io.Copy(conn, targetConn)
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// echoServer answers every line with the same line
+func echoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	t.Log("Testing TCP connections through SOCKS5 and HTTP CONNECT proxies with authentication")
+	echo := echoServer(t)
+	proxies := map[string]string{"socks5": fakeSocks5(t), "http": fakeHttpProxy(t)}
+	for scheme, address := range proxies {
+		p, err := Parse(scheme + "://user:secret@" + address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := p.DialTimeout(echo, 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %s", scheme, err)
+		}
+		conn.Write([]byte("ping\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "ping\n" {
+			t.Errorf("%s: expected the echo of ping, got %q %v", scheme, line, err)
+		}
+		conn.Close()
+
+		wrongPassword, err := Parse(scheme + "://user:wrong@" + address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wrongPassword.DialTimeout(echo, 5*time.Second)
+		if err == nil {
+			t.Errorf("%s: expected the proxy to refuse a wrong password", scheme)
+		}
+	}
+}
+
+func TestUdpAssociate(t *testing.T) {
+	t.Log("Testing UDP datagrams relayed by the SOCKS5 proxy")
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	p, err := Parse("socks5://user:secret@" + fakeSocks5(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteTo([]byte("request"), target.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 100)
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, relayAddr, err := target.ReadFromUDP(buff)
+	if err != nil || string(buff[:n]) != "request" {
+		t.Fatalf("expected the request at the target, got %q %v", buff[:n], err)
+	}
+	target.WriteToUDP([]byte("response"), relayAddr)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := conn.ReadFrom(buff)
+	if err != nil || string(buff[:n]) != "response" || from.String() != target.LocalAddr().String() {
+		t.Errorf("expected the response from %s, got %q from %v %v", target.LocalAddr(), buff[:n], from, err)
+	}
+}
+
+func TestProxyOnly(t *testing.T) {
+	t.Log("Testing that proxy-only mode refuses the udp an http proxy cannot carry")
+	p, err := Parse("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.ListenPacket()
+	if err != nil {
+		t.Fatal("expected direct udp when the proxy is not the only way out ", err)
+	}
+	conn.Close()
+	p.Only = true
+	_, err = p.ListenPacket()
+	if !errors.Is(err, ErrDirectRefused) || p.AllowsDirect() {
+		t.Errorf("expected direct connections to be refused, got %v", err)
+	}
+	var direct *Proxy
+	if !direct.AllowsDirect() {
+		t.Error("expected no proxy to allow direct connections")
+	}
+	_, err = Parse("ftp://127.0.0.1")
+	if err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// values of RFC 1928 and of the username and password authentication of RFC 1929
+const (
+	socksVersion       = 5
+	socksAuthNone      = 0
+	socksAuthPassword  = 2
+	socksNoAcceptable  = 0xFF
+	socksPasswordAuth  = 1
+	socksCmdConnect    = 1
+	socksCmdAssociate  = 3
+	socksAtypIPv4      = 1
+	socksAtypDomain    = 3
+	socksAtypIPv6      = 4
+	socksReplySuccess  = 0
+	socksUdpHeaderSize = 10
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksConnect asks the SOCKS5 proxy on conn to connect to address
+func (p *Proxy) socksConnect(conn net.Conn, address string) (net.Conn, error) {
+	err := p.socksAuthenticate(conn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.socksRequest(conn, socksCmdConnect, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socksAuthenticate offers the username and password authentication only when we have credentials
+func (p *Proxy) socksAuthenticate(conn net.Conn) error {
+	greeting := []byte{socksVersion, 1, socksAuthNone}
+	if p.username != "" {
+		greeting = []byte{socksVersion, 2, socksAuthNone, socksAuthPassword}
+	}
+	_, err := conn.Write(greeting)
+	if err != nil {
+		return err
+	}
+	choice := make([]byte, 2)
+	_, err = io.ReadFull(conn, choice)
+	if err != nil {
+		return err
+	}
+	if choice[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	switch choice[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthPassword:
+		if p.username == "" {
+			return fmt.Errorf("the proxy asked for credentials we do not have")
+		}
+		if len(p.username) > 255 || len(p.password) > 255 {
+			return fmt.Errorf("proxy username and password are limited to 255 bytes")
+		}
+		auth := []byte{socksPasswordAuth, byte(len(p.username))}
+		auth = append(auth, p.username...)
+		auth = append(auth, byte(len(p.password)))
+		auth = append(auth, p.password...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return err
+		}
+		status := make([]byte, 2)
+		_, err = io.ReadFull(conn, status)
+		if err != nil {
+			return err
+		}
+		if status[1] != 0 {
+			return fmt.Errorf("the proxy refused our credentials")
+		}
+		return nil
+	default:
+		return fmt.Errorf("no authentication method accepted by the proxy")
+	}
+}
+
+// socksRequest sends a command and returns the address of the reply, the one the proxy bound for it
+func (p *Proxy) socksRequest(conn net.Conn, command byte, address string) (*net.UDPAddr, error) {
+	request := []byte{socksVersion, command, 0}
+	request, err := appendSocksAddr(request, address)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 3)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply[1] != socksReplySuccess {
+		message, ok := socksReplies[reply[1]]
+		if !ok {
+			message = "error " + strconv.Itoa(int(reply[1]))
+		}
+		return nil, errors.New(message)
+	}
+	return readSocksAddr(conn)
+}
+
+// appendSocksAddr appends the address type, the address and the port, a host name is resolved by the proxy
+func appendSocksAddr(buff []byte, address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		buff = append(buff, socksAtypIPv4)
+		buff = append(buff, ip.To4()...)
+	case ip != nil:
+		buff = append(buff, socksAtypIPv6)
+		buff = append(buff, ip.To16()...)
+	case len(host) > 255:
+		return nil, fmt.Errorf("host name %s is too long", host)
+	default:
+		buff = append(buff, socksAtypDomain, byte(len(host)))
+		buff = append(buff, host...)
+	}
+	return binary.BigEndian.AppendUint16(buff, uint16(port)), nil
+}
+
+func readSocksAddr(reader io.Reader) (*net.UDPAddr, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(reader, atyp)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	switch atyp[0] {
+	case socksAtypIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socksAtypIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(reader, length)
+		if err != nil {
+			return nil, err
+		}
+		// the address of a reply is only used for UDP, where the proxy always answers with an ip
+		_, err = io.ReadFull(reader, make([]byte, length[0]+2))
+		return &net.UDPAddr{}, err
+	default:
+		return nil, fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	_, err = io.ReadFull(reader, ip)
+	if err != nil {
+		return nil, err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(reader, port)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
+
+// socksAssociate opens a UDP association, the datagrams are relayed by the proxy as long as the control
+// connection stays open
+func (p *Proxy) socksAssociate() (net.PacketConn, error) {
+	control, err := net.DialTimeout("tcp", p.address, handshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to proxy %s: %w", p.String(), err)
+	}
+	control.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = p.socksAuthenticate(control)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	// we do not know the address the proxy sees our datagrams from, zeros let it take the first one
+	relay, err := p.socksRequest(control, socksCmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("proxy %s refused the udp association: %w", p.String(), err)
+	}
+	control.SetDeadline(time.Time{})
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		// the relay listens on every address of the proxy
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	c := &socksPacketConn{UDPConn: conn, control: control, relay: relay}
+	go c.watchControl()
+	return c, nil
+}
+
+// socksPacketConn sends every datagram to the relay of the proxy, prefixed by the header with its destination
+type socksPacketConn struct {
+	*net.UDPConn
+	control   net.Conn
+	relay     *net.UDPAddr
+	closeOnce sync.Once
+}
+
+func (c *socksPacketConn) WriteTo(buff []byte, addr net.Addr) (int, error) {
+	packet, err := appendSocksAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	packet = append(packet, buff...)
+	_, err = c.UDPConn.WriteTo(packet, c.relay)
+	if err != nil {
+		return 0, err
+	}
+	return len(buff), nil
+}
+
+// ReadFrom returns the datagrams relayed by the proxy with the address they come from, the fragments and the
+// datagrams of anyone else are dropped
+func (c *socksPacketConn) ReadFrom(buff []byte) (int, net.Addr, error) {
+	packet := make([]byte, 65536)
+	for {
+		n, from, err := c.UDPConn.ReadFromUDP(packet)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port || n < socksUdpHeaderSize || packet[2] != 0 {
+			continue
+		}
+		reader := &sliceReader{buff: packet[3:n]}
+		addr, err := readSocksAddr(reader)
+		if err != nil {
+			continue
+		}
+		return copy(buff, reader.buff), addr, nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.control.Close()
+		err = c.UDPConn.Close()
+	})
+	return err
+}
+
+// watchControl closes the socket when the proxy closes the control connection, the association is over
+func (c *socksPacketConn) watchControl() {
+	io.Copy(io.Discard, c.control)
+	c.Close()
+}
+
+type sliceReader struct {
+	buff []byte
+}
+
+func (r *sliceReader) Read(buff []byte) (int, error) {
+	if len(r.buff) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buff, r.buff)
+	r.buff = r.buff[n:]
+	return n, nil
+}
@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// chunkSize is the most bytes read or written at once through a limited connection, so that a single call
+// does not take the whole budget of a second
+const chunkSize = 16 * 1024
+
+// Limiter is a token bucket filled with bytesPerSecond tokens every second, a limit of 0 means unlimited.
+// Taking more tokens than available leaves the bucket in debt, the caller waits until the debt is paid
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// changed is closed and replaced by SetLimit, it wakes the callers waiting at the old rate
+	changed chan struct{}
+}
+
+func NewLimiter(bytesPerSecond int) *Limiter {
+	l := &Limiter{}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit changes the limit, it can be called while transfers are running
+func (l *Limiter) SetLimit(bytesPerSecond int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the tokens earned at the old rate are kept
+	now := time.Now()
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	}
+	l.rate = float64(max(bytesPerSecond, 0))
+	// one second of traffic can be sent at once, never less than a chunk
+	l.burst = max(l.rate, chunkSize)
+	l.tokens = min(l.tokens, l.burst)
+	// lifting the limit forgives the debt
+	if l.rate == 0 {
+		l.tokens = 0
+	}
+	l.last = now
+	if l.changed != nil {
+		close(l.changed)
+	}
+	l.changed = make(chan struct{})
+}
+
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+// reserve takes n tokens and returns how long the caller has to wait before using them, with the rate and the
+// channel closed when the limit changes
+func (l *Limiter) reserve(n int) (time.Duration, float64, chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0, 0, l.changed
+	}
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, l.rate, l.changed
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), l.rate, l.changed
+}
+
+// WaitN blocks until n bytes can be transferred
+func (l *Limiter) WaitN(n int) {
+	l.wait(n, nil)
+}
+
+// wait blocks until n bytes can be transferred or stop is closed. When the limit changes the tokens still missing
+// are waited for at the new rate, so that lifting a limit wakes the callers paying a large debt
+func (l *Limiter) wait(n int, stop <-chan struct{}) {
+	if l == nil {
+		return
+	}
+	delay, rate, changed := l.reserve(n)
+	for delay > 0 {
+		deadline := time.Now().Add(delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			return
+		case <-stop:
+			timer.Stop()
+			return
+		case <-changed:
+			timer.Stop()
+			missing := time.Until(deadline).Seconds() * rate
+			_, rate, changed = l.reserve(0)
+			if rate == 0 || missing <= 0 {
+				return
+			}
+			delay = time.Duration(missing / rate * float64(time.Second))
+		}
+	}
+}
+
+// Limits are the download and upload limiters of a torrent or of the whole client
+type Limits struct {
+	Download *Limiter
+	Upload   *Limiter
+}
+
+// NewLimits returns the limiters of the given rates in bytes per second, 0 means unlimited
+func NewLimits(downloadBytesPerSecond, uploadBytesPerSecond int) *Limits {
+	return &Limits{
+		Download: NewLimiter(downloadBytesPerSecond),
+		Upload:   NewLimiter(uploadBytesPerSecond),
+	}
+}
+
+// Conn is a connection whose reads and writes respect every one of its limits
+type Conn struct {
+	net.Conn
+	limits []*Limits
+	// a message is written in chunks, the lock keeps the messages written by different goroutines whole
+	writeMu sync.Mutex
+	// closed ends the waits for the limits once the connection is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConn wraps the connection, nil limits are ignored
+func NewConn(conn net.Conn, limits ...*Limits) *Conn {
+	limitedConn := &Conn{Conn: conn, closed: make(chan struct{})}
+	for _, l := range limits {
+		if l != nil {
+			limitedConn.limits = append(limitedConn.limits, l)
+		}
+	}
+	return limitedConn
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b[:min(len(b), chunkSize)])
+	for _, l := range c.limits {
+		l.Download.wait(n, c.closed)
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(written+chunkSize, len(b))]
+		for _, l := range c.limits {
+			l.Upload.wait(len(chunk), c.closed)
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the connection and wakes its reads and writes waiting for the limits
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// Reader limits the download rate of a reader, used for the web seeds
+type Reader struct {
+	r      io.Reader
+	limits []*Limits
+}
+
+func NewReader(r io.Reader, limits ...*Limits) *Reader {
+	limitedReader := &Reader{r: r}
+	for _, l := range limits {
+		if l != nil {
+			limitedReader.limits = append(limitedReader.limits, l)
+		}
+	}
+	return limitedReader
+}
+
+func (r *Reader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b[:min(len(b), chunkSize)])
+	for _, l := range r.limits {
+		l.Download.WaitN(n)
+	}
+	return n, err
+}
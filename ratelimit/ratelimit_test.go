@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Log("Testing that the limiter waits for the tokens and that 0 is unlimited")
+	l := NewLimiter(100_000)
+	start := time.Now()
+	l.WaitN(30_000)
+	l.WaitN(20_000)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected 50000 bytes at 100000 bytes per second to take about half a second but took %s", elapsed)
+	}
+
+	l.SetLimit(0)
+	start = time.Now()
+	l.WaitN(10_000_000)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected no wait without a limit but waited %s", elapsed)
+	}
+	var nilLimiter *Limiter
+	nilLimiter.WaitN(100)
+}
+
+func TestLimiterWakeUp(t *testing.T) {
+	t.Log("Testing that lifting the limit and closing the connection end the waits for the tokens")
+	l := NewLimiter(1000)
+	waited := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		// a debt of about 100 seconds
+		l.WaitN(100_000)
+		waited <- time.Since(start)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.SetLimit(0)
+	select {
+	case elapsed := <-waited:
+		if elapsed > time.Second {
+			t.Error("expected the wait to end with the limit but took ", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected lifting the limit to wake the waiting caller")
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	limitedConn := NewConn(client, NewLimits(0, 1000))
+	written := make(chan error)
+	go func() {
+		_, err := limitedConn.Write(bytes.Repeat([]byte{1}, 100_000))
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	limitedConn.Close()
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Error("expected the write of a closed connection to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected closing the connection to wake the throttled write")
+	}
+}
+
+func TestConn(t *testing.T) {
+	t.Log("Testing that a limited connection respects the upload limit of every limit")
+	client, server := net.Pipe()
+	defer client.Close()
+	global := NewLimits(0, 0)
+	torrent := NewLimits(0, 200_000)
+	limitedConn := NewConn(client, global, nil, torrent)
+	data := bytes.Repeat([]byte{1}, 60_000)
+
+	received := make(chan []byte)
+	go func() {
+		buff, _ := io.ReadAll(io.LimitReader(server, int64(len(data))))
+		received <- buff
+	}()
+	start := time.Now()
+	n, err := limitedConn.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatal("expected the whole write to succeed ", n, err)
+	}
+	if !bytes.Equal(<-received, data) {
+		t.Error("expected the data to arrive unchanged")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected 60000 bytes at 200000 bytes per second to take about 300ms but took %s", elapsed)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	t.Log("Testing the parsing of a schedule rule")
+	rule, err := ParseRule("fri-mon 22:30-06:00 2k 500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Rule{
+		Days:     []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday},
+		Start:    22*time.Hour + 30*time.Minute,
+		End:      6 * time.Hour,
+		Download: 2048,
+		Upload:   500,
+	}
+	if !reflect.DeepEqual(rule, expected) {
+		t.Error("expected ", expected, " but got ", rule)
+	}
+	for _, invalid := range []string{"mon 09:00-18:00 1", "xyz 09:00-18:00 1 1", "mon 9-18 1 1", "mon 09:00-18:00 1x 1"} {
+		if _, err := ParseRule(invalid); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestScheduleApply(t *testing.T) {
+	t.Log("Testing that the schedule applies the limits of the matching rule")
+	workHours, _ := ParseRule("mon-fri 09:00-18:00 1000 100")
+	night, _ := ParseRule("fri 22:00-02:00 5000 500")
+	schedule := &Schedule{Rules: []Rule{workHours, night}, DefaultDownload: 0, DefaultUpload: 0}
+	limits := NewLimits(0, 0)
+
+	cases := []struct {
+		now      time.Time
+		download int
+		upload   int
+	}{
+		{time.Date(2024, 1, 3, 10, 0, 0, 0, time.Local), 1000, 100}, // wednesday morning
+		{time.Date(2024, 1, 3, 19, 0, 0, 0, time.Local), 0, 0},      // wednesday evening
+		{time.Date(2024, 1, 6, 1, 0, 0, 0, time.Local), 5000, 500},  // saturday night, window of friday
+		{time.Date(2024, 1, 7, 1, 0, 0, 0, time.Local), 0, 0},       // sunday night
+	}
+	for _, c := range cases {
+		schedule.Apply(limits, c.now)
+		if limits.Download.Limit() != c.download || limits.Upload.Limit() != c.upload {
+			t.Errorf("at %s expected limits %d and %d but got %d and %d", c.now, c.download, c.upload, limits.Download.Limit(), limits.Upload.Limit())
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Rule sets different limits during a time window of some days of the week
+type Rule struct {
+	Days []time.Weekday
+	// Start and End are offsets from midnight, a window with End before Start goes past midnight
+	Start    time.Duration
+	End      time.Duration
+	Download int
+	Upload   int
+}
+
+// Schedule applies the limits of the first rule matching the current time, or the default ones when none does
+type Schedule struct {
+	Rules           []Rule
+	DefaultDownload int
+	DefaultUpload   int
+}
+
+// ParseRule parses a rule like "mon-fri 09:00-18:00 500k 100k", days, time window and the download and upload limits
+func ParseRule(rule string) (Rule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 4 {
+		return Rule{}, fmt.Errorf("invalid rule %q, expected days, time window, download and upload limits", rule)
+	}
+	days, err := parseDays(fields[0])
+	if err != nil {
+		return Rule{}, err
+	}
+	startTime, endTime, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return Rule{}, fmt.Errorf("invalid time window %q", fields[1])
+	}
+	start, err := parseTimeOfDay(startTime)
+	if err != nil {
+		return Rule{}, err
+	}
+	end, err := parseTimeOfDay(endTime)
+	if err != nil {
+		return Rule{}, err
+	}
+	download, err := ParseRate(fields[2])
+	if err != nil {
+		return Rule{}, err
+	}
+	upload, err := ParseRate(fields[3])
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{Days: days, Start: start, End: end, Download: download, Upload: upload}, nil
+}
+
+// ParseRate parses a rate in bytes per second, with an optional k or m suffix for KiB and MiB per second
+func ParseRate(value string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(strings.ToLower(value), "k"):
+		multiplier = 1024
+	case strings.HasSuffix(strings.ToLower(value), "m"):
+		multiplier = 1024 * 1024
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	rate, err := strconv.Atoi(value)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return rate * multiplier, nil
+}
+
+// parseDays parses a comma separated list of days or day ranges, like "mon-fri" or "sat,sun"
+func parseDays(value string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, dayRange := range strings.Split(strings.ToLower(value), ",") {
+		first, last, isRange := strings.Cut(dayRange, "-")
+		if !isRange {
+			last = first
+		}
+		firstDay, ok := weekdays[first]
+		lastDay, lastOk := weekdays[last]
+		if !ok || !lastOk {
+			return nil, fmt.Errorf("invalid days %q", value)
+		}
+		for day := firstDay; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == lastDay {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected hh:mm", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func (r *Rule) matches(now time.Time) bool {
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	day := now.Weekday()
+	if r.End < r.Start && sinceMidnight < r.End {
+		// the early hours belong to the window that started the day before
+		day = (day + 6) % 7
+		sinceMidnight += 24 * time.Hour
+	}
+	end := r.End
+	if end < r.Start {
+		end += 24 * time.Hour
+	}
+	for _, ruleDay := range r.Days {
+		if ruleDay == day {
+			return sinceMidnight >= r.Start && sinceMidnight < end
+		}
+	}
+	return false
+}
+
+// Apply sets the limits that are valid at the given time
+func (s *Schedule) Apply(limits *Limits, now time.Time) {
+	download, upload := s.DefaultDownload, s.DefaultUpload
+	for _, rule := range s.Rules {
+		if rule.matches(now) {
+			download, upload = rule.Download, rule.Upload
+			break
+		}
+	}
+	if limits.Download.Limit() != download {
+		limits.Download.SetLimit(download)
+	}
+	if limits.Upload.Limit() != upload {
+		limits.Upload.SetLimit(upload)
+	}
+}
+
+// Run applies the schedule every minute until stop is closed
+func (s *Schedule) Run(limits *Limits, stop chan struct{}) {
+	s.Apply(limits, time.Now())
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.Apply(limits, now)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"main/daemon"
+	"main/p2p"
+	"main/ratelimit"
+	"main/session"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const remoteUsage = `USAGE: remote [-api url] command arguments
+  add [-save-path dir] [-paused] file.torrent|url|magnet
+  list
+  show id
+  pause id
+  resume id
+  remove [-delete-data] id
+  limit id download upload
+  priority id file skip|low|normal|high
+  peers id
+  trackers id
+  session
+  session-limit download upload
+the id is the info hash of a torrent or a unique prefix of it, the limits are in bytes per second with k and m
+suffixes for KiB and MiB and - keeps a limit as it is`
+
+// remote controls a daemon through its REST API
+func remote(args []string) {
+	flags := flag.NewFlagSet("remote", flag.ExitOnError)
+	apiUrl := flags.String("api", "http://127.0.0.1:9091", "address of the control API of the daemon")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		log.Fatal(remoteUsage)
+	}
+	client := daemon.NewClient(*apiUrl)
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "add":
+		addFlags := flag.NewFlagSet("add", flag.ExitOnError)
+		savePath := addFlags.String("save-path", "", "directory the torrent is downloaded in, the one of the daemon when empty")
+		paused := addFlags.Bool("paused", false, "add the torrent without starting it")
+		addFlags.Parse(commandArgs)
+		requireArgs(addFlags.Args(), 1)
+		options := session.AddOptions{SavePath: *savePath, Paused: *paused}
+		source := addFlags.Arg(0)
+		var status session.Status
+		var err error
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "magnet:") {
+			status, err = client.AddURL(source, options)
+		} else {
+			torrentData, readErr := os.ReadFile(source)
+			if readErr != nil {
+				log.Fatal(readErr)
+			}
+			status, err = client.AddFile(torrentData, options)
+		}
+		printStatus(status, err)
+	case "list":
+		statuses, err := client.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATE\tDONE\tDOWN\tUP\tPEERS\tNAME")
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s\t%s\t%.1f%%\t%s/s\t%s/s\t%d\t%s\n", status.InfoHash[:8], status.State, status.Progress*100,
+				formatBytes(status.DownloadRate), formatBytes(status.UploadRate), status.Peers, status.Name)
+		}
+		w.Flush()
+	case "show":
+		requireArgs(commandArgs, 1)
+		printStatus(client.Get(commandArgs[0]))
+	case "pause":
+		requireArgs(commandArgs, 1)
+		printStatus(client.Pause(commandArgs[0]))
+	case "resume":
+		requireArgs(commandArgs, 1)
+		printStatus(client.Resume(commandArgs[0]))
+	case "remove":
+		removeFlags := flag.NewFlagSet("remove", flag.ExitOnError)
+		deleteData := removeFlags.Bool("delete-data", false, "delete the downloaded data too")
+		removeFlags.Parse(commandArgs)
+		requireArgs(removeFlags.Args(), 1)
+		err := client.Remove(removeFlags.Arg(0), *deleteData)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "limit":
+		requireArgs(commandArgs, 3)
+		printStatus(client.SetLimits(commandArgs[0], parseLimit(commandArgs[1]), parseLimit(commandArgs[2])))
+	case "priority":
+		requireArgs(commandArgs, 3)
+		file, err := strconv.Atoi(commandArgs[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		priority, err := p2p.ParsePriority(commandArgs[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		printStatus(client.SetFilePriority(commandArgs[0], file, priority))
+	case "peers":
+		requireArgs(commandArgs, 1)
+		peers, err := client.Peers(commandArgs[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ADDRESS\tCONNECTED\tDOWNLOADED\tCHOKED\tINTERESTED\tHASH FAILURES")
+		for _, peerStatus := range peers {
+			fmt.Fprintf(w, "%s\t%t\t%s\t%t\t%t\t%d\n", peerStatus.Address, peerStatus.Connected, formatBytes(peerStatus.Downloaded),
+				peerStatus.Choked, peerStatus.Interested, peerStatus.HashFailures)
+		}
+		w.Flush()
+	case "trackers":
+		requireArgs(commandArgs, 1)
+		trackers, err := client.Trackers(commandArgs[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIER\tURL\tLAST ANNOUNCE\tPEERS\tSEEDERS\tLEECHERS\tERROR")
+		for _, tracker := range trackers {
+			lastAnnounce := "never"
+			if !tracker.LastAnnounce.IsZero() {
+				lastAnnounce = tracker.LastAnnounce.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%s\n", tracker.Tier, tracker.Url, lastAnnounce, tracker.Peers,
+				tracker.Seeders, tracker.Leechers, tracker.LastError)
+		}
+		w.Flush()
+	case "session":
+		printSessionStatus(client.Session())
+	case "session-limit":
+		requireArgs(commandArgs, 2)
+		printSessionStatus(client.SetSessionLimits(parseLimit(commandArgs[0]), parseLimit(commandArgs[1])))
+	default:
+		log.Fatal(remoteUsage)
+	}
+}
+
+func requireArgs(args []string, n int) {
+	if len(args) < n {
+		log.Fatal(remoteUsage)
+	}
+}
+
+// parseLimit reads a rate of the command line, nil for - which keeps the limit as it is
+func parseLimit(value string) *int {
+	if value == "-" {
+		return nil
+	}
+	limit, err := ratelimit.ParseRate(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &limit
+}
+
+func printStatus(status session.Status, err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\n  id: %s\n  state: %s", status.Name, status.InfoHash, status.State)
+	if status.Error != "" {
+		fmt.Printf(" (%s)", status.Error)
+	}
+	fmt.Printf("\n  progress: %.1f%% of %s, %s left\n", status.Progress*100, formatBytes(status.Size), formatBytes(status.Left))
+	fmt.Printf("  downloaded: %s at %s/s, uploaded: %s at %s/s\n", formatBytes(status.Downloaded), formatBytes(status.DownloadRate),
+		formatBytes(status.Uploaded), formatBytes(status.UploadRate))
+	fmt.Printf("  limits: %s down, %s up\n", formatLimit(status.DownloadLimit), formatLimit(status.UploadLimit))
+	fmt.Printf("  peers: %d, save path: %s\n", status.Peers, status.SavePath)
+	for i, file := range status.Files {
+		fmt.Printf("  file %d: %s (%s) %s\n", i, file.Path, formatBytes(file.Length), file.Priority)
+	}
+}
+
+func printSessionStatus(status daemon.SessionStatus, err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("torrents: %d, download dir: %s, peer port: %d\n", status.Torrents, status.DownloadDir, status.Port)
+	fmt.Printf("downloaded: %s, uploaded: %s\n", formatBytes(status.Downloaded), formatBytes(status.Uploaded))
+	fmt.Printf("limits: %s down, %s up\n", formatLimit(status.DownloadLimit), formatLimit(status.UploadLimit))
+}
+
+func formatLimit(limit int) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return formatBytes(int64(limit)) + "/s"
+}
+
+// formatBytes writes a size with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,488 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"main/logging"
+	"main/lsd"
+	"main/p2p"
+	"main/peer"
+	"main/portmap"
+	"main/proxy"
+	"main/ratelimit"
+	"main/torrentfile"
+	"main/utp"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTorrentSize is the biggest .torrent file fetched from an url
+	maxTorrentSize = 16 << 20
+	fetchTimeout   = 30 * time.Second
+	// defaultMetadataTimeout is how long the peers of a magnet link have to send its metadata
+	defaultMetadataTimeout = time.Minute
+	rateInterval           = time.Second
+)
+
+var (
+	ErrNotFound  = errors.New("torrent not found")
+	ErrDuplicate = errors.New("torrent already added")
+	// ErrUnavailable wraps the failures that can go away on their own, like a magnet link whose peers did not send
+	// the metadata or an url that could not be fetched
+	ErrUnavailable = errors.New("torrent unavailable")
+)
+
+// Options are the services shared by the torrents of a session and the defaults of the torrents added to it
+type Options struct {
+	// DownloadDir is where the torrents added without a save path are downloaded
+	DownloadDir string
+	// Port is the listening port of the peers, for both TCP and uTP, 0 picks a free one
+	Port uint16
+	// Encryption is the MSE policy of the connections, outgoing and incoming
+	Encryption peer.Encryption
+	// UseUTP, LocalDiscovery and MapPort start the shared uTP socket, BEP 14 discovery and port mapping
+	UseUTP         bool
+	LocalDiscovery bool
+	MapPort        bool
+	// AnnounceToAllTiers, UploadSlots and MaxConnections are the settings of every torrent
+	AnnounceToAllTiers bool
+	UploadSlots        int
+	MaxConnections     int
+	// Conns limits the connections of all the torrents together, when nil the session creates one with the
+	// default limits
+	Conns *p2p.ConnManager
+	// Proxy carries the connections to the peers, to the web seeds and the .torrent files fetched from urls
+	Proxy *proxy.Proxy
+	// Logger receives what happens to the session and to its torrents, nil discards it
+	Logger *slog.Logger
+	// WatchDir is polled for .torrent and .magnet files to add, none is watched when empty
+	WatchDir string
+	// WatchInterval is how often the watch directory is polled, defaultWatchInterval when 0
+	WatchInterval time.Duration
+	// MetadataTimeout is how long the peers of a magnet link have to send its metadata, defaultMetadataTimeout
+	// when 0
+	MetadataTimeout time.Duration
+}
+
+// AddOptions are the settings of a torrent being added
+type AddOptions struct {
+	// SavePath is the directory the torrent is downloaded in, the DownloadDir of the session when empty
+	SavePath string
+	// Paused adds the torrent without starting it
+	Paused bool
+}
+
+// Session runs many torrents at once on a single listener, uTP socket, local discovery and port mapping, with
+// limits shared by all of them. Its torrents can be paused, resumed and removed while the session runs
+type Session struct {
+	options     Options
+	listener    *peer.Listener
+	utp         *utp.Socket
+	lsd         *lsd.Service
+	portMapping *portmap.Service
+	limits      *ratelimit.Limits
+	stop        chan struct{}
+	// imports are the .magnet files of the watch directory being imported, Close waits for them
+	imports sync.WaitGroup
+
+	mu          sync.Mutex
+	torrents    map[[20]byte]*Torrent
+	closed      bool
+	downloadDir string
+	// importing are the paths of the .magnet files whose metadata is being downloaded, retries the ones whose
+	// metadata did not come and that are imported again later
+	importing map[string]bool
+	retries   map[string]watchRetry
+}
+
+// New starts the shared services, the ones that fail are logged and the session goes on without them
+func New(options Options) *Session {
+	if options.Conns == nil {
+		options.Conns = p2p.NewConnManager(0, 0)
+	}
+	s := &Session{
+		options:   options,
+		limits:    ratelimit.NewLimits(0, 0),
+		stop:      make(chan struct{}),
+		torrents:  make(map[[20]byte]*Torrent),
+		importing: make(map[string]bool),
+		retries:   make(map[string]watchRetry),
+		// the download dir can be changed while the session runs
+		downloadDir: options.DownloadDir,
+	}
+	// behind a proxy-only setup nobody can reach us and the local network must not see us
+	if !options.Proxy.AllowsDirect() {
+		s.startLoops()
+		return s
+	}
+	listener, err := peer.Listen(options.Port)
+	if err != nil {
+		s.logger().Warn("impossible to accept incoming peers", "error", err)
+	} else {
+		listener.SetEncryption(options.Encryption)
+		listener.SetLogger(options.Logger)
+		s.listener = listener
+		options.Port = listener.Port()
+	}
+	if options.UseUTP {
+		socket, err := utp.Listen("udp", net.JoinHostPort("", strconv.Itoa(int(options.Port))))
+		if err != nil {
+			s.logger().Warn("impossible to use uTP", "error", err)
+		} else {
+			socket.SetLogger(options.Logger)
+			if s.listener != nil {
+				s.listener.Serve(socket)
+			}
+			s.utp = socket
+		}
+	}
+	if options.LocalDiscovery {
+		localDiscovery, err := lsd.New(options.Port)
+		if err != nil {
+			s.logger().Warn("impossible to discover peers on the local network", "error", err)
+		} else {
+			localDiscovery.SetLogger(options.Logger)
+			s.lsd = localDiscovery
+		}
+	}
+	// a mapping is useless when nobody can connect to us
+	if options.MapPort && s.listener != nil {
+		portMapping, err := portmap.Start(options.Port, portmap.Options{Logger: options.Logger})
+		if err != nil {
+			s.logger().Warn("impossible to map the listening port", "error", err)
+		} else {
+			s.portMapping = portMapping
+		}
+	}
+	s.startLoops()
+	return s
+}
+
+func (s *Session) logger() *slog.Logger {
+	return logging.Or(s.options.Logger)
+}
+
+// Port returns the port the peers connect to, 0 when incoming peers are not accepted
+func (s *Session) Port() uint16 {
+	if s.listener == nil {
+		return 0
+	}
+	return s.listener.Port()
+}
+
+// DownloadDir returns where the torrents added without a save path are downloaded
+func (s *Session) DownloadDir() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloadDir
+}
+
+// SetDownloadDir changes where the torrents added from now on without a save path are downloaded
+func (s *Session) SetDownloadDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloadDir = dir
+}
+
+// Add adds the torrent of a .torrent file and starts it unless it is added paused. A torrent that is already in
+// the session is returned together with ErrDuplicate
+func (s *Session) Add(torrentData []byte, options AddOptions) (*Torrent, error) {
+	file, err := torrentfile.ParseTorrent(torrentData)
+	if err != nil {
+		return nil, err
+	}
+	return s.addFile(file, options)
+}
+
+// addFile adds a parsed torrent with the services and the settings of the session
+func (s *Session) addFile(file *torrentfile.TorrentFile, options AddOptions) (*Torrent, error) {
+	if options.SavePath == "" {
+		options.SavePath = s.DownloadDir()
+	}
+	s.configure(file)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("session closed")
+	}
+	if existing, ok := s.torrents[file.InfoHash]; ok {
+		return existing, ErrDuplicate
+	}
+	t := &Torrent{
+		session:  s,
+		file:     file,
+		savePath: options.SavePath,
+		addedAt:  time.Now(),
+		state:    StatePaused,
+	}
+	s.torrents[file.InfoHash] = t
+	s.logger().Info("torrent added", "name", file.Name, logging.InfoHash(file.InfoHash), "save_path", options.SavePath)
+	if !options.Paused {
+		t.mu.Lock()
+		t.start()
+		t.mu.Unlock()
+	}
+	return t, nil
+}
+
+// configure gives a torrent the services and the settings of the session
+func (s *Session) configure(file *torrentfile.TorrentFile) {
+	file.AnnounceToAllTiers = s.options.AnnounceToAllTiers
+	file.UploadSlots = s.options.UploadSlots
+	file.MaxConnections = s.options.MaxConnections
+	file.Conns = s.options.Conns
+	file.Encryption = s.options.Encryption
+	file.Proxy = s.options.Proxy
+	file.Logger = s.options.Logger
+	file.GlobalLimits = s.limits
+	file.Limits = ratelimit.NewLimits(0, 0)
+	// the torrents only use the services of the session, the ones that failed to start stay off
+	file.Listener = s.listener
+	file.LocalDiscovery = false
+	file.LSD = s.lsd
+	file.UseUTP = s.utp != nil
+	file.UTP = s.utp
+	file.MapPort = false
+	file.PortMapping = s.portMapping
+}
+
+// AddURL fetches a .torrent file and adds it, the metadata of a magnet link is downloaded from its peers first
+func (s *Session) AddURL(torrentUrl string, options AddOptions) (*Torrent, error) {
+	if strings.HasPrefix(torrentUrl, "magnet:") {
+		return s.addMagnet(torrentUrl, options)
+	}
+	response, err := s.options.Proxy.HTTPClient(fetchTimeout).Get(torrentUrl)
+	if err != nil {
+		return nil, fmt.Errorf("%w, impossible to fetch the torrent: %w", ErrUnavailable, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("%w, impossible to fetch the torrent: %s", ErrUnavailable, response.Status)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("impossible to fetch the torrent: %s", response.Status)
+	}
+	torrentData, err := io.ReadAll(io.LimitReader(response.Body, maxTorrentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("impossible to fetch the torrent: %w", err)
+	}
+	if len(torrentData) > maxTorrentSize {
+		return nil, fmt.Errorf("impossible to fetch the torrent: bigger than %d bytes", maxTorrentSize)
+	}
+	return s.Add(torrentData, options)
+}
+
+// addMagnet downloads the metadata of a magnet link with the services of the session and adds its torrent, the
+// download stops when the session is closed. A torrent that is already in the session is returned without asking
+// the peers
+func (s *Session) addMagnet(link string, options AddOptions) (*Torrent, error) {
+	file, err := torrentfile.ParseMagnet(link)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	existing, ok := s.torrents[file.InfoHash]
+	closed := s.closed
+	s.mu.Unlock()
+	switch {
+	case closed:
+		return nil, errors.New("session closed")
+	case ok:
+		return existing, ErrDuplicate
+	}
+	s.configure(file)
+	ctx, cancel := context.WithTimeout(context.Background(), s.metadataTimeout())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err = file.FetchMetadata(ctx)
+	if errors.Is(err, torrentfile.ErrNoMetadata) {
+		return nil, fmt.Errorf("%w, %w", ErrUnavailable, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.addFile(file, options)
+}
+
+func (s *Session) metadataTimeout() time.Duration {
+	if s.options.MetadataTimeout == 0 {
+		return defaultMetadataTimeout
+	}
+	return s.options.MetadataTimeout
+}
+
+// List returns the torrents in the order they were added
+func (s *Session) List() []*Torrent {
+	s.mu.Lock()
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(torrents, func(a, b *Torrent) int {
+		if c := a.addedAt.Compare(b.addedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.file.InfoHash[:], b.file.InfoHash[:])
+	})
+	return torrents
+}
+
+// Get returns the torrent of the info hash
+func (s *Session) Get(infoHash [20]byte) (*Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// Find returns the torrent whose hex info hash starts with prefix, the prefix must match a single torrent
+func (s *Session) Find(prefix string) (*Torrent, error) {
+	prefix = strings.ToLower(prefix)
+	var found *Torrent
+	for _, t := range s.List() {
+		if !strings.HasPrefix(hex.EncodeToString(t.file.InfoHash[:]), prefix) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("more than one torrent starts with %q", prefix)
+		}
+		found = t
+	}
+	if prefix == "" || found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// Remove stops the torrent and removes it from the session, with deleteData its downloaded data is deleted too
+func (s *Session) Remove(infoHash [20]byte, deleteData bool) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	t.stopDownload(true)
+	s.logger().Info("torrent removed", "name", t.file.Name, logging.InfoHash(infoHash), "delete_data", deleteData)
+	if !deleteData {
+		return nil
+	}
+	err := os.RemoveAll(filepath.Join(t.savePath, t.file.Name))
+	if err != nil {
+		return fmt.Errorf("impossible to delete the data of the torrent: %w", err)
+	}
+	return nil
+}
+
+// SetLimits changes the download and upload limits shared by every torrent, in bytes per second, 0 is unlimited
+func (s *Session) SetLimits(download, upload int) {
+	s.limits.Download.SetLimit(download)
+	s.limits.Upload.SetLimit(upload)
+}
+
+// Limits returns the download and upload limits shared by every torrent
+func (s *Session) Limits() (int, int) {
+	return s.limits.Download.Limit(), s.limits.Upload.Limit()
+}
+
+// Totals returns the piece bytes downloaded and uploaded by every torrent of the session
+func (s *Session) Totals() (int64, int64) {
+	var downloaded, uploaded int64
+	for _, t := range s.List() {
+		if stats := t.file.Stats(); stats != nil {
+			downloaded += stats.Downloaded()
+			uploaded += stats.Uploaded()
+		}
+	}
+	return downloaded, uploaded
+}
+
+// Close stops every torrent and the shared services
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	s.mu.Unlock()
+	close(s.stop)
+	var wg sync.WaitGroup
+	for _, t := range torrents {
+		wg.Add(1)
+		go func(t *Torrent) {
+			defer wg.Done()
+			t.stopDownload(true)
+		}(t)
+	}
+	wg.Wait()
+	// the metadata of the magnet links is downloaded with the services closed below
+	s.imports.Wait()
+	var errs []error
+	if s.portMapping != nil {
+		errs = append(errs, s.portMapping.Close())
+	}
+	if s.lsd != nil {
+		errs = append(errs, s.lsd.Close())
+	}
+	if s.utp != nil {
+		errs = append(errs, s.utp.Close())
+	}
+	if s.listener != nil {
+		errs = append(errs, s.listener.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// startLoops starts the background work of the session once its services are set
+func (s *Session) startLoops() {
+	go s.rateLoop()
+	if s.options.WatchDir != "" {
+		go s.watchLoop()
+	}
+}
+
+// rateLoop samples the counters of the torrents to compute their transfer rates
+func (s *Session) rateLoop() {
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, t := range s.List() {
+				t.sampleRates()
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
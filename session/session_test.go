@@ -0,0 +1,267 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"main/bencode"
+	"main/p2p"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTorrent returns a .torrent file of data downloadable from the web seed, its tracker does not answer
+func testTorrent(t *testing.T, name string, data []byte, webSeed string) []byte {
+	pieceLength := 16
+	var pieces []byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		hash := sha1.Sum(data[begin:min(begin+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	torrentData, err := bencode.Encode(map[string]interface{}{
+		"announce": "http://127.0.0.1:1/announce",
+		"url-list": webSeed,
+		"info": map[string]interface{}{
+			"name":         name,
+			"length":       len(data),
+			"piece length": pieceLength,
+			"pieces":       string(pieces),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrentData
+}
+
+// waitForState polls the torrent until it reaches the state
+func waitForState(t *testing.T, torrent *Torrent, state State) Status {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := torrent.Status()
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the torrent %s but it is %s %s", state, status.State, status.Error)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSession(t *testing.T) {
+	t.Log("Testing adding, downloading, pausing and removing torrents")
+	data := []byte("the content of the torrent, a few pieces long")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	session := New(Options{DownloadDir: t.TempDir()})
+	defer session.Close()
+
+	torrentData := testTorrent(t, "file.txt", data, server.URL+"/file.txt")
+	torrent, err := session.Add(torrentData, AddOptions{Paused: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := torrent.Status()
+	if status.State != StatePaused || status.Left != int64(len(data)) || len(status.Files) != 1 ||
+		status.Files[0].Priority != p2p.PriorityNormal {
+		t.Error("wrong status of a paused torrent ", status)
+	}
+	if _, err := session.Add(torrentData, AddOptions{}); !errors.Is(err, ErrDuplicate) {
+		t.Error("expected ErrDuplicate but got ", err)
+	}
+	if _, err := session.Add([]byte("garbage"), AddOptions{}); err == nil {
+		t.Error("expected an error adding an invalid torrent")
+	}
+	if _, err := session.AddURL("magnet:?xt=urn:btih:"+torrent.Status().InfoHash, AddOptions{}); !errors.Is(err, ErrDuplicate) {
+		t.Error("expected ErrDuplicate for the magnet link of the torrent but got ", err)
+	}
+	// nobody can send the metadata of a magnet link without trackers when the local discovery is off
+	if _, err := session.AddURL("magnet:?xt=urn:btih:0000000000000000000000000000000000000000", AddOptions{}); err == nil {
+		t.Error("expected an error for a magnet link without peers")
+	}
+
+	torrent.SetLimits(1000, 500)
+	torrent.Resume()
+	status = waitForState(t, torrent, StateCompleted)
+	if status.Left != 0 || status.Progress != 1 || status.DownloadLimit != 1000 || status.UploadLimit != 500 {
+		t.Error("wrong status of a completed torrent ", status)
+	}
+	outputPath := filepath.Join(session.DownloadDir(), "file.txt")
+	downloaded, _ := os.ReadFile(outputPath)
+	if !bytes.Equal(downloaded, data) {
+		t.Errorf("expected %q but got %q", data, downloaded)
+	}
+	found, err := session.Find(status.InfoHash[:6])
+	if err != nil || found != torrent {
+		t.Error("expected to find the torrent by a prefix of its info hash ", err)
+	}
+
+	err = session.Remove(torrent.InfoHash(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Error("expected the data to be deleted but got ", err)
+	}
+	if _, err := session.Get(torrent.InfoHash()); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound but got ", err)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	t.Log("Testing that a paused torrent stops at once and resumes from where it was")
+	data := []byte("0123456789abcdef0123456789ABCDEF")
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	releaseAll := func() {
+		releaseOnce.Do(func() { close(release) })
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first piece is served at once, the second one only after the pause
+		if r.Header.Get("Range") != "bytes=0-15" {
+			<-release
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	defer releaseAll()
+	session := New(Options{DownloadDir: t.TempDir()})
+	defer session.Close()
+
+	torrent, err := session.Add(testTorrent(t, "file.bin", data, server.URL+"/file.bin"), AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for torrent.Status().Left != 16 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first piece was not downloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	paused := make(chan struct{})
+	go func() {
+		torrent.Pause()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the torrent did not pause")
+	}
+	if status := torrent.Status(); status.State != StatePaused || status.Left != 16 {
+		t.Error("wrong status of a paused torrent ", status)
+	}
+
+	releaseAll()
+	torrent.Resume()
+	waitForState(t, torrent, StateCompleted)
+	downloaded, _ := os.ReadFile(filepath.Join(session.DownloadDir(), "file.bin"))
+	if !bytes.Equal(downloaded, data) {
+		t.Errorf("expected %q but got %q", data, downloaded)
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	t.Log("Testing that the files dropped in the watch directory are added, marked invalid or tried again later")
+	// a tracker that never answers leaves the metadata of a magnet link to time out
+	release := make(chan struct{})
+	var announces atomic.Int32
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces.Add(1)
+		<-release
+	}))
+	defer tracker.Close()
+	defer close(release)
+	watchDir := t.TempDir()
+	data := []byte("the content of the watched torrent")
+	torrentData := testTorrent(t, "watched.txt", data, "http://127.0.0.1:1/watched.txt")
+	os.WriteFile(filepath.Join(watchDir, "good.torrent"), torrentData, 0644)
+	os.WriteFile(filepath.Join(watchDir, "bad.torrent"), []byte("garbage"), 0644)
+	os.WriteFile(filepath.Join(watchDir, "link.magnet"), []byte("magnet:?xt=urn:btih:0000000000000000000000000000000000000000\n"), 0644)
+	os.WriteFile(filepath.Join(watchDir, "broken.magnet"), []byte("magnet:?xt=urn:btih:abcd"), 0644)
+	os.WriteFile(filepath.Join(watchDir, "slow.magnet"), []byte("magnet:?xt=urn:btih:"+strings.Repeat("1", 40)+"&tr="+tracker.URL+"/announce"), 0644)
+	os.WriteFile(filepath.Join(watchDir, "notes.txt"), []byte("not a torrent"), 0644)
+	session := New(Options{DownloadDir: t.TempDir(), WatchDir: watchDir, WatchInterval: 10 * time.Millisecond,
+		MetadataTimeout: 100 * time.Millisecond})
+	defer session.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, goodErr := os.Stat(filepath.Join(watchDir, "good.torrent.added"))
+		_, badErr := os.Stat(filepath.Join(watchDir, "bad.torrent.invalid"))
+		_, magnetErr := os.Stat(filepath.Join(watchDir, "broken.magnet.invalid"))
+		// the magnet link whose metadata timed out is announced again
+		if goodErr == nil && badErr == nil && magnetErr == nil && announces.Load() >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the watched files were not imported ", goodErr, badErr, magnetErr, announces.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	torrents := session.List()
+	if len(torrents) != 1 || torrents[0].Name() != "watched.txt" || torrents[0].Status().SavePath != session.DownloadDir() {
+		t.Error("expected the good torrent to be added with the default save path ", torrents)
+	}
+	report, _ := os.ReadFile(filepath.Join(watchDir, "broken.magnet.error"))
+	if !bytes.Contains(report, []byte("invalid info hash")) {
+		t.Errorf("wrong error report of the magnet link %q", report)
+	}
+	if report, _ := os.ReadFile(filepath.Join(watchDir, "bad.torrent.error")); len(report) == 0 {
+		t.Error("expected an error report of the invalid torrent")
+	}
+	if _, err := os.Stat(filepath.Join(watchDir, "notes.txt")); err != nil {
+		t.Error("expected the other files to be left alone ", err)
+	}
+	for _, name := range []string{"link.magnet", "slow.magnet"} {
+		if _, err := os.Stat(filepath.Join(watchDir, name)); err != nil {
+			t.Error("expected the magnet link without metadata to be left alone ", err)
+		}
+		if _, err := os.Stat(filepath.Join(watchDir, name+".error")); err == nil {
+			t.Error("expected no error report of the magnet link without metadata ", name)
+		}
+	}
+
+	// the same torrent dropped again is already in the session
+	os.WriteFile(filepath.Join(watchDir, "again.torrent"), torrentData, 0644)
+	for {
+		if _, err := os.Stat(filepath.Join(watchDir, "again.torrent.added")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the duplicate torrent was not imported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(session.List()) != 1 {
+		t.Error("expected the duplicate torrent not to be added twice")
+	}
+
+	// the magnet link of a torrent of the session needs no metadata
+	os.WriteFile(filepath.Join(watchDir, "again.magnet"), []byte("magnet:?xt=urn:btih:"+session.List()[0].Status().InfoHash), 0644)
+	for {
+		if _, err := os.Stat(filepath.Join(watchDir, "again.magnet.added")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the magnet link of the duplicate torrent was not imported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// closing the session stops the import, the magnet link is imported again at the next start
+	session.Close()
+	if _, err := os.Stat(filepath.Join(watchDir, "slow.magnet")); err != nil {
+		t.Error("expected the magnet link of a stopped import to be left alone ", err)
+	}
+}
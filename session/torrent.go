@@ -0,0 +1,235 @@
+package session
+
+import (
+	"context"
+	"encoding/hex"
+	"main/logging"
+	"main/p2p"
+	"main/torrentfile"
+	"path"
+	"sync"
+	"time"
+)
+
+// State is what a torrent of the session is doing
+type State string
+
+const (
+	StateDownloading State = "downloading"
+	StatePaused      State = "paused"
+	// StateCompleted torrents have every wanted piece, they are not seeded
+	StateCompleted State = "completed"
+	// StateError torrents stopped on an error, resuming them tries again
+	StateError State = "error"
+)
+
+// Torrent is a torrent of the session, its methods are safe to call while it downloads
+type Torrent struct {
+	session  *Session
+	file     *torrentfile.TorrentFile
+	savePath string
+	addedAt  time.Time
+
+	mu    sync.Mutex
+	state State
+	err   error
+	// removed torrents are never started again
+	removed bool
+	// cancel stops the running download, done is closed once it returned
+	cancel context.CancelFunc
+	done   chan struct{}
+	// the rates are the bytes transferred during the last rateInterval
+	downloadRate   int64
+	uploadRate     int64
+	lastDownloaded int64
+	lastUploaded   int64
+}
+
+// Status is a snapshot of a torrent of the session
+type Status struct {
+	InfoHash      string       `json:"info_hash"`
+	Name          string       `json:"name"`
+	State         State        `json:"state"`
+	Error         string       `json:"error,omitempty"`
+	SavePath      string       `json:"save_path"`
+	Size          int64        `json:"size"`
+	Left          int64        `json:"left"`
+	Progress      float64      `json:"progress"`
+	Downloaded    int64        `json:"downloaded"`
+	Uploaded      int64        `json:"uploaded"`
+	DownloadRate  int64        `json:"download_rate"`
+	UploadRate    int64        `json:"upload_rate"`
+	DownloadLimit int          `json:"download_limit"`
+	UploadLimit   int          `json:"upload_limit"`
+	Peers         int          `json:"peers"`
+	Private       bool         `json:"private"`
+	AddedAt       time.Time    `json:"added_at"`
+	Files         []FileStatus `json:"files"`
+}
+
+// FileStatus is a file of a torrent, a single-file torrent has one named after the torrent
+type FileStatus struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	// Completed are the bytes of the file in verified pieces, as of the last download when it is not running
+	Completed int64        `json:"completed"`
+	Priority  p2p.Priority `json:"priority"`
+}
+
+func (t *Torrent) InfoHash() [20]byte {
+	return t.file.InfoHash
+}
+
+func (t *Torrent) Name() string {
+	return t.file.Name
+}
+
+// start runs the download in the background, the caller must hold t.mu
+func (t *Torrent) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.state, t.err = StateDownloading, nil
+	t.cancel, t.done = cancel, done
+	go func() {
+		err := t.file.DownloadContext(ctx, t.savePath)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		switch {
+		case ctx.Err() != nil:
+			t.state = StatePaused
+		case err != nil:
+			t.state, t.err = StateError, err
+			t.session.logger().Warn("download failed", "name", t.file.Name, logging.InfoHash(t.file.InfoHash), "error", err)
+		default:
+			t.state = StateCompleted
+			t.session.logger().Info("download completed", "name", t.file.Name, logging.InfoHash(t.file.InfoHash))
+		}
+		cancel()
+		t.cancel = nil
+		t.downloadRate, t.uploadRate = 0, 0
+		close(done)
+	}()
+}
+
+// Pause stops the download and waits for its peers to be disconnected, the pieces already downloaded are kept
+func (t *Torrent) Pause() {
+	t.stopDownload(false)
+}
+
+// stopDownload stops the running download and waits for it, a removed torrent cannot be resumed
+func (t *Torrent) stopDownload(remove bool) {
+	t.mu.Lock()
+	t.removed = t.removed || remove
+	cancel, done := t.cancel, t.done
+	t.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Resume starts the download again, the data already on disk is checked and only the missing pieces are downloaded
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil || t.removed {
+		return
+	}
+	t.start()
+}
+
+// SetFilePriority changes the priority of a file, a completed torrent is started again when a skipped file of it
+// becomes wanted
+func (t *Torrent) SetFilePriority(file int, priority p2p.Priority) error {
+	err := t.file.SetFilePriority(file, priority)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == StateCompleted && priority != p2p.PrioritySkip && !t.removed {
+		t.start()
+	}
+	return nil
+}
+
+// SetLimits changes the download and upload limits of the torrent, in bytes per second, 0 is unlimited
+func (t *Torrent) SetLimits(download, upload int) {
+	t.file.Limits.Download.SetLimit(download)
+	t.file.Limits.Upload.SetLimit(upload)
+}
+
+// Peers returns the peers of the torrent, none when it is not downloading
+func (t *Torrent) Peers() []p2p.PeerStatus {
+	return t.file.PeerStatuses()
+}
+
+// Trackers returns the trackers of the torrent with the outcome of their last announce
+func (t *Torrent) Trackers() []torrentfile.TrackerStatus {
+	return t.file.TrackerStatus()
+}
+
+func (t *Torrent) Status() Status {
+	size := int64(t.file.Length)
+	status := Status{
+		InfoHash:      hex.EncodeToString(t.file.InfoHash[:]),
+		Name:          t.file.Name,
+		SavePath:      t.savePath,
+		Size:          size,
+		Left:          size,
+		DownloadLimit: t.file.Limits.Download.Limit(),
+		UploadLimit:   t.file.Limits.Upload.Limit(),
+		Private:       t.file.Private,
+		AddedAt:       t.addedAt,
+	}
+	if stats := t.file.Stats(); stats != nil {
+		status.Left = stats.Left()
+		status.Downloaded = stats.Downloaded()
+		status.Uploaded = stats.Uploaded()
+	}
+	if size > 0 {
+		status.Progress = float64(size-status.Left) / float64(size)
+	}
+	for _, peerStatus := range t.file.PeerStatuses() {
+		if peerStatus.Connected {
+			status.Peers++
+		}
+	}
+	progress := t.file.FileProgress()
+	if len(t.file.Files) == 0 {
+		status.Files = []FileStatus{{Path: t.file.Name, Length: size, Completed: progress[0], Priority: t.file.FilePriority(0)}}
+	}
+	for i, file := range t.file.Files {
+		status.Files = append(status.Files, FileStatus{
+			Path:      path.Join(append([]string{t.file.Name}, file.Path...)...),
+			Length:    int64(file.Length),
+			Completed: progress[i],
+			Priority:  t.file.FilePriority(i),
+		})
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status.State = t.state
+	if t.err != nil {
+		status.Error = t.err.Error()
+	}
+	status.DownloadRate, status.UploadRate = t.downloadRate, t.uploadRate
+	return status
+}
+
+// sampleRates computes the rates from the bytes transferred since the previous sample
+func (t *Torrent) sampleRates() {
+	stats := t.file.Stats()
+	if stats == nil {
+		return
+	}
+	downloaded, uploaded := stats.Downloaded(), stats.Uploaded()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil {
+		t.downloadRate = (downloaded - t.lastDownloaded) * int64(time.Second) / int64(rateInterval)
+		t.uploadRate = (uploaded - t.lastUploaded) * int64(time.Second) / int64(rateInterval)
+	}
+	t.lastDownloaded, t.lastUploaded = downloaded, uploaded
+}
@@ -0,0 +1,199 @@
+package session
+
+import (
+	"errors"
+	"main/torrentfile"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWatchInterval = 2 * time.Second
+	// the imported files are renamed with these suffixes, the error of an invalid one is written next to it
+	addedSuffix   = ".added"
+	invalidSuffix = ".invalid"
+	errorSuffix   = ".error"
+	// maxRetryDelay bounds the wait before a magnet link whose metadata did not come is tried again
+	maxRetryDelay = time.Hour
+)
+
+// watchedFile is the size and the modification time of a file of the watch directory, a file is only imported once
+// they stop changing between two scans so that a file still being written is not read half way
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchRetry is when a watched file whose torrent was unavailable is imported again, the delay doubles at every
+// failure
+type watchRetry struct {
+	delay time.Duration
+	next  time.Time
+}
+
+// watchLoop polls the watch directory until the session is closed, the standard library has no notifications of
+// the changes of a directory that work everywhere
+func (s *Session) watchLoop() {
+	interval := s.options.WatchInterval
+	if interval == 0 {
+		interval = defaultWatchInterval
+	}
+	err := os.MkdirAll(s.options.WatchDir, 0755)
+	if err != nil {
+		s.logger().Warn("impossible to create the watch directory", "dir", s.options.WatchDir, "error", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	seen := make(map[string]watchedFile)
+	for {
+		seen = s.scanWatchDir(seen)
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// scanWatchDir imports the .torrent and .magnet files that did not change since the previous scan and returns the
+// ones that are still waiting
+func (s *Session) scanWatchDir(previous map[string]watchedFile) map[string]watchedFile {
+	entries, err := os.ReadDir(s.options.WatchDir)
+	if err != nil {
+		s.logger().Warn("impossible to read the watch directory", "dir", s.options.WatchDir, "error", err)
+		return previous
+	}
+	waiting := make(map[string]watchedFile)
+	for _, entry := range entries {
+		name := entry.Name()
+		extension := strings.ToLower(filepath.Ext(name))
+		// the hidden files are usually the ones being copied
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || (extension != ".torrent" && extension != ".magnet") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		current := watchedFile{size: info.Size(), modTime: info.ModTime()}
+		if last, ok := previous[name]; !ok || last != current {
+			waiting[name] = current
+			continue
+		}
+		// the metadata of a magnet link can take a minute to come, the other files are not kept waiting for it
+		if extension == ".magnet" {
+			s.importMagnetFile(filepath.Join(s.options.WatchDir, name))
+			continue
+		}
+		// a closed session refuses the torrents, they must not be marked invalid for it
+		select {
+		case <-s.stop:
+			return waiting
+		default:
+		}
+		s.importWatchedFile(filepath.Join(s.options.WatchDir, name))
+	}
+	return waiting
+}
+
+// importWatchedFile adds the torrent of a file with the default options and renames the file with the outcome, a
+// torrent that is already in the session counts as added. A torrent that is unavailable for now is left in place to
+// be tried again later
+func (s *Session) importWatchedFile(path string) {
+	t, err := s.addWatchedFile(path)
+	if errors.Is(err, ErrUnavailable) {
+		s.retryWatchedFile(path, err)
+		return
+	}
+	s.mu.Lock()
+	delete(s.retries, path)
+	s.mu.Unlock()
+	switch {
+	case errors.Is(err, ErrDuplicate):
+		s.logger().Info("torrent of the watch directory already added", "file", path, "name", t.Name())
+	case err != nil:
+		// a closed session refuses the torrents, the file is imported again at the next start
+		select {
+		case <-s.stop:
+			s.logger().Info("import of a watched file stopped by the session", "file", path, "error", err)
+			return
+		default:
+		}
+		s.logger().Warn("invalid file in the watch directory", "file", path, "error", err)
+		writeErr := os.WriteFile(path+errorSuffix, []byte(err.Error()+"\n"), 0644)
+		if writeErr != nil {
+			s.logger().Warn("impossible to write the error of a watched file", "file", path, "error", writeErr)
+		}
+		s.renameWatchedFile(path, path+invalidSuffix)
+		return
+	default:
+		s.logger().Info("torrent added from the watch directory", "file", path, "name", t.Name())
+	}
+	s.renameWatchedFile(path, path+addedSuffix)
+}
+
+// importMagnetFile imports a .magnet file in the background, the file stays where it is until the import ends and
+// the scans skip it meanwhile
+func (s *Session) importMagnetFile(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.importing[path] || time.Now().Before(s.retries[path].next) {
+		return
+	}
+	s.importing[path] = true
+	s.imports.Add(1)
+	go func() {
+		defer s.imports.Done()
+		s.importWatchedFile(path)
+		s.mu.Lock()
+		delete(s.importing, path)
+		s.mu.Unlock()
+	}()
+}
+
+// retryWatchedFile schedules the next import of a file whose torrent was unavailable, the downloads stopped by the
+// session are imported again at the next start
+func (s *Session) retryWatchedFile(path string, err error) {
+	select {
+	case <-s.stop:
+		s.logger().Info("import of a watched file stopped by the session", "file", path, "error", err)
+		return
+	default:
+	}
+	s.mu.Lock()
+	retry := s.retries[path]
+	retry.delay = min(max(2*retry.delay, s.metadataTimeout()), maxRetryDelay)
+	retry.next = time.Now().Add(retry.delay)
+	s.retries[path] = retry
+	s.mu.Unlock()
+	s.logger().Warn("torrent of the watch directory unavailable, trying again later", "file", path, "retry_in", retry.delay, "error", err)
+}
+
+// addWatchedFile validates a .torrent file and adds it, a .magnet file holds a magnet link
+func (s *Session) addWatchedFile(path string) (*Torrent, error) {
+	if strings.EqualFold(filepath.Ext(path), ".magnet") {
+		link, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		magnetLink := strings.TrimSpace(string(link))
+		if !strings.HasPrefix(magnetLink, "magnet:") {
+			return nil, errors.New("the file does not hold a magnet link")
+		}
+		return s.AddURL(magnetLink, AddOptions{})
+	}
+	file, err := torrentfile.OpenTorrent(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.addFile(file, AddOptions{})
+}
+
+func (s *Session) renameWatchedFile(path, newPath string) {
+	err := os.Rename(path, newPath)
+	if err != nil {
+		s.logger().Warn("impossible to rename a watched file", "file", path, "error", err)
+	}
+}
@@ -0,0 +1,218 @@
+package torrentfile
+
+import (
+	"fmt"
+	"main/peer"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	// a tracker that fails is retried after minRetryInterval, doubling the wait on every failure up to the announce interval
+	minRetryInterval = 15 * time.Second
+)
+
+// Announcer keeps a torrent announced for the whole download following the BEP 12 multitracker rules,
+// re-announcing every interval requested by the tracker
+type Announcer struct {
+	// Tiers are shuffled once, the tracker that answers is moved to the front of its tier
+	Tiers [][]string
+	// TrackerUrl is the last tracker that answered
+	TrackerUrl  string
+	torrent     *TorrentFile
+	interval    time.Duration
+	minInterval time.Duration
+	failures    int
+	started     map[string]bool
+	trackerIds  map[string]string
+	events      chan Event
+	done        chan struct{}
+
+	mu       sync.Mutex
+	statuses map[string]TrackerStatus
+}
+
+// TrackerStatus is the outcome of the last announce to a tracker
+type TrackerStatus struct {
+	Url  string `json:"url"`
+	Tier int    `json:"tier"`
+	// LastAnnounce is zero when the tracker was not announced to yet
+	LastAnnounce time.Time `json:"last_announce"`
+	// LastError is empty when the last announce worked
+	LastError string `json:"last_error,omitempty"`
+	Peers     int    `json:"peers"`
+	Seeders   int    `json:"seeders"`
+	Leechers  int    `json:"leechers"`
+}
+
+func NewAnnouncer(tiers [][]string, torrent *TorrentFile) *Announcer {
+	var shuffledTiers [][]string
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffledTier := make([]string, len(tier))
+		copy(shuffledTier, tier)
+		rand.Shuffle(len(shuffledTier), func(i, j int) {
+			shuffledTier[i], shuffledTier[j] = shuffledTier[j], shuffledTier[i]
+		})
+		shuffledTiers = append(shuffledTiers, shuffledTier)
+	}
+	return &Announcer{
+		Tiers:      shuffledTiers,
+		torrent:    torrent,
+		interval:   defaultAnnounceInterval,
+		started:    make(map[string]bool),
+		trackerIds: make(map[string]string),
+		events:     make(chan Event, 2),
+		done:       make(chan struct{}),
+		statuses:   make(map[string]TrackerStatus),
+	}
+}
+
+// Announce tries the trackers of every tier in order until one of them answers, and remembers the intervals it returns
+func (a *Announcer) Announce(event Event) (*TrackerResponse, error) {
+	lastErr := fmt.Errorf("no tracker to announce to")
+	for _, tier := range a.Tiers {
+		for i, trackerUrl := range tier {
+			trackerEvent := event
+			if !a.started[trackerUrl] {
+				// a tracker that never accepted our started event does not know about us
+				if event == EventCompleted || event == EventStopped {
+					continue
+				}
+				trackerEvent = EventStarted
+			}
+			trackerResponse, err := a.announceTo(trackerUrl, trackerEvent)
+			a.record(trackerUrl, trackerResponse, err)
+			if err != nil {
+				a.torrent.logger().Warn("error announcing to tracker", "tracker", trackerUrl, "error", err)
+				lastErr = err
+				continue
+			}
+			if trackerResponse.Warning != "" {
+				a.torrent.logger().Warn("warning from tracker", "tracker", trackerUrl, "warning", trackerResponse.Warning)
+			}
+			if trackerResponse.TrackerId != "" {
+				a.trackerIds[trackerUrl] = trackerResponse.TrackerId
+			}
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = trackerUrl
+			a.TrackerUrl = trackerUrl
+			a.failures = 0
+			if trackerEvent == EventStarted {
+				a.started[trackerUrl] = true
+			}
+			if trackerResponse.Interval > 0 {
+				a.interval = trackerResponse.Interval
+			}
+			a.minInterval = trackerResponse.MinInterval
+			return trackerResponse, nil
+		}
+	}
+	a.failures++
+	return nil, lastErr
+}
+
+func (a *Announcer) announceTo(trackerUrl string, event Event) (*TrackerResponse, error) {
+	params := a.torrent.announceParams(event)
+	params.TrackerId = a.trackerIds[trackerUrl]
+	if strings.HasPrefix(trackerUrl, "http") {
+		builtUrl, err := buildTrackerUrl(trackerUrl, params)
+		if err != nil {
+			return nil, err
+		}
+		trackerUrl = builtUrl
+	}
+	return announceToTracker(trackerUrl, params)
+}
+
+// record keeps the outcome of an announce for the status of the tracker
+func (a *Announcer) record(trackerUrl string, trackerResponse *TrackerResponse, err error) {
+	status := TrackerStatus{Url: trackerUrl, LastAnnounce: time.Now()}
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.Peers = len(trackerResponse.Peers)
+		status.Seeders = trackerResponse.Seeders
+		status.Leechers = trackerResponse.Leechers
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.statuses[trackerUrl] = status
+}
+
+// status returns the outcome of the last announce to the tracker, false when it was not announced to
+func (a *Announcer) status(trackerUrl string) (TrackerStatus, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status, ok := a.statuses[trackerUrl]
+	return status, ok
+}
+
+// nextAnnounce returns how long to wait before the next regular announce
+func (a *Announcer) nextAnnounce() time.Duration {
+	wait := a.interval
+	if a.failures > 0 {
+		wait = minRetryInterval << (a.failures - 1)
+		if wait <= 0 || wait > a.interval {
+			wait = a.interval
+		}
+	}
+	if wait < a.minInterval {
+		wait = a.minInterval
+	}
+	return wait
+}
+
+// Run re-announces to the tracker until Stop is called, passing every peer obtained to onPeers
+func (a *Announcer) Run(onPeers func([]peer.Peer)) {
+	defer close(a.done)
+	timer := time.NewTimer(a.nextAnnounce())
+	defer timer.Stop()
+
+	for {
+		event := EventNone
+		select {
+		case <-timer.C:
+		case event = <-a.events:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		if event == EventStopped && len(a.started) == 0 {
+			return
+		}
+		trackerResponse, err := a.Announce(event)
+		if event == EventStopped {
+			if err != nil {
+				a.torrent.logger().Warn("error sending stopped event", "tracker", a.TrackerUrl, "error", err)
+			}
+			return
+		}
+		if err != nil {
+			a.torrent.logger().Warn("error re-announcing, no tracker answered", "error", err)
+		} else if len(trackerResponse.Peers) > 0 {
+			a.torrent.logger().Info("obtained peers from tracker", "tracker", a.TrackerUrl, "peers", len(trackerResponse.Peers))
+			onPeers(trackerResponse.Peers)
+		}
+		timer.Reset(a.nextAnnounce())
+	}
+}
+
+// Completed tells the tracker that the download has finished
+func (a *Announcer) Completed() {
+	a.events <- EventCompleted
+}
+
+// Stop sends the stopped event and waits for Run to return
+func (a *Announcer) Stop() {
+	a.events <- EventStopped
+	<-a.done
+}
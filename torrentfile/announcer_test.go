@@ -0,0 +1,184 @@
+package torrentfile
+
+import (
+	"errors"
+	"main/peer"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNextAnnounce(t *testing.T) {
+	t.Log("Testing next announce interval")
+	announcer := NewAnnouncer([][]string{{"udp://tracker.example.org:1337"}}, &TorrentFile{})
+	announcer.interval = 10 * time.Minute
+	if announcer.nextAnnounce() != 10*time.Minute {
+		t.Error("expected the tracker interval but got ", announcer.nextAnnounce())
+	}
+	announcer.failures = 3
+	if announcer.nextAnnounce() != 4*minRetryInterval {
+		t.Error("expected exponential retry interval but got ", announcer.nextAnnounce())
+	}
+	announcer.failures = 40
+	if announcer.nextAnnounce() != 10*time.Minute {
+		t.Error("expected retry interval capped to the tracker interval but got ", announcer.nextAnnounce())
+	}
+	announcer.failures = 0
+	announcer.minInterval = 20 * time.Minute
+	if announcer.nextAnnounce() != 20*time.Minute {
+		t.Error("expected min interval to be respected but got ", announcer.nextAnnounce())
+	}
+}
+
+func TestAnnouncerRun(t *testing.T) {
+	t.Log("Testing periodic re-announce")
+	var mu sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali1e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+
+	announcer := NewAnnouncer([][]string{{server.URL + "/announce"}}, &TorrentFile{Length: 10})
+	_, err := announcer.Announce(EventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peersChan := make(chan []peer.Peer, 1)
+	go announcer.Run(func(peers []peer.Peer) {
+		peersChan <- peers
+	})
+
+	select {
+	case peers := <-peersChan:
+		expected := []peer.Peer{{IpAddr: []byte{127, 0, 0, 1}, Port: 6881}}
+		if !reflect.DeepEqual(peers, expected) {
+			t.Error("expected ", expected, " but got ", peers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tracker was not re-announced")
+	}
+	announcer.Completed()
+	announcer.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expectedEvents := []string{"started", "", "completed", "stopped"}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Error("expected events ", expectedEvents, " but got ", events)
+	}
+}
+
+func TestAnnouncerTiers(t *testing.T) {
+	t.Log("Testing multitracker tiers")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+	workingTracker := server.URL + "/announce"
+	deadTracker := "http://127.0.0.1:1/announce"
+
+	announcer := NewAnnouncer([][]string{{deadTracker}, {deadTracker + "?tier=2", workingTracker}}, &TorrentFile{})
+	_, err := announcer.Announce(EventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if announcer.TrackerUrl != workingTracker {
+		t.Error("expected tracker ", workingTracker, " to answer but got ", announcer.TrackerUrl)
+	}
+	if announcer.Tiers[1][0] != workingTracker {
+		t.Error("expected working tracker to be promoted to the front of its tier but got ", announcer.Tiers[1])
+	}
+	if announcer.Tiers[0][0] != deadTracker {
+		t.Error("expected first tier to be left untouched but got ", announcer.Tiers[0])
+	}
+	torrent := &TorrentFile{AnnounceList: [][]string{{deadTracker}, {deadTracker + "?tier=2", workingTracker}}}
+	torrent.announcers = []*Announcer{announcer}
+	statuses := torrent.TrackerStatus()
+	if len(statuses) != 3 || statuses[0].LastError == "" || statuses[2].Tier != 1 || statuses[2].Peers != 1 ||
+		statuses[2].LastError != "" || statuses[2].LastAnnounce.IsZero() {
+		t.Error("wrong tracker status ", statuses)
+	}
+
+	announcer = NewAnnouncer([][]string{{deadTracker}}, &TorrentFile{})
+	_, err = announcer.Announce(EventStarted)
+	if err == nil || announcer.failures != 1 {
+		t.Error("expected an error when no tracker answers")
+	}
+}
+
+func TestNewAnnouncers(t *testing.T) {
+	t.Log("Testing announcers for all tiers")
+	torrentFile := &TorrentFile{
+		Announce:           "udp://a.example.org:1337",
+		AnnounceList:       [][]string{{"udp://a.example.org:1337"}, {"udp://b.example.org:1337", "udp://c.example.org:1337"}},
+		AnnounceToAllTiers: true,
+	}
+	if len(torrentFile.newAnnouncers()) != 2 {
+		t.Error("expected an announcer for every tier")
+	}
+	torrentFile.Private = true
+	if len(torrentFile.newAnnouncers()) != 1 {
+		t.Error("expected a single announcer for a private torrent")
+	}
+	torrentFile.AnnounceList = nil
+	announcers := torrentFile.newAnnouncers()
+	if len(announcers) != 1 || announcers[0].Tiers[0][0] != torrentFile.Announce {
+		t.Error("expected to fall back to the announce url")
+	}
+}
+
+func TestAnnouncerTrackerId(t *testing.T) {
+	t.Log("Testing tracker id echo and dictionary peers")
+	var mu sync.Mutex
+	var trackerIds []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		trackerIds = append(trackerIds, r.URL.Query().Get("trackerid"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali1800e5:peersld2:ip9:127.0.0.14:porti6881eee10:tracker id5:xyz42e"))
+	}))
+	defer server.Close()
+
+	announcer := NewAnnouncer([][]string{{server.URL + "/announce"}}, &TorrentFile{})
+	for i := 0; i < 2; i++ {
+		trackerResponse, err := announcer.Announce(EventNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []peer.Peer{{IpAddr: net.IP{127, 0, 0, 1}, Port: 6881}}
+		if !reflect.DeepEqual(trackerResponse.Peers, expected) {
+			t.Error("expected ", expected, " but got ", trackerResponse.Peers)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(trackerIds, []string{"", "xyz42"}) {
+		t.Error("expected the tracker id to be echoed but got ", trackerIds)
+	}
+}
+
+func TestAnnouncerFailureReason(t *testing.T) {
+	t.Log("Testing tracker failure reason")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason22:torrent not registerede"))
+	}))
+	defer server.Close()
+
+	announcer := NewAnnouncer([][]string{{server.URL + "/announce"}}, &TorrentFile{})
+	_, err := announcer.Announce(EventStarted)
+	var trackerError *TrackerError
+	if !errors.As(err, &trackerError) || trackerError.Message != "torrent not registered" {
+		t.Fatal("expected a tracker error but got ", err)
+	}
+	if trackerError.TrackerUrl != server.URL+"/announce" {
+		t.Error("expected the tracker url without parameters but got ", trackerError.TrackerUrl)
+	}
+}
@@ -0,0 +1,207 @@
+package torrentfile
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"main/peer"
+	"net/url"
+	"strings"
+)
+
+const (
+	// metadataConnections is the number of peers asked for the metadata at the same time
+	metadataConnections = 5
+	// metadataLeft is reported to the trackers while the size of a magnet link is unknown, it must not be 0 or the
+	// trackers take us for a seeder and send no seeders
+	metadataLeft = 16384
+)
+
+// ErrNoMetadata is returned when no peer sent the metadata of a magnet link, other peers may send it later
+var ErrNoMetadata = errors.New("no peer sent the metadata of the magnet link")
+
+// ParseMagnet reads a magnet link of BEP 9, the torrent it returns has no metadata until FetchMetadata downloads
+// it from the peers. Its name is the display name of the link or the hex info hash
+func ParseMagnet(link string) (*TorrentFile, error) {
+	magnetUrl, err := url.Parse(link)
+	if err != nil || magnetUrl.Scheme != "magnet" {
+		return nil, fmt.Errorf("invalid magnet link %q", link)
+	}
+	query := magnetUrl.Query()
+	var infoHash [20]byte
+	found := false
+	for _, exactTopic := range query["xt"] {
+		encodedHash, ok := strings.CutPrefix(exactTopic, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var hash []byte
+		switch len(encodedHash) {
+		case 40:
+			hash, err = hex.DecodeString(encodedHash)
+		case 32:
+			hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encodedHash))
+		default:
+			err = fmt.Errorf("wrong length %d", len(encodedHash))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid info hash in magnet link: %w", err)
+		}
+		copy(infoHash[:], hash)
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link without a BitTorrent info hash")
+	}
+	peerId, err := GeneratePeerId()
+	if err != nil {
+		return nil, fmt.Errorf("impossible to generate peer id: ERROR %s", err.Error())
+	}
+	torrent := &TorrentFile{
+		InfoHash: infoHash,
+		Name:     query.Get("dn"),
+		PeerId:   peerId,
+		UrlList:  query["ws"],
+	}
+	if torrent.Name == "" {
+		torrent.Name = hex.EncodeToString(infoHash[:])
+	}
+	// every tracker of the link is a tier of its own, like in the clients that wrote the link
+	for _, trackerUrl := range query["tr"] {
+		if torrent.Announce == "" {
+			torrent.Announce = trackerUrl
+		}
+		torrent.AnnounceList = append(torrent.AnnounceList, []string{trackerUrl})
+	}
+	return torrent, nil
+}
+
+// HasMetadata reports whether the pieces of the torrent are known, a torrent of a magnet link has them once
+// FetchMetadata returned
+func (t *TorrentFile) HasMetadata() bool {
+	return len(t.PieceHashes) > 0
+}
+
+// FetchMetadata downloads the info dictionary of a torrent of a magnet link from the peers its trackers and the
+// local discovery find, and fills in the pieces, the name and the files. It must be called before the torrent is
+// downloaded or shared, it returns once a peer sent the metadata, when ctx is done or when no peer is left to ask
+func (t *TorrentFile) FetchMetadata(ctx context.Context) error {
+	if t.HasMetadata() {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	found := make(chan []peer.Peer)
+	addPeers := func(peers []peer.Peer) {
+		select {
+		case found <- peers:
+		case <-ctx.Done():
+		}
+	}
+
+	localDiscovery := t.LSD
+	if !t.Proxy.AllowsDirect() {
+		localDiscovery = nil
+	}
+	if localDiscovery != nil {
+		localDiscovery.Add(t.InfoHash, func(peers []peer.Peer) { go addPeers(peers) })
+		defer localDiscovery.Remove(t.InfoHash)
+	}
+	// the announcers read the torrent while its metadata is filled in, they get a copy without it
+	finder := &TorrentFile{
+		Announce:           t.Announce,
+		AnnounceList:       t.AnnounceList,
+		InfoHash:           t.InfoHash,
+		PeerId:             t.PeerId,
+		AnnounceToAllTiers: t.AnnounceToAllTiers,
+		Logger:             t.Logger,
+	}
+	if t.Listener != nil && t.Proxy.AllowsDirect() {
+		finder.port = t.Listener.Port()
+	}
+	announcers := finder.newAnnouncers()
+	announced := make(chan struct{})
+	for _, announcer := range announcers {
+		go func(announcer *Announcer) {
+			trackerResponse, err := announcer.Announce(EventStarted)
+			if err == nil {
+				addPeers(trackerResponse.Peers)
+			}
+			select {
+			case announced <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}(announcer)
+	}
+
+	dialer := peer.Dialer{Encryption: t.Encryption, UTP: t.UTP, Proxy: t.Proxy, Logger: t.logger()}
+	slots := make(chan struct{}, metadataConnections)
+	results := make(chan []byte)
+	failed := make(chan struct{})
+	tried := make(map[string]bool)
+	announcing, fetching := len(announcers), 0
+	for {
+		if announcing == 0 && fetching == 0 && localDiscovery == nil {
+			return ErrNoMetadata
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrNoMetadata, ctx.Err())
+		case <-announced:
+			announcing--
+		case <-failed:
+			fetching--
+		case peers := <-found:
+			for _, metadataPeer := range peers {
+				addr := metadataPeer.String()
+				if tried[addr] || (t.Conns != nil && t.Conns.Refuses(addr)) {
+					continue
+				}
+				tried[addr] = true
+				fetching++
+				go func(metadataPeer peer.Peer) {
+					select {
+					case slots <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+					info, err := peer.FetchMetadata(ctx, metadataPeer, t.PeerId, t.InfoHash, dialer)
+					<-slots
+					if err != nil {
+						t.logger().Debug("no metadata from peer", "peer", metadataPeer.String(), "error", err)
+						select {
+						case failed <- struct{}{}:
+						case <-ctx.Done():
+						}
+						return
+					}
+					select {
+					case results <- info:
+					case <-ctx.Done():
+					}
+				}(metadataPeer)
+			}
+		case info := <-results:
+			return t.setMetadata(info)
+		}
+	}
+}
+
+// setMetadata fills in the torrent from its info dictionary, the info hash stays the one of the magnet link
+func (t *TorrentFile) setMetadata(info []byte) error {
+	metadata, err := ParseTorrent(append(append([]byte("d8:announce0:4:info"), info...), 'e'))
+	if err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+	t.PieceHashes = metadata.PieceHashes
+	t.PieceLength = metadata.PieceLength
+	t.Length = metadata.Length
+	t.Name = metadata.Name
+	t.Files = metadata.Files
+	t.Private = metadata.Private
+	t.logger().Info("received the metadata of the magnet link", "name", t.Name, "pieces", len(t.PieceHashes))
+	return nil
+}
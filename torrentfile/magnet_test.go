@@ -0,0 +1,139 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"main/bencode"
+	"main/handshake"
+	"main/message"
+	"main/peer"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveMetadata answers a peer that asks the info dictionary with ut_metadata, the dictionary fits a single piece
+func serveMetadata(conn net.Conn, infoHash [20]byte, info []byte) {
+	defer conn.Close()
+	conn.Write(handshake.NewHandshake(infoHash, [20]byte{7}).Serialize())
+	extendedHandshake, _ := bencode.Encode(map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": 2},
+		"metadata_size": len(info),
+	})
+	conn.Write(message.FormatExtended(message.ExtendedHandshakeID, extendedHandshake).Serialize())
+	for {
+		readMessage, err := message.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if readMessage == nil || readMessage.ID != message.MsgExtended {
+			continue
+		}
+		id, _, _ := message.ParseExtended(readMessage)
+		if id == message.ExtendedHandshakeID {
+			continue
+		}
+		// our handshake gives ut_metadata the id 1
+		header, _ := bencode.Encode(map[string]interface{}{"msg_type": 1, "piece": 0, "total_size": len(info)})
+		conn.Write(message.FormatExtended(1, append(header, info...)).Serialize())
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	t.Log("Testing magnet links with hex and base32 info hashes")
+	infoHash := [20]byte{0xab, 0xcd, 1, 2, 3}
+	torrent, err := ParseMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash[:]) + "&dn=file.iso" +
+		"&tr=http%3A%2F%2Fa.example.org%2Fannounce&tr=udp%3A%2F%2Fb.example.org%3A80&ws=http%3A%2F%2Fseed.example.org%2F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.InfoHash != infoHash || torrent.Name != "file.iso" || torrent.HasMetadata() {
+		t.Error("wrong torrent of the magnet link ", torrent.InfoHash, torrent.Name)
+	}
+	expectedTiers := [][]string{{"http://a.example.org/announce"}, {"udp://b.example.org:80"}}
+	if torrent.Announce != "http://a.example.org/announce" || !reflect.DeepEqual(torrent.AnnounceList, expectedTiers) {
+		t.Error("wrong trackers of the magnet link ", torrent.Announce, torrent.AnnounceList)
+	}
+	if !reflect.DeepEqual(torrent.UrlList, []string{"http://seed.example.org/"}) {
+		t.Error("wrong web seeds of the magnet link ", torrent.UrlList)
+	}
+
+	torrent, err = ParseMagnet("magnet:?xt=urn:btih:vpgqcaqdaaaaaaaaaaaaaaaaaaaaaaaa")
+	if err != nil || torrent.InfoHash != infoHash || torrent.Name != hex.EncodeToString(infoHash[:]) {
+		t.Error("wrong torrent of the base32 magnet link ", torrent, err)
+	}
+	for _, link := range []string{"http://example.org/a.torrent", "magnet:?dn=file.iso", "magnet:?xt=urn:btih:abcd"} {
+		if _, err := ParseMagnet(link); err == nil {
+			t.Error("expected an error for ", link)
+		}
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	t.Log("Testing the metadata of a magnet link downloaded from a peer of its tracker")
+	info, err := bencode.Encode(map[string]interface{}{
+		"name":         "file.iso",
+		"length":       20,
+		"piece length": 16,
+		"pieces":       strings.Repeat("a", 40),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoHash := sha1.Sum(info)
+	seed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seed.Close()
+	go func() {
+		for {
+			conn, err := seed.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := handshake.ReadHandshake(conn); err != nil {
+				conn.Close()
+				continue
+			}
+			go serveMetadata(conn, infoHash, info)
+		}
+	}()
+	seedPeer := peer.Peer{IpAddr: net.IPv4(127, 0, 0, 1), Port: uint16(seed.Addr().(*net.TCPAddr).Port)}
+	var left string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		left = r.URL.Query().Get("left")
+		response, _ := bencode.Encode(map[string]interface{}{"interval": 1800, "peers": string(peer.MarshallPeers([]peer.Peer{seedPeer}))})
+		w.Write(response)
+	}))
+	defer tracker.Close()
+
+	torrent, err := ParseMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash[:]) + "&tr=" + tracker.URL + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.Encryption = peer.Encryption{Policy: peer.EncryptionDisable}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = torrent.FetchMetadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left == "0" || left == "" {
+		t.Error("expected the unknown size not to be announced as a seeder but got left ", left)
+	}
+	if !torrent.HasMetadata() || torrent.Name != "file.iso" || torrent.Length != 20 || len(torrent.PieceHashes) != 2 || torrent.InfoHash != infoHash {
+		t.Error("wrong torrent after the metadata ", torrent.Name, torrent.Length, len(torrent.PieceHashes))
+	}
+
+	// without trackers nor local discovery nobody can send the metadata
+	torrent, _ = ParseMagnet("magnet:?xt=urn:btih:" + strings.Repeat("0", 40))
+	if err := torrent.FetchMetadata(context.Background()); err == nil {
+		t.Error("expected an error for a magnet link without peers")
+	}
+}
@@ -1,17 +1,24 @@
 package torrentfile
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
-	"log"
+	"log/slog"
 	"main/bencode"
+	"main/logging"
+	"main/lsd"
 	"main/p2p"
 	"main/peer"
+	"main/portmap"
+	"main/proxy"
+	"main/ratelimit"
+	"main/utp"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 )
 
@@ -25,20 +32,98 @@ type TorrentFile struct {
 	Length       int
 	Name         string
 	PeerId       [20]byte
+	Private      bool
+	// Files is the layout of a multi-file torrent, empty for a single file
+	Files []p2p.File
+	// UrlList are the web seeds of BEP 19
+	UrlList []string
+	// AnnounceToAllTiers announces to one tracker of every tier instead of only the first one that answers,
+	// it is ignored for private torrents
+	AnnounceToAllTiers bool
+	// Listener accepts the incoming peers, when nil Download listens on its own for the duration of the download
+	Listener *peer.Listener
+	// LocalDiscovery looks for peers on the local network with BEP 14, it is ignored for private torrents
+	LocalDiscovery bool
+	// LSD is the local service discovery shared by the torrents, when nil and LocalDiscovery is set Download
+	// starts its own for the duration of the download
+	LSD *lsd.Service
+	// UploadSlots is the number of peers we upload to at the same time, 4 when not set
+	UploadSlots int
+	// Limits caps the transfer rates of the torrent, GlobalLimits the ones shared with the other torrents, both can be nil
+	Limits       *ratelimit.Limits
+	GlobalLimits *ratelimit.Limits
+	// MaxConnections is the limit of connected peers of the torrent, 50 when not set
+	MaxConnections int
+	// Conns limits the connections of all the torrents together, when nil the torrent uses its own
+	Conns *p2p.ConnManager
+	// Encryption is the MSE policy of the connections, the one of the incoming connections is only applied to
+	// the listener Download creates, a shared Listener is configured by its owner
+	Encryption peer.Encryption
+	// UseUTP connects to the peers over uTP before trying TCP and accepts the uTP connections
+	UseUTP bool
+	// UTP is the uTP socket shared by the torrents, when nil and UseUTP is set Download opens its own on the
+	// listening port for the duration of the download, its owner serves it on the shared Listener
+	UTP *utp.Socket
+	// Proxy carries the connections to the peers and to the web seeds, the trackers go through the one of
+	// UseProxy. When the proxy is the only way out Download does not accept incoming peers nor uses uTP and
+	// the local discovery
+	Proxy *proxy.Proxy
+	// MapPort maps the listening port on the gateway of the local network with PCP, NAT-PMP or UPnP and reports
+	// the external address and port to the trackers
+	MapPort bool
+	// PortMapping is the mapping shared by the torrents, when nil and MapPort is set Download maps the port of
+	// its own listener for the duration of the download
+	PortMapping *portmap.Service
+	// Logger receives what happens to the download, the records carry the info hash. The services Download
+	// starts on its own log to it too, nil discards everything
+	Logger *slog.Logger
+	// FilePriorities are the priorities of the files by index, or of the only file of a single-file torrent,
+	// change them with SetFilePriority while downloading
+	FilePriorities []p2p.Priority
+
+	// mu guards the state of the running download, which is read by the status methods
+	mu       sync.Mutex
+	stats    *p2p.Stats
+	download *p2p.Torrent
+	// lastDownload is the running download or the one that ended last, it knows the pieces we have
+	lastDownload *p2p.Torrent
+	announcers   []*Announcer
+	// ipv6, port and portMapping are what the announces report, the announcers read them while Download sets them
+	ipv6        net.IP
+	port        uint16
+	portMapping *portmap.Service
 }
 
-const port uint16 = 6881
+const defaultPort uint16 = 6881
 
 func OpenTorrent(path string) (*TorrentFile, error) {
 	torrentData, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	return ParseTorrent(torrentData)
+}
+
+// ParseTorrent reads the content of a .torrent file, a malformed one returns an error instead of making the
+// parser panic since the data can come from anyone over the network
+func ParseTorrent(torrentData []byte) (torrent *TorrentFile, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			torrent, err = nil, fmt.Errorf("invalid torrent file: %v", r)
+		}
+	}()
 	torrentBencode := bencode.UnmarshallBencode(torrentData)
-	torrent, err := bencodeToTorrentFile(torrentBencode)
+	torrent, err = bencodeToTorrentFile(torrentBencode)
 	if err != nil {
 		return nil, err
 	}
+	if len(torrent.PieceHashes) == 0 || torrent.PieceLength <= 0 || torrent.Name == "" {
+		return nil, fmt.Errorf("invalid torrent file: missing pieces, piece length or name")
+	}
+	// the name is the file or the directory the torrent is saved in, it must stay in the output directory
+	if !filepath.IsLocal(torrent.Name) || filepath.Base(torrent.Name) != torrent.Name {
+		return nil, fmt.Errorf("invalid torrent file: unsafe name %q", torrent.Name)
+	}
 	return torrent, nil
 }
 
@@ -64,7 +149,7 @@ func bencodeToTorrentFile(torrentBencode *bencode.Bencode) (*TorrentFile, error)
 	if err != nil {
 		return nil, fmt.Errorf("impossible to generate peer id: ERROR %s", err.Error())
 	}
-	return &TorrentFile{
+	torrentFile := &TorrentFile{
 		Announce:     torrentBencode.Announce,
 		AnnounceList: torrentBencode.AnnounceList,
 		InfoHash:     infoHash,
@@ -73,107 +158,447 @@ func bencodeToTorrentFile(torrentBencode *bencode.Bencode) (*TorrentFile, error)
 		Length:       torrentBencode.Info.Length,
 		Name:         torrentBencode.Info.Name,
 		PeerId:       peerId,
-	}, nil
+		Private:      torrentBencode.Info.Private == 1,
+		UrlList:      torrentBencode.UrlList,
+	}
+	for _, file := range torrentBencode.Info.Files {
+		torrentFile.Files = append(torrentFile.Files, p2p.File{Path: file.Path, Length: file.Length})
+		if torrentBencode.Info.Length == 0 {
+			torrentFile.Length += file.Length
+		}
+	}
+	return torrentFile, nil
 }
 
-func (t *TorrentFile) requestPeers() []peer.Peer {
+// publicIPv6 returns the first global IPv6 address of the machine, nil if it has none
+func publicIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil {
+			continue
+		}
+		if ipNet.IP.IsGlobalUnicast() && !ipNet.IP.IsPrivate() {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+// Trackers returns every tracker of the torrent, the ones of the announce-list if present or the announce url otherwise
+func (t *TorrentFile) Trackers() []string {
+	if len(t.AnnounceList) == 0 {
+		return []string{t.Announce}
+	}
+	var trackers []string
+	for _, tier := range t.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+	return trackers
+}
+
+// newAnnouncers returns a single announcer for all the tiers, or one for every tier when announcing to all of them
+func (t *TorrentFile) newAnnouncers() []*Announcer {
+	tiers := t.AnnounceList
+	if len(tiers) == 0 {
+		// Handle the case where only the single tracker URL `Announce` is provided
+		tiers = [][]string{{t.Announce}}
+	}
+	if !t.AnnounceToAllTiers || t.Private {
+		return []*Announcer{NewAnnouncer(tiers, t)}
+	}
+	var announcers []*Announcer
+	for _, tier := range tiers {
+		announcers = append(announcers, NewAnnouncer([][]string{tier}, t))
+	}
+	return announcers
+}
+
+// requestPeers sends the started event to the trackers and returns the announcers together with the peers obtained
+func (t *TorrentFile) requestPeers() ([]*Announcer, []peer.Peer, error) {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var peers []peer.Peer
+	announcers := t.newAnnouncers()
 
-	if len(t.AnnounceList) > 0 {
-		for _, trackerUrlList := range t.AnnounceList {
-			wg.Add(1)
-			go func(trackerUrl string) {
-				defer wg.Done()
-
-				if strings.HasPrefix(trackerUrl, "http") {
-					newTrackerUrl, err := t.BuildTrackerUrl(trackerUrl)
-					if err != nil {
-						log.Println("Error building url tracker ", err)
-						return
-					}
-					trackerUrl = newTrackerUrl
-				}
-
-				obtainedPeers, err := GetPeersFromTracker(trackerUrl, t.InfoHash, t.PeerId)
-				if err == nil {
-					mu.Lock()
-					peers = append(peers, obtainedPeers...)
-					mu.Unlock()
-					log.Println("OBTAINED SOME PEERS FROM TRACKER: ", trackerUrl, " NUM: ", len(obtainedPeers))
-				} else {
-					log.Printf("Error getting peers from tracker: %s, error: %s", trackerUrl, err)
-				}
-			}(trackerUrlList[0])
-		}
-		wg.Wait()
-	} else {
-		// Handle the case where only the single tracker URL `Announce` is provided
-		if strings.HasPrefix(t.Announce, "http") {
-			newTrackerUrl, err := t.BuildTrackerUrl(t.Announce)
+	for _, announcer := range announcers {
+		wg.Add(1)
+		go func(announcer *Announcer) {
+			defer wg.Done()
+			trackerResponse, err := announcer.Announce(EventStarted)
 			if err != nil {
-				log.Fatal("Error building url tracker ", err, " unfortunately this is the only tracker available for this torrent")
+				t.logger().Warn("error getting peers, no tracker answered", "error", err)
+				return
 			}
-			t.Announce = newTrackerUrl
+			mu.Lock()
+			peers = append(peers, trackerResponse.Peers...)
+			mu.Unlock()
+			t.logger().Info("obtained peers from tracker", "tracker", announcer.TrackerUrl, "peers", len(trackerResponse.Peers))
+		}(announcer)
+	}
+	wg.Wait()
+
+	if len(peers) == 0 {
+		return announcers, nil, fmt.Errorf("no peers found, impossible to download the torrent")
+	}
+	return announcers, peers, nil
+}
+
+func (t *TorrentFile) Download(outputPath string) error {
+	return t.DownloadContext(context.Background(), outputPath)
+}
+
+// DownloadContext downloads the torrent until it completes or ctx is done, in which case it returns the error of
+// ctx. The pieces already in the output file are kept, so downloading again a stopped torrent resumes it
+func (t *TorrentFile) DownloadContext(ctx context.Context, outputPath string) error {
+	t.mu.Lock()
+	if t.stats == nil {
+		t.stats = p2p.NewStats(int64(t.Length))
+	}
+	stats := t.stats
+	filePriorities := append([]p2p.Priority(nil), t.FilePriorities...)
+	t.mu.Unlock()
+	var ipv6 net.IP
+	if t.Proxy.AllowsDirect() {
+		// behind a proxy-only setup our own address must not reach the trackers
+		ipv6 = publicIPv6()
+	}
+	t.mu.Lock()
+	t.ipv6 = ipv6
+	t.mu.Unlock()
+
+	torrentDownload := p2p.Torrent{
+		InfoHash:       t.InfoHash,
+		PieceHashes:    t.PieceHashes,
+		PieceLength:    t.PieceLength,
+		Length:         t.Length,
+		Name:           t.Name,
+		PeerId:         t.PeerId,
+		Stats:          stats,
+		Files:          t.Files,
+		FilePriorities: filePriorities,
+		WebSeeds:       t.UrlList,
+		UploadSlots:    t.UploadSlots,
+		Limits:         t.Limits,
+		GlobalLimits:   t.GlobalLimits,
+		MaxConnections: t.MaxConnections,
+		Conns:          t.Conns,
+		Dialer:         peer.Dialer{Encryption: t.Encryption, Proxy: t.Proxy, Logger: t.logger()},
+		Logger:         t.logger(),
+	}
+	stopDownload := context.AfterFunc(ctx, torrentDownload.Stop)
+	defer stopDownload()
+	t.mu.Lock()
+	t.download = &torrentDownload
+	t.lastDownload = &torrentDownload
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.download = nil
+		t.mu.Unlock()
+	}()
+
+	listener := t.Listener
+	if !t.Proxy.AllowsDirect() {
+		listener = nil
+	} else if listener == nil {
+		ownListener, err := peer.Listen(defaultPort)
+		if err != nil {
+			t.logger().Warn("impossible to accept incoming peers", "error", err)
+		} else {
+			defer ownListener.Close()
+			ownListener.SetEncryption(t.Encryption)
+			ownListener.SetLogger(t.Logger)
+			listener = ownListener
 		}
+	}
+	if listener != nil {
+		listener.Handle(t.InfoHash, torrentDownload.AddIncomingPeer)
+		defer listener.Remove(t.InfoHash)
+		t.mu.Lock()
+		t.port = listener.Port()
+		t.mu.Unlock()
+	}
 
-		obtainedPeers, err := GetPeersFromTracker(t.Announce, t.InfoHash, t.PeerId)
+	utpSocket := t.UTP
+	if utpSocket == nil && t.UseUTP && t.Proxy.AllowsDirect() {
+		ownSocket, err := utp.Listen("udp", net.JoinHostPort("", strconv.Itoa(int(t.listenPort()))))
 		if err != nil {
-			log.Fatal("Error getting peers from tracker: ", err, " unfortunately this is the only tracker available for this torrent")
+			t.logger().Warn("impossible to use uTP", "error", err)
+		} else {
+			defer ownSocket.Close()
+			ownSocket.SetLogger(t.Logger)
+			if listener != nil {
+				listener.Serve(ownSocket)
+			}
+			utpSocket = ownSocket
 		}
-		peers = append(peers, obtainedPeers...)
+	}
+	torrentDownload.Dialer.UTP = utpSocket
+	// the udp trackers are announced from the same port, be the socket ours or the one shared by a session
+	if utpSocket != nil && t.Proxy.AllowsDirect() {
+		udpTracker.share(utpSocket.PacketConn())
 	}
 
-	if len(peers) == 0 {
-		log.Fatal("No peers found, impossible to download the torrent")
+	// a mapping is useless when nobody can connect to us
+	var portMapping *portmap.Service
+	if listener != nil {
+		portMapping = t.PortMapping
 	}
+	if portMapping == nil && t.MapPort && listener != nil {
+		ownPortMapping, err := portmap.Start(t.listenPort(), portmap.Options{Logger: t.Logger})
+		if err != nil {
+			t.logger().Warn("impossible to map the listening port", "error", err)
+		} else {
+			// the closed mapping must not be reported by the next download
+			defer func() {
+				t.mu.Lock()
+				t.portMapping = nil
+				t.mu.Unlock()
+				ownPortMapping.Close()
+			}()
+			portMapping = ownPortMapping
+		}
+	}
+	t.mu.Lock()
+	t.portMapping = portMapping
+	t.mu.Unlock()
 
-	return peers
-}
+	// BEP 14 must not be used for private torrents
+	var localDiscovery *lsd.Service
+	allowsLocalDiscovery := !t.Private && t.Proxy.AllowsDirect()
+	if allowsLocalDiscovery {
+		localDiscovery = t.LSD
+	}
+	if localDiscovery == nil && t.LocalDiscovery && allowsLocalDiscovery {
+		ownLocalDiscovery, err := lsd.New(t.listenPort())
+		if err != nil {
+			t.logger().Warn("impossible to discover peers on the local network", "error", err)
+		} else {
+			defer ownLocalDiscovery.Close()
+			ownLocalDiscovery.SetLogger(t.Logger)
+			localDiscovery = ownLocalDiscovery
+		}
+	}
+	if localDiscovery != nil {
+		localDiscovery.Add(t.InfoHash, torrentDownload.AddPeers)
+		defer localDiscovery.Remove(t.InfoHash)
+	}
 
-func (t *TorrentFile) Download(outputPath string) error {
-	peers := t.requestPeers()
+	announcers, peers, err := t.requestPeers()
+	t.mu.Lock()
+	t.announcers = announcers
+	t.mu.Unlock()
+	if err != nil && localDiscovery == nil && len(t.UrlList) == 0 {
+		return err
+	}
+	if err != nil {
+		// the web seeds and the peers of the local network may still be enough
+		t.logger().Warn("downloading from the web seeds and the local network only", "error", err)
+	}
+	torrentDownload.AddPeers(peers)
 
-	torrentDownload := p2p.Torrent{
-		InfoHash:    t.InfoHash,
-		PieceHashes: t.PieceHashes,
-		PieceLength: t.PieceLength,
-		Length:      t.Length,
-		Name:        t.Name,
-		PeerId:      t.PeerId,
-		Peers:       peers,
+	// trackers keep being announced for the whole download so that fresh peers keep coming in
+	for _, announcer := range announcers {
+		go announcer.Run(torrentDownload.AddPeers)
 	}
+	defer func() {
+		for _, announcer := range announcers {
+			announcer.Stop()
+		}
+	}()
 
-	err := os.MkdirAll(outputPath, 0777)
+	err = os.MkdirAll(outputPath, 0777)
 	if err != nil {
 		return err
 	}
 
-	downloadedTorrentFile, err := os.Create(filepath.Join(outputPath, t.Name))
+	err = torrentDownload.Download(filepath.Join(outputPath, t.Name))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
-	err = torrentDownload.Download(filepath.Join(outputPath, t.Name))
-	defer downloadedTorrentFile.Close()
-	return err
+	for _, announcer := range announcers {
+		announcer.Completed()
+	}
+	return nil
 }
 
-func (t *TorrentFile) BuildTrackerUrl(trackerAnnounce string) (string, error) {
+// Stats returns the counters of the downloads of the torrent, nil before the first one starts. They are kept
+// from a download to the next one
+func (t *TorrentFile) Stats() *p2p.Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// PeerStatuses returns the peers of the running download, none when the torrent is not downloading
+func (t *TorrentFile) PeerStatuses() []p2p.PeerStatus {
+	t.mu.Lock()
+	download := t.download
+	t.mu.Unlock()
+	if download == nil {
+		return nil
+	}
+	return download.PeerStatuses()
+}
+
+// FileProgress returns the downloaded bytes of every file, as of the last download when none is running. A single-file
+// torrent has one file
+func (t *TorrentFile) FileProgress() []int64 {
+	t.mu.Lock()
+	lastDownload := t.lastDownload
+	t.mu.Unlock()
+	if lastDownload == nil {
+		return make([]int64, max(len(t.Files), 1))
+	}
+	return lastDownload.FileProgress()
+}
+
+// TrackerStatus returns every tracker of the torrent by tier with the outcome of its last announce, the trackers
+// keep the one of the last download after it ends
+func (t *TorrentFile) TrackerStatus() []TrackerStatus {
+	t.mu.Lock()
+	announcers := t.announcers
+	t.mu.Unlock()
+	tiers := t.AnnounceList
+	if len(tiers) == 0 {
+		tiers = [][]string{{t.Announce}}
+	}
+	var statuses []TrackerStatus
+	for tierIndex, tier := range tiers {
+		for _, trackerUrl := range tier {
+			status := TrackerStatus{Url: trackerUrl}
+			for _, announcer := range announcers {
+				if announced, ok := announcer.status(trackerUrl); ok {
+					status = announced
+				}
+			}
+			status.Tier = tierIndex
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// FilePriority returns the priority of a file
+func (t *TorrentFile) FilePriority(file int) p2p.Priority {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if file < 0 || file >= len(t.FilePriorities) {
+		return p2p.PriorityNormal
+	}
+	return t.FilePriorities[file]
+}
+
+// SetFilePriority changes the priority of a file, the running download follows it at once
+func (t *TorrentFile) SetFilePriority(file int, priority p2p.Priority) error {
+	files := max(len(t.Files), 1)
+	if file < 0 || file >= files {
+		return fmt.Errorf("the torrent has no file %d", file)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	priorities := make([]p2p.Priority, files)
+	copy(priorities, t.FilePriorities)
+	priorities[file] = priority
+	t.FilePriorities = priorities
+	if t.download != nil {
+		return t.download.SetFilePriority(file, priority)
+	}
+	return nil
+}
+
+func (t *TorrentFile) logger() *slog.Logger {
+	return logging.Or(t.Logger).With(logging.InfoHash(t.InfoHash))
+}
+
+// listenPort returns the port we listen on in the local network
+func (t *TorrentFile) listenPort() uint16 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.port != 0 {
+		return t.port
+	}
+	return defaultPort
+}
+
+// announceParams returns the announce values for the current state of the download
+func (t *TorrentFile) announceParams(event Event) *AnnounceParams {
+	t.mu.Lock()
+	ipv6, portMapping := t.ipv6, t.portMapping
+	t.mu.Unlock()
+	params := &AnnounceParams{
+		InfoHash: t.InfoHash,
+		PeerId:   t.PeerId,
+		Port:     t.listenPort(),
+		Left:     int64(t.Length),
+		Event:    event,
+		IPv6:     ipv6,
+		NumWant:  -1,
+	}
+	// the peers outside of the local network reach us on the address and port of the gateway
+	if portMapping != nil {
+		if externalPort := portMapping.ExternalPort(); externalPort != 0 {
+			params.Port = externalPort
+		}
+		params.IPv4 = portMapping.ExternalIP().To4()
+	}
+	if stats := t.Stats(); stats != nil {
+		params.Downloaded = stats.Downloaded()
+		params.Uploaded = stats.Uploaded()
+		params.Left = stats.Left()
+	}
+	// the size of a magnet link is only known once its metadata came
+	if !t.HasMetadata() && t.Length == 0 {
+		params.Left = metadataLeft
+	}
+	// we are leaving the swarm, no need for peers
+	if event == EventStopped {
+		params.NumWant = 0
+	}
+	return params
+}
+
+func (t *TorrentFile) BuildTrackerUrl(trackerAnnounce string, event Event) (string, error) {
 	// not using directly t.announce because i can then use this func for using other tracker from the announce list
+	return buildTrackerUrl(trackerAnnounce, t.announceParams(event))
+}
+
+func buildTrackerUrl(trackerAnnounce string, params *AnnounceParams) (string, error) {
 	parsedUrl, err := url.Parse(trackerAnnounce)
 	if err != nil {
 		return "", err
 	}
 	rawQuery := url.Values{
-		"info_hash":  []string{string(t.InfoHash[:])},
-		"downloaded": []string{"0"},
-		"left":       []string{strconv.Itoa(t.Length)},
-		"peer_id":    []string{string(t.PeerId[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
+		"info_hash":  []string{string(params.InfoHash[:])},
+		"downloaded": []string{strconv.FormatInt(params.Downloaded, 10)},
+		"left":       []string{strconv.FormatInt(params.Left, 10)},
+		"peer_id":    []string{string(params.PeerId[:])},
+		"port":       []string{strconv.Itoa(int(params.Port))},
+		"uploaded":   []string{strconv.FormatInt(params.Uploaded, 10)},
 		"compact":    []string{"1"},
 	}
+	if params.Event != EventNone {
+		rawQuery.Set("event", params.Event.String())
+	}
+	if params.TrackerId != "" {
+		rawQuery.Set("trackerid", params.TrackerId)
+	}
+	if params.IPv6 != nil {
+		rawQuery.Set("ipv6", params.IPv6.String())
+	}
+	if params.IPv4 != nil {
+		rawQuery.Set("ip", params.IPv4.String())
+	}
+	if params.NumWant >= 0 {
+		rawQuery.Set("numwant", strconv.Itoa(int(params.NumWant)))
+	}
 	parsedUrl.RawQuery = rawQuery.Encode()
 	return parsedUrl.String(), nil
 }
@@ -2,6 +2,9 @@ package torrentfile
 
 import (
 	"main/bencode"
+	"main/p2p"
+	"net"
+	"net/url"
 	"reflect"
 	"testing"
 )
@@ -60,6 +63,35 @@ func TestBencodeToTorrentFile(t *testing.T) {
 	}
 }
 
+func TestParseTorrent(t *testing.T) {
+	t.Log("Testing the parsing of valid and malformed torrent files")
+	torrentData, err := bencode.Encode(map[string]interface{}{
+		"announce": "http://tracker.example.org/announce",
+		"info": map[string]interface{}{
+			"name":         "file.iso",
+			"length":       10,
+			"piece length": 16384,
+			"pieces":       "1234567890abcdefghij",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile, err := ParseTorrent(torrentData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrentFile.Name != "file.iso" || torrentFile.Length != 10 || len(torrentFile.PieceHashes) != 1 {
+		t.Error("wrong torrent file ", torrentFile)
+	}
+	for _, malformed := range []string{"", "garbage", "d8:announce3:abce", string(torrentData[:len(torrentData)/2])} {
+		_, err := ParseTorrent([]byte(malformed))
+		if err == nil {
+			t.Errorf("expected an error parsing %q", malformed)
+		}
+	}
+}
+
 func TestBuildTrackerUrl(t *testing.T) {
 	t.Log("Testing parse tracker url")
 	torrentBencode := bencode.Bencode{
@@ -81,7 +113,7 @@ func TestBuildTrackerUrl(t *testing.T) {
 	}
 	torrentFile.PeerId = [20]byte{}
 	expectedUrl := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%F3%0A%60%F1%8CI%05%DA%F2%29%F6%FD%96%82%A9%03~%03r%01&left=661651456&peer_id=%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&port=6881&uploaded=0"
-	result, err := torrentFile.BuildTrackerUrl(torrentFile.Announce)
+	result, err := torrentFile.BuildTrackerUrl(torrentFile.Announce, EventNone)
 	if err != nil {
 		t.Error(err)
 	}
@@ -89,3 +121,45 @@ func TestBuildTrackerUrl(t *testing.T) {
 		t.Errorf("Expected %s but got %s", expectedUrl, result)
 	}
 }
+
+func TestBuildTrackerUrlWithStats(t *testing.T) {
+	t.Log("Testing tracker url with download statistics")
+	torrentFile := &TorrentFile{Length: 1000}
+	torrentFile.stats = p2p.NewStats(400)
+	result, err := torrentFile.BuildTrackerUrl("http://tracker.example.org/announce", EventStopped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedUrl, err := url.Parse(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsedUrl.Query()
+	if query.Get("left") != "400" || query.Get("downloaded") != "0" || query.Get("uploaded") != "0" {
+		t.Error("wrong statistics in tracker url ", result)
+	}
+	if query.Get("event") != "stopped" || query.Get("numwant") != "0" {
+		t.Error("expected stopped event without peers wanted but got ", result)
+	}
+}
+
+func TestBuildTrackerUrlExternalAddress(t *testing.T) {
+	t.Log("Testing tracker url with the external address of a port mapping")
+	params := &AnnounceParams{Port: 7881, IPv4: net.IPv4(203, 0, 113, 7), NumWant: -1}
+	result, err := buildTrackerUrl("http://tracker.example.org/announce", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedUrl, err := url.Parse(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsedUrl.Query()
+	if query.Get("ip") != "203.0.113.7" || query.Get("port") != "7881" {
+		t.Error("expected the external address 203.0.113.7:7881 but got ", result)
+	}
+	serialized := NewAnnounce(42, 7, params).Serialize()
+	if !net.IP(serialized[84:88]).Equal(params.IPv4) {
+		t.Error("expected the external address in the udp announce but got ", net.IP(serialized[84:88]))
+	}
+}
@@ -3,107 +3,302 @@ package torrentfile
 import (
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"main/bencode"
+	"main/logging"
+	"main/metrics"
 	"main/peer"
-	"math/rand/v2"
+	"main/proxy"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Event is the announce event, the values are the ones used by the udp tracker protocol
+type Event int32
+
+const (
+	EventNone      Event = 0
+	EventCompleted Event = 1
+	EventStarted   Event = 2
+	EventStopped   Event = 3
+)
+
+// AnnounceParams are the values reported to the tracker on every announce
+type AnnounceParams struct {
+	InfoHash   [20]byte
+	PeerId     [20]byte
+	Port       uint16
+	Downloaded int64
+	Uploaded   int64
+	Left       int64
+	Event      Event
+	// TrackerId is the tracker id received in a previous announce, echoed back to the tracker
+	TrackerId string
+	// IPv6 is our global IPv6 address, sent to http trackers as described by BEP 7 when we have one
+	IPv6 net.IP
+	// IPv4 is our external IPv4 address when a port mapping told it, the trackers otherwise see the address the
+	// announce comes from
+	IPv4 net.IP
+	// NumWant is the number of peers we want from the tracker, -1 lets the tracker decide
+	NumWant int32
+}
+
+// TrackerResponse is the part of an announce response that both http and udp trackers have in common
+type TrackerResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+	// Warning is a message the tracker wants us to see even though the announce worked
+	Warning   string
+	TrackerId string
+	Peers     []peer.Peer
+}
+
+const httpTrackerTimeout = 15 * time.Second
+
+var httpClient = &http.Client{Timeout: httpTrackerTimeout}
+
+// trackerLogger receives the exchanges with the trackers shared by every torrent, the ones of a torrent go to
+// its own Logger
+var trackerLogger = logging.Discard
+
+// UseProxy sends the requests to every tracker through the proxy, the udp ones too when it is a SOCKS5 proxy
+func UseProxy(p *proxy.Proxy) {
+	httpClient = p.HTTPClient(httpTrackerTimeout)
+	udpTracker.useProxy(p)
+}
+
+// announceCounts are the announces of every torrent by tracker and result, a tracker is identified by its url
+// without the announce parameters
+var announceCounts = struct {
+	mu     sync.Mutex
+	counts map[announceOutcome]int64
+}{counts: make(map[announceOutcome]int64)}
+
+type announceOutcome struct {
+	tracker string
+	result  string
+}
+
+// CollectTrackerMetrics writes the number of announces that succeeded and failed of every tracker
+func CollectTrackerMetrics(w *metrics.Writer) {
+	announceCounts.mu.Lock()
+	outcomes := make([]announceOutcome, 0, len(announceCounts.counts))
+	for outcome := range announceCounts.counts {
+		outcomes = append(outcomes, outcome)
+	}
+	slices.SortFunc(outcomes, func(a, b announceOutcome) int {
+		return strings.Compare(a.tracker+" "+a.result, b.tracker+" "+b.result)
+	})
+	counts := make([]int64, len(outcomes))
+	for i, outcome := range outcomes {
+		counts[i] = announceCounts.counts[outcome]
+	}
+	announceCounts.mu.Unlock()
+	for i, outcome := range outcomes {
+		w.Counter("gotorrent_tracker_announces_total", "Announces to the tracker by result", float64(counts[i]),
+			metrics.Label{Name: "tracker", Value: outcome.tracker}, metrics.Label{Name: "result", Value: outcome.result})
+	}
+}
+
+func countAnnounce(trackerUrl string, err error) {
+	outcome := announceOutcome{tracker: withoutQuery(trackerUrl), result: "success"}
+	if err != nil {
+		outcome.result = "failure"
+	}
+	announceCounts.mu.Lock()
+	defer announceCounts.mu.Unlock()
+	announceCounts.counts[outcome]++
+}
+
+// UseLogger logs the exchanges with the trackers, like UseProxy it is meant to be called before the first announce
+func UseLogger(logger *slog.Logger) {
+	trackerLogger = logging.Or(logger)
+}
+
+// String returns the value of the event parameter of an http announce, empty for EventNone
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
 func GetPeersFromTracker(trackerUrl string, infoHash, peerId [20]byte) ([]peer.Peer, error) {
-	log.Println("trying to get peers from tracker ", trackerUrl)
+	params := &AnnounceParams{
+		InfoHash: infoHash,
+		PeerId:   peerId,
+		Port:     defaultPort,
+		NumWant:  -1,
+	}
+	trackerResponse, err := announceToTracker(trackerUrl, params)
+	if err != nil {
+		return nil, err
+	}
+	return trackerResponse.Peers, nil
+}
+
+// Scrape asks the tracker for the statistics of the swarms of the given torrents
+func Scrape(trackerUrl string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("no info hash to scrape")
+	}
+	if strings.HasPrefix(trackerUrl, "http") {
+		return scrapeHttpTracker(trackerUrl, infoHashes)
+	}
+	return scrapeUdpTracker(trackerUrl, infoHashes)
+}
+
+// ScrapeUrl derives the scrape url from the announce url, it is only possible when the last
+// element of the path starts with "announce"
+func ScrapeUrl(announceUrl string) (string, error) {
+	parsedUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", err
+	}
+	lastSlash := strings.LastIndex(parsedUrl.Path, "/")
+	if lastSlash == -1 || !strings.HasPrefix(parsedUrl.Path[lastSlash+1:], "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announceUrl)
+	}
+	parsedUrl.Path = parsedUrl.Path[:lastSlash+1] + "scrape" + strings.TrimPrefix(parsedUrl.Path[lastSlash+1:], "announce")
+	return parsedUrl.String(), nil
+}
+
+// announceToTracker expects an http tracker url to be already built with BuildTrackerUrl
+func announceToTracker(trackerUrl string, params *AnnounceParams) (*TrackerResponse, error) {
+	trackerLogger.Debug("announcing", "tracker", withoutQuery(trackerUrl), "event", params.Event.String())
+	var trackerResponse *TrackerResponse
+	var err error
 	if strings.HasPrefix(trackerUrl, "http") {
-		return getPeersFromHttpTracker(trackerUrl)
+		trackerResponse, err = getPeersFromHttpTracker(trackerUrl)
+	} else {
+		trackerResponse, err = getPeersFromUdpTracker(trackerUrl, params)
 	}
-	return getPeersFromUdpTracker(trackerUrl, infoHash, peerId)
+	countAnnounce(trackerUrl, err)
+	return trackerResponse, err
 }
 
-func getPeersFromHttpTracker(trackerUrl string) ([]peer.Peer, error) {
-	rawTrackerResponse, err := http.Get(trackerUrl)
+func getPeersFromHttpTracker(trackerUrl string) (*TrackerResponse, error) {
+	rawTrackerResponse, err := httpClient.Get(trackerUrl)
 	if err != nil {
 		return nil, err
 	}
+	defer rawTrackerResponse.Body.Close()
 	body, err := io.ReadAll(rawTrackerResponse.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading the tracker response body: %s", err.Error())
 	}
 	trackerResponse, err := bencode.UnmarshallTrackerBencodeResponse(body)
+	if trackerResponse.FailureReason != "" {
+		return nil, &TrackerError{TrackerUrl: withoutQuery(trackerUrl), Message: trackerResponse.FailureReason}
+	}
 	if err != nil {
 		return nil, err
 	}
 	peers, err := peer.UnmarshallPeers([]byte(trackerResponse.Peers))
-	return peers, err
-}
-
-func getPeersFromUdpTracker(url string, infoHash, peerId [20]byte) ([]peer.Peer, error) {
-	transactionId := rand.Uint32()
-	udpConn, connectionId, err := getConnectionIdByHandshaking(url, transactionId)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Connected to ", url, " with connection id ", connectionId)
-	defer udpConn.Close()
-	announceResponse, err := announceTracker(udpConn, connectionId, transactionId, infoHash, peerId)
+	peers = append(peers, trackerPeersToPeers(trackerResponse.PeerList)...)
+	peers6, err := peer.UnmarshallPeers6([]byte(trackerResponse.Peers6))
 	if err != nil {
 		return nil, err
 	}
-	return announceResponse.Peers, nil
+	peers = append(peers, peers6...)
+	return &TrackerResponse{
+		Interval:    time.Duration(trackerResponse.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResponse.MinInterval) * time.Second,
+		Seeders:     trackerResponse.Complete,
+		Leechers:    trackerResponse.Incomplete,
+		Warning:     trackerResponse.WarningMessage,
+		TrackerId:   trackerResponse.TrackerId,
+		Peers:       peers,
+	}, nil
 }
 
-// getConnectionIdByHandshaking return the udp connection, the connection id as an int and possible error
-func getConnectionIdByHandshaking(trackerUrl string, transactionId uint32) (*net.UDPConn, uint64, error) {
-	parsedTrackedUrl, err := url.Parse(trackerUrl)
-	if err != nil {
-		return nil, 0, err
+// trackerPeersToPeers converts the non compact peer list, where the ip can also be a dns name
+func trackerPeersToPeers(trackerPeers []bencode.TrackerPeer) []peer.Peer {
+	var peers []peer.Peer
+	for _, trackerPeer := range trackerPeers {
+		if trackerPeer.Port <= 0 || trackerPeer.Port > 65535 {
+			continue
+		}
+		ipAddr := net.ParseIP(trackerPeer.Ip)
+		if ipAddr == nil {
+			resolvedIps, err := net.LookupIP(trackerPeer.Ip)
+			if err != nil || len(resolvedIps) == 0 {
+				trackerLogger.Debug("impossible to resolve peer, skipping it", "peer", trackerPeer.Ip, "error", err)
+				continue
+			}
+			ipAddr = resolvedIps[0]
+		}
+		if ipv4 := ipAddr.To4(); ipv4 != nil {
+			ipAddr = ipv4
+		}
+		peers = append(peers, peer.Peer{IpAddr: ipAddr, Port: uint16(trackerPeer.Port)})
 	}
-	udpAdress, err := net.ResolveUDPAddr(parsedTrackedUrl.Scheme, parsedTrackedUrl.Host)
+	return peers
+}
+
+// withoutQuery removes the announce parameters from a tracker url so that it can be shown to the user
+func withoutQuery(trackerUrl string) string {
+	parsedUrl, err := url.Parse(trackerUrl)
 	if err != nil {
-		return nil, 0, err
+		return trackerUrl
 	}
+	parsedUrl.RawQuery = ""
+	return parsedUrl.String()
+}
 
-	udpConn, err := net.DialUDP("udp", nil, udpAdress)
+func scrapeHttpTracker(trackerUrl string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	scrapeUrl, err := ScrapeUrl(trackerUrl)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	connectionRequest := NewConnection(transactionId)
-	_, err = udpConn.Write(connectionRequest.Serialize())
+	parsedUrl, err := url.Parse(scrapeUrl)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	connectionResponseBuff := make([]byte, 16)
-	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer udpConn.SetReadDeadline(time.Time{})
-	n, _, _, _, err := udpConn.ReadMsgUDP(connectionResponseBuff, nil)
-	if err != nil {
-		return nil, 0, err
+	query := parsedUrl.Query()
+	for _, infoHash := range infoHashes {
+		query.Add("info_hash", string(infoHash[:]))
 	}
-	connectionId, err := ParseConnectionResponse(connectionResponseBuff[:n], connectionRequest.TransactionId)
-	return udpConn, connectionId, err
-}
+	parsedUrl.RawQuery = query.Encode()
 
-func announceTracker(udpConn *net.UDPConn, connectionId uint64, transactionId uint32, infoHash, peerId [20]byte) (*AnnounceResponse, error) {
-	udpConn.SetDeadline(time.Now().Add(time.Second * 5))
-	defer udpConn.SetDeadline(time.Time{})
-	announceRequest := NewAnnounce(connectionId, transactionId, infoHash, peerId)
-	serializedAnnounceRequest := announceRequest.Serialize()
-	_, err := udpConn.Write(serializedAnnounceRequest)
+	rawScrapeResponse, err := httpClient.Get(parsedUrl.String())
 	if err != nil {
 		return nil, err
 	}
-
-	announceResponseBuff := make([]byte, 4096)
-	err = udpConn.SetReadBuffer(4096)
+	defer rawScrapeResponse.Body.Close()
+	body, err := io.ReadAll(rawScrapeResponse.Body)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error reading the scrape response body: %s", err.Error())
 	}
-	read, _, _, _, err := udpConn.ReadMsgUDP(announceResponseBuff, nil)
+	scrapeFiles, err := bencode.UnmarshallScrapeBencodeResponse(body)
 	if err != nil {
 		return nil, err
 	}
-	response, err := ParseAnnounceResponse(announceResponseBuff[:read], transactionId)
-	return response, err
+	results := make(map[[20]byte]ScrapeResult, len(scrapeFiles))
+	for rawInfoHash, scrapeFile := range scrapeFiles {
+		var infoHash [20]byte
+		copy(infoHash[:], rawInfoHash)
+		results[infoHash] = ScrapeResult{
+			Seeders:   scrapeFile.Complete,
+			Leechers:  scrapeFile.Incomplete,
+			Completed: scrapeFile.Downloaded,
+		}
+	}
+	return results, nil
 }
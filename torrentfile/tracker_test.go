@@ -0,0 +1,117 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"main/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScrapeUrl(t *testing.T) {
+	t.Log("Testing scrape url")
+	tests := map[string]string{
+		"http://example.com/announce":             "http://example.com/scrape",
+		"http://example.com/x/announce":           "http://example.com/x/scrape",
+		"http://example.com/announce.php":         "http://example.com/scrape.php",
+		"http://example.com/announce?passkey=abc": "http://example.com/scrape?passkey=abc",
+		"http://example.com/a":                    "",
+		"http://example.com/announce/x":           "",
+	}
+	for announceUrl, expected := range tests {
+		result, err := ScrapeUrl(announceUrl)
+		if expected == "" {
+			if err == nil {
+				t.Error("expected an error for ", announceUrl, " but got ", result)
+			}
+			continue
+		}
+		if err != nil || result != expected {
+			t.Errorf("expected %s for %s but got %s, %v", expected, announceUrl, result, err)
+		}
+	}
+}
+
+func TestScrapeHttpTracker(t *testing.T) {
+	t.Log("Testing http scrape")
+	infoHash := [20]byte{'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a', 'a'}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || r.URL.Query().Get("info_hash") != string(infoHash[:]) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("d5:filesd20:" + string(infoHash[:]) + "d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer server.Close()
+
+	results, err := Scrape(server.URL+"/announce", [][20]byte{infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ScrapeResult{Seeders: 5, Leechers: 10, Completed: 50}
+	if results[infoHash] != expected {
+		t.Error("expected ", expected, " but got ", results[infoHash])
+	}
+}
+
+func TestParseScrapeResponse(t *testing.T) {
+	t.Log("Testing udp scrape response")
+	response := make([]byte, 32)
+	binary.BigEndian.PutUint32(response[0:4], 2)
+	binary.BigEndian.PutUint32(response[4:8], 99)
+	binary.BigEndian.PutUint32(response[8:12], 1)
+	binary.BigEndian.PutUint32(response[12:16], 2)
+	binary.BigEndian.PutUint32(response[16:20], 3)
+	binary.BigEndian.PutUint32(response[20:24], 4)
+	binary.BigEndian.PutUint32(response[24:28], 5)
+	binary.BigEndian.PutUint32(response[28:32], 6)
+	results, err := ParseScrapeResponse(response, 99, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0] != (ScrapeResult{Seeders: 1, Completed: 2, Leechers: 3}) || results[1] != (ScrapeResult{Seeders: 4, Completed: 5, Leechers: 6}) {
+		t.Error("wrong scrape results ", results)
+	}
+	_, err = ParseScrapeResponse(response, 98, 2)
+	if err == nil {
+		t.Error("expected an error for a wrong transaction id")
+	}
+	_, err = ParseScrapeResponse(response, 99, 3)
+	if err == nil {
+		t.Error("expected an error for a truncated response")
+	}
+}
+
+func TestTrackerMetrics(t *testing.T) {
+	t.Log("Testing the announces counted by tracker and result")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/announce" {
+			w.Write([]byte("d14:failure reason7:refusede"))
+			return
+		}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	params := &AnnounceParams{NumWant: -1}
+	for _, path := range []string{"/announce", "/announce", "/refused"} {
+		trackerUrl, err := buildTrackerUrl(server.URL+path, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		announceToTracker(trackerUrl, params)
+	}
+	var output strings.Builder
+	writer := &metrics.Writer{}
+	CollectTrackerMetrics(writer)
+	writer.WriteTo(&output)
+	for _, line := range []string{
+		`gotorrent_tracker_announces_total{tracker="` + server.URL + `/announce",result="success"} 2`,
+		`gotorrent_tracker_announces_total{tracker="` + server.URL + `/refused",result="failure"} 1`,
+	} {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Errorf("expected %q in the metrics:\n%s", line, output.String())
+		}
+	}
+}
@@ -5,6 +5,14 @@ import (
 	"fmt"
 	"main/peer"
 	"math/rand"
+	"net"
+)
+
+const (
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
 )
 
 type ConnectionRequest struct {
@@ -26,7 +34,7 @@ type AnnounceRequest struct {
 	iPAddress     int32
 	key           uint32
 	numWant       int32
-	port          int16
+	port          uint16
 }
 
 type AnnounceResponse struct {
@@ -38,30 +46,55 @@ type AnnounceResponse struct {
 	Peers         []peer.Peer
 }
 
+type ScrapeRequest struct {
+	ConnectionId  uint64
+	TransactionId uint32
+	InfoHashes    [][20]byte
+}
+
+// ScrapeResult are the swarm statistics of a torrent returned by a scrape
+type ScrapeResult struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+// maxUdpScrapeHashes is the number of info hashes that fit in a single udp scrape packet
+const maxUdpScrapeHashes = 74
+
 func NewConnection(transactionId uint32) *ConnectionRequest {
 	return &ConnectionRequest{
 		ProtocolId:    0x41727101980,
-		Action:        0,
+		Action:        udpActionConnect,
 		TransactionId: transactionId,
 	}
 }
 
-func NewAnnounce(connectionId uint64, transactionId uint32, infoHash, peerId [20]byte) *AnnounceRequest {
+func NewAnnounce(connectionId uint64, transactionId uint32, params *AnnounceParams) *AnnounceRequest {
 	return &AnnounceRequest{
 		connectionID:  connectionId,
-		action:        1,
+		action:        udpActionAnnounce,
 		transactionID: transactionId,
-		infoHash:      infoHash,
-		peerID:        peerId,
-		downloaded:    0,
-		left:          0,
-		uploaded:      0,
-		event:         0,
-		iPAddress:     0,
+		infoHash:      params.InfoHash,
+		peerID:        params.PeerId,
+		downloaded:    params.Downloaded,
+		left:          params.Left,
+		uploaded:      params.Uploaded,
+		event:         int32(params.Event),
+		iPAddress:     udpAnnounceIP(params.IPv4),
 		key:           rand.Uint32(),
-		numWant:       -1,
-		port:          6881,
+		numWant:       params.NumWant,
+		port:          params.Port,
+	}
+}
+
+// udpAnnounceIP is the ip field of an udp announce, 0 lets the tracker use the address of the sender
+func udpAnnounceIP(ip net.IP) int32 {
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return 0
 	}
+	return int32(binary.BigEndian.Uint32(ipv4))
 }
 
 func (connReq *ConnectionRequest) Serialize() []byte {
@@ -76,32 +109,42 @@ func (connReq *ConnectionRequest) Serialize() []byte {
 func (req *AnnounceRequest) Serialize() []byte {
 	announceMsg := make([]byte, 98)
 	binary.BigEndian.PutUint64(announceMsg[0:8], req.connectionID)
-	binary.BigEndian.PutUint32(announceMsg[8:12], uint32(1))
+	binary.BigEndian.PutUint32(announceMsg[8:12], uint32(req.action))
 	binary.BigEndian.PutUint32(announceMsg[12:16], req.transactionID)
 	copy(announceMsg[16:36], req.infoHash[:])
 	copy(announceMsg[36:56], req.peerID[:])
 
-	binary.BigEndian.PutUint64(announceMsg[56:64], 0) // downloaded
-	binary.BigEndian.PutUint64(announceMsg[64:72], 0) // left, unknown w/ magnet links
-	binary.BigEndian.PutUint64(announceMsg[72:80], 0) // uploaded
+	binary.BigEndian.PutUint64(announceMsg[56:64], uint64(req.downloaded))
+	binary.BigEndian.PutUint64(announceMsg[64:72], uint64(req.left)) // unknown w/ magnet links
+	binary.BigEndian.PutUint64(announceMsg[72:80], uint64(req.uploaded))
 
-	binary.BigEndian.PutUint32(announceMsg[80:84], 0) // event 0:none; 1:completed; 2:started; 3:stopped
-	binary.BigEndian.PutUint32(announceMsg[84:88], 0) // IP address, default: 0
+	binary.BigEndian.PutUint32(announceMsg[80:84], uint32(req.event))     // event 0:none; 1:completed; 2:started; 3:stopped
+	binary.BigEndian.PutUint32(announceMsg[84:88], uint32(req.iPAddress)) // IP address, default: 0
 
-	binary.BigEndian.PutUint32(announceMsg[88:92], rand.Uint32()) // key - for tracker's statistics
+	binary.BigEndian.PutUint32(announceMsg[88:92], req.key) // key - for tracker's statistics
 
-	neg1 := -1
-	binary.BigEndian.PutUint32(announceMsg[92:96], uint32(neg1))     // num_want -1 default
-	binary.BigEndian.PutUint16(announceMsg[96:98], uint16(req.port)) // port
+	binary.BigEndian.PutUint32(announceMsg[92:96], uint32(req.numWant)) // num_want -1 default
+	binary.BigEndian.PutUint16(announceMsg[96:98], req.port)
 	return announceMsg
 }
 
+func (req *ScrapeRequest) Serialize() []byte {
+	buff := make([]byte, 16+20*len(req.InfoHashes))
+	binary.BigEndian.PutUint64(buff[0:8], req.ConnectionId)
+	binary.BigEndian.PutUint32(buff[8:12], udpActionScrape)
+	binary.BigEndian.PutUint32(buff[12:16], req.TransactionId)
+	for i, infoHash := range req.InfoHashes {
+		copy(buff[16+i*20:], infoHash[:])
+	}
+	return buff
+}
+
 func ParseConnectionResponse(connectionResponse []byte, myTransactionId uint32) (uint64, error) {
 	if len(connectionResponse) < 16 {
 		return 0, fmt.Errorf("invalid connection response, expected 16 bytes but got %d", len(connectionResponse))
 	}
 	action := binary.BigEndian.Uint32(connectionResponse[0:4])
-	if action != 0 {
+	if action != udpActionConnect {
 		return 0, fmt.Errorf("invalid connection response, expected action to be 0 (connection) but got %d", action)
 	}
 	transactionId := binary.BigEndian.Uint32(connectionResponse[4:8])
@@ -112,12 +155,13 @@ func ParseConnectionResponse(connectionResponse []byte, myTransactionId uint32)
 	return connectionId, nil
 }
 
-func ParseAnnounceResponse(announceResponseBuff []byte, myTransactionId uint32) (*AnnounceResponse, error) {
+// ParseAnnounceResponse parses the response of an udp tracker, the peers are IPv6 ones if the tracker was contacted over IPv6
+func ParseAnnounceResponse(announceResponseBuff []byte, myTransactionId uint32, ipv6 bool) (*AnnounceResponse, error) {
 	if len(announceResponseBuff) < 20 {
 		return nil, fmt.Errorf("announce response was too small, expected at least 20 bytes but got %d", len(announceResponseBuff))
 	}
 	action := binary.BigEndian.Uint32(announceResponseBuff[0:4])
-	if action != 1 {
+	if action != udpActionAnnounce {
 		return nil, fmt.Errorf("announce response was expected to be action equal to 1, got %d", action)
 	}
 	transactionId := binary.BigEndian.Uint32(announceResponseBuff[4:8])
@@ -127,7 +171,11 @@ func ParseAnnounceResponse(announceResponseBuff []byte, myTransactionId uint32)
 	interval := binary.BigEndian.Uint32(announceResponseBuff[8:12])
 	leechers := binary.BigEndian.Uint32(announceResponseBuff[12:16])
 	seeders := binary.BigEndian.Uint32(announceResponseBuff[16:20])
-	peers, err := peer.UnmarshallPeers(announceResponseBuff[20:])
+	unmarshallPeers := peer.UnmarshallPeers
+	if ipv6 {
+		unmarshallPeers = peer.UnmarshallPeers6
+	}
+	peers, err := unmarshallPeers(announceResponseBuff[20:])
 	if err != nil {
 		return nil, err
 	}
@@ -140,3 +188,129 @@ func ParseAnnounceResponse(announceResponseBuff []byte, myTransactionId uint32)
 		Peers:         peers,
 	}, nil
 }
+
+// ParseScrapeResponse returns the statistics in the same order of the info hashes of the request
+func ParseScrapeResponse(scrapeResponseBuff []byte, myTransactionId uint32, numInfoHashes int) ([]ScrapeResult, error) {
+	if len(scrapeResponseBuff) < 8 {
+		return nil, fmt.Errorf("scrape response was too small, expected at least 8 bytes but got %d", len(scrapeResponseBuff))
+	}
+	action := binary.BigEndian.Uint32(scrapeResponseBuff[0:4])
+	if action != udpActionScrape {
+		return nil, fmt.Errorf("scrape response was expected to be action equal to 2, got %d", action)
+	}
+	transactionId := binary.BigEndian.Uint32(scrapeResponseBuff[4:8])
+	if myTransactionId != transactionId {
+		return nil, fmt.Errorf("invalid scrape response, expected transaction id to be %d but got %d", myTransactionId, transactionId)
+	}
+	if len(scrapeResponseBuff) < 8+12*numInfoHashes {
+		return nil, fmt.Errorf("scrape response was too small for %d info hashes, got %d bytes", numInfoHashes, len(scrapeResponseBuff))
+	}
+	results := make([]ScrapeResult, numInfoHashes)
+	for i := range results {
+		offset := 8 + i*12
+		results[i] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(scrapeResponseBuff[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(scrapeResponseBuff[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(scrapeResponseBuff[offset+8 : offset+12])),
+		}
+	}
+	return results, nil
+}
+
+// ParseConnectionRequest is used by the tracker side of the protocol
+func ParseConnectionRequest(connectionRequestBuff []byte) (*ConnectionRequest, error) {
+	if len(connectionRequestBuff) < 16 {
+		return nil, fmt.Errorf("invalid connection request, expected 16 bytes but got %d", len(connectionRequestBuff))
+	}
+	connectionRequest := &ConnectionRequest{
+		ProtocolId:    binary.BigEndian.Uint64(connectionRequestBuff[0:8]),
+		Action:        int(binary.BigEndian.Uint32(connectionRequestBuff[8:12])),
+		TransactionId: binary.BigEndian.Uint32(connectionRequestBuff[12:16]),
+	}
+	if connectionRequest.ProtocolId != NewConnection(0).ProtocolId || connectionRequest.Action != udpActionConnect {
+		return nil, fmt.Errorf("invalid connection request, wrong protocol id or action")
+	}
+	return connectionRequest, nil
+}
+
+// ParseAnnounceRequest is used by the tracker side of the protocol, it returns the connection id, the transaction id and the announced values
+func ParseAnnounceRequest(announceRequestBuff []byte) (uint64, uint32, *AnnounceParams, error) {
+	if len(announceRequestBuff) < 98 {
+		return 0, 0, nil, fmt.Errorf("invalid announce request, expected 98 bytes but got %d", len(announceRequestBuff))
+	}
+	params := &AnnounceParams{
+		Downloaded: int64(binary.BigEndian.Uint64(announceRequestBuff[56:64])),
+		Left:       int64(binary.BigEndian.Uint64(announceRequestBuff[64:72])),
+		Uploaded:   int64(binary.BigEndian.Uint64(announceRequestBuff[72:80])),
+		Event:      Event(binary.BigEndian.Uint32(announceRequestBuff[80:84])),
+		NumWant:    int32(binary.BigEndian.Uint32(announceRequestBuff[92:96])),
+		Port:       binary.BigEndian.Uint16(announceRequestBuff[96:98]),
+	}
+	copy(params.InfoHash[:], announceRequestBuff[16:36])
+	copy(params.PeerId[:], announceRequestBuff[36:56])
+	connectionId := binary.BigEndian.Uint64(announceRequestBuff[0:8])
+	transactionId := binary.BigEndian.Uint32(announceRequestBuff[12:16])
+	return connectionId, transactionId, params, nil
+}
+
+// ParseScrapeRequest is used by the tracker side of the protocol
+func ParseScrapeRequest(scrapeRequestBuff []byte) (*ScrapeRequest, error) {
+	if len(scrapeRequestBuff) < 36 || (len(scrapeRequestBuff)-16)%20 != 0 {
+		return nil, fmt.Errorf("invalid scrape request of %d bytes", len(scrapeRequestBuff))
+	}
+	scrapeRequest := &ScrapeRequest{
+		ConnectionId:  binary.BigEndian.Uint64(scrapeRequestBuff[0:8]),
+		TransactionId: binary.BigEndian.Uint32(scrapeRequestBuff[12:16]),
+		InfoHashes:    make([][20]byte, (len(scrapeRequestBuff)-16)/20),
+	}
+	for i := range scrapeRequest.InfoHashes {
+		copy(scrapeRequest.InfoHashes[i][:], scrapeRequestBuff[16+i*20:])
+	}
+	return scrapeRequest, nil
+}
+
+func SerializeConnectionResponse(transactionId uint32, connectionId uint64) []byte {
+	buff := make([]byte, 16)
+	binary.BigEndian.PutUint32(buff[0:4], udpActionConnect)
+	binary.BigEndian.PutUint32(buff[4:8], transactionId)
+	binary.BigEndian.PutUint64(buff[8:16], connectionId)
+	return buff
+}
+
+// Serialize writes the peers in the compact IPv6 format when the request came over IPv6, otherwise in the IPv4 one
+func (res *AnnounceResponse) Serialize(ipv6 bool) []byte {
+	marshallPeers := peer.MarshallPeers
+	if ipv6 {
+		marshallPeers = peer.MarshallPeers6
+	}
+	peers := marshallPeers(res.Peers)
+	buff := make([]byte, 20+len(peers))
+	binary.BigEndian.PutUint32(buff[0:4], udpActionAnnounce)
+	binary.BigEndian.PutUint32(buff[4:8], res.TransactionID)
+	binary.BigEndian.PutUint32(buff[8:12], uint32(res.Interval))
+	binary.BigEndian.PutUint32(buff[12:16], uint32(res.Leechers))
+	binary.BigEndian.PutUint32(buff[16:20], uint32(res.Seeders))
+	copy(buff[20:], peers)
+	return buff
+}
+
+func SerializeScrapeResponse(transactionId uint32, results []ScrapeResult) []byte {
+	buff := make([]byte, 8+12*len(results))
+	binary.BigEndian.PutUint32(buff[0:4], udpActionScrape)
+	binary.BigEndian.PutUint32(buff[4:8], transactionId)
+	for i, result := range results {
+		offset := 8 + i*12
+		binary.BigEndian.PutUint32(buff[offset:offset+4], uint32(result.Seeders))
+		binary.BigEndian.PutUint32(buff[offset+4:offset+8], uint32(result.Completed))
+		binary.BigEndian.PutUint32(buff[offset+8:offset+12], uint32(result.Leechers))
+	}
+	return buff
+}
+
+func SerializeErrorResponse(transactionId uint32, message string) []byte {
+	buff := make([]byte, 8+len(message))
+	binary.BigEndian.PutUint32(buff[0:4], udpActionError)
+	binary.BigEndian.PutUint32(buff[4:8], transactionId)
+	copy(buff[8:], message)
+	return buff
+}
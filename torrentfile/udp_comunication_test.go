@@ -0,0 +1,68 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSerializeAnnounceRequest(t *testing.T) {
+	t.Log("Testing serialize announce request")
+	params := &AnnounceParams{
+		InfoHash:   [20]byte{1, 2, 3},
+		PeerId:     [20]byte{4, 5, 6},
+		Port:       51413,
+		Downloaded: 1000,
+		Uploaded:   300,
+		Left:       2000,
+		Event:      EventCompleted,
+		NumWant:    50,
+	}
+	serialized := NewAnnounce(42, 7, params).Serialize()
+	if len(serialized) != 98 {
+		t.Fatal("expected announce request of 98 bytes but got ", len(serialized))
+	}
+	if binary.BigEndian.Uint64(serialized[0:8]) != 42 || binary.BigEndian.Uint32(serialized[12:16]) != 7 {
+		t.Error("wrong connection id or transaction id")
+	}
+	if serialized[16] != 1 || serialized[36] != 4 {
+		t.Error("wrong info hash or peer id")
+	}
+	if binary.BigEndian.Uint64(serialized[56:64]) != 1000 {
+		t.Error("expected downloaded 1000 but got ", binary.BigEndian.Uint64(serialized[56:64]))
+	}
+	if binary.BigEndian.Uint64(serialized[64:72]) != 2000 {
+		t.Error("expected left 2000 but got ", binary.BigEndian.Uint64(serialized[64:72]))
+	}
+	if binary.BigEndian.Uint64(serialized[72:80]) != 300 {
+		t.Error("expected uploaded 300 but got ", binary.BigEndian.Uint64(serialized[72:80]))
+	}
+	if binary.BigEndian.Uint32(serialized[80:84]) != 1 {
+		t.Error("expected completed event but got ", binary.BigEndian.Uint32(serialized[80:84]))
+	}
+	if binary.BigEndian.Uint32(serialized[92:96]) != 50 {
+		t.Error("expected num want 50 but got ", binary.BigEndian.Uint32(serialized[92:96]))
+	}
+	if binary.BigEndian.Uint16(serialized[96:98]) != 51413 {
+		t.Error("expected port 51413 but got ", binary.BigEndian.Uint16(serialized[96:98]))
+	}
+}
+
+func TestParseAnnounceResponseIPv6(t *testing.T) {
+	t.Log("Testing announce response of an IPv6 tracker")
+	response := make([]byte, 38)
+	binary.BigEndian.PutUint32(response[0:4], udpActionAnnounce)
+	binary.BigEndian.PutUint32(response[4:8], 5)
+	binary.BigEndian.PutUint32(response[8:12], 1800)
+	copy(response[20:38], []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1})
+	announceResponse, err := ParseAnnounceResponse(response, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(announceResponse.Peers) != 1 || announceResponse.Peers[0].String() != "[2001:db8::1]:6881" {
+		t.Error("unexpected peers ", announceResponse.Peers)
+	}
+	_, err = ParseAnnounceResponse(response[:36], 5, true)
+	if err == nil {
+		t.Error("expected an error for a truncated IPv6 peer")
+	}
+}
@@ -0,0 +1,336 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"main/proxy"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// a connection id can be used until one minute after it has been received
+	connectionIdLifetime = time.Minute
+	// BEP 15 waits 15 * 2^n seconds before retransmitting
+	udpBaseTimeout = 15 * time.Second
+	// BEP 15 allows n to grow up to 8 (3840 seconds), fewer retransmissions keep a dead tracker from
+	// blocking the announce for hours before falling back to the next one
+	udpMaxRetransmissions = 2
+)
+
+// TrackerError is the failure message sent by a tracker that refused our request
+type TrackerError struct {
+	TrackerUrl string
+	Message    string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s refused the request: %s", e.TrackerUrl, e.Message)
+}
+
+var errUdpTimeout = errors.New("udp tracker did not answer in time")
+
+type udpConnectionId struct {
+	id       uint64
+	received time.Time
+}
+
+type udpTransaction struct {
+	addr     *net.UDPAddr
+	response chan []byte
+}
+
+// udpTrackerClient talks to every udp tracker through a single socket, caching the connection ids
+type udpTrackerClient struct {
+	mu                 sync.Mutex
+	conn               net.PacketConn
+	proxy              *proxy.Proxy
+	connectionIds      map[string]udpConnectionId
+	transactions       map[uint32]*udpTransaction
+	baseTimeout        time.Duration
+	maxRetransmissions int
+}
+
+var udpTracker = newUdpTrackerClient(udpBaseTimeout, udpMaxRetransmissions)
+
+func newUdpTrackerClient(baseTimeout time.Duration, maxRetransmissions int) *udpTrackerClient {
+	return &udpTrackerClient{
+		connectionIds:      make(map[string]udpConnectionId),
+		transactions:       make(map[uint32]*udpTransaction),
+		baseTimeout:        baseTimeout,
+		maxRetransmissions: maxRetransmissions,
+	}
+}
+
+func getPeersFromUdpTracker(trackerUrl string, params *AnnounceParams) (*TrackerResponse, error) {
+	announceResponse, err := udpTracker.announce(trackerUrl, params)
+	if err != nil {
+		return nil, err
+	}
+	return &TrackerResponse{
+		Interval: time.Duration(announceResponse.Interval) * time.Second,
+		Seeders:  int(announceResponse.Seeders),
+		Leechers: int(announceResponse.Leechers),
+		Peers:    announceResponse.Peers,
+	}, nil
+}
+
+func scrapeUdpTracker(trackerUrl string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	return udpTracker.scrape(trackerUrl, infoHashes)
+}
+
+func (c *udpTrackerClient) announce(trackerUrl string, params *AnnounceParams) (*AnnounceResponse, error) {
+	addr, err := resolveUdpTracker(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+	response, transactionId, err := c.request(trackerUrl, addr, func(connectionId uint64, transactionId uint32) []byte {
+		return NewAnnounce(connectionId, transactionId, params).Serialize()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ParseAnnounceResponse(response, transactionId, addr.IP.To4() == nil)
+}
+
+func (c *udpTrackerClient) scrape(trackerUrl string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	addr, err := resolveUdpTracker(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[[20]byte]ScrapeResult, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += maxUdpScrapeHashes {
+		batch := infoHashes[start:min(start+maxUdpScrapeHashes, len(infoHashes))]
+		response, transactionId, err := c.request(trackerUrl, addr, func(connectionId uint64, transactionId uint32) []byte {
+			scrapeRequest := &ScrapeRequest{
+				ConnectionId:  connectionId,
+				TransactionId: transactionId,
+				InfoHashes:    batch,
+			}
+			return scrapeRequest.Serialize()
+		})
+		if err != nil {
+			return nil, err
+		}
+		batchResults, err := ParseScrapeResponse(response, transactionId, len(batch))
+		if err != nil {
+			return nil, err
+		}
+		for i, result := range batchResults {
+			results[batch[i]] = result
+		}
+	}
+	return results, nil
+}
+
+func resolveUdpTracker(trackerUrl string) (*net.UDPAddr, error) {
+	parsedTrackerUrl, err := url.Parse(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+	if parsedTrackerUrl.Scheme != "udp" {
+		return nil, fmt.Errorf("unsupported tracker scheme %s", parsedTrackerUrl.Scheme)
+	}
+	return net.ResolveUDPAddr("udp", parsedTrackerUrl.Host)
+}
+
+// request sends the packet built by buildPacket, retransmitting it until the tracker answers, and returns
+// the response together with the transaction id used
+func (c *udpTrackerClient) request(trackerUrl string, addr *net.UDPAddr, buildPacket func(connectionId uint64, transactionId uint32) []byte) ([]byte, uint32, error) {
+	connection, err := c.connectionId(trackerUrl, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	transactionId := c.newTransaction(addr)
+	defer c.endTransaction(transactionId)
+	reconnected := false
+
+	for n := 0; ; n++ {
+		if time.Since(connection.received) > connectionIdLifetime && !reconnected {
+			// the connection id expired while waiting, get a new one and start the schedule from scratch
+			connection, err = c.connectionId(trackerUrl, addr)
+			if err != nil {
+				return nil, 0, err
+			}
+			reconnected = true
+			n = 0
+		}
+		response, err := c.exchange(trackerUrl, addr, transactionId, buildPacket(connection.id, transactionId), n)
+		if errors.Is(err, errUdpTimeout) && n < c.maxRetransmissions {
+			trackerLogger.Debug("no answer from tracker, retransmitting", "tracker", trackerUrl, "attempt", n+1)
+			continue
+		}
+		var trackerError *TrackerError
+		if errors.As(err, &trackerError) {
+			// the tracker may have refused our connection id, do not reuse it
+			c.mu.Lock()
+			delete(c.connectionIds, addr.String())
+			c.mu.Unlock()
+		}
+		return response, transactionId, err
+	}
+}
+
+// connectionId returns the cached connection id of the tracker or obtains a new one
+func (c *udpTrackerClient) connectionId(trackerUrl string, addr *net.UDPAddr) (udpConnectionId, error) {
+	c.mu.Lock()
+	connection, ok := c.connectionIds[addr.String()]
+	c.mu.Unlock()
+	if ok && time.Since(connection.received) < connectionIdLifetime {
+		return connection, nil
+	}
+
+	transactionId := c.newTransaction(addr)
+	defer c.endTransaction(transactionId)
+	connectionRequest := NewConnection(transactionId)
+	for n := 0; ; n++ {
+		response, err := c.exchange(trackerUrl, addr, transactionId, connectionRequest.Serialize(), n)
+		if errors.Is(err, errUdpTimeout) && n < c.maxRetransmissions {
+			trackerLogger.Debug("no answer from tracker, retransmitting the connection request", "tracker", trackerUrl,
+				"attempt", n+1)
+			continue
+		}
+		if err != nil {
+			return udpConnectionId{}, err
+		}
+		id, err := ParseConnectionResponse(response, transactionId)
+		if err != nil {
+			return udpConnectionId{}, err
+		}
+		connection = udpConnectionId{id: id, received: time.Now()}
+		c.mu.Lock()
+		c.connectionIds[addr.String()] = connection
+		c.mu.Unlock()
+		trackerLogger.Debug("connected to tracker", "tracker", trackerUrl, "connection_id", id)
+		return connection, nil
+	}
+}
+
+// exchange sends a packet and waits 15 * 2^n seconds for the response, turning error responses into a TrackerError
+func (c *udpTrackerClient) exchange(trackerUrl string, addr *net.UDPAddr, transactionId uint32, packet []byte, n int) ([]byte, error) {
+	conn, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	transaction := c.transactions[transactionId]
+	c.mu.Unlock()
+
+	_, err = conn.WriteTo(packet, addr)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(c.baseTimeout << n)
+	defer timer.Stop()
+	select {
+	case response := <-transaction.response:
+		if binary.BigEndian.Uint32(response[0:4]) == udpActionError {
+			return nil, &TrackerError{TrackerUrl: trackerUrl, Message: string(response[8:])}
+		}
+		return response, nil
+	case <-timer.C:
+		return nil, errUdpTimeout
+	}
+}
+
+// start opens the shared socket the first time it is needed and returns it
+func (c *udpTrackerClient) start() (net.PacketConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	conn, err := c.proxy.ListenPacket()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.readLoop(conn)
+	return conn, nil
+}
+
+// share makes the client use a socket shared with other protocols, like the one of uTP, when it has none yet
+// so that the trackers see the same port the peers connect to. When the shared socket is closed the client
+// opens its own again, a client that goes through a proxy keeps its own
+func (c *udpTrackerClient) share(conn net.PacketConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil || c.proxy != nil {
+		return
+	}
+	c.conn = conn
+	go c.readLoop(conn)
+}
+
+// useProxy sends the following requests through the proxy, the socket opened so far is closed
+func (c *udpTrackerClient) useProxy(p *proxy.Proxy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proxy = p
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// readLoop hands every packet to the transaction waiting for it
+func (c *udpTrackerClient) readLoop(conn net.PacketConn) {
+	buff := make([]byte, 65536)
+	for {
+		n, packetAddr, err := conn.ReadFrom(buff)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				trackerLogger.Warn("error reading from the udp tracker socket", "error", err)
+			}
+			c.mu.Lock()
+			if c.conn == conn {
+				c.conn = nil
+			}
+			c.mu.Unlock()
+			return
+		}
+		addr, ok := packetAddr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		// every response starts with the action and the transaction id
+		if n < 8 {
+			continue
+		}
+		transactionId := binary.BigEndian.Uint32(buff[4:8])
+		c.mu.Lock()
+		transaction, ok := c.transactions[transactionId]
+		c.mu.Unlock()
+		if !ok || !transaction.addr.IP.Equal(addr.IP) || transaction.addr.Port != addr.Port {
+			continue
+		}
+		response := make([]byte, n)
+		copy(response, buff[:n])
+		select {
+		case transaction.response <- response:
+		default:
+		}
+	}
+}
+
+func (c *udpTrackerClient) newTransaction(addr *net.UDPAddr) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		transactionId := rand.Uint32()
+		if _, ok := c.transactions[transactionId]; !ok {
+			c.transactions[transactionId] = &udpTransaction{addr: addr, response: make(chan []byte, 1)}
+			return transactionId
+		}
+	}
+}
+
+func (c *udpTrackerClient) endTransaction(transactionId uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.transactions, transactionId)
+}
@@ -0,0 +1,269 @@
+package torrentfile
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"main/peer"
+	"main/utp"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUdpTracker is a local BEP 15 tracker that can drop packets and refuse announces
+type fakeUdpTracker struct {
+	conn           *net.UDPConn
+	mu             sync.Mutex
+	dropPackets    int
+	connects       int
+	announces      int
+	failureMessage string
+	// lastAddr is the address the last announce came from
+	lastAddr *net.UDPAddr
+}
+
+func startFakeUdpTracker(t *testing.T) *fakeUdpTracker {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &fakeUdpTracker{conn: conn}
+	go tracker.serve()
+	t.Cleanup(func() { conn.Close() })
+	return tracker
+}
+
+func (f *fakeUdpTracker) url() string {
+	return "udp://" + f.conn.LocalAddr().String()
+}
+
+func (f *fakeUdpTracker) serve() {
+	buff := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		if f.dropPackets > 0 {
+			f.dropPackets--
+			f.mu.Unlock()
+			continue
+		}
+		f.mu.Unlock()
+		if n < 16 {
+			continue
+		}
+		action := binary.BigEndian.Uint32(buff[8:12])
+		transactionId := buff[12:16]
+		var response []byte
+		switch action {
+		case udpActionConnect:
+			f.mu.Lock()
+			f.connects++
+			f.mu.Unlock()
+			response = make([]byte, 16)
+			copy(response[4:8], transactionId)
+			binary.BigEndian.PutUint64(response[8:16], 0xcafe)
+		case udpActionAnnounce:
+			f.mu.Lock()
+			f.announces++
+			f.lastAddr = addr
+			failureMessage := f.failureMessage
+			f.mu.Unlock()
+			if failureMessage != "" {
+				response = make([]byte, 8, 8+len(failureMessage))
+				binary.BigEndian.PutUint32(response[0:4], udpActionError)
+				copy(response[4:8], transactionId)
+				response = append(response, failureMessage...)
+				break
+			}
+			response = make([]byte, 26)
+			binary.BigEndian.PutUint32(response[0:4], udpActionAnnounce)
+			copy(response[4:8], transactionId)
+			binary.BigEndian.PutUint32(response[8:12], 1800)
+			copy(response[20:26], []byte{127, 0, 0, 1, 0x1a, 0xe1})
+		case udpActionScrape:
+			numInfoHashes := (n - 16) / 20
+			response = make([]byte, 8+12*numInfoHashes)
+			binary.BigEndian.PutUint32(response[0:4], udpActionScrape)
+			copy(response[4:8], transactionId)
+			for i := 0; i < numInfoHashes; i++ {
+				binary.BigEndian.PutUint32(response[8+i*12:], uint32(i))
+			}
+		}
+		f.conn.WriteToUDP(response, addr)
+	}
+}
+
+func TestUdpTrackerAnnounce(t *testing.T) {
+	t.Log("Testing udp announce with connection id reuse")
+	tracker := startFakeUdpTracker(t)
+	client := newUdpTrackerClient(50*time.Millisecond, 3)
+	params := &AnnounceParams{Port: 6881, NumWant: -1}
+
+	for i := 0; i < 2; i++ {
+		response, err := client.announce(tracker.url(), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []peer.Peer{{IpAddr: net.IP{127, 0, 0, 1}, Port: 6881}}
+		if response.Interval != 1800 || !reflect.DeepEqual(response.Peers, expected) {
+			t.Error("unexpected announce response ", response)
+		}
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.connects != 1 || tracker.announces != 2 {
+		t.Errorf("expected 1 connect and 2 announces but got %d and %d", tracker.connects, tracker.announces)
+	}
+}
+
+func TestUdpTrackerRetransmit(t *testing.T) {
+	t.Log("Testing udp retransmission")
+	tracker := startFakeUdpTracker(t)
+	tracker.mu.Lock()
+	tracker.dropPackets = 2
+	tracker.mu.Unlock()
+	client := newUdpTrackerClient(50*time.Millisecond, 3)
+
+	_, err := client.announce(tracker.url(), &AnnounceParams{NumWant: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.mu.Lock()
+	tracker.dropPackets = 100
+	tracker.mu.Unlock()
+	client = newUdpTrackerClient(10*time.Millisecond, 2)
+	start := time.Now()
+	_, err = client.announce(tracker.url(), &AnnounceParams{NumWant: -1})
+	if !errors.Is(err, errUdpTimeout) {
+		t.Fatal("expected a timeout but got ", err)
+	}
+	// 10 + 20 + 40 milliseconds
+	if time.Since(start) < 70*time.Millisecond {
+		t.Error("gave up before the retransmission schedule ended ", time.Since(start))
+	}
+}
+
+func TestUdpTrackerError(t *testing.T) {
+	t.Log("Testing udp error response")
+	tracker := startFakeUdpTracker(t)
+	tracker.mu.Lock()
+	tracker.failureMessage = "torrent not registered"
+	tracker.mu.Unlock()
+	client := newUdpTrackerClient(50*time.Millisecond, 3)
+
+	_, err := client.announce(tracker.url(), &AnnounceParams{NumWant: -1})
+	var trackerError *TrackerError
+	if !errors.As(err, &trackerError) || trackerError.Message != "torrent not registered" {
+		t.Fatal("expected a tracker error but got ", err)
+	}
+}
+
+func TestUdpTrackerScrape(t *testing.T) {
+	t.Log("Testing udp scrape in batches")
+	tracker := startFakeUdpTracker(t)
+	client := newUdpTrackerClient(50*time.Millisecond, 3)
+
+	infoHashes := make([][20]byte, maxUdpScrapeHashes+2)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+	results, err := client.scrape(tracker.url(), infoHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(infoHashes) {
+		t.Fatalf("expected %d results but got %d", len(infoHashes), len(results))
+	}
+	if results[infoHashes[maxUdpScrapeHashes+1]].Seeders != 1 {
+		t.Error("expected the second batch to be scraped separately")
+	}
+}
+
+func TestUdpTrackerSharedSocket(t *testing.T) {
+	t.Log("Testing udp announces through the socket shared with uTP")
+	tracker := startFakeUdpTracker(t)
+	socket, err := utp.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newUdpTrackerClient(50*time.Millisecond, 3)
+	client.share(socket.PacketConn())
+	_, err = client.announce(tracker.url(), &AnnounceParams{NumWant: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.mu.Lock()
+	lastAddr := tracker.lastAddr
+	tracker.mu.Unlock()
+	if lastAddr.String() != socket.Addr().String() {
+		t.Errorf("expected the announce from %s, got it from %s", socket.Addr(), lastAddr)
+	}
+
+	// once the shared socket is closed the client opens its own
+	socket.Close()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		client.mu.Lock()
+		conn := client.conn
+		client.mu.Unlock()
+		if conn == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	_, err = client.announce(tracker.url(), &AnnounceParams{NumWant: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadSharesInjectedUTP(t *testing.T) {
+	t.Log("Testing that the uTP socket of a session carries the udp announces of its torrents")
+	tracker := startFakeUdpTracker(t)
+	socket, err := utp.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	listener, err := peer.Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// the client of the package may already use a socket of another test
+	shared := udpTracker
+	udpTracker = newUdpTrackerClient(50*time.Millisecond, 3)
+	defer func() { udpTracker = shared }()
+
+	// a session hands its listener and uTP socket to every torrent it downloads
+	torrent := &TorrentFile{
+		Announce:    tracker.url(),
+		InfoHash:    [20]byte{1},
+		PieceHashes: [][20]byte{{2}},
+		PieceLength: 10,
+		Length:      10,
+		Name:        "a.iso",
+		Listener:    listener,
+		UseUTP:      true,
+		UTP:         socket,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- torrent.DownloadContext(ctx, t.TempDir()) }()
+	var lastAddr *net.UDPAddr
+	for deadline := time.Now().Add(2 * time.Second); lastAddr == nil && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		tracker.mu.Lock()
+		lastAddr = tracker.lastAddr
+		tracker.mu.Unlock()
+	}
+	cancel()
+	<-done
+	if lastAddr == nil || lastAddr.String() != socket.Addr().String() {
+		t.Errorf("expected the announce from %s, got it from %v", socket.Addr(), lastAddr)
+	}
+}
@@ -0,0 +1,160 @@
+package tracker
+
+import (
+	"errors"
+	"main/bencode"
+	"main/peer"
+	"main/torrentfile"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ListenHTTP serves the /announce and /scrape endpoints on the given address until Close is called
+func (t *Tracker) ListenHTTP(address string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: t}
+	t.addCloser(server.Close)
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.logger().Error("error serving the http tracker", "error", err)
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		t.serveAnnounce(w, r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		t.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (t *Tracker) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	params := &torrentfile.AnnounceParams{}
+	if len(query.Get("info_hash")) != 20 || len(query.Get("peer_id")) != 20 {
+		writeFailure(w, "invalid info_hash or peer_id")
+		return
+	}
+	copy(params.InfoHash[:], query.Get("info_hash"))
+	copy(params.PeerId[:], query.Get("peer_id"))
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil {
+		writeFailure(w, "invalid port")
+		return
+	}
+	params.Port = uint16(port)
+	params.Downloaded, _ = strconv.ParseInt(query.Get("downloaded"), 10, 64)
+	params.Uploaded, _ = strconv.ParseInt(query.Get("uploaded"), 10, 64)
+	params.Left, err = strconv.ParseInt(query.Get("left"), 10, 64)
+	if err != nil {
+		writeFailure(w, "invalid left")
+		return
+	}
+	params.NumWant = -1
+	if numWant, err := strconv.ParseInt(query.Get("numwant"), 10, 32); err == nil {
+		params.NumWant = int32(numWant)
+	}
+	switch query.Get("event") {
+	case "started":
+		params.Event = torrentfile.EventStarted
+	case "completed":
+		params.Event = torrentfile.EventCompleted
+	case "stopped":
+		params.Event = torrentfile.EventStopped
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, "invalid remote address")
+		return
+	}
+	result, err := t.announce(net.ParseIP(host), params)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	response := map[string]interface{}{
+		"interval":   int(t.Interval.Seconds()),
+		"complete":   result.seeders,
+		"incomplete": result.leechers,
+	}
+	if query.Get("compact") == "0" {
+		peerList := make([]interface{}, 0, len(result.peers))
+		for _, swarmPeer := range result.peers {
+			peerDict := map[string]interface{}{
+				"ip":   swarmPeer.peer.IpAddr.String(),
+				"port": int(swarmPeer.peer.Port),
+			}
+			if query.Get("no_peer_id") != "1" {
+				peerDict["peer id"] = swarmPeer.peerId[:]
+			}
+			peerList = append(peerList, peerDict)
+		}
+		response["peers"] = peerList
+	} else {
+		peers := make([]peer.Peer, len(result.peers))
+		for i, swarmPeer := range result.peers {
+			peers[i] = swarmPeer.peer
+		}
+		response["peers"] = peer.MarshallPeers(peers)
+		if compactPeers6 := peer.MarshallPeers6(peers); len(compactPeers6) > 0 {
+			response["peers6"] = compactPeers6
+		}
+	}
+	writeBencode(w, response)
+}
+
+func (t *Tracker) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, rawInfoHash := range r.URL.Query()["info_hash"] {
+		if len(rawInfoHash) != 20 {
+			writeFailure(w, "invalid info_hash")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], rawInfoHash)
+		infoHashes = append(infoHashes, infoHash)
+	}
+	var results []torrentfile.ScrapeResult
+	if len(infoHashes) == 0 {
+		infoHashes, results = t.scrapeAll()
+	} else {
+		results = t.scrape(infoHashes)
+	}
+
+	files := make(map[string]interface{}, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		files[string(infoHash[:])] = map[string]interface{}{
+			"complete":   results[i].Seeders,
+			"downloaded": results[i].Completed,
+			"incomplete": results[i].Leechers,
+		}
+	}
+	writeBencode(w, map[string]interface{}{"files": files})
+}
+
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, map[string]interface{}{"failure reason": reason})
+}
+
+func writeBencode(w http.ResponseWriter, value map[string]interface{}) {
+	encoded, err := bencode.Encode(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(encoded)
+}
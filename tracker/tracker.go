@@ -0,0 +1,230 @@
+package tracker
+
+import (
+	"fmt"
+	"log/slog"
+	"main/logging"
+	"main/peer"
+	"main/torrentfile"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval = 30 * time.Minute
+	defaultNumWant  = 50
+	maxNumWant      = 200
+)
+
+type swarmPeer struct {
+	peer     peer.Peer
+	peerId   [20]byte
+	left     int64
+	lastSeen time.Time
+}
+
+type swarm struct {
+	peers     map[string]*swarmPeer
+	completed int
+}
+
+// Tracker keeps the swarms in memory and answers the announces and scrapes of both the http and the udp protocol
+type Tracker struct {
+	// Interval is the announce interval asked to the clients
+	Interval time.Duration
+	// PeerExpiry is how long a peer that stops announcing stays in the swarm, by default twice the interval
+	PeerExpiry time.Duration
+	// Logger receives the errors of the servers, nil discards them
+	Logger *slog.Logger
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	allowlist map[[20]byte]bool
+	stop      chan struct{}
+	closeOnce sync.Once
+	closers   []func() error
+}
+
+// announceResult is what the tracker answers to an announce, whatever the protocol
+type announceResult struct {
+	peers    []*swarmPeer
+	seeders  int
+	leechers int
+}
+
+func New() *Tracker {
+	t := &Tracker{
+		Interval: defaultInterval,
+		swarms:   make(map[[20]byte]*swarm),
+		stop:     make(chan struct{}),
+	}
+	go t.expireLoop()
+	return t
+}
+
+// Allow restricts the tracker to the given torrents, without calling it every torrent is tracked
+func (t *Tracker) Allow(infoHashes ...[20]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.allowlist == nil {
+		t.allowlist = make(map[[20]byte]bool)
+	}
+	for _, infoHash := range infoHashes {
+		t.allowlist[infoHash] = true
+	}
+}
+
+// Close stops the servers started by the tracker
+func (t *Tracker) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		t.mu.Lock()
+		closers := t.closers
+		t.mu.Unlock()
+		for _, closer := range closers {
+			if closeErr := closer(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (t *Tracker) logger() *slog.Logger {
+	return logging.Or(t.Logger)
+}
+
+func (t *Tracker) peerExpiry() time.Duration {
+	if t.PeerExpiry > 0 {
+		return t.PeerExpiry
+	}
+	return 2 * t.Interval
+}
+
+// announce registers the peer in the swarm and returns other peers of the swarm, seeders are not given to other seeders
+func (t *Tracker) announce(ipAddr net.IP, params *torrentfile.AnnounceParams) (*announceResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.allowlist != nil && !t.allowlist[params.InfoHash] {
+		return nil, fmt.Errorf("torrent not allowed on this tracker")
+	}
+	if params.Port == 0 {
+		return nil, fmt.Errorf("invalid port")
+	}
+	s, ok := t.swarms[params.InfoHash]
+	if !ok {
+		s = &swarm{peers: make(map[string]*swarmPeer)}
+		t.swarms[params.InfoHash] = s
+	}
+
+	if ipv4 := ipAddr.To4(); ipv4 != nil {
+		ipAddr = ipv4
+	}
+	announcingPeer := peer.Peer{IpAddr: ipAddr, Port: params.Port}
+	key := announcingPeer.String()
+	if params.Event == torrentfile.EventStopped {
+		delete(s.peers, key)
+	} else {
+		if params.Event == torrentfile.EventCompleted {
+			s.completed++
+		}
+		s.peers[key] = &swarmPeer{
+			peer:     announcingPeer,
+			peerId:   params.PeerId,
+			left:     params.Left,
+			lastSeen: time.Now(),
+		}
+	}
+
+	numWant := int(params.NumWant)
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+	result := &announceResult{}
+	for peerKey, swarmPeer := range s.peers {
+		if swarmPeer.left == 0 {
+			result.seeders++
+		} else {
+			result.leechers++
+		}
+		if peerKey == key || len(result.peers) >= numWant || (params.Left == 0 && swarmPeer.left == 0) {
+			continue
+		}
+		result.peers = append(result.peers, swarmPeer)
+	}
+	rand.Shuffle(len(result.peers), func(i, j int) {
+		result.peers[i], result.peers[j] = result.peers[j], result.peers[i]
+	})
+	return result, nil
+}
+
+func (t *Tracker) scrape(infoHashes [][20]byte) []torrentfile.ScrapeResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	results := make([]torrentfile.ScrapeResult, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		s, ok := t.swarms[infoHash]
+		if !ok {
+			continue
+		}
+		results[i].Completed = s.completed
+		for _, swarmPeer := range s.peers {
+			if swarmPeer.left == 0 {
+				results[i].Seeders++
+			} else {
+				results[i].Leechers++
+			}
+		}
+	}
+	return results
+}
+
+// scrapeAll returns the statistics of every swarm, used by an http scrape without info hashes
+func (t *Tracker) scrapeAll() ([][20]byte, []torrentfile.ScrapeResult) {
+	t.mu.Lock()
+	infoHashes := make([][20]byte, 0, len(t.swarms))
+	for infoHash := range t.swarms {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	t.mu.Unlock()
+	return infoHashes, t.scrape(infoHashes)
+}
+
+func (t *Tracker) expireLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.expirePeers()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// expirePeers removes the peers that did not announce for longer than the peer expiry
+func (t *Tracker) expirePeers() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for infoHash, s := range t.swarms {
+		for key, swarmPeer := range s.peers {
+			if time.Since(swarmPeer.lastSeen) > t.peerExpiry() {
+				delete(s.peers, key)
+			}
+		}
+		if len(s.peers) == 0 && s.completed == 0 {
+			delete(t.swarms, infoHash)
+		}
+	}
+}
+
+func (t *Tracker) addCloser(closer func() error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closers = append(t.closers, closer)
+}
@@ -0,0 +1,149 @@
+package tracker
+
+import (
+	"main/torrentfile"
+	"net"
+	"testing"
+	"time"
+)
+
+var testInfoHash = [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+// addPeer registers a peer as if it announced from 127.0.0.1
+func addPeer(t *testing.T, tracker *Tracker, port uint16, left int64) {
+	_, err := tracker.announce(net.IPv4(127, 0, 0, 1), &torrentfile.AnnounceParams{
+		InfoHash: testInfoHash,
+		PeerId:   [20]byte{byte(port)},
+		Port:     port,
+		Left:     left,
+		Event:    torrentfile.EventStarted,
+		NumWant:  -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestTorrent() *torrentfile.TorrentFile {
+	return &torrentfile.TorrentFile{InfoHash: testInfoHash, PeerId: [20]byte{'c', 'l', 'i', 'e', 'n', 't'}, Length: 100}
+}
+
+func TestAnnounce(t *testing.T) {
+	t.Log("Testing that seeders only get leechers and that stopped peers leave the swarm")
+	tracker := New()
+	defer tracker.Close()
+	addPeer(t, tracker, 1000, 0)
+	addPeer(t, tracker, 1001, 50)
+
+	result, err := tracker.announce(net.IPv4(127, 0, 0, 1), &torrentfile.AnnounceParams{InfoHash: testInfoHash, Port: 1002, Left: 0, NumWant: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.seeders != 2 || result.leechers != 1 {
+		t.Errorf("expected 2 seeders and 1 leecher but got %d and %d", result.seeders, result.leechers)
+	}
+	if len(result.peers) != 1 || result.peers[0].peer.Port != 1001 {
+		t.Errorf("expected only the leecher on port 1001 but got %v", result.peers)
+	}
+
+	_, err = tracker.announce(net.IPv4(127, 0, 0, 1), &torrentfile.AnnounceParams{InfoHash: testInfoHash, Port: 1001, Event: torrentfile.EventStopped})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := tracker.scrape([][20]byte{testInfoHash})
+	if results[0].Seeders != 2 || results[0].Leechers != 0 {
+		t.Errorf("expected 2 seeders and no leechers after the stop but got %+v", results[0])
+	}
+}
+
+func TestAllow(t *testing.T) {
+	t.Log("Testing that torrents outside the allowlist are refused")
+	tracker := New()
+	defer tracker.Close()
+	tracker.Allow([20]byte{42})
+	_, err := tracker.announce(net.IPv4(127, 0, 0, 1), &torrentfile.AnnounceParams{InfoHash: testInfoHash, Port: 1000})
+	if err == nil {
+		t.Error("expected the announce of a torrent not allowed to fail")
+	}
+}
+
+func TestExpirePeers(t *testing.T) {
+	t.Log("Testing that peers that stop announcing are removed")
+	tracker := New()
+	defer tracker.Close()
+	tracker.PeerExpiry = time.Millisecond
+	addPeer(t, tracker, 1000, 50)
+	time.Sleep(5 * time.Millisecond)
+	tracker.expirePeers()
+	results := tracker.scrape([][20]byte{testInfoHash})
+	if results[0].Leechers != 0 {
+		t.Errorf("expected the peer to expire but the swarm still has %d leechers", results[0].Leechers)
+	}
+}
+
+func TestHTTPTracker(t *testing.T) {
+	t.Log("Testing announce and scrape through the http tracker")
+	tracker := New()
+	defer tracker.Close()
+	addr, err := tracker.ListenHTTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addPeer(t, tracker, 1000, 0)
+	announceUrl := "http://" + addr.String() + "/announce"
+
+	announcer := torrentfile.NewAnnouncer([][]string{{announceUrl}}, newTestTorrent())
+	response, err := announcer.Announce(torrentfile.EventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 1 || response.Peers[0].Port != 1000 {
+		t.Errorf("expected the seeder on port 1000 but got %v", response.Peers)
+	}
+	if response.Seeders != 1 || response.Leechers != 1 {
+		t.Errorf("expected 1 seeder and 1 leecher but got %d and %d", response.Seeders, response.Leechers)
+	}
+
+	results, err := torrentfile.Scrape(announceUrl, [][20]byte{testInfoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[testInfoHash] != (torrentfile.ScrapeResult{Seeders: 1, Leechers: 1}) {
+		t.Errorf("unexpected scrape result %+v", results[testInfoHash])
+	}
+}
+
+func TestUDPTracker(t *testing.T) {
+	t.Log("Testing announce and scrape through the udp tracker")
+	tracker := New()
+	defer tracker.Close()
+	addr, err := tracker.ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addPeer(t, tracker, 1000, 0)
+	announceUrl := "udp://" + addr.String() + "/announce"
+
+	announcer := torrentfile.NewAnnouncer([][]string{{announceUrl}}, newTestTorrent())
+	response, err := announcer.Announce(torrentfile.EventStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 1 || response.Peers[0].Port != 1000 {
+		t.Errorf("expected the seeder on port 1000 but got %v", response.Peers)
+	}
+
+	results, err := torrentfile.Scrape(announceUrl, [][20]byte{testInfoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[testInfoHash] != (torrentfile.ScrapeResult{Seeders: 1, Leechers: 1}) {
+		t.Errorf("unexpected scrape result %+v", results[testInfoHash])
+	}
+
+	tracker.Allow([20]byte{42})
+	_, err = torrentfile.NewAnnouncer([][]string{{announceUrl}}, newTestTorrent()).Announce(torrentfile.EventStarted)
+	if err == nil {
+		t.Error("expected the tracker to refuse a torrent outside the allowlist")
+	}
+}
@@ -0,0 +1,106 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"main/torrentfile"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// connection ids are accepted for two minutes, clients use them for one
+const connectionIdLifetime = 2 * time.Minute
+
+// ListenUDP serves the BEP 15 protocol on the given address until Close is called
+func (t *Tracker) ListenUDP(address string) (net.Addr, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	t.addCloser(conn.Close)
+	go t.serveUDP(conn)
+	return conn.LocalAddr(), nil
+}
+
+func (t *Tracker) serveUDP(conn *net.UDPConn) {
+	connectionIds := make(map[uint64]time.Time)
+	buff := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFromUDP(buff)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			t.logger().Warn("error reading from the udp tracker socket", "error", err)
+			continue
+		}
+		if n < 16 {
+			continue
+		}
+		response := t.handleUDPPacket(buff[:n], addr, connectionIds)
+		if response != nil {
+			conn.WriteToUDP(response, addr)
+		}
+	}
+}
+
+// handleUDPPacket returns the response to a request, connectionIds is only used by the serving goroutine
+func (t *Tracker) handleUDPPacket(packet []byte, addr *net.UDPAddr, connectionIds map[uint64]time.Time) []byte {
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := binary.BigEndian.Uint32(packet[12:16])
+	if action == 0 {
+		_, err := torrentfile.ParseConnectionRequest(packet)
+		if err != nil {
+			return nil
+		}
+		for id, issued := range connectionIds {
+			if time.Since(issued) > connectionIdLifetime {
+				delete(connectionIds, id)
+			}
+		}
+		connectionId := rand.Uint64()
+		connectionIds[connectionId] = time.Now()
+		return torrentfile.SerializeConnectionResponse(transactionId, connectionId)
+	}
+
+	issued, ok := connectionIds[binary.BigEndian.Uint64(packet[0:8])]
+	if !ok || time.Since(issued) > connectionIdLifetime {
+		return torrentfile.SerializeErrorResponse(transactionId, "invalid connection id")
+	}
+	switch action {
+	case 1:
+		_, _, params, err := torrentfile.ParseAnnounceRequest(packet)
+		if err != nil {
+			return torrentfile.SerializeErrorResponse(transactionId, err.Error())
+		}
+		result, err := t.announce(addr.IP, params)
+		if err != nil {
+			return torrentfile.SerializeErrorResponse(transactionId, err.Error())
+		}
+		announceResponse := &torrentfile.AnnounceResponse{
+			Action:        1,
+			TransactionID: transactionId,
+			Interval:      int32(t.Interval.Seconds()),
+			Leechers:      int32(result.leechers),
+			Seeders:       int32(result.seeders),
+		}
+		for _, swarmPeer := range result.peers {
+			announceResponse.Peers = append(announceResponse.Peers, swarmPeer.peer)
+		}
+		// IPv4 clients get IPv4 peers, IPv6 clients get IPv6 peers
+		return announceResponse.Serialize(addr.IP.To4() == nil)
+	case 2:
+		scrapeRequest, err := torrentfile.ParseScrapeRequest(packet)
+		if err != nil {
+			return torrentfile.SerializeErrorResponse(transactionId, err.Error())
+		}
+		return torrentfile.SerializeScrapeResponse(transactionId, t.scrape(scrapeRequest.InfoHashes))
+	default:
+		return torrentfile.SerializeErrorResponse(transactionId, "unknown action")
+	}
+}
@@ -0,0 +1,549 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPayload keeps the packets under the MTU of most links
+	maxPayload = 1200
+	minWindow  = maxPayload
+	// maxWindow bounds the congestion window, maxReceiveBuffer the data buffered for the reader
+	maxWindow        = 1 << 20
+	maxReceiveBuffer = 1 << 20
+	// maxOutOfOrder is the number of packets after the first missing one that are kept
+	maxOutOfOrder = 1024
+	// LEDBAT keeps the queuing delay it adds around target and grows the window by at most
+	// maxWindowIncrease bytes every round trip
+	target            = 100 * time.Millisecond
+	maxWindowIncrease = 3000
+	// delayHistoryPeriod is how often the oldest minimum of the base delay is dropped
+	delayHistoryPeriod = time.Minute
+	initialTimeout     = time.Second
+	minTimeout         = 500 * time.Millisecond
+	maxTimeout         = 8 * time.Second
+	maxTransmissions   = 8
+	// closeLinger is how long a closed connection waits for its FIN to be acknowledged
+	closeLinger = 30 * time.Second
+)
+
+var (
+	errReset    = errors.New("utp: connection reset by peer")
+	errTimedOut = errors.New("utp: connection timed out")
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+)
+
+type outPacket struct {
+	typ           uint8
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	// selectivelyAcked packets were received after a missing one, they are no longer in flight
+	selectivelyAcked bool
+}
+
+type inPacket struct {
+	typ     uint8
+	payload []byte
+}
+
+// Conn is a uTP connection, it delivers the bytes reliably and in order like TCP while its LEDBAT congestion
+// control keeps the delay it adds to the link around target, backing off in favour of the other traffic
+type Conn struct {
+	socket         *Socket
+	remote         net.Addr
+	recvId, sendId uint16
+
+	mu    sync.Mutex
+	state connState
+	seqNr uint16
+	// ackNr is the last packet received in order
+	ackNr    uint16
+	outgoing []*outPacket
+	inFlight int
+	received map[uint16]inPacket
+	readBuff []byte
+	eof      bool
+	err      error
+	closed   bool
+	closedAt time.Time
+	finAcked bool
+
+	window     float64
+	slowStart  bool
+	peerWindow uint32
+	rtt        time.Duration
+	rttVar     time.Duration
+	timeout    time.Duration
+	lastLoss   time.Time
+	// replyDelay is the one way delay of the last packet of the peer, it is sent back in every packet
+	replyDelay uint32
+	delays     delayHistory
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// changed is closed and replaced every time the state changes to wake up the blocked calls
+	changed chan struct{}
+}
+
+func newConn(socket *Socket, remote net.Addr, recvId, sendId uint16) *Conn {
+	return &Conn{
+		socket:     socket,
+		remote:     remote,
+		recvId:     recvId,
+		sendId:     sendId,
+		received:   make(map[uint16]inPacket),
+		window:     2 * minWindow,
+		slowStart:  true,
+		peerWindow: maxReceiveBuffer,
+		timeout:    initialTimeout,
+		changed:    make(chan struct{}),
+	}
+}
+
+func (c *Conn) Read(buff []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if len(c.readBuff) > 0 {
+			wasFull := c.receiveWindow() < maxPayload
+			n := copy(buff, c.readBuff)
+			c.readBuff = c.readBuff[n:]
+			if wasFull {
+				// the peer stopped sending because of our window, tell it there is room again
+				c.sendState()
+			}
+			return n, nil
+		}
+		switch {
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.closed:
+			return 0, net.ErrClosed
+		case !c.readDeadline.IsZero() && time.Now().After(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.wait(c.readDeadline)
+	}
+}
+
+func (c *Conn) Write(buff []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(buff) {
+		switch {
+		case c.err != nil:
+			return written, c.err
+		case c.closed:
+			return written, net.ErrClosed
+		case !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline):
+			return written, os.ErrDeadlineExceeded
+		}
+		size := min(maxPayload, len(buff)-written)
+		if !c.canSend(size) {
+			c.wait(c.writeDeadline)
+			continue
+		}
+		payload := make([]byte, size)
+		copy(payload, buff[written:])
+		c.sendPacket(stData, payload)
+		written += size
+	}
+	return written, nil
+}
+
+// Close sends a FIN, the socket keeps the connection until the FIN is acknowledged
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	if c.err == nil {
+		c.sendPacket(stFin, nil)
+	}
+	c.notify()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// notify wakes up the calls waiting for a change, the caller must hold c.mu
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases c.mu until the state changes or the deadline passes, it returns false when the deadline passed
+func (c *Conn) wait(deadline time.Time) bool {
+	changed := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	if deadline.IsZero() {
+		<-changed
+		return true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.notify()
+}
+
+// canSend reports whether a packet fits in the congestion window and in the window of the peer, a single
+// packet is always allowed when nothing is in flight so that a closed window is probed
+func (c *Conn) canSend(size int) bool {
+	if c.inFlight == 0 {
+		return true
+	}
+	limit := min(int(c.window), int(c.peerWindow))
+	return c.inFlight+size <= limit
+}
+
+func (c *Conn) receiveWindow() int {
+	return max(maxReceiveBuffer-len(c.readBuff), 0)
+}
+
+// sendPacket sends a packet that has to be acknowledged, the caller must hold c.mu
+func (c *Conn) sendPacket(typ uint8, payload []byte) {
+	p := &outPacket{typ: typ, seqNr: c.seqNr, payload: payload}
+	c.seqNr++
+	c.outgoing = append(c.outgoing, p)
+	c.inFlight += len(payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	now := time.Now()
+	p.sentAt = now
+	p.transmissions++
+	h := c.header(p.typ, now)
+	h.seqNr = p.seqNr
+	if p.typ == stSyn {
+		h.connectionId = c.recvId
+	}
+	c.socket.writeTo(h.serialize(p.payload), c.remote)
+}
+
+// sendState acknowledges the packets received so far, with the selective ack of the ones after a missing packet
+func (c *Conn) sendState() {
+	h := c.header(stState, time.Now())
+	h.seqNr = c.seqNr
+	h.selectiveAck = c.selectiveAck()
+	c.socket.writeTo(h.serialize(nil), c.remote)
+}
+
+func (c *Conn) header(typ uint8, now time.Time) header {
+	return header{
+		typ:           typ,
+		connectionId:  c.sendId,
+		timestamp:     timestampMicros(now),
+		timestampDiff: c.replyDelay,
+		windowSize:    uint32(c.receiveWindow()),
+		ackNr:         c.ackNr,
+	}
+}
+
+// selectiveAck returns the bitmask of the packets received after the first missing one, a multiple of 4 bytes
+func (c *Conn) selectiveAck() []byte {
+	if len(c.received) == 0 {
+		return nil
+	}
+	last := 0
+	for seqNr := range c.received {
+		last = max(last, int(seqNr-c.ackNr-2))
+	}
+	mask := make([]byte, min((last/32+1)*4, 64))
+	for seqNr := range c.received {
+		bit := int(seqNr - c.ackNr - 2)
+		if bit < len(mask)*8 {
+			mask[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return mask
+}
+
+// handlePacket processes a packet the socket received for the connection
+func (c *Conn) handlePacket(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.notify()
+	now := time.Now()
+	if h.typ == stReset {
+		c.fail(errReset)
+		return
+	}
+	if h.typ == stSyn {
+		// our answer to the SYN was lost
+		c.sendState()
+		return
+	}
+	c.replyDelay = timestampMicros(now) - h.timestamp
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+	}
+	c.peerWindow = h.windowSize
+	c.processAck(h, now)
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+		c.sendState()
+	}
+}
+
+func (c *Conn) processAck(h header, now time.Time) {
+	// an ack of a packet we never sent is bogus
+	if !seqLess(h.ackNr, c.seqNr) {
+		return
+	}
+	ackedBytes := 0
+	if len(c.outgoing) > 0 && !seqLess(h.ackNr, c.outgoing[0].seqNr) {
+		// the link works again, drop the backoff of the timeouts
+		c.timeout = c.rttTimeout()
+	}
+	for len(c.outgoing) > 0 && !seqLess(h.ackNr, c.outgoing[0].seqNr) {
+		p := c.outgoing[0]
+		c.outgoing = c.outgoing[1:]
+		if !p.selectivelyAcked {
+			ackedBytes += len(p.payload)
+			c.inFlight -= len(p.payload)
+			// Karn's algorithm, the round trip of a retransmitted packet is ambiguous, and the one of a packet
+			// acked late by a selective ack includes the wait for the missing packet before it
+			if p.transmissions == 1 {
+				c.updateRtt(now.Sub(p.sentAt))
+			}
+		}
+		if p.typ == stFin {
+			c.finAcked = true
+		}
+	}
+
+	// selective ack: a packet followed by 3 received packets is lost
+	receivedAfter := 0
+	for i := len(c.outgoing) - 1; i >= 0; i-- {
+		p := c.outgoing[i]
+		bit := int(p.seqNr - h.ackNr - 2)
+		if !p.selectivelyAcked && bit >= 0 && bit < len(h.selectiveAck)*8 && h.selectiveAck[bit/8]&(1<<(bit%8)) != 0 {
+			p.selectivelyAcked = true
+			ackedBytes += len(p.payload)
+			c.inFlight -= len(p.payload)
+			if p.transmissions == 1 {
+				c.updateRtt(now.Sub(p.sentAt))
+			}
+		}
+		if p.selectivelyAcked {
+			receivedAfter++
+			continue
+		}
+		if receivedAfter >= 3 && now.Sub(p.sentAt) > max(c.rtt*3/2, 2*tickInterval) {
+			c.lost(now)
+			c.transmit(p)
+		}
+	}
+	if ackedBytes > 0 {
+		c.updateWindow(ackedBytes, h.timestampDiff, now)
+	}
+}
+
+// lost halves the window, at most once every round trip
+func (c *Conn) lost(now time.Time) {
+	c.slowStart = false
+	if now.Sub(c.lastLoss) > c.rtt {
+		c.window = max(c.window/2, minWindow)
+		c.lastLoss = now
+	}
+}
+
+func (c *Conn) updateRtt(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.timeout = c.rttTimeout()
+}
+
+func (c *Conn) rttTimeout() time.Duration {
+	if c.rtt == 0 {
+		return initialTimeout
+	}
+	return min(max(c.rtt+4*c.rttVar, minTimeout), maxTimeout)
+}
+
+// updateWindow is the LEDBAT congestion control of BEP 29, delay is how long our packets took to reach the peer.
+// The lowest delay seen is the base delay of the link, what is above it is the queuing delay we add
+func (c *Conn) updateWindow(ackedBytes int, delay uint32, now time.Time) {
+	c.delays.add(delay, now)
+	queuingDelay := time.Duration(delay-c.delays.base()) * time.Microsecond
+	offTarget := float64(target-queuingDelay) / float64(target)
+	if c.slowStart && queuingDelay < target/2 {
+		c.window += float64(ackedBytes)
+	} else {
+		c.slowStart = false
+		windowFactor := float64(ackedBytes) / max(c.window, float64(ackedBytes))
+		c.window += maxWindowIncrease * max(offTarget, -1) * windowFactor
+	}
+	c.window = min(max(c.window, minWindow), maxWindow)
+}
+
+func (c *Conn) receive(h header, payload []byte) {
+	if !seqLess(c.ackNr, h.seqNr) || h.seqNr-c.ackNr > maxOutOfOrder {
+		// already received or too far ahead
+		return
+	}
+	if h.seqNr != c.ackNr+1 {
+		c.received[h.seqNr] = inPacket{typ: h.typ, payload: append([]byte(nil), payload...)}
+		return
+	}
+	c.deliver(h.typ, payload)
+	for {
+		p, ok := c.received[c.ackNr+1]
+		if !ok {
+			return
+		}
+		delete(c.received, c.ackNr+1)
+		c.deliver(p.typ, p.payload)
+	}
+}
+
+func (c *Conn) deliver(typ uint8, payload []byte) {
+	c.ackNr++
+	if typ == stFin {
+		c.eof = true
+		return
+	}
+	if !c.eof {
+		c.readBuff = append(c.readBuff, payload...)
+	}
+}
+
+// tick retransmits the oldest packet when its ack is late, it returns true when the connection is over and
+// the socket can forget it
+func (c *Conn) tick(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return true
+	}
+	if c.closed && (c.finAcked || now.Sub(c.closedAt) > closeLinger) {
+		c.fail(net.ErrClosed)
+		return true
+	}
+	for _, p := range c.outgoing {
+		if p.selectivelyAcked {
+			continue
+		}
+		if now.Sub(p.sentAt) < c.timeout {
+			break
+		}
+		if p.transmissions >= maxTransmissions {
+			c.fail(errTimedOut)
+			return true
+		}
+		c.timeout = min(c.timeout*2, maxTimeout)
+		c.window = minWindow
+		c.slowStart = false
+		c.transmit(p)
+		break
+	}
+	return false
+}
+
+// delayHistory keeps the lowest delay of the current and of the previous period, the base delay is the lowest of
+// the two so that it follows a route change within two periods
+type delayHistory struct {
+	current, previous uint32
+	hasPrevious       bool
+	started           time.Time
+}
+
+func (d *delayHistory) add(delay uint32, now time.Time) {
+	if d.started.IsZero() {
+		d.current = delay
+		d.started = now
+		return
+	}
+	if now.Sub(d.started) > delayHistoryPeriod {
+		d.previous, d.hasPrevious = d.current, true
+		d.current = delay
+		d.started = now
+	}
+	// the clocks of the peers are not synchronized, the delays wrap around like the sequence numbers
+	if int32(delay-d.current) < 0 {
+		d.current = delay
+	}
+}
+
+func (d *delayHistory) base() uint32 {
+	if d.hasPrevious && int32(d.previous-d.current) < 0 {
+		return d.previous
+	}
+	return d.current
+}
@@ -0,0 +1,95 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// packet types of BEP 29
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	protocolVersion = 1
+	headerSize      = 20
+	// extensionSelectiveAck carries a bitmask of the packets received after the first missing one
+	extensionSelectiveAck = 1
+)
+
+var errNotUTP = errors.New("not a uTP packet")
+
+type header struct {
+	typ           uint8
+	connectionId  uint16
+	timestamp     uint32
+	timestampDiff uint32
+	windowSize    uint32
+	seqNr         uint16
+	ackNr         uint16
+	// selectiveAck is the bitmask of the selective ack extension, bit i is packet ackNr+2+i
+	selectiveAck []byte
+}
+
+func (h *header) serialize(payload []byte) []byte {
+	buff := make([]byte, headerSize, headerSize+len(h.selectiveAck)+2+len(payload))
+	buff[0] = h.typ<<4 | protocolVersion
+	binary.BigEndian.PutUint16(buff[2:], h.connectionId)
+	binary.BigEndian.PutUint32(buff[4:], h.timestamp)
+	binary.BigEndian.PutUint32(buff[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(buff[12:], h.windowSize)
+	binary.BigEndian.PutUint16(buff[16:], h.seqNr)
+	binary.BigEndian.PutUint16(buff[18:], h.ackNr)
+	if len(h.selectiveAck) > 0 {
+		buff[1] = extensionSelectiveAck
+		buff = append(buff, 0, byte(len(h.selectiveAck)))
+		buff = append(buff, h.selectiveAck...)
+	}
+	return append(buff, payload...)
+}
+
+// parsePacket returns the header and the payload of a packet, errNotUTP tells the packets of the other
+// protocols sharing the socket, like the DHT and the UDP trackers, from the uTP ones
+func parsePacket(buff []byte) (header, []byte, error) {
+	if len(buff) < headerSize || buff[0]&0x0F != protocolVersion || buff[0]>>4 > stSyn {
+		return header{}, nil, errNotUTP
+	}
+	h := header{
+		typ:           buff[0] >> 4,
+		connectionId:  binary.BigEndian.Uint16(buff[2:]),
+		timestamp:     binary.BigEndian.Uint32(buff[4:]),
+		timestampDiff: binary.BigEndian.Uint32(buff[8:]),
+		windowSize:    binary.BigEndian.Uint32(buff[12:]),
+		seqNr:         binary.BigEndian.Uint16(buff[16:]),
+		ackNr:         binary.BigEndian.Uint16(buff[18:]),
+	}
+	extension := buff[1]
+	buff = buff[headerSize:]
+	// every extension starts with the type of the next one and its length
+	for extension != 0 {
+		if len(buff) < 2 || len(buff) < 2+int(buff[1]) {
+			return header{}, nil, errNotUTP
+		}
+		length := int(buff[1])
+		if extension == extensionSelectiveAck {
+			h.selectiveAck = buff[2 : 2+length]
+		}
+		extension = buff[0]
+		buff = buff[2+length:]
+	}
+	return h, buff, nil
+}
+
+// seqLess compares sequence numbers that wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func timestampMicros(now time.Time) uint32 {
+	return uint32(now.UnixMicro())
+}
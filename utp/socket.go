@@ -0,0 +1,320 @@
+package utp
+
+import (
+	"fmt"
+	"log/slog"
+	"main/logging"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// acceptBacklog is the number of incoming connections waiting for Accept, the following ones are reset
+	acceptBacklog = 64
+	// otherBacklog is the number of packets of the other protocols waiting to be read
+	otherBacklog = 256
+	tickInterval = 50 * time.Millisecond
+)
+
+// Socket multiplexes the uTP connections of a UDP socket, it is a net.Listener of the incoming connections.
+// The packets that are not uTP, like the ones of the DHT and of the UDP trackers, are read from PacketConn so
+// that every protocol shares the same port
+type Socket struct {
+	conn        net.PacketConn
+	mu          sync.Mutex
+	conns       map[connKey]*Conn
+	acceptQueue chan *Conn
+	other       chan otherPacket
+	closed      chan struct{}
+	closeOnce   sync.Once
+	// logger receives the send errors, it is read by every connection without taking mu
+	logger atomic.Pointer[slog.Logger]
+}
+
+// connKey identifies a connection by the address of the peer and the id of the packets it sends us
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+type otherPacket struct {
+	buff []byte
+	addr net.Addr
+}
+
+func Listen(network, address string) (*Socket, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(conn), nil
+}
+
+// NewSocket runs uTP on a packet connection, the socket owns it and closes it on Close
+func NewSocket(conn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:        conn,
+		conns:       make(map[connKey]*Conn),
+		acceptQueue: make(chan *Conn, acceptBacklog),
+		other:       make(chan otherPacket, otherBacklog),
+		closed:      make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Accept waits for the next incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptQueue:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close closes the UDP socket and every connection
+func (s *Socket) Close() error {
+	err := net.ErrClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.conns = make(map[connKey]*Conn)
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// DialTimeout opens a uTP connection, the SYN is retransmitted until the peer answers or the timeout expires
+func (s *Socket) DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	recvId := rand.N[uint16](0xFFFF)
+	for s.conns[connKey{addr.String(), recvId}] != nil {
+		recvId = rand.N[uint16](0xFFFF)
+	}
+	c := newConn(s, addr, recvId, recvId+1)
+	s.conns[connKey{addr.String(), recvId}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = stateSynSent
+	c.seqNr = 1
+	c.sendPacket(stSyn, nil)
+	deadline := time.Now().Add(timeout)
+	for c.state == stateSynSent && c.err == nil {
+		if !c.wait(deadline) {
+			c.fail(fmt.Errorf("utp: dial %s: %w", address, os.ErrDeadlineExceeded))
+		}
+	}
+	if c.err != nil {
+		s.remove(c)
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// PacketConn returns the view of the socket used by the other protocols, it reads the packets that are not uTP
+func (s *Socket) PacketConn() net.PacketConn {
+	return &sharedConn{socket: s}
+}
+
+// SetLogger sets the logger of the errors of the socket, nothing is logged until it is called
+func (s *Socket) SetLogger(logger *slog.Logger) {
+	s.logger.Store(logger)
+}
+
+func (s *Socket) writeTo(buff []byte, addr net.Addr) {
+	_, err := s.conn.WriteTo(buff, addr)
+	if err != nil {
+		select {
+		case <-s.closed:
+		default:
+			logging.Or(s.logger.Load()).Debug("error sending uTP packet", "peer", addr.String(), "error", err)
+		}
+	}
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.remote.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) readLoop() {
+	buff := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buff)
+		if err != nil {
+			s.Close()
+			return
+		}
+		h, payload, err := parsePacket(buff[:n])
+		if err != nil {
+			packet := otherPacket{buff: make([]byte, n), addr: addr}
+			copy(packet.buff, buff[:n])
+			select {
+			case s.other <- packet:
+			default:
+			}
+			continue
+		}
+		s.handlePacket(h, payload, addr)
+	}
+}
+
+func (s *Socket) handlePacket(h header, payload []byte, addr net.Addr) {
+	key := connKey{addr.String(), h.connectionId}
+	if h.typ == stSyn {
+		// the SYN carries the id the peer receives on, it sends on the next one
+		key.id++
+	}
+	s.mu.Lock()
+	c := s.conns[key]
+	if c == nil && h.typ == stReset {
+		// a reset carries the id we send on, it is one away from the one we receive on
+		c = s.conns[connKey{key.addr, key.id - 1}]
+		if c == nil {
+			c = s.conns[connKey{key.addr, key.id + 1}]
+		}
+	}
+	s.mu.Unlock()
+	switch {
+	case c != nil:
+		c.handlePacket(h, payload)
+	case h.typ == stSyn:
+		s.accept(h, addr)
+	case h.typ != stReset:
+		reset := header{typ: stReset, connectionId: h.connectionId, timestamp: timestampMicros(time.Now()), ackNr: h.seqNr}
+		s.writeTo(reset.serialize(nil), addr)
+	}
+}
+
+func (s *Socket) accept(syn header, addr net.Addr) {
+	c := newConn(s, addr, syn.connectionId+1, syn.connectionId)
+	c.state = stateConnected
+	c.seqNr = rand.N[uint16](0xFFFF)
+	c.ackNr = syn.seqNr
+	c.peerWindow = syn.windowSize
+	c.replyDelay = timestampMicros(time.Now()) - syn.timestamp
+	key := connKey{addr.String(), c.recvId}
+	s.mu.Lock()
+	s.conns[key] = c
+	s.mu.Unlock()
+	c.mu.Lock()
+	c.sendState()
+	c.mu.Unlock()
+	select {
+	case s.acceptQueue <- c:
+	default:
+		s.remove(c)
+		reset := header{typ: stReset, connectionId: syn.connectionId, timestamp: timestampMicros(time.Now()), ackNr: syn.seqNr}
+		s.writeTo(reset.serialize(nil), addr)
+	}
+}
+
+// tickLoop retransmits the lost packets and forgets the connections that are over
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				if c.tick(now) {
+					s.remove(c)
+				}
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// sharedConn is the net.PacketConn of the protocols sharing the socket with uTP
+type sharedConn struct {
+	socket       *Socket
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *sharedConn) ReadFrom(buff []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-c.socket.other:
+		return copy(buff, packet.buff), packet.addr, nil
+	case <-c.socket.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *sharedConn) WriteTo(buff []byte, addr net.Addr) (int, error) {
+	return c.socket.conn.WriteTo(buff, addr)
+}
+
+// Close closes the whole socket, uTP included
+func (c *sharedConn) Close() error {
+	return c.socket.Close()
+}
+
+func (c *sharedConn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+func (c *sharedConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.socket.conn.SetWriteDeadline(t)
+}
+
+func (c *sharedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *sharedConn) SetWriteDeadline(t time.Time) error {
+	return c.socket.conn.SetWriteDeadline(t)
+}
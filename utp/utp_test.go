@@ -0,0 +1,160 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	mathrand "math/rand/v2"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops and delays a part of the packets written to it, the delayed ones arrive out of order
+type lossyConn struct {
+	net.PacketConn
+	mu    sync.Mutex
+	rng   *mathrand.Rand
+	loss  float64
+	delay float64
+}
+
+func (c *lossyConn) WriteTo(buff []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rng.Float64() < c.loss
+	delay := c.rng.Float64() < c.delay
+	c.mu.Unlock()
+	if drop {
+		return len(buff), nil
+	}
+	if delay {
+		packet := append([]byte(nil), buff...)
+		time.AfterFunc(5*time.Millisecond, func() { c.PacketConn.WriteTo(packet, addr) })
+		return len(buff), nil
+	}
+	return c.PacketConn.WriteTo(buff, addr)
+}
+
+func lossySocket(t *testing.T, loss, delay float64, seed uint64) *Socket {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := NewSocket(&lossyConn{PacketConn: conn, rng: mathrand.New(mathrand.NewPCG(seed, seed)), loss: loss, delay: delay})
+	t.Cleanup(func() { socket.Close() })
+	return socket
+}
+
+func TestTransferOverLossyLink(t *testing.T) {
+	t.Log("Testing that the data arrives complete and in order over links that lose and reorder packets")
+	server := lossySocket(t, 0.1, 0.1, 1)
+	client := lossySocket(t, 0.1, 0.1, 2)
+	upload := make([]byte, 300*1024)
+	download := make([]byte, 200*1024)
+	rand.Read(upload)
+	rand.Read(download)
+
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		defer conn.Close()
+		go conn.Write(download)
+		received, err := io.ReadAll(conn)
+		if err == nil && !bytes.Equal(received, upload) {
+			t.Errorf("the server received %d bytes different from the %d sent", len(received), len(upload))
+		}
+		serverDone <- err
+	}()
+
+	conn, err := client.DialTimeout(server.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	_, err = conn.Write(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(download))
+	_, err = io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, download) {
+		t.Error("the client received different data from the one sent")
+	}
+	conn.Close()
+	if err := <-serverDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedSocket(t *testing.T) {
+	t.Log("Testing that the packets of the other protocols are read from the shared socket")
+	socket := lossySocket(t, 0, 0, 1)
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	// the start of a DHT query and of a UDP tracker connect request
+	packets := [][]byte{[]byte("d1:ad2:id20:"), {0, 0, 4, 0x17, 0x27, 0x10, 0x19, 0x80, 0, 0, 0, 0}}
+	sharedConn := socket.PacketConn()
+	sharedConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, packet := range packets {
+		other.WriteTo(packet, socket.Addr())
+		buff := make([]byte, 100)
+		n, addr, err := sharedConn.ReadFrom(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buff[:n], packet) || addr.String() != other.LocalAddr().String() {
+			t.Errorf("expected %v from %s, got %v from %s", packet, other.LocalAddr(), buff[:n], addr)
+		}
+	}
+	_, err = sharedConn.WriteTo([]byte("answer"), other.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLedbatBacksOff(t *testing.T) {
+	t.Log("Testing that the window grows without queuing delay and shrinks when the delay is over the target")
+	now := time.Now()
+	c := newConn(nil, nil, 0, 1)
+	c.slowStart = false
+	c.window = 100 * maxPayload
+	c.updateWindow(maxPayload, 5000, now)
+	c.updateWindow(maxPayload, 5000+10000, now)
+	grown := c.window
+	if grown <= 100*maxPayload {
+		t.Errorf("expected the window to grow with 10ms of queuing delay, got %f", grown)
+	}
+	for i := 0; i < 100; i++ {
+		c.updateWindow(maxPayload, 5000+300000, now)
+	}
+	if c.window >= grown {
+		t.Errorf("expected the window to shrink with 300ms of queuing delay, got %f", c.window)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	t.Log("Testing that dialing a peer that does not speak uTP times out")
+	socket := lossySocket(t, 0, 0, 1)
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	_, err = socket.DialTimeout(silent.LocalAddr().String(), 200*time.Millisecond)
+	var netErr net.Error
+	if err == nil || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}